@@ -0,0 +1,52 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, nil))
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Error(w, "bad", http.StatusBadRequest)
+	}), logger)
+
+	req := httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader("not json"))
+	req.SetBasicAuth("collectd", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, want := range []string{
+		`msg="HTTP request"`,
+		"method=POST",
+		"path=/collectd-post",
+		"status=400",
+		"remote=192.0.2.1:1234",
+		"request_bytes=8",
+		"response_bytes=4",
+		"user=collectd",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log %q does not contain %q", out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/collectd_exporter/source"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultTopLimit is the number of hosts and plugins listed by /api/v1/top
+// unless the "limit" query parameter is given.
+const defaultTopLimit = 10
+
+// apiResponse is the envelope of all API responses, modeled after the
+// Prometheus HTTP API.
+type apiResponse struct {
+	Status string `json:"status"`
+	Data   any    `json:"data,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// registerAPI registers the handlers of the JSON API for the inventory of c
+// on mux. The handlers deleting value lists fail unless admin is set.
+func registerAPI(mux *http.ServeMux, c *collector.Collector, admin bool, logger *slog.Logger) {
+	mux.HandleFunc("GET /api/v1/hosts", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: c.Hosts()}, logger)
+	})
+	mux.HandleFunc("GET /api/v1/metadata", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: c.Metadata(r.URL.Query().Get("metric"))}, logger)
+	})
+	mux.HandleFunc("GET /api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		series := c.ListSeries(r.URL.Query().Get("host"))
+		if series == nil {
+			series = []collector.Series{}
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: series}, logger)
+	})
+	mux.HandleFunc("GET /api/v1/top", func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultTopLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+				writeAPIResponse(w, http.StatusBadRequest, apiResponse{Status: "error", Error: fmt.Sprintf("invalid limit %q", s)}, logger)
+				return
+			}
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: c.Top(limit)}, logger)
+	})
+
+	deleteHandler := func(del func(r *http.Request) (int, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !admin {
+				writeAPIResponse(w, http.StatusForbidden, apiResponse{Status: "error", Error: "admin APIs disabled"}, logger)
+				return
+			}
+			n, err := del(r)
+			if err != nil {
+				writeAPIResponse(w, http.StatusServiceUnavailable, apiResponse{Status: "error", Error: err.Error()}, logger)
+				return
+			}
+			logger.Info("Deleted value lists via the admin API", "path", r.URL.Path, "value_lists", n)
+			writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: map[string]int{"deleted": n}}, logger)
+		}
+	}
+	mux.HandleFunc("DELETE /api/v1/hosts/{host}", deleteHandler(func(r *http.Request) (int, error) {
+		return c.DeleteHost(r.Context(), r.PathValue("host"))
+	}))
+	mux.HandleFunc("DELETE /api/v1/series/{identifier...}", deleteHandler(func(r *http.Request) (int, error) {
+		return c.DeleteValueList(r.Context(), r.PathValue("identifier"))
+	}))
+	mux.HandleFunc("POST /api/v1/admin/flush", deleteHandler(func(r *http.Request) (int, error) {
+		return c.Flush(r.Context())
+	}))
+}
+
+// registerStatusAPI registers the handlers returning the resolved command
+// line flags and the loaded configuration file on mux, like the status API of
+// Prometheus. The configuration holds no secrets, as pre-shared keys and
+// passwords are only referenced by file.
+func registerStatusAPI(mux *http.ServeMux, flags map[string]string, cfg *collector.Config, logger *slog.Logger) {
+	mux.HandleFunc("GET /api/v1/status/flags", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: flags}, logger)
+	})
+	mux.HandleFunc("GET /api/v1/status/config", func(w http.ResponseWriter, r *http.Request) {
+		data := ""
+		if cfg != nil {
+			out, err := yaml.Marshal(cfg)
+			if err != nil {
+				writeAPIResponse(w, http.StatusInternalServerError, apiResponse{Status: "error", Error: err.Error()}, logger)
+				return
+			}
+			data = string(out)
+		}
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: map[string]string{"yaml": data}}, logger)
+	})
+}
+
+// registerQuarantineAPI registers the handler listing the invalid payloads
+// kept by q on mux.
+func registerQuarantineAPI(mux *http.ServeMux, q *source.Quarantine, logger *slog.Logger) {
+	mux.HandleFunc("GET /debug/invalid-payloads", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: q.Payloads()}, logger)
+	})
+}
+
+// registerUnknownTypesAPI registers the handler listing the types missing
+// from the types.db cached by u on mux.
+func registerUnknownTypesAPI(mux *http.ServeMux, u *source.UnknownTypes, logger *slog.Logger) {
+	mux.HandleFunc("GET /debug/unknown-types", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: u.Types()}, logger)
+	})
+}
+
+// flagValues returns the values of the flags of app by name.
+func flagValues(app *kingpin.Application) map[string]string {
+	flags := map[string]string{}
+	for _, f := range app.Model().Flags {
+		flags[f.Name] = f.Value.String()
+	}
+	return flags
+}
+
+// writeAPIResponse writes resp as JSON with the given status code.
+func writeAPIResponse(w http.ResponseWriter, code int, resp apiResponse, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Debug("Error writing API response", "err", err)
+	}
+}
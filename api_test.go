@@ -0,0 +1,145 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestAPI(t *testing.T) {
+	c, err := collector.New(nil, collector.Options{KeepExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0).UTC(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	})
+	mux := http.NewServeMux()
+	registerAPI(mux, c, false, promslog.NewNopLogger())
+
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"/api/v1/series", `{"status":"success","data":[{"name":"collectd_load","labels":{"instance":"example.com"},"identifier":"example.com/load/load","time":"2023-11-14T22:13:20Z"}]}`},
+		{"/api/v1/series?host=other", `{"status":"success","data":[]}`},
+		{"/api/v1/hosts", `"host":"example.com"`},
+		{"/api/v1/metadata", `{"status":"success","data":{"collectd_load":[{"type":"gauge","help":"Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'value'","unit":"","plugin":"load","collectd_type":"load"}]}}`},
+		{"/api/v1/metadata?metric=other", `{"status":"success","data":{}}`},
+		{"/api/v1/top?limit=1", `"hosts_by_series":[{"name":"example.com"`},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got status %d, content type %q", tc.url, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		if !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s: got %s, want %s", tc.url, rec.Body.String(), tc.want)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	c, err := collector.New(nil, collector.Options{KeepExpired: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		for _, plugin := range []string{"load", "memory"} {
+			c.Ingest(&api.ValueList{
+				Identifier: api.Identifier{Host: host, Plugin: plugin, Type: "gauge"},
+				Time:       time.Now(),
+				Interval:   10 * time.Second,
+				Values:     []api.Value{api.Gauge(1)},
+			})
+		}
+	}
+	// Deletions are processed by Run.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	serve := func(admin bool, method, url string) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		registerAPI(mux, c, admin, promslog.NewNopLogger())
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		return rec
+	}
+
+	if rec := serve(false, http.MethodDelete, "/api/v1/hosts/a.example.com"); rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d with the admin API disabled", rec.Code)
+	}
+	cases := []struct {
+		method, url string
+		want        string
+		hosts       int
+	}{
+		{http.MethodDelete, "/api/v1/series/a.example.com/load/gauge", `{"deleted":1}`, 2},
+		{http.MethodDelete, "/api/v1/hosts/a.example.com", `{"deleted":1}`, 1},
+		{http.MethodPost, "/api/v1/admin/flush", `{"deleted":2}`, 0},
+	}
+	for _, tc := range cases {
+		rec := serve(true, tc.method, tc.url)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s %s: got status %d, body %s, want %s", tc.method, tc.url, rec.Code, rec.Body.String(), tc.want)
+		}
+		if hosts := c.Hosts(); len(hosts) != tc.hosts {
+			t.Errorf("%s %s: got hosts %+v, want %d", tc.method, tc.url, hosts, tc.hosts)
+		}
+	}
+}
+
+func TestStatusAPI(t *testing.T) {
+	cfg, err := collector.ParseConfig([]byte("instance_labels:\n- plugin: cpu\n  source: plugin_instance\n  regex: 'cpu(?P<cpu>[0-9]+)'\n\nsecurity_levels:\n  alice: Encrypt\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := kingpin.New("collectd_exporter", "")
+	app.Flag("web.listen-address", "").Default(":9103").String()
+	if _, err := app.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		cfg       *collector.Config
+		url, want string
+	}{
+		{cfg, "/api/v1/status/flags", `"web.listen-address":":9103"`},
+		{cfg, "/api/v1/status/config", `{"status":"success","data":{"yaml":"instance_labels:\n- plugin: cpu\n  source: plugin_instance\n  regex: cpu(?P\u003ccpu\u003e[0-9]+)\nsecurity_levels:\n  alice: Encrypt\n"}}`},
+		{nil, "/api/v1/status/config", `{"status":"success","data":{"yaml":""}}`},
+	} {
+		mux := http.NewServeMux()
+		registerStatusAPI(mux, flagValues(app), tc.cfg, promslog.NewNopLogger())
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s: got status %d, body %s, want %s", tc.url, rec.Code, rec.Body.String(), tc.want)
+		}
+	}
+}
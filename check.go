@@ -0,0 +1,160 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v2"
+)
+
+// checkTypesDB validates the types.db file read from r. Unlike
+// api.NewTypesDB, which silently skips lines it cannot parse, it returns an
+// error for every invalid line.
+func checkTypesDB(r io.Reader) ([]error, error) {
+	var (
+		problems []error
+		seen     = map[string]int{}
+		lineNo   int
+	)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if first, ok := seen[fields[0]]; ok {
+			problems = append(problems, fmt.Errorf("line %d: type %q already defined on line %d", lineNo, fields[0], first))
+		}
+		seen[fields[0]] = lineNo
+
+		if len(fields) == 1 {
+			problems = append(problems, fmt.Errorf("line %d: type %q has no data sources", lineNo, fields[0]))
+			continue
+		}
+		for _, source := range fields[1:] {
+			if err := checkDataSource(strings.TrimSuffix(source, ",")); err != nil {
+				problems = append(problems, fmt.Errorf("line %d: type %q: %w", lineNo, fields[0], err))
+			}
+		}
+	}
+
+	return problems, s.Err()
+}
+
+// checkDataSource validates a data source specification of the form
+// "name:type:min:max".
+func checkDataSource(source string) error {
+	f := strings.Split(source, ":")
+	if len(f) != 4 {
+		return fmt.Errorf("data source %q: expected 4 colon-separated fields, got %d", source, len(f))
+	}
+
+	switch f[1] {
+	case "COUNTER", "DERIVE", "GAUGE":
+	default:
+		return fmt.Errorf("data source %q: invalid type %q", f[0], f[1])
+	}
+
+	bounds := make([]float64, 2)
+	for i, b := range f[2:] {
+		if b == "U" {
+			continue
+		}
+		v, err := strconv.ParseFloat(b, 64)
+		if err != nil {
+			return fmt.Errorf("data source %q: invalid bound %q", f[0], b)
+		}
+		bounds[i] = v
+	}
+	if f[2] != "U" && f[3] != "U" && bounds[0] > bounds[1] {
+		return fmt.Errorf("data source %q: minimum %s exceeds maximum %s", f[0], f[2], f[3])
+	}
+
+	return nil
+}
+
+// checkConfig validates the given types.db, configuration and web
+// configuration files, writing the result for every file to w. It returns
+// false if any file is invalid.
+func checkConfig(w io.Writer, typesDBFiles []string, configFile string, webConfigFiles ...string) bool {
+	ok := true
+	report := func(path string, problems ...error) {
+		if len(problems) == 0 {
+			fmt.Fprintf(w, "%s: OK\n", path)
+			return
+		}
+		ok = false
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s: %v\n", path, p)
+		}
+	}
+
+	for _, path := range typesDBFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			report(path, err)
+			continue
+		}
+		problems, err := checkTypesDB(f)
+		f.Close()
+		if err != nil {
+			problems = append(problems, err)
+		}
+		report(path, problems...)
+	}
+
+	if configFile != "" {
+		_, err := collector.LoadConfig(configFile)
+		var typeErr *yaml.TypeError
+		switch {
+		case errors.As(err, &typeErr):
+			// Report every offending field with its line number.
+			problems := make([]error, 0, len(typeErr.Errors))
+			for _, e := range typeErr.Errors {
+				problems = append(problems, errors.New(e))
+			}
+			report(configFile, problems...)
+		case err != nil:
+			report(configFile, err)
+		default:
+			report(configFile)
+		}
+	}
+
+	for _, path := range webConfigFiles {
+		if path == "" {
+			continue
+		}
+		if err := web.Validate(path); err != nil {
+			report(path, err)
+		} else {
+			report(path)
+		}
+	}
+
+	return ok
+}
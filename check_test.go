@@ -0,0 +1,82 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckTypesDB(t *testing.T) {
+	typesDB := `# Comment
+load shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000
+if_octets rx:DERIVE:0:U, tx:DERIVE:0:U
+
+absolute value:ABSOLUTE:0:U
+bounds value:GAUGE:10:1
+fields value:GAUGE:0
+load value:GAUGE:U:U
+empty
+`
+	want := []string{
+		`line 5: type "absolute": data source "value": invalid type "ABSOLUTE"`,
+		`line 6: type "bounds": data source "value": minimum 10 exceeds maximum 1`,
+		`line 7: type "fields": data source "value:GAUGE:0": expected 4 colon-separated fields, got 3`,
+		`line 8: type "load" already defined on line 2`,
+		`line 9: type "empty" has no data sources`,
+	}
+
+	problems, err := checkTypesDB(strings.NewReader(typesDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got problems %v, want %v", problems, want)
+	}
+	for i, p := range problems {
+		if p.Error() != want[i] {
+			t.Errorf("got %q, want %q", p, want[i])
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	valid := writeFile(t, "mappings:\n  - plugin: df\n    help: Disk space.\n")
+	var out bytes.Buffer
+	if !checkConfig(&out, nil, valid, "") {
+		t.Errorf("valid config reported as invalid: %s", out.String())
+	}
+
+	invalid := writeFile(t, "mappings:\n  - plugin: df\n    tpye: df_complex\n")
+	out.Reset()
+	if checkConfig(&out, nil, invalid, "") {
+		t.Error("invalid config reported as valid")
+	}
+	if want := invalid + ": line 3: field tpye not found in type collector.mapping\n"; out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AccountingOther is the label value the values of plugins and hosts beyond
+// Options.AccountingLimit are accounted under.
+const AccountingOther = "__other__"
+
+// accounting counts the values and bytes received by plugin and by host.
+// Only the first limit plugins and hosts are counted individually, so that
+// the number of series stays bounded.
+type accounting struct {
+	limit   int
+	plugins map[string]bool
+	hosts   map[string]bool
+
+	pluginValues *prometheus.CounterVec
+	pluginBytes  *prometheus.CounterVec
+	hostValues   *prometheus.CounterVec
+	hostBytes    *prometheus.CounterVec
+}
+
+func newAccounting(limit int) *accounting {
+	return &accounting{
+		limit:   limit,
+		plugins: map[string]bool{},
+		hosts:   map[string]bool{},
+		pluginValues: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_plugin_received_values_total",
+				Help: "Number of values received, by plugin.",
+			},
+			[]string{"plugin"},
+		),
+		pluginBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_plugin_received_bytes_total",
+				Help: "Approximate number of bytes of the value lists received, by plugin.",
+			},
+			[]string{"plugin"},
+		),
+		hostValues: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_host_received_values_total",
+				Help: "Number of values received, by host.",
+			},
+			[]string{"instance"},
+		),
+		hostBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_host_received_bytes_total",
+				Help: "Approximate number of bytes of the value lists received, by host.",
+			},
+			[]string{"instance"},
+		),
+	}
+}
+
+// record accounts vl, which was received in the given number of bytes. It
+// must only be called from Run().
+func (a *accounting) record(vl api.ValueList, bytes int) {
+	plugin := a.bound(a.plugins, vl.Plugin)
+	a.pluginValues.WithLabelValues(plugin).Add(float64(len(vl.Values)))
+	a.pluginBytes.WithLabelValues(plugin).Add(float64(bytes))
+
+	host := a.bound(a.hosts, vl.Host)
+	a.hostValues.WithLabelValues(host).Add(float64(len(vl.Values)))
+	a.hostBytes.WithLabelValues(host).Add(float64(bytes))
+}
+
+// bound returns the label value name is accounted under, given the names
+// counted individually so far.
+func (a *accounting) bound(seen map[string]bool, name string) string {
+	if seen[name] {
+		return name
+	}
+	if len(seen) >= a.limit {
+		return AccountingOther
+	}
+	seen[name] = true
+	return name
+}
+
+// Collect implements prometheus.Collector.
+func (a *accounting) Collect(ch chan<- prometheus.Metric) {
+	a.pluginValues.Collect(ch)
+	a.pluginBytes.Collect(ch)
+	a.hostValues.Collect(ch)
+	a.hostBytes.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (a *accounting) Describe(ch chan<- *prometheus.Desc) {
+	a.pluginValues.Describe(ch)
+	a.pluginBytes.Describe(ch)
+	a.hostValues.Describe(ch)
+	a.hostBytes.Describe(ch)
+}
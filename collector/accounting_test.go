@@ -0,0 +1,58 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/collectd_exporter/source"
+)
+
+func TestAccounting(t *testing.T) {
+	c := newTestCollector(t, Options{AccountingLimit: 1})
+	for _, id := range []api.Identifier{
+		{Host: "a", Plugin: "load", Type: "load"},
+		{Host: "a", Plugin: "cpu", Type: "cpu"},
+		{Host: "b", Plugin: "load", Type: "load"},
+	} {
+		c.ingest(&api.ValueList{
+			Identifier: id,
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1), api.Gauge(2)},
+		}, source.Info{Bytes: 100})
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	want := `
+		# HELP collectd_exporter_host_received_bytes_total Approximate number of bytes of the value lists received, by host.
+		# TYPE collectd_exporter_host_received_bytes_total counter
+		collectd_exporter_host_received_bytes_total{instance="__other__"} 100
+		collectd_exporter_host_received_bytes_total{instance="a"} 200
+		# HELP collectd_exporter_plugin_received_values_total Number of values received, by plugin.
+		# TYPE collectd_exporter_plugin_received_values_total counter
+		collectd_exporter_plugin_received_values_total{plugin="__other__"} 2
+		collectd_exporter_plugin_received_values_total{plugin="load"} 4
+	`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"collectd_exporter_host_received_bytes_total", "collectd_exporter_plugin_received_values_total"); err != nil {
+		t.Error(err)
+	}
+}
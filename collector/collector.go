@@ -0,0 +1,1529 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collector converts collectd value lists to Prometheus metrics. A
+// Collector implements both api.Writer, to receive value lists from any of the
+// collectd.org transports, and prometheus.Collector, to expose the converted
+// metrics.
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/collectd_exporter/source"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tracer records spans of the global OpenTelemetry tracer provider, which
+// does nothing unless configured by the application.
+var tracer = otel.Tracer("github.com/prometheus/collectd_exporter/collector")
+
+const (
+	// DefaultNamespace is the prefix of converted metric names.
+	DefaultNamespace = "collectd"
+
+	// DefaultTimeout specifies the number of iterations after which a
+	// metric times out, i.e. becomes stale and is removed from the
+	// collector. It is modeled and named after the top-level "Timeout"
+	// setting of collectd.
+	DefaultTimeout = 2
+
+	// DefaultHostRetention is the time after which a host that stopped
+	// sending value lists is forgotten.
+	DefaultHostRetention = 24 * time.Hour
+
+	// DefaultGCInterval is the maximum interval between two garbage
+	// collections of expired value lists.
+	DefaultGCInterval = time.Minute
+
+	// DefaultMaxClockSkew is the default difference between the time
+	// of a value list and the time it is received beyond which the clock
+	// of its host is considered off.
+	DefaultMaxClockSkew = 10 * time.Second
+)
+
+// BoundsPolicy determines how values outside of the range declared in
+// types.db are handled.
+type BoundsPolicy string
+
+const (
+	BoundsIgnore BoundsPolicy = "ignore"
+	BoundsDrop   BoundsPolicy = "drop"
+	BoundsClamp  BoundsPolicy = "clamp"
+)
+
+// CollisionPolicy determines how the label named after the plugin is renamed
+// if the plugin is called "instance" or "type", which would collide with the
+// labels holding the host and type instance.
+type CollisionPolicy string
+
+const (
+	// CollisionOverwrite keeps the plugin name, so that one label
+	// overwrites the other.
+	CollisionOverwrite CollisionPolicy = "overwrite"
+	// CollisionPrefix prefixes the plugin name with "plugin_".
+	CollisionPrefix CollisionPolicy = "prefix"
+	// CollisionPluginInstance names the label "plugin_instance".
+	CollisionPluginInstance CollisionPolicy = "plugin-instance"
+)
+
+// LabelLimitPolicy determines how plugin and type instances longer than
+// Options.MaxLabelLength are handled.
+type LabelLimitPolicy string
+
+const (
+	LabelLimitTruncate LabelLimitPolicy = "truncate"
+	LabelLimitHash     LabelLimitPolicy = "hash"
+	LabelLimitDrop     LabelLimitPolicy = "drop"
+)
+
+// HostPolicy determines how the host names of value lists are normalized
+// before they are cached and exported as the instance label.
+type HostPolicy string
+
+const (
+	// HostPreserve keeps host names as received.
+	HostPreserve HostPolicy = "preserve"
+	// HostLowercase converts host names to lower case, so that hosts
+	// reporting as "WEB01" and "web01" are exported as one.
+	HostLowercase HostPolicy = "lowercase"
+	// HostMap replaces host names listed in the host_map of Config,
+	// regardless of their case, and keeps the others.
+	HostMap HostPolicy = "map"
+)
+
+// IdentifierMode determines how the collectd identifier of converted series,
+// e.g. "example.com/cpu-0/cpu-user", is exposed.
+type IdentifierMode string
+
+const (
+	// IdentifierNone does not expose identifiers.
+	IdentifierNone IdentifierMode = "none"
+	// IdentifierLabel adds an "identifier" label to all converted series.
+	IdentifierLabel IdentifierMode = "label"
+	// IdentifierInfo exports an info metric per value list, which has the
+	// labels of its series and an "identifier" label.
+	IdentifierInfo IdentifierMode = "info"
+)
+
+// Options controls how a Collector converts value lists. The zero value
+// converts value lists the way collectd_exporter does by default.
+type Options struct {
+	// Namespace is the prefix of converted metric names. Defaults to
+	// DefaultNamespace.
+	Namespace string
+	// ConstLabels are added to all converted series, unless the value list
+	// already provides a label of the same name. They are applied as a
+	// StaticEnricher ahead of Enrichers, but after the labels requested by
+	// the sender in source.Info.
+	ConstLabels prometheus.Labels
+	// ExportedBy identifies the exporter, e.g. by its address, in an
+	// exported_by label of all converted series and in
+	// collectd_exporter_exported_by_info. It takes precedence over the labels
+	// of enrichers, so that exporters behind one load-balanced address can
+	// be told apart. The empty string adds no label.
+	ExportedBy string
+	// Enrichers add labels to the converted series. Labels of later
+	// enrichers take precedence; labels derived from the value list itself
+	// are never overridden.
+	Enrichers []Enricher
+	// Timeout is the number of intervals after which a value list expires,
+	// unless overridden by the expiry rules of Config. Defaults to
+	// DefaultTimeout.
+	Timeout int
+	// DefaultInterval replaces the interval of value lists received without
+	// one, which would otherwise expire immediately. 0 keeps the interval.
+	DefaultInterval time.Duration
+	// HostRetention is the time for which the last time a value list was
+	// received from a host is exported. Defaults to DefaultHostRetention.
+	HostRetention time.Duration
+	// GCInterval is the maximum interval between two garbage collections
+	// of expired value lists. Collections run earlier once the earliest
+	// cached value list expires. Defaults to DefaultGCInterval.
+	GCInterval time.Duration
+	// GCJitter is the maximum fraction of the delay until the next garbage
+	// collection added at random, so that collections of many hosts
+	// reporting in the same interval do not coincide with scrapes. Must be
+	// between 0 and 1.
+	GCJitter float64
+	// MaxClockSkew is the difference between the time of a value list
+	// and the time it is received, beyond its interval for value lists
+	// lagging behind, above which the value list is counted as skewed.
+	// Defaults to DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+	// KeepExpired exports value lists regardless of their age. This is
+	// useful when converting captured traffic offline.
+	KeepExpired bool
+	// SnapshotInterval is the interval in which Run converts the cache to a
+	// snapshot, which scrapes read without blocking ingestion. 0 converts
+	// the cache on every scrape. Snapshots cannot be combined with expiry
+	// rules using the expire-after-scrape mode.
+	SnapshotInterval time.Duration
+
+	// CounterWrap enables the correction of 32-bit COUNTER wrap-arounds.
+	CounterWrap bool
+	// StoreRates converts DERIVE and COUNTER values to gauges holding
+	// per-second rates.
+	StoreRates bool
+	// TypesDB is used to look up the valid range of data sources. May be
+	// nil.
+	TypesDB *api.TypesDB
+	// Bounds determines what happens to values outside of that range.
+	// Defaults to BoundsIgnore.
+	Bounds BoundsPolicy
+	// Config holds the mapping rules. May be nil.
+	Config *Config
+	// Filter selects the value lists to accept.
+	Filter Filter
+	// MaxLabelLength is the maximum length in bytes of the plugin and type
+	// instances, which are converted to label values. 0 means no limit.
+	MaxLabelLength int
+	// LabelLimit determines what happens to value lists exceeding
+	// MaxLabelLength: LabelLimitTruncate shortens the instance,
+	// LabelLimitHash replaces it with its 64-bit FNV-1a hash in hex and
+	// LabelLimitDrop drops the value list. Defaults to LabelLimitTruncate.
+	LabelLimit LabelLimitPolicy
+	// LabelCollisions determines how labels named after the plugins
+	// "instance" and "type" are renamed. Defaults to CollisionOverwrite.
+	LabelCollisions CollisionPolicy
+	// HostNormalization determines how host names are normalized. Defaults
+	// to HostPreserve.
+	HostNormalization HostPolicy
+	// Profile replaces the names, labels and units of the series of common
+	// plugins. Defaults to ProfileNone.
+	Profile Profile
+	// DSLabel, if set, is the name of a label holding the data source name
+	// of value lists with several data sources of the same value type, such
+	// as the "rx" and "tx" data sources of if_octets. Their series then
+	// share one metric name instead of having the data source name
+	// appended.
+	DSLabel string
+	// Identifier determines how the collectd identifier of converted series
+	// is exposed. Defaults to IdentifierNone.
+	Identifier IdentifierMode
+	// Exemplars attaches exemplars to counters.
+	Exemplars bool
+	// CreatedTimestamps exposes the time counters were first received, or
+	// last reset, as their created timestamp.
+	CreatedTimestamps bool
+	// AccountingLimit is the number of plugins and hosts the received values
+	// and bytes are counted for individually. Those of further plugins and
+	// hosts are counted as AccountingOther. 0 disables the accounting.
+	AccountingLimit int
+	// DedupeSenders keeps the value lists of each identifier from a single
+	// sender, as told by the source name and address, when redundant
+	// relays forward the same hosts. Another sender takes over once the
+	// current one has not sent the identifier for two intervals.
+	DedupeSenders bool
+	// MaxMemoryBytes bounds the approximate memory consumed by the cached
+	// value lists. Once exceeded, the value lists least recently updated
+	// by collectd are evicted until the cache is below 90% of the bound.
+	// 0 means no limit.
+	MaxMemoryBytes int
+	// MaxSeriesPerHost caps the number of series the cached value lists of
+	// a host are converted to, e.g. to protect the exporter from an agent
+	// running a plugin with unbounded instances. Value lists of new
+	// identifiers exceeding it are dropped, while those already cached
+	// keep being updated. 0 means no limit.
+	MaxSeriesPerHost int
+	// LogSample is the fraction of received value lists that are logged at
+	// info level along with their source and resulting metric names, to
+	// diagnose naming issues. 0 disables logging.
+	LogSample float64
+	// Tap, if set, is called with every value list stored in the cache
+	// and a prometheus.Collector exposing the series it is converted to,
+	// e.g. to print them in dry-run mode. It is called from Run and blocks
+	// ingestion until it returns.
+	Tap func(vl api.ValueList, series prometheus.Collector)
+
+	// Pipeline lists the names of the stages received value lists pass
+	// through, in order. Built-in stages that are disabled by the options
+	// above are skipped. Defaults to DefaultPipeline.
+	Pipeline []string
+	// Stages defines additional stages, which are referenced by name from
+	// Pipeline. They take precedence over built-in stages of the same name.
+	Stages map[string]Stage
+}
+
+// Collector caches received value lists and exposes them as Prometheus
+// metrics.
+type Collector struct {
+	ch          chan sample
+	ping        chan struct{}
+	deletes     chan deleteRequest
+	valueLists  map[string]api.ValueList
+	conversions map[string]*conversion
+	created     map[string][]time.Time
+	histograms  map[string][]prometheus.Histogram
+	scraped     map[string]bool
+	hosts       map[string]hostState
+	snapshot    atomic.Pointer[snapshot]
+	pipeline    *pipeline
+	accounting  *accounting
+	traffic     *traffic
+	memory      *memory
+	quota       *seriesQuota
+	families    *families
+	intervals   *intervals
+	dedupe      *senderDedupe
+	gaps        *gaps
+	hostMap     map[string]string
+	skew        *clockSkew
+	enrichers   []Enricher
+	profile     func(api.ValueList) (profiled, bool)
+	mu          sync.Mutex
+	logger      *slog.Logger
+	opts        Options
+
+	lastPush    prometheus.Gauge
+	hostSeen    *prometheus.Desc
+	hostSkew    *prometheus.Desc
+	exportedBy  *prometheus.Desc
+	hostCount   *prometheus.Desc
+	hostInfo    *prometheus.Desc
+	snapshotAt  *prometheus.Desc
+	outOfBounds *prometheus.CounterVec
+	decreases   *prometheus.CounterVec
+	longLabels  *prometheus.CounterVec
+	noInterval  prometheus.Counter
+	filtered    prometheus.Counter
+	duplicates  prometheus.Counter
+	collisions  prometheus.Counter
+	aborted     prometheus.Counter
+}
+
+// sample is a value list written to a Collector along with its origin.
+type sample struct {
+	vl  *api.ValueList
+	src source.Info
+}
+
+// valueListPool holds the copies of written value lists passed to Run, so that
+// writes do not allocate.
+var valueListPool = sync.Pool{New: func() any { return new(api.ValueList) }}
+
+// New returns a new Collector. Value lists written to it are only processed
+// while Run is active; offline tools may call Ingest instead. A nil logger
+// discards all log messages.
+func New(logger *slog.Logger, opts Options) (*Collector, error) {
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = DefaultNamespace
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.HostRetention <= 0 {
+		opts.HostRetention = DefaultHostRetention
+	}
+	if opts.GCInterval <= 0 {
+		opts.GCInterval = DefaultGCInterval
+	}
+	if opts.MaxClockSkew <= 0 {
+		opts.MaxClockSkew = DefaultMaxClockSkew
+	}
+	if opts.GCJitter < 0 || opts.GCJitter > 1 {
+		return nil, fmt.Errorf("garbage collection jitter %v must be between 0 and 1", opts.GCJitter)
+	}
+	if opts.Bounds == "" {
+		opts.Bounds = BoundsIgnore
+	}
+	if opts.Identifier == "" {
+		opts.Identifier = IdentifierNone
+	}
+	if opts.LabelLimit == "" {
+		opts.LabelLimit = LabelLimitTruncate
+	}
+	if opts.LabelCollisions == "" {
+		opts.LabelCollisions = CollisionOverwrite
+	}
+	if opts.HostNormalization == "" {
+		opts.HostNormalization = HostPreserve
+	}
+	hostMap, err := newHostMap(opts.HostNormalization, opts.Config)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Profile == "" {
+		opts.Profile = ProfileNone
+	}
+	profile, ok := profiles[opts.Profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", opts.Profile)
+	}
+	if opts.DSLabel != "" && (!model.LabelName(opts.DSLabel).IsValidLegacy() || reservedLabels[opts.DSLabel] || opts.DSLabel == "identifier") {
+		return nil, fmt.Errorf("invalid data source label %q", opts.DSLabel)
+	}
+	if opts.SnapshotInterval > 0 && opts.Config.expiresAfterScrape() {
+		return nil, fmt.Errorf("expiry mode %q cannot be used with snapshots", expireAfterScrape)
+	}
+
+	c := &Collector{
+		ch:          make(chan sample),
+		ping:        make(chan struct{}),
+		deletes:     make(chan deleteRequest),
+		valueLists:  make(map[string]api.ValueList),
+		conversions: make(map[string]*conversion),
+		created:     make(map[string][]time.Time),
+		histograms:  make(map[string][]prometheus.Histogram),
+		scraped:     make(map[string]bool),
+		hosts:       make(map[string]hostState),
+		traffic:     newTraffic(time.Now()),
+		memory:      newMemory(),
+		families:    newFamilies(opts.Namespace),
+		intervals:   newIntervals(),
+		gaps:        newGaps(),
+		hostMap:     hostMap,
+		skew:        newClockSkew(opts.MaxClockSkew),
+		profile:     profile,
+		logger:      logger,
+		opts:        opts,
+
+		lastPush: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "collectd_last_push_timestamp_seconds",
+				Help: "Unix timestamp of the last received collectd metrics push in seconds.",
+			},
+		),
+		hostSeen: prometheus.NewDesc(
+			"collectd_host_last_seen_timestamp_seconds",
+			"Unix timestamp at which the last value list of a host was received in seconds.",
+			[]string{"instance"}, nil,
+		),
+		hostSkew: prometheus.NewDesc(
+			"collectd_host_clock_skew_seconds",
+			"Time of the last value list of a host minus the time it was received in seconds. Values up to the interval below zero are expected from buffering.",
+			[]string{"instance"}, nil,
+		),
+		hostInfo: prometheus.NewDesc(
+			"collectd_host_info",
+			"Metadata about the hosts value lists were received from, taken from their most recent value list.",
+			[]string{"instance", "source", "source_ip", "user", "version"}, nil,
+		),
+		snapshotAt: prometheus.NewDesc(
+			"collectd_exporter_snapshot_timestamp_seconds",
+			"Time the snapshot of converted series served by scrapes was built.",
+			nil, nil,
+		),
+		hostCount: prometheus.NewDesc(
+			"collectd_exporter_hosts",
+			"Number of hosts value lists were received from within the host retention period.",
+			nil, nil,
+		),
+		outOfBounds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_out_of_bounds_values_total",
+				Help: "Number of values outside of the range declared in types.db, by type and action taken.",
+			},
+			[]string{"type", "action"},
+		),
+		decreases: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_derive_decreases_total",
+				Help: "Number of decreasing DERIVE values matching a derive rule, by type and mode of the rule.",
+			},
+			[]string{"type", "mode"},
+		),
+		longLabels: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_long_label_values_total",
+				Help: "Number of plugin and type instances longer than the maximum label value length, by action taken.",
+			},
+			[]string{"action"},
+		),
+		noInterval: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_missing_interval_value_lists_total",
+				Help: "Number of received value lists without an interval.",
+			},
+		),
+		filtered: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_filtered_value_lists_total",
+				Help: "Number of received value lists dropped by the plugin, type and host filters.",
+			},
+		),
+		collisions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_label_collisions_total",
+				Help: "Number of received value lists whose plugin name collides with the instance or type label.",
+			},
+		),
+		duplicates: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_duplicate_series_total",
+				Help: "Number of converted series dropped on collection because a more recent value list produced the same metric name and labels.",
+			},
+		),
+		aborted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_aborted_collections_total",
+				Help: "Number of collections stopped early because the scrape was canceled or timed out.",
+			},
+		),
+	}
+
+	builtin := map[string]Stage{
+		StageFilter: filterStage{filter: opts.Filter, filtered: c.filtered},
+	}
+	if opts.MaxLabelLength > 0 {
+		builtin[StageLabelLimits] = labelLimitStage{
+			max:       opts.MaxLabelLength,
+			policy:    opts.LabelLimit,
+			truncated: c.longLabels,
+		}
+	}
+	if opts.CounterWrap {
+		builtin[StageCounterWrap] = &wrapStage{counters: map[api.Identifier][]counterState{}}
+	}
+	if opts.Config != nil && len(opts.Config.Derive) > 0 {
+		builtin[StageDerive] = &deriveStage{config: opts.Config, states: map[api.Identifier][]deriveState{}, decreases: c.decreases}
+	}
+	if opts.StoreRates {
+		builtin[StageRates] = &rateStage{previous: history{}}
+	}
+	if opts.Bounds != BoundsIgnore && opts.TypesDB != nil {
+		builtin[StageBounds] = &boundsStage{
+			typesDB:     opts.TypesDB,
+			policy:      opts.Bounds,
+			previous:    history{},
+			outOfBounds: c.outOfBounds,
+		}
+	}
+	if opts.Config != nil && len(opts.Config.Downsample) > 0 {
+		builtin[StageDownsample] = &downsampleStage{config: opts.Config, kept: map[api.Identifier]time.Time{}}
+	}
+	if opts.Config != nil && len(opts.Config.Debounce) > 0 {
+		builtin[StageDebounce] = &debounceStage{config: opts.Config, kept: map[api.Identifier]api.ValueList{}}
+	}
+
+	if opts.AccountingLimit > 0 {
+		c.accounting = newAccounting(opts.AccountingLimit)
+	}
+	if opts.DedupeSenders {
+		c.dedupe = newSenderDedupe()
+	}
+	if opts.MaxSeriesPerHost > 0 {
+		c.quota = newSeriesQuota(opts.MaxSeriesPerHost)
+	}
+
+	// Labels configured at the exporter take precedence over those of the
+	// sender.
+	c.enrichers = append(c.enrichers, EnricherFunc(func(_ *api.ValueList, src source.Info) prometheus.Labels {
+		return src.Labels
+	}))
+	if len(opts.ConstLabels) > 0 {
+		c.enrichers = append(c.enrichers, StaticEnricher(opts.ConstLabels))
+	}
+	c.enrichers = append(c.enrichers, opts.Enrichers...)
+	if opts.ExportedBy != "" {
+		c.enrichers = append(c.enrichers, StaticEnricher(prometheus.Labels{"exported_by": opts.ExportedBy}))
+		c.exportedBy = prometheus.NewDesc(
+			"collectd_exporter_exported_by_info",
+			"Address of the exporter given in the exported_by label of the converted series.",
+			nil, prometheus.Labels{"exported_by": opts.ExportedBy},
+		)
+	}
+
+	if c.pipeline, err = newPipeline(opts, builtin); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Run processes the value lists written to c and periodically removes expired
+// value lists until ctx is canceled.
+func (c *Collector) Run(ctx context.Context) {
+	if c.opts.SnapshotInterval > 0 {
+		go c.runSnapshots(ctx)
+	}
+
+	gc := time.NewTimer(c.gcDelay(time.Time{}, time.Now()))
+	defer gc.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case s := <-c.ch:
+			c.ingest(s.vl, s.src)
+			*s.vl = api.ValueList{}
+			valueListPool.Put(s.vl)
+
+		case c.ping <- struct{}{}:
+
+		case r := <-c.deletes:
+			r.done <- c.delete(r)
+
+		case now := <-gc.C:
+			gc.Reset(c.gcDelay(c.gc(now), now))
+		}
+	}
+}
+
+// remove removes the value list vl with the given ID from the cache, along
+// with its pipeline state. It must only be called from Run() with c.mu held.
+func (c *Collector) remove(id string, vl api.ValueList) {
+	delete(c.valueLists, id)
+	c.families.remove(c.conversions[id])
+	delete(c.conversions, id)
+	delete(c.created, id)
+	delete(c.histograms, id)
+	delete(c.scraped, id)
+	c.pipeline.expire(vl.Identifier)
+	c.memory.remove(id, vl)
+	c.intervals.remove(vl)
+	if c.quota != nil {
+		c.quota.remove(id, vl)
+	}
+	if c.dedupe != nil {
+		c.dedupe.expire(vl.Identifier)
+	}
+}
+
+// deleteRequest asks Run to delete the cached value lists and hosts matched
+// by its functions, which may be nil to match nothing.
+type deleteRequest struct {
+	valueLists func(api.Identifier) bool
+	hosts      func(string) bool
+	done       chan int
+}
+
+// delete deletes what r matches and returns the number of deleted value
+// lists.
+func (c *Collector) delete(r deleteRequest) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	if r.valueLists != nil {
+		for id, vl := range c.valueLists {
+			if r.valueLists(vl.Identifier) {
+				c.remove(id, vl)
+				n++
+			}
+		}
+	}
+	if r.hosts != nil {
+		for host := range c.hosts {
+			if r.hosts(host) {
+				delete(c.hosts, host)
+				c.gaps.forgetHost(host)
+				c.skew.forgetHost(host)
+			}
+		}
+	}
+	return n
+}
+
+// requestDelete passes r to Run and returns the number of deleted value
+// lists, or ctx.Err() if Run does not respond in time.
+func (c *Collector) requestDelete(ctx context.Context, r deleteRequest) (int, error) {
+	r.done = make(chan int, 1)
+	select {
+	case c.deletes <- r:
+		return <-r.done, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// DeleteHost removes all value lists of host from the cache and forgets the
+// host. It returns the number of removed value lists.
+func (c *Collector) DeleteHost(ctx context.Context, host string) (int, error) {
+	return c.requestDelete(ctx, deleteRequest{
+		valueLists: func(id api.Identifier) bool { return id.Host == host },
+		hosts:      func(h string) bool { return h == host },
+	})
+}
+
+// DeleteValueList removes the value list with the given identifier, as
+// formatted by api.Identifier.String(), from the cache. It returns the number
+// of removed value lists, i.e. zero or one.
+func (c *Collector) DeleteValueList(ctx context.Context, identifier string) (int, error) {
+	return c.requestDelete(ctx, deleteRequest{
+		valueLists: func(id api.Identifier) bool { return id.String() == identifier },
+	})
+}
+
+// Flush removes all value lists from the cache and forgets all hosts. It
+// returns the number of removed value lists.
+func (c *Collector) Flush(ctx context.Context) (int, error) {
+	return c.requestDelete(ctx, deleteRequest{
+		valueLists: func(api.Identifier) bool { return true },
+		hosts:      func(string) bool { return true },
+	})
+}
+
+// Ping waits until Run is ready to process value lists, so that supervisors
+// can detect a hanging processing loop. It returns ctx.Err() if Run does not
+// respond in time.
+func (c *Collector) Ping(ctx context.Context) error {
+	select {
+	case <-c.ping:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ingest passes vl, received from src, through the pipeline and the
+// enrichers and stores it in the cache. It must only be called from Run() or
+// Ingest().
+func (c *Collector) ingest(vl *api.ValueList, src source.Info) {
+	sampled := c.opts.LogSample > 0 && rand.Float64() < c.opts.LogSample
+	setMetricType(vl, src.MetricType)
+	vl.Host = c.normalizeHost(vl.Host)
+	if c.accounting != nil {
+		c.accounting.record(*vl, src.Bytes)
+	}
+	received := time.Now()
+	c.traffic.record(*vl, received)
+	if vl.Interval <= 0 {
+		c.noInterval.Inc()
+		vl.Interval = c.opts.DefaultInterval
+	}
+	if c.dedupe != nil && !c.dedupe.keep(*vl, src, received) {
+		return
+	}
+	c.gaps.record(*vl)
+	skew := c.skew.record(*vl, received)
+	if !c.pipeline.process(vl) {
+		if sampled {
+			attrs := append(sourceAttrs(src), "identifier", vl.Identifier.String())
+			c.logger.Info("Sampled value list dropped by the pipeline", attrs...)
+		}
+		return
+	}
+	if labelsCollide(*vl) {
+		c.collisions.Inc()
+	}
+	extra := c.enrich(vl, src)
+	if sampled {
+		c.logSample(*vl, src, extra)
+	}
+
+	id := vl.Identifier.String()
+	// Only Run modifies the cache, so it is read here without holding c.mu.
+	conv := c.convert(*vl, extra, c.conversions[id])
+	if !c.families.allow(conv, c.conversions[id]) {
+		c.logger.Debug("Dropping value list conflicting with another metric family", "identifier", id)
+		return
+	}
+	if c.quota != nil && !c.quota.allow(id, *vl, len(conv.series)) {
+		c.logger.Debug("Dropping value list exceeding the series quota of its host", "identifier", id)
+		return
+	}
+	var created []time.Time
+	if c.opts.CreatedTimestamps {
+		created = counterCreated(*vl, c.valueLists[id], c.created[id])
+	}
+	c.mu.Lock()
+	if prev, ok := c.valueLists[id]; ok {
+		c.intervals.remove(prev)
+	}
+	c.intervals.add(*vl)
+	c.valueLists[id] = *vl
+	c.families.set(conv, c.conversions[id])
+	c.conversions[id] = conv
+	if created != nil {
+		c.created[id] = created
+	}
+	delete(c.scraped, id)
+	c.hosts[vl.Host] = hostState{seen: received, skew: skew, src: src}
+	c.observeHistograms(id, *vl)
+	c.memory.set(id, *vl, valueListSize(id, *vl, conv))
+	if c.quota != nil {
+		c.quota.set(id, *vl, len(conv.series))
+	}
+	histograms := c.histograms[id]
+	c.mu.Unlock()
+
+	if c.opts.Tap != nil {
+		c.opts.Tap(*vl, entryCollector{c: c, e: cacheEntry{id: id, vl: *vl, conv: conv, created: created, histograms: histograms}})
+	}
+
+	if c.opts.MaxMemoryBytes > 0 {
+		c.evict(c.opts.MaxMemoryBytes)
+	}
+}
+
+// logSample logs vl, received from src, with the names and labels of the
+// series it is converted to.
+func (c *Collector) logSample(vl api.ValueList, src source.Info, extra prometheus.Labels) {
+	names := make([]string, len(vl.Values))
+	for i := range vl.Values {
+		names[i] = c.name(vl, i)
+	}
+	attrs := append(sourceAttrs(src),
+		"identifier", vl.Identifier.String(),
+		"values", vl.Values,
+		"metrics", names,
+		"labels", c.labels(vl, extra),
+	)
+	c.logger.Info("Sampled value list", attrs...)
+}
+
+// sourceAttrs returns the known fields of src as log attributes.
+func sourceAttrs(src source.Info) []any {
+	var attrs []any
+	if src.Name != "" {
+		attrs = append(attrs, "source", src.Name)
+	}
+	if src.Addr.IsValid() {
+		attrs = append(attrs, "address", src.Addr)
+	}
+	if src.Username != "" {
+		attrs = append(attrs, "user", src.Username)
+	}
+	if src.Version != "" {
+		attrs = append(attrs, "version", src.Version)
+	}
+	return attrs
+}
+
+// enrich returns the labels added to the series of vl by the enrichers, or
+// nil if there are none.
+func (c *Collector) enrich(vl *api.ValueList, src source.Info) prometheus.Labels {
+	var extra prometheus.Labels
+	for _, e := range c.enrichers {
+		for name, value := range e.Enrich(vl, src) {
+			if extra == nil {
+				extra = prometheus.Labels{}
+			}
+			extra[name] = value
+		}
+	}
+	return extra
+}
+
+// observeHistograms adds the gauge values of vl to the histograms configured
+// for its data sources. c.mu must be held.
+func (c *Collector) observeHistograms(id string, vl api.ValueList) {
+	if c.opts.Config == nil {
+		return
+	}
+
+	for i, v := range vl.Values {
+		m := c.opts.Config.mapping(vl, i)
+		if m == nil || m.Histogram == nil {
+			continue
+		}
+		g, ok := v.(api.Gauge)
+		if !ok || math.IsNaN(float64(g)) {
+			continue
+		}
+		scale := m.factor()
+
+		hs := c.histograms[id]
+		if len(hs) != len(vl.Values) {
+			hs = make([]prometheus.Histogram, len(vl.Values))
+			c.histograms[id] = hs
+		}
+		if hs[i] == nil {
+			name := c.histogramName(m, vl, i)
+			labels := c.conversions[id].series[i].labels
+			if !c.opts.Config.keepSeries(name, labels) {
+				continue
+			}
+			hs[i] = prometheus.NewHistogram(m.Histogram.opts(name, c.help(vl, i), labels))
+		}
+		hs[i].Observe(float64(g)*scale + m.Offset)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(context.Background(), ch)
+}
+
+// WithContext returns a prometheus.Collector collecting the same metrics as
+// c, which stops converting value lists once ctx is done, e.g. because the
+// scraping client disconnected or the scrape timed out.
+func (c *Collector) WithContext(ctx context.Context) prometheus.Collector {
+	return contextCollector{c: c, ctx: ctx}
+}
+
+// contextCollector is a Collector bound to the context of a scrape.
+type contextCollector struct {
+	c   *Collector
+	ctx context.Context
+}
+
+// Collect implements prometheus.Collector.
+func (cc contextCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.c.collect(cc.ctx, ch)
+}
+
+// Describe implements prometheus.Collector.
+func (cc contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	cc.c.Describe(ch)
+}
+
+// Self returns a prometheus.Collector exposing only the collector's own
+// metrics, without the converted series and the metrics about collectd
+// hosts.
+func (c *Collector) Self() prometheus.Collector {
+	return selfCollector{c: c}
+}
+
+// selfCollector exports only the own metrics of a Collector.
+type selfCollector struct {
+	c *Collector
+}
+
+// Collect implements prometheus.Collector.
+func (s selfCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.collectSelf(ch)
+	ch <- s.c.duplicates
+	ch <- s.c.aborted
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked.
+func (s selfCollector) Describe(chan<- *prometheus.Desc) {}
+
+// ConvertedWithContext returns a prometheus.Collector exposing the converted
+// series and the metrics about collectd hosts, but not the collector's own
+// metrics. It stops converting value lists once ctx is done.
+func (c *Collector) ConvertedWithContext(ctx context.Context) prometheus.Collector {
+	return convertedCollector{c: c, ctx: ctx}
+}
+
+// convertedCollector exports the metrics converted from value lists of a
+// Collector.
+type convertedCollector struct {
+	c   *Collector
+	ctx context.Context
+}
+
+// Collect implements prometheus.Collector.
+func (cc convertedCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.c.collectConverted(cc.ctx, ch)
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked.
+func (cc convertedCollector) Describe(chan<- *prometheus.Desc) {}
+
+// collect sends all metrics of c to ch. The series are only converted while
+// ctx is not done.
+func (c *Collector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	self := shardFrom(ctx).Index == 0
+	if self {
+		c.collectSelf(ch)
+	}
+	c.collectConverted(ctx, ch)
+	if self {
+		// Sent last to include the duplicates and abort of this collection.
+		ch <- c.duplicates
+		ch <- c.aborted
+	}
+}
+
+// collectConverted sends the metrics about the collectd hosts of the shard
+// of ctx and the series converted from their value lists to ch.
+func (c *Collector) collectConverted(ctx context.Context, ch chan<- prometheus.Metric) {
+	// All value lists are checked for expiry at the same time, so that the
+	// series and intervals agree.
+	now := time.Now()
+	hosts := shardFrom(ctx).Contains
+	c.collectHosts(ch, hosts)
+	c.collectSeries(ctx, ch, hosts, now)
+	c.collectIntervals(ch, hosts, now)
+}
+
+// collectSelf sends the own metrics of c to ch, except for those updated by
+// collections.
+func (c *Collector) collectSelf(ch chan<- prometheus.Metric) {
+	ch <- c.lastPush
+	if c.exportedBy != nil {
+		ch <- prometheus.MustNewConstMetric(c.exportedBy, prometheus.GaugeValue, 1)
+	}
+	if s := c.snapshot.Load(); s != nil {
+		ch <- prometheus.MustNewConstMetric(c.snapshotAt, prometheus.GaugeValue, float64(s.time.UnixNano())/1e9)
+	}
+	c.outOfBounds.Collect(ch)
+	c.decreases.Collect(ch)
+	c.longLabels.Collect(ch)
+	ch <- c.noInterval
+	ch <- c.filtered
+	ch <- c.collisions
+	c.families.Collect(ch)
+	c.collectMemory(ch)
+	c.collectSuggestedInterval(ch)
+	c.gaps.missed.Collect(ch)
+	c.skew.exceeded.Collect(ch)
+	c.pipeline.Collect(ch)
+	if c.accounting != nil {
+		c.accounting.Collect(ch)
+	}
+	if c.dedupe != nil {
+		c.dedupe.Collect(ch)
+	}
+	if c.quota != nil {
+		c.quota.Collect(ch)
+	}
+}
+
+// hostState is what is known about a host from its most recent value list.
+type hostState struct {
+	seen time.Time
+	skew time.Duration
+	src  source.Info
+}
+
+// collectHosts sends the time the last value list of each host for which
+// include returns true was received, its clock skew, the host's metadata and
+// the number of those hosts to ch.
+func (c *Collector) collectHosts(ch chan<- prometheus.Metric, include func(string) bool) {
+	c.mu.Lock()
+	hosts := maps.Clone(c.hosts)
+	c.mu.Unlock()
+	maps.DeleteFunc(hosts, func(host string, _ hostState) bool { return !include(host) })
+
+	for host, h := range hosts {
+		seen, err := prometheus.NewConstMetric(c.hostSeen, prometheus.GaugeValue, float64(h.seen.UnixNano())/1e9, host)
+		if err != nil {
+			c.logger.Error("Error creating host metric", "instance", host, "err", err)
+			continue
+		}
+		ch <- seen
+		ch <- prometheus.MustNewConstMetric(c.hostSkew, prometheus.GaugeValue, h.skew.Seconds(), host)
+
+		var addr string
+		if h.src.Addr.IsValid() {
+			addr = h.src.Addr.String()
+		}
+		info, err := prometheus.NewConstMetric(c.hostInfo, prometheus.GaugeValue, 1, host, h.src.Name, addr, h.src.Username, h.src.Version)
+		if err != nil {
+			c.logger.Error("Error creating host metric", "instance", host, "err", err)
+			continue
+		}
+		ch <- info
+	}
+	ch <- prometheus.MustNewConstMetric(c.hostCount, prometheus.GaugeValue, float64(len(hosts)))
+}
+
+// collectIntervals sends the reporting interval of every plugin of the hosts
+// for which include returns true to ch, taken from the most recent of their
+// value lists unexpired at now.
+func (c *Collector) collectIntervals(ch chan<- prometheus.Metric, include func(string) bool, now time.Time) {
+	type key struct{ host, plugin string }
+	latest := map[key]api.ValueList{}
+	c.mu.Lock()
+	for _, vl := range c.valueLists {
+		// Pushed series are not reported by collectd plugins.
+		if c.expired(vl, now) || !include(vl.Host) || pushed(vl) {
+			continue
+		}
+		k := key{vl.Host, vl.Plugin}
+		if prev, ok := latest[k]; !ok || vl.Time.After(prev.Time) {
+			latest[k] = vl
+		}
+	}
+	c.mu.Unlock()
+
+	name := c.opts.Namespace + "_interval_seconds"
+	for k, vl := range latest {
+		labels := prometheus.Labels{"instance": k.host, "plugin": k.plugin}
+		if !c.opts.Config.keepSeries(name, labels) {
+			continue
+		}
+		desc := prometheus.NewDesc(name, "Interval in which collectd reports the values of a plugin, in seconds.", nil, labels)
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, vl.Interval.Seconds())
+		if err != nil {
+			c.logger.Error("Error creating interval metric", "instance", k.host, "plugin", k.plugin, "err", err)
+			continue
+		}
+		ch <- m
+	}
+}
+
+// collectSeries sends the metrics converted from the value lists of the hosts
+// for which include returns true, or of all hosts if include is nil,
+// unexpired at now to ch. It stops once ctx is done. The metrics are taken
+// from the latest snapshot, if snapshots are enabled and one was built
+// already.
+func (c *Collector) collectSeries(ctx context.Context, ch chan<- prometheus.Metric, include func(string) bool, now time.Time) {
+	if s := c.snapshot.Load(); s != nil {
+		for _, series := range s.series {
+			if err := ctx.Err(); err != nil {
+				c.aborted.Inc()
+				c.logger.Debug("Aborting collection", "err", err)
+				return
+			}
+			if (include == nil || include(series.host)) && !expiredAt(series.deadline, now) {
+				ch <- series.metric
+			}
+		}
+		return
+	}
+	c.convertSeries(ctx, include, now, func(_ string, _ time.Time, m prometheus.Metric) { ch <- m })
+}
+
+// convertSeries converts the value lists of the hosts for which include
+// returns true, or of all hosts if include is nil, unexpired at now, and
+// passes the resulting metrics to send along with the host and expiry
+// deadline of their value list. It stops and returns ctx.Err() once ctx is
+// done.
+func (c *Collector) convertSeries(ctx context.Context, include func(string) bool, now time.Time, send func(host string, deadline time.Time, m prometheus.Metric)) error {
+	_, span := tracer.Start(ctx, "collectd.collect")
+	defer span.End()
+
+	c.mu.Lock()
+	entries := make([]cacheEntry, 0, len(c.valueLists))
+	for id, vl := range c.valueLists {
+		if c.scraped[id] || (include != nil && !include(vl.Host)) {
+			continue
+		}
+		e := cacheEntry{id: id, vl: vl, conv: c.conversions[id], created: c.created[id], histograms: c.histograms[id]}
+		if r := c.opts.Config.expiry(vl); r != nil && r.Mode == expireAfterScrape {
+			// Hidden until the next value list arrives. It is removed
+			// from the cache once it times out.
+			c.scraped[id] = true
+			e.hidden = true
+		}
+		entries = append(entries, e)
+	}
+	c.mu.Unlock()
+	span.SetAttributes(attribute.Int("collectd.value_lists", len(entries)))
+
+	// Different value lists may be converted to the same series, e.g. after
+	// rewriting host names. Exporting both would fail the scrape, so the
+	// series of the most recent value list is kept.
+	slices.SortFunc(entries, func(a, b cacheEntry) int {
+		if n := b.vl.Time.Compare(a.vl.Time); n != 0 {
+			return n
+		}
+		return strings.Compare(a.vl.Identifier.String(), b.vl.Identifier.String())
+	})
+	seen := map[string]bool{}
+	unique := func(vl api.ValueList, name, key string) bool {
+		if !seen[key] {
+			seen[key] = true
+			return true
+		}
+		c.duplicates.Inc()
+		c.logger.Debug("Dropping duplicate series", "name", name, "identifier", vl.Identifier.String())
+		return false
+	}
+
+	for n, e := range entries {
+		if err := ctx.Err(); err != nil {
+			c.abortCollection(entries[n:], err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		deadline := c.deadline(e.vl)
+		if expiredAt(deadline, now) {
+			continue
+		}
+		c.collectEntry(func(m prometheus.Metric) { send(e.vl.Host, deadline, m) }, e, unique)
+	}
+	return nil
+}
+
+// collectEntry passes the series converted from the value list of e to send.
+// Only series for which unique returns true are sent.
+func (c *Collector) collectEntry(send func(prometheus.Metric), e cacheEntry, unique func(api.ValueList, string, string) bool) {
+	vl := e.vl
+	for i, h := range e.histograms {
+		if h == nil {
+			continue
+		}
+		name := c.histogramName(c.opts.Config.mapping(vl, i), vl, i)
+		if unique(vl, name, seriesKey(name, e.conv.series[i].labels)) {
+			send(h)
+		}
+	}
+
+	for i, series := range e.conv.series {
+		if series.desc == nil || !unique(vl, series.name, series.key) {
+			continue
+		}
+
+		var created time.Time
+		if i < len(e.created) {
+			created = e.created[i]
+		}
+		m, err := newMetric(vl, i, series.desc, series.scale, series.offset, created)
+		if err != nil {
+			c.logger.Error("Error converting collectd data type to a Prometheus metric", "err", err)
+			continue
+		}
+		if c.opts.Exemplars {
+			m = withExemplar(m, vl, i, series.scale)
+		}
+
+		send(m)
+	}
+	c.collectComputed(send, vl, e.conv.extra, unique)
+	if c.opts.Identifier == IdentifierInfo {
+		c.collectIdentifier(send, vl, e.conv.extra)
+	}
+}
+
+// entryCollector exports the series converted from a single value list.
+type entryCollector struct {
+	c *Collector
+	e cacheEntry
+}
+
+// Collect implements prometheus.Collector.
+func (ec entryCollector) Collect(ch chan<- prometheus.Metric) {
+	ec.c.collectEntry(func(m prometheus.Metric) { ch <- m }, ec.e, func(api.ValueList, string, string) bool { return true })
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked.
+func (ec entryCollector) Describe(chan<- *prometheus.Desc) {}
+
+// abortCollection records a collection stopped because of err, with the
+// value lists of entries not sent. Those hidden after being scraped are
+// shown again, as the scrape is incomplete.
+func (c *Collector) abortCollection(entries []cacheEntry, err error) {
+	c.aborted.Inc()
+	c.logger.Debug("Aborting collection", "unsent_value_lists", len(entries), "err", err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		if e.hidden {
+			delete(c.scraped, e.id)
+		}
+	}
+}
+
+// collectIdentifier passes an info metric mapping the labels of the series of
+// vl, which was enriched with extra, to its identifier to send.
+func (c *Collector) collectIdentifier(send func(prometheus.Metric), vl api.ValueList, extra prometheus.Labels) {
+	labels := c.labels(vl, extra)
+	labels["identifier"] = vl.Identifier.String()
+	name := c.opts.Namespace + "_identifier_info"
+	if !c.opts.Config.keepSeries(name, labels) {
+		return
+	}
+
+	desc := prometheus.NewDesc(name, "Maps the labels of converted series to the collectd identifier they originate from.", nil, labels)
+	m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1)
+	if err != nil {
+		c.logger.Error("Error creating identifier info metric", "identifier", vl.Identifier.String(), "err", err)
+		return
+	}
+	send(m)
+}
+
+// cacheEntry is a cached value list along with its conversion, created
+// timestamps and histograms. hidden is set if the value list is hidden after
+// this scrape.
+type cacheEntry struct {
+	id         string
+	hidden     bool
+	vl         api.ValueList
+	conv       *conversion
+	created    []time.Time
+	histograms []prometheus.Histogram
+}
+
+// seriesKey returns a string identifying the series with the given name and
+// labels.
+func seriesKey(name string, labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		names = append(names, l)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range names {
+		b.WriteByte(0xff)
+		b.WriteString(l)
+		b.WriteByte(0xff)
+		b.WriteString(labels[l])
+	}
+	return b.String()
+}
+
+// histogramName returns the name of the histogram configured by m for
+// one data source of vl.
+func (c *Collector) histogramName(m *mapping, vl api.ValueList, index int) string {
+	if m.Histogram.Name != "" {
+		return m.Histogram.Name
+	}
+	return c.name(vl, index) + "_histogram"
+}
+
+// collectComputed passes the computed metrics configured for vl, which was
+// enriched with extra, to send. Only series for which unique returns true are
+// sent.
+func (c *Collector) collectComputed(send func(prometheus.Metric), vl api.ValueList, extra prometheus.Labels, unique func(api.ValueList, string, string) bool) {
+	computed := c.opts.Config.computedMetrics(vl)
+	if len(computed) == 0 {
+		return
+	}
+
+	vars := make(map[string]float64, len(vl.Values))
+	for i, v := range vl.Values {
+		if f, _, err := convertValue(v); err == nil {
+			vars[vl.DSName(i)] = f
+		}
+	}
+	labels := c.labels(vl, extra)
+
+	for _, cm := range computed {
+		if !c.opts.Config.keepSeries(cm.Name, labels) || !unique(vl, cm.Name, seriesKey(cm.Name, labels)) {
+			continue
+		}
+		value, err := cm.expr.eval(vars)
+		if err != nil {
+			c.logger.Debug("Error evaluating computed metric", "name", cm.Name, "identifier", vl.Identifier.String(), "err", err)
+			continue
+		}
+
+		m, err := prometheus.NewConstMetric(prometheus.NewDesc(cm.Name, cm.Help, nil, labels), prometheus.GaugeValue, value)
+		if err != nil {
+			c.logger.Error("Error creating computed metric", "name", cm.Name, "err", err)
+			continue
+		}
+
+		send(m)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lastPush.Desc()
+	ch <- c.hostSeen
+	ch <- c.hostSkew
+	ch <- c.hostCount
+	ch <- c.hostInfo
+	ch <- c.snapshotAt
+	if c.exportedBy != nil {
+		ch <- c.exportedBy
+	}
+	c.outOfBounds.Describe(ch)
+	c.decreases.Describe(ch)
+	c.longLabels.Describe(ch)
+	ch <- c.noInterval.Desc()
+	ch <- c.filtered.Desc()
+	ch <- c.collisions.Desc()
+	c.families.Describe(ch)
+	c.memory.describe(ch)
+	ch <- c.intervals.desc
+	c.gaps.missed.Describe(ch)
+	c.skew.exceeded.Describe(ch)
+	c.pipeline.Describe(ch)
+	if c.accounting != nil {
+		c.accounting.Describe(ch)
+	}
+	if c.dedupe != nil {
+		c.dedupe.Describe(ch)
+	}
+	if c.quota != nil {
+		c.quota.Describe(ch)
+	}
+	ch <- c.duplicates.Desc()
+	ch <- c.aborted.Desc()
+}
+
+// Write writes "vl" to the collector's channel, to be (asynchronously)
+// processed by Run(). The source.Info stored in ctx is passed to the
+// enrichers. It implements api.Writer. vl is copied, so the caller may reuse
+// it once Write returns.
+func (c *Collector) Write(ctx context.Context, vl *api.ValueList) error {
+	c.lastPush.Set(float64(time.Now().UnixNano()) / 1e9)
+
+	// The span covers the time spent waiting for Run to accept vl. The
+	// identifier is only formatted for sampled spans, as it allocates.
+	ctx, span := tracer.Start(ctx, "collectd.write")
+	defer span.End()
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("collectd.identifier", vl.Identifier.String()))
+	}
+
+	src, _ := source.FromContext(ctx)
+	cp := valueListPool.Get().(*api.ValueList)
+	*cp = *vl
+	select {
+	case c.ch <- sample{vl: cp, src: src}:
+		return nil
+	case <-ctx.Done():
+		valueListPool.Put(cp)
+		return ctx.Err()
+	}
+}
+
+// Ingest processes vl synchronously. It is meant for offline conversion and
+// must not be called while Run is active.
+func (c *Collector) Ingest(vl *api.ValueList) {
+	cp := *vl
+	c.ingest(&cp, source.Info{})
+}
+
+// Series returns a prometheus.Collector exposing only the converted series,
+// without the collector's own metrics.
+func (c *Collector) Series() prometheus.Collector {
+	return seriesCollector{c: c, ctx: context.Background()}
+}
+
+// HostSeries returns a prometheus.Collector exposing only the series
+// converted from the value lists of host, which stops once ctx is done.
+func (c *Collector) HostSeries(ctx context.Context, host string) prometheus.Collector {
+	return seriesCollector{c: c, ctx: ctx, host: host}
+}
+
+// seriesCollector exports only the converted series of a Collector,
+// optionally limited to one host.
+type seriesCollector struct {
+	c    *Collector
+	ctx  context.Context
+	host string
+}
+
+// Collect implements prometheus.Collector.
+func (s seriesCollector) Collect(ch chan<- prometheus.Metric) {
+	var include func(string) bool
+	if s.host != "" {
+		include = func(host string) bool { return host == s.host }
+	}
+	s.c.collectSeries(s.ctx, ch, include, time.Now())
+}
+
+// Describe implements prometheus.Collector. The collector is unchecked.
+func (s seriesCollector) Describe(chan<- *prometheus.Desc) {}
+
+// name returns the metric name of one data source of vl, as given by the
+// profile if it converts vl, with the unit of its mapping appended.
+func (c *Collector) name(vl api.ValueList, index int) string {
+	if pushed(vl) {
+		return seriesName(c.opts.Namespace, vl, index, false)
+	}
+	if p, ok := c.profile(vl); ok {
+		return p.names[index]
+	}
+	name := seriesName(c.opts.Namespace, vl, index, !c.dsLabelled(vl))
+	if m := c.opts.Config.mapping(vl, index); m != nil && m.Unit != "" {
+		name = withUnit(name, m.Unit)
+	}
+	return name
+}
+
+// help returns the HELP text of the metric of one data source of vl.
+func (c *Collector) help(vl api.ValueList, index int) string {
+	if pushed(vl) {
+		return pushedHelp
+	}
+	if c.dsLabelled(vl) {
+		return dsLabelHelp(vl, index, c.opts.Config)
+	}
+	return newHelp(vl, index, c.opts.Config, c.opts.TypesDB)
+}
+
+// dsLabelled returns whether the data source names of vl are exported as the
+// label given by Options.DSLabel. This requires several data sources of the
+// same value type and no label of that name converted from the identifier.
+func (c *Collector) dsLabelled(vl api.ValueList) bool {
+	if c.opts.DSLabel == "" || len(vl.Values) < 2 || vl.Plugin == c.opts.DSLabel {
+		return false
+	}
+	if _, ok := c.profile(vl); ok {
+		return false
+	}
+	_, first, err := convertValue(vl.Values[0])
+	if err != nil {
+		return false
+	}
+	for _, v := range vl.Values[1:] {
+		if _, t, err := convertValue(v); err != nil || t != first {
+			return false
+		}
+	}
+	return true
+}
+
+// scale returns the factor converting the values of one data source of vl
+// to the unit of its metric.
+func (c *Collector) scale(vl api.ValueList, index int) float64 {
+	if p, ok := c.profile(vl); ok {
+		return p.scale
+	}
+	if m := c.opts.Config.mapping(vl, index); m != nil {
+		return m.factor()
+	}
+	return 1
+}
+
+// offset returns the offset added to the gauge values of one data source of
+// vl after scaling them.
+func (c *Collector) offset(vl api.ValueList, index int) float64 {
+	if _, ok := c.profile(vl); ok {
+		return 0
+	}
+	if m := c.opts.Config.mapping(vl, index); m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+// labels returns the labels of the series converted from vl, as given by the
+// profile if it converts vl or with the labels extracted by the instance label
+// rules, with the identifier label, if enabled, and the extra labels of the
+// enrichers added.
+func (c *Collector) labels(vl api.ValueList, extra prometheus.Labels) prometheus.Labels {
+	labels := newLabels(vl, c.opts.LabelCollisions)
+	if p, ok := c.profile(vl); ok {
+		labels = prometheus.Labels{"instance": vl.Host}
+		maps.Copy(labels, p.labels)
+	} else if pi, ti := c.opts.Config.instanceLabels(vl); pi != nil || ti != nil {
+		pluginLabel, typeLabel := instanceLabelNames(vl, c.opts.LabelCollisions)
+		if pi != nil {
+			delete(labels, pluginLabel)
+		}
+		if ti != nil {
+			delete(labels, typeLabel)
+		}
+		for _, captured := range []prometheus.Labels{pi, ti} {
+			for name, value := range captured {
+				if _, ok := labels[name]; !ok {
+					labels[name] = value
+				}
+			}
+		}
+	}
+	if c.opts.Identifier == IdentifierLabel {
+		labels["identifier"] = vl.Identifier.String()
+	}
+	for name, value := range extra {
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+	return labels
+}
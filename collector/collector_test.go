@@ -0,0 +1,1103 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/meta"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/collectd_exporter/source"
+)
+
+func TestNewName(t *testing.T) {
+	cases := []struct {
+		vl    api.ValueList
+		index int
+		want  string
+	}{
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "cpu",
+				Type:   "cpu",
+			},
+			DSNames: []string{"value"},
+			Values:  []api.Value{api.Derive(0)},
+		}, 0, "collectd_cpu_total"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "dns",
+				Type:   "dns_qtype",
+			},
+			DSNames: []string{"value"},
+			Values:  []api.Value{api.Derive(0)},
+		}, 0, "collectd_dns_dns_qtype_total"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "df",
+				Type:   "df",
+			},
+			DSNames: []string{"used", "free"},
+			Values:  []api.Value{api.Gauge(0), api.Gauge(1)},
+		}, 0, "collectd_df_used"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "df",
+				Type:   "df",
+			},
+			DSNames: []string{"used", "free"},
+			Values:  []api.Value{api.Gauge(0), api.Gauge(1)},
+		}, 1, "collectd_df_free"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "cpu",
+				Type:   "percent",
+			},
+			DSNames: []string{"value"},
+			Values:  []api.Value{api.Gauge(0)},
+		}, 0, "collectd_cpu_percent"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "interface",
+				Type:   "if_octets",
+			},
+			DSNames: []string{"rx", "tx"},
+			Values:  []api.Value{api.Counter(0), api.Counter(1)},
+		}, 0, "collectd_interface_if_octets_rx_total"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "interface",
+				Type:   "if_octets",
+			},
+			DSNames: []string{"rx", "tx"},
+			Values:  []api.Value{api.Counter(0), api.Counter(1)},
+		}, 1, "collectd_interface_if_octets_tx_total"},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Plugin: "docker",
+				Type:   "cpu.percent",
+			},
+			DSNames: []string{"value"},
+			Values:  []api.Value{api.Gauge(0)},
+		}, 0, "collectd_docker_cpu_percent"},
+	}
+
+	for _, c := range cases {
+		got := newName(DefaultNamespace, c.vl, c.index)
+		if got != c.want {
+			t.Errorf("newName(%v): got %q, want %q", c.vl, got, c.want)
+		}
+	}
+}
+
+func TestNewLabels(t *testing.T) {
+	cases := []struct {
+		vl   api.ValueList
+		want prometheus.Labels
+	}{
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:           "example.com",
+				Plugin:         "cpu",
+				PluginInstance: "0",
+				Type:           "cpu",
+				TypeInstance:   "user",
+			},
+		}, prometheus.Labels{
+			"cpu":      "0",
+			"type":     "user",
+			"instance": "example.com",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "example.com",
+				Plugin:       "df",
+				Type:         "df_complex",
+				TypeInstance: "used",
+			},
+		}, prometheus.Labels{
+			"df":       "used",
+			"instance": "example.com",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:   "example.com",
+				Plugin: "load",
+				Type:   "load",
+			},
+		}, prometheus.Labels{
+			"instance": "example.com",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "example.com",
+				Plugin:       source.PrometheusPlugin,
+				Type:         "http_requests_total",
+				TypeInstance: `{code="200",instance="web1",type="api"}`,
+			},
+			Meta: meta.Data{metricTypeMeta: meta.String(source.PrometheusCounter)},
+		}, prometheus.Labels{
+			"code":     "200",
+			"type":     "api",
+			"instance": "example.com",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "example.com",
+				Plugin:       source.PrometheusPlugin,
+				Type:         "http_requests_total",
+				TypeInstance: `{code="200"}`,
+			},
+		}, prometheus.Labels{
+			"prometheus": `{code="200"}`,
+			"instance":   "example.com",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "example.com",
+				Plugin:       "exec",
+				Type:         "gauge",
+				TypeInstance: `{code="200"}`,
+			},
+		}, prometheus.Labels{
+			"exec":     `{code="200"}`,
+			"instance": "example.com",
+		}},
+		{api.ValueList{
+			Identifier: api.Identifier{
+				Host:         "example.com",
+				Plugin:       "uptime",
+				Type:         "uptime",
+				TypeInstance: `{code="200"}`,
+			},
+		}, prometheus.Labels{
+			"uptime":   `{code="200"}`,
+			"instance": "example.com",
+		}},
+	}
+
+	for _, c := range cases {
+		got := newLabels(c.vl, CollisionOverwrite)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("newLabels(%v): got %v, want %v", c.vl, got, c.want)
+		}
+	}
+}
+
+func TestLabelCollisions(t *testing.T) {
+	instance := api.ValueList{Identifier: api.Identifier{Host: "example.com", Plugin: "instance", Type: "gauge", PluginInstance: "a"}}
+	typ := api.ValueList{Identifier: api.Identifier{Host: "example.com", Plugin: "type", Type: "gauge", PluginInstance: "a", TypeInstance: "b"}}
+
+	cases := []struct {
+		vl     api.ValueList
+		policy CollisionPolicy
+		want   prometheus.Labels
+	}{
+		{instance, CollisionOverwrite, prometheus.Labels{"instance": "example.com"}},
+		{instance, CollisionPrefix, prometheus.Labels{"plugin_instance": "a", "instance": "example.com"}},
+		{instance, CollisionPluginInstance, prometheus.Labels{"plugin_instance": "a", "instance": "example.com"}},
+		{typ, CollisionOverwrite, prometheus.Labels{"type": "b", "instance": "example.com"}},
+		{typ, CollisionPrefix, prometheus.Labels{"plugin_type": "a", "type": "b", "instance": "example.com"}},
+		{typ, CollisionPluginInstance, prometheus.Labels{"plugin_instance": "a", "type": "b", "instance": "example.com"}},
+	}
+	for _, c := range cases {
+		if got := newLabels(c.vl, c.policy); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("newLabels(%v, %q): got %v, want %v", c.vl, c.policy, got, c.want)
+		}
+	}
+
+	c := newTestCollector(t, Options{})
+	for _, vl := range []api.ValueList{instance, typ, {Identifier: api.Identifier{Plugin: "type", Type: "gauge", PluginInstance: "a"}}} {
+		vl.Values = []api.Value{api.Gauge(1)}
+		c.Ingest(&vl)
+	}
+	if got := testutil.ToFloat64(c.collisions); got != 2 {
+		t.Errorf("got %v collisions, want 2", got)
+	}
+}
+
+func TestCounterStateCorrect(t *testing.T) {
+	cases := []struct {
+		name   string
+		values []api.Counter
+		want   []api.Counter
+	}{
+		{
+			name:   "increasing",
+			values: []api.Counter{10, 20, 30},
+			want:   []api.Counter{10, 20, 30},
+		},
+		{
+			name:   "32-bit wrap",
+			values: []api.Counter{math.MaxUint32 - 10, 5, 100},
+			want:   []api.Counter{math.MaxUint32 - 10, math.MaxUint32 + 6, math.MaxUint32 + 101},
+		},
+		{
+			name:   "repeated wraps",
+			values: []api.Counter{4000000000, 1000, 4000000000, 1000},
+			want:   []api.Counter{4000000000, 1000 + 1<<32, 4000000000 + 1<<32, 1000 + 2<<32},
+		},
+		{
+			name:   "reset",
+			values: []api.Counter{1000000, 10},
+			want:   []api.Counter{1000000, 10},
+		},
+		{
+			name:   "64-bit counter",
+			values: []api.Counter{1 << 40, 1},
+			want:   []api.Counter{1 << 40, 1},
+		},
+	}
+
+	for _, c := range cases {
+		var s counterState
+		for i, v := range c.values {
+			if got := s.correct(v); got != c.want[i] {
+				t.Errorf("%s: correct(%d) at index %d: got %d, want %d", c.name, v, i, got, c.want[i])
+			}
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	cases := []struct {
+		prev, cur api.Value
+		d         time.Duration
+		want      float64
+	}{
+		{api.Derive(10), api.Derive(30), 10 * time.Second, 2},
+		{api.Derive(30), api.Derive(10), 10 * time.Second, -2},
+		{api.Counter(100), api.Counter(150), 5 * time.Second, 10},
+		{api.Counter(150), api.Counter(100), 5 * time.Second, math.NaN()},
+		{api.Derive(10), api.Derive(30), 0, math.NaN()},
+		{api.Counter(10), api.Derive(30), time.Second, math.NaN()},
+	}
+
+	for _, c := range cases {
+		got := rate(c.prev, c.cur, c.d)
+		if got != c.want && !(math.IsNaN(got) && math.IsNaN(c.want)) {
+			t.Errorf("rate(%v, %v, %v): got %v, want %v", c.prev, c.cur, c.d, got, c.want)
+		}
+	}
+}
+
+func TestCheckBounds(t *testing.T) {
+	typesDB, err := api.NewTypesDB(strings.NewReader("percent value:GAUGE:0:100.1\nif_octets rx:DERIVE:0:U, tx:DERIVE:0:U\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		policy BoundsPolicy
+		vl     api.ValueList
+		prev   *previousValues
+		want   []api.Value
+		keep   bool
+	}{
+		{
+			name:   "gauge within range",
+			policy: BoundsDrop,
+			vl:     api.ValueList{Identifier: api.Identifier{Type: "percent"}, Values: []api.Value{api.Gauge(50)}},
+			want:   []api.Value{api.Gauge(50)},
+			keep:   true,
+		},
+		{
+			name:   "gauge dropped",
+			policy: BoundsDrop,
+			vl:     api.ValueList{Identifier: api.Identifier{Type: "percent"}, Values: []api.Value{api.Gauge(-1)}},
+			keep:   false,
+		},
+		{
+			name:   "gauge clamped",
+			policy: BoundsClamp,
+			vl:     api.ValueList{Identifier: api.Identifier{Type: "percent"}, Values: []api.Value{api.Gauge(1000)}},
+			want:   []api.Value{api.Gauge(100.1)},
+			keep:   true,
+		},
+		{
+			name:   "unknown type",
+			policy: BoundsDrop,
+			vl:     api.ValueList{Identifier: api.Identifier{Type: "unknown"}, Values: []api.Value{api.Gauge(-1)}},
+			want:   []api.Value{api.Gauge(-1)},
+			keep:   true,
+		},
+		{
+			name:   "negative derive rate",
+			policy: BoundsClamp,
+			vl: api.ValueList{
+				Identifier: api.Identifier{Type: "if_octets"},
+				Time:       now,
+				Values:     []api.Value{api.Derive(10), api.Derive(100)},
+			},
+			prev: &previousValues{time: now.Add(-10 * time.Second), values: []api.Value{api.Derive(20), api.Derive(50)}},
+			keep: false,
+		},
+		{
+			name:   "derive without predecessor",
+			policy: BoundsDrop,
+			vl: api.ValueList{
+				Identifier: api.Identifier{Type: "if_octets"},
+				Time:       now,
+				Values:     []api.Value{api.Derive(10), api.Derive(100)},
+			},
+			want: []api.Value{api.Derive(10), api.Derive(100)},
+			keep: true,
+		},
+	}
+
+	for _, tc := range cases {
+		s := &boundsStage{
+			typesDB:     typesDB,
+			policy:      tc.policy,
+			previous:    history{},
+			outOfBounds: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "out_of_bounds"}, []string{"type", "action"}),
+		}
+		if tc.prev != nil {
+			s.previous[tc.vl.Identifier] = *tc.prev
+		}
+		vl := tc.vl
+		keep := s.Process(&vl)
+		if keep != tc.keep {
+			t.Errorf("%s: got keep %v, want %v", tc.name, keep, tc.keep)
+			continue
+		}
+		if keep && !reflect.DeepEqual(vl.Values, tc.want) {
+			t.Errorf("%s: got values %v, want %v", tc.name, vl.Values, tc.want)
+		}
+	}
+}
+
+func TestNewHelp(t *testing.T) {
+	typesDB, err := api.NewTypesDB(strings.NewReader("df_complex value:GAUGE:0:U\nload shortterm:GAUGE:0:5000\ncpu value:DERIVE:U:U\nsignal_quality value:GAUGE:U:0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Mappings: []mapping{
+		{Plugin: "df", Type: "df_complex", Help: "Disk space in bytes."},
+		{Plugin: "cpu", Type: "cpu", Unit: "seconds", FromUnit: "jiffies"},
+	}}
+	df := api.ValueList{
+		Identifier: api.Identifier{Plugin: "df", Type: "df_complex"},
+		Values:     []api.Value{api.Gauge(0)},
+	}
+	memory := api.ValueList{
+		Identifier: api.Identifier{Plugin: "memory", Type: "df_complex"},
+		Values:     []api.Value{api.Gauge(0)},
+	}
+	vl := func(plugin, typ string, value api.Value) api.ValueList {
+		return api.ValueList{Identifier: api.Identifier{Plugin: plugin, Type: typ}, Values: []api.Value{value}}
+	}
+
+	cases := []struct {
+		vl      api.ValueList
+		cfg     *Config
+		typesDB *api.TypesDB
+		want    string
+	}{
+		{df, nil, nil, "Collectd exporter: 'df' Type: 'df_complex' Dstype: 'api.Gauge' Dsname: 'value'"},
+		{df, nil, typesDB, "'df' plugin, type 'df_complex', data source 'value': gauge in bytes, at least 0."},
+		{df, cfg, typesDB, "Disk space in bytes."},
+		{memory, cfg, nil, "Collectd exporter: 'memory' Type: 'df_complex' Dstype: 'api.Gauge' Dsname: 'value'"},
+		{vl("load", "load", api.Gauge(1)), nil, typesDB, "'load' plugin, type 'load', data source 'shortterm': gauge, between 0 and 5000."},
+		// The unit of the mapping takes precedence.
+		{vl("cpu", "cpu", api.Derive(1)), cfg, typesDB, "'cpu' plugin, type 'cpu', data source 'value': derive in seconds."},
+		{vl("wireless", "signal_quality", api.Gauge(1)), nil, typesDB, "'wireless' plugin, type 'signal_quality', data source 'value': gauge, at most 0."},
+		// Types missing from types.db get the generic text.
+		{vl("load", "unknown", api.Gauge(1)), nil, typesDB, "Collectd exporter: 'load' Type: 'unknown' Dstype: 'api.Gauge' Dsname: 'value'"},
+	}
+
+	for _, c := range cases {
+		if got := newHelp(c.vl, 0, c.cfg, c.typesDB); got != c.want {
+			t.Errorf("newHelp(%v): got %q, want %q", c.vl, got, c.want)
+		}
+	}
+}
+
+// newTestCollector returns a collector without the Run() goroutine, so that
+// tests can call ingest() synchronously.
+func newTestCollector(t testing.TB, opts Options) *Collector {
+	t.Helper()
+
+	c, err := New(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestHistogram(t *testing.T) {
+	c := newTestCollector(t, Options{Config: &Config{Mappings: []mapping{
+		{Plugin: "ping", Type: "ping", Histogram: &histogramConfig{Buckets: []float64{1, 10}}},
+	}}})
+
+	for _, v := range []float64{0.5, 5, 50} {
+		c.ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "ping", Type: "ping", TypeInstance: "gateway"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(v)},
+		}, source.Info{})
+	}
+
+	want := `
+# HELP collectd_ping_histogram Collectd exporter: 'ping' Type: 'ping' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_ping_histogram histogram
+collectd_ping_histogram_bucket{instance="example.com",ping="gateway",le="1"} 1
+collectd_ping_histogram_bucket{instance="example.com",ping="gateway",le="10"} 2
+collectd_ping_histogram_bucket{instance="example.com",ping="gateway",le="+Inf"} 3
+collectd_ping_histogram_sum{instance="example.com",ping="gateway"} 55.5
+collectd_ping_histogram_count{instance="example.com",ping="gateway"} 3
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_ping_histogram"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	c := newTestCollector(t, Options{Config: &Config{Mappings: []mapping{
+		{Plugin: "ping", Histogram: &histogramConfig{NativeBucketFactor: 1.1}},
+	}}})
+	for _, v := range []float64{0.5, 5, 50} {
+		c.ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "ping", Type: "ping"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(v)},
+		}, source.Info{})
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "collectd_ping_histogram" {
+			continue
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 3 {
+			t.Errorf("got sample count %d, want 3", h.GetSampleCount())
+		}
+		if len(h.GetBucket()) != 0 {
+			t.Errorf("got %d classic buckets, want none", len(h.GetBucket()))
+		}
+		if len(h.GetPositiveSpan()) == 0 {
+			t.Error("got no native histogram spans")
+		}
+		return
+	}
+	t.Error("native histogram not found")
+}
+
+func TestWithExemplar(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	vl := api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "interface", Type: "if_octets"},
+		Time:       now,
+		DSNames:    []string{"rx", "tx"},
+		Values:     []api.Value{api.Derive(10), api.Gauge(1)},
+	}
+
+	for i, wantExemplar := range []bool{true, false} {
+		desc := prometheus.NewDesc(newName(DefaultNamespace, vl, i), "help", nil, newLabels(vl, CollisionOverwrite))
+		m, err := newMetric(vl, i, desc, 1, 0, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var pb dto.Metric
+		if err := withExemplar(m, vl, i, 1).Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		e := pb.GetCounter().GetExemplar()
+		if (e != nil) != wantExemplar {
+			t.Errorf("index %d: got exemplar %v, want exemplar: %v", i, e, wantExemplar)
+			continue
+		}
+		if e == nil {
+			continue
+		}
+		if e.GetValue() != 10 || e.GetTimestamp().AsTime() != now.UTC() {
+			t.Errorf("got exemplar %v", e)
+		}
+		if len(e.GetLabel()) != 1 || e.GetLabel()[0].GetName() != "host" || e.GetLabel()[0].GetValue() != "example.com" {
+			t.Errorf("got exemplar labels %v", e.GetLabel())
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	c := newTestCollector(t, Options{
+		Namespace:   "custom",
+		ConstLabels: prometheus.Labels{"dc": "eu1", "instance": "ignored"},
+		KeepExpired: true,
+	})
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		DSNames:    []string{"shortterm"},
+		Values:     []api.Value{api.Gauge(0.5)},
+	})
+
+	want := `
+# HELP custom_load_shortterm Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'shortterm'
+# TYPE custom_load_shortterm gauge
+custom_load_shortterm{dc="eu1",instance="example.com"} 0.5
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// Without Run, Write blocks until the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Write(ctx, &api.ValueList{Values: []api.Value{api.Gauge(1)}}); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestPing(t *testing.T) {
+	c := newTestCollector(t, Options{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got error %v without Run, want %v", err, context.DeadlineExceeded)
+	}
+
+	runCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go c.Run(runCtx)
+	if err := c.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogSample(t *testing.T) {
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "user"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		DSNames:    []string{"value"},
+		Values:     []api.Value{api.Derive(42)},
+	}
+
+	for _, sample := range []float64{0, 1} {
+		var out bytes.Buffer
+		c, err := New(slog.New(slog.NewTextHandler(&out, nil)), Options{LogSample: sample})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Ingest(vl)
+
+		logged := strings.Contains(out.String(), `msg="Sampled value list"`)
+		if logged != (sample == 1) {
+			t.Errorf("sample %v: got log %q", sample, out.String())
+		}
+		if logged && !strings.Contains(out.String(), "metrics=[collectd_cpu_total]") {
+			t.Errorf("log %q lacks the metric name", out.String())
+		}
+	}
+}
+
+func TestDuplicateSeries(t *testing.T) {
+	c := newTestCollector(t, Options{KeepExpired: true})
+	// Both value lists are converted to collectd_disk_ops{disk="sda"}.
+	for i, id := range []api.Identifier{
+		{Host: "example.com", Plugin: "disk", Type: "ops", PluginInstance: "sda"},
+		{Host: "example.com", Plugin: "disk", Type: "ops", TypeInstance: "sda"},
+	} {
+		c.Ingest(&api.ValueList{
+			Identifier: id,
+			Time:       time.Unix(1700000000+int64(i), 0),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(i)},
+		})
+	}
+
+	want := `
+# HELP collectd_disk_ops Collectd exporter: 'disk' Type: 'ops' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_disk_ops gauge
+collectd_disk_ops{disk="sda",instance="example.com"} 1
+# HELP collectd_exporter_duplicate_series_total Number of converted series dropped on collection because a more recent value list produced the same metric name and labels.
+# TYPE collectd_exporter_duplicate_series_total counter
+collectd_exporter_duplicate_series_total 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_disk_ops", "collectd_exporter_duplicate_series_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "user"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Derive(42)},
+	}
+
+	cases := []struct {
+		mode IdentifierMode
+		want string
+	}{
+		{IdentifierLabel, `
+# HELP collectd_cpu_total Collectd exporter: 'cpu' Type: 'cpu' Dstype: 'api.Derive' Dsname: 'value'
+# TYPE collectd_cpu_total counter
+collectd_cpu_total{cpu="0",identifier="example.com/cpu-0/cpu-user",instance="example.com",type="user"} 42
+`},
+		{IdentifierInfo, `
+# HELP collectd_cpu_total Collectd exporter: 'cpu' Type: 'cpu' Dstype: 'api.Derive' Dsname: 'value'
+# TYPE collectd_cpu_total counter
+collectd_cpu_total{cpu="0",instance="example.com",type="user"} 42
+# HELP collectd_identifier_info Maps the labels of converted series to the collectd identifier they originate from.
+# TYPE collectd_identifier_info gauge
+collectd_identifier_info{cpu="0",identifier="example.com/cpu-0/cpu-user",instance="example.com",type="user"} 1
+`},
+	}
+	for _, tc := range cases {
+		c := newTestCollector(t, Options{Identifier: tc.mode, KeepExpired: true})
+		c.Ingest(vl)
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.Series())
+		if err := testutil.GatherAndCompare(reg, strings.NewReader(tc.want)); err != nil {
+			t.Errorf("%s: %v", tc.mode, err)
+		}
+	}
+}
+
+func TestIntervals(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	now := time.Now()
+	for _, vl := range []api.ValueList{
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu"}, Time: now.Add(-time.Second), Interval: 10 * time.Second},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "1", Type: "cpu"}, Time: now, Interval: 20 * time.Second},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "smart", Type: "temperature"}, Time: now, Interval: time.Hour},
+	} {
+		vl.Values = []api.Value{api.Gauge(1)}
+		c.Ingest(&vl)
+	}
+	// Pushed series have no plugin interval.
+	pushed := api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: source.PrometheusPlugin, Type: "jobs"},
+		Time:       now,
+		Interval:   time.Minute,
+		Values:     []api.Value{api.Gauge(1)},
+	}
+	c.ingest(&pushed, source.Info{MetricType: source.PrometheusGauge})
+
+	want := `
+# HELP collectd_interval_seconds Interval in which collectd reports the values of a plugin, in seconds.
+# TYPE collectd_interval_seconds gauge
+collectd_interval_seconds{instance="example.com",plugin="cpu"} 20
+collectd_interval_seconds{instance="example.com",plugin="smart"} 3600
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_interval_seconds"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com"} {
+		c.ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "load"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		}, source.Info{Name: "http", Addr: netip.MustParseAddr("192.0.2.1"), Version: "5.12.0"})
+	}
+	if got := testutil.CollectAndCount(c.ConvertedWithContext(context.Background()), "collectd_host_last_seen_timestamp_seconds"); got != 2 {
+		t.Errorf("got %d last seen series, want 2", got)
+	}
+
+	want := `
+# HELP collectd_exporter_hosts Number of hosts value lists were received from within the host retention period.
+# TYPE collectd_exporter_hosts gauge
+collectd_exporter_hosts 2
+# HELP collectd_host_info Metadata about the hosts value lists were received from, taken from their most recent value list.
+# TYPE collectd_host_info gauge
+collectd_host_info{instance="a.example.com",source="http",source_ip="192.0.2.1",user="",version="5.12.0"} 1
+collectd_host_info{instance="b.example.com",source="http",source_ip="192.0.2.1",user="",version="5.12.0"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_exporter_hosts", "collectd_host_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+// collectorFunc is a prometheus.Collector calling a collect function.
+type collectorFunc func(chan<- prometheus.Metric)
+
+// Collect implements prometheus.Collector.
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) { f(ch) }
+
+// Describe implements prometheus.Collector. The collector is unchecked.
+func (f collectorFunc) Describe(chan<- *prometheus.Desc) {}
+
+func TestDefaultInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, 10 * time.Second} {
+		c := newTestCollector(t, Options{DefaultInterval: interval})
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "exec", Type: "gauge"},
+			Time:       time.Now().Add(-time.Second),
+			Values:     []api.Value{api.Gauge(1)},
+		})
+
+		if got := testutil.ToFloat64(c.noInterval); got != 1 {
+			t.Errorf("default interval %v: got %v value lists without interval, want 1", interval, got)
+		}
+		want := 0
+		if interval > 0 {
+			want = 1
+		}
+		if got := testutil.CollectAndCount(c.Series()); got != want {
+			t.Errorf("default interval %v: got %d series, want %d", interval, got, want)
+		}
+	}
+}
+
+func TestCollectCanceled(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+expiry:
+  - plugin: exec
+    mode: expire-after-scrape
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "exec", Type: "gauge"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := testutil.CollectAndCount(c.HostSeries(ctx, "example.com")); got != 0 {
+		t.Errorf("canceled collection: got %d series, want 0", got)
+	}
+	if got := testutil.ToFloat64(c.aborted); got != 1 {
+		t.Errorf("got %v aborted collections, want 1", got)
+	}
+	// The series is not hidden by the incomplete scrape.
+	if got := testutil.CollectAndCount(c.Series()); got != 1 {
+		t.Errorf("got %d series after canceled collection, want 1", got)
+	}
+	if got := testutil.CollectAndCount(c.Series()); got != 0 {
+		t.Errorf("got %d series after scrape, want 0", got)
+	}
+}
+
+func TestCreatedTimestamps(t *testing.T) {
+	c := newTestCollector(t, Options{CreatedTimestamps: true})
+	start := time.Now().Add(-15 * time.Second).Truncate(time.Second).UTC()
+	ingest := func(at time.Time, v api.Derive) {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "interface", Type: "if_packets"},
+			Time:       at,
+			Interval:   10 * time.Second,
+			Values:     []api.Value{v, api.Gauge(1)},
+			DSNames:    []string{"rx", "tx"},
+		})
+	}
+	created := func() map[string]time.Time {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.Series())
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]time.Time{}
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				if m.GetCounter() != nil {
+					got[mf.GetName()] = m.GetCounter().GetCreatedTimestamp().AsTime()
+				} else if m.GetGauge() != nil {
+					got[mf.GetName()] = time.Time{}
+				}
+			}
+		}
+		return got
+	}
+
+	ingest(start, 10)
+	ingest(start.Add(5*time.Second), 20)
+	want := map[string]time.Time{
+		"collectd_interface_if_packets_rx_total": start,
+		"collectd_interface_if_packets_tx":       {},
+	}
+	if got := created(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got created timestamps %v, want %v", got, want)
+	}
+
+	// A reset restarts the counter.
+	reset := start.Add(10 * time.Second)
+	ingest(reset, 5)
+	want["collectd_interface_if_packets_rx_total"] = reset
+	if got := created(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reset: got created timestamps %v, want %v", got, want)
+	}
+}
+
+func TestSelfAndConverted(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	})
+
+	names := func(collector prometheus.Collector) map[string]bool {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collector)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := map[string]bool{}
+		for _, mf := range mfs {
+			names[mf.GetName()] = true
+		}
+		return names
+	}
+	self := names(c.Self())
+	if !self["collectd_last_push_timestamp_seconds"] || self["collectd_load"] || self["collectd_host_last_seen_timestamp_seconds"] {
+		t.Errorf("got own metrics %v", self)
+	}
+	converted := names(c.ConvertedWithContext(context.Background()))
+	if !converted["collectd_load"] || !converted["collectd_host_last_seen_timestamp_seconds"] || converted["collectd_last_push_timestamp_seconds"] {
+		t.Errorf("got converted metrics %v", converted)
+	}
+}
+
+func TestDSLabel(t *testing.T) {
+	c := newTestCollector(t, Options{DSLabel: "ds"})
+	now := time.Now()
+	for _, vl := range []*api.ValueList{
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}, Values: []api.Value{api.Derive(1), api.Derive(2)}, DSNames: []string{"rx", "tx"}},
+		// Data sources of different value types cannot share a metric.
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "mixed", Type: "mixed"}, Values: []api.Value{api.Gauge(3), api.Derive(4)}, DSNames: []string{"a", "b"}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"}, Values: []api.Value{api.Gauge(5)}},
+	} {
+		vl.Time, vl.Interval = now, 10*time.Second
+		c.Ingest(vl)
+	}
+
+	want := `
+# HELP collectd_interface_if_octets_total Collectd exporter: 'interface' Type: 'if_octets' Dstype: 'api.Derive'
+# TYPE collectd_interface_if_octets_total counter
+collectd_interface_if_octets_total{ds="rx",instance="example.com",interface="eth0"} 1
+collectd_interface_if_octets_total{ds="tx",instance="example.com",interface="eth0"} 2
+# HELP collectd_load Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_load gauge
+collectd_load{instance="example.com"} 5
+# HELP collectd_mixed_a Collectd exporter: 'mixed' Type: 'mixed' Dstype: 'api.Gauge' Dsname: 'a'
+# TYPE collectd_mixed_a gauge
+collectd_mixed_a{instance="example.com"} 3
+# HELP collectd_mixed_b_total Collectd exporter: 'mixed' Type: 'mixed' Dstype: 'api.Derive' Dsname: 'b'
+# TYPE collectd_mixed_b_total counter
+collectd_mixed_b_total{instance="example.com"} 4
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	for _, invalid := range []string{"instance", "type", "not-a-label"} {
+		if _, err := New(nil, Options{DSLabel: invalid}); err == nil {
+			t.Errorf("expected an error for data source label %q", invalid)
+		}
+	}
+}
+
+func TestPushedSeries(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	now := time.Now()
+	for _, p := range []struct {
+		vl  api.ValueList
+		typ string
+	}{
+		{api.ValueList{Identifier: api.Identifier{Host: "edge1", Plugin: source.PrometheusPlugin, Type: "http_requests_total", TypeInstance: `{code="200"}`}, Values: []api.Value{api.Gauge(1027)}}, source.PrometheusCounter},
+		{api.ValueList{Identifier: api.Identifier{Host: "edge1", Plugin: source.PrometheusPlugin, Type: "uptime"}, Values: []api.Value{api.Gauge(30)}}, source.PrometheusGauge},
+		{api.ValueList{Identifier: api.Identifier{Host: "edge1", Plugin: source.PrometheusPlugin, Type: "node_load1", TypeInstance: `{job="node"}`}, Values: []api.Value{api.Gauge(0.5)}}, source.PrometheusUntyped},
+		// Does not clash with the pushed series of the same name.
+		{api.ValueList{Identifier: api.Identifier{Host: "edge1", Plugin: "uptime", Type: "uptime"}, Values: []api.Value{api.Gauge(60)}}, ""},
+		// Sent by collectd, so not a pushed series whatever its metadata.
+		{api.ValueList{Identifier: api.Identifier{Host: "edge1", Plugin: source.PrometheusPlugin, Type: "spoofed"}, Values: []api.Value{api.Gauge(1)}, Meta: meta.Data{metricTypeMeta: meta.String(source.PrometheusGauge)}}, ""},
+	} {
+		p.vl.Time, p.vl.Interval = now, 10*time.Second
+		p.vl.DSNames = []string{"value"}
+		c.ingest(&p.vl, source.Info{MetricType: p.typ})
+	}
+
+	want := `
+# HELP collectd_prometheus_spoofed Collectd exporter: 'prometheus' Type: 'spoofed' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_prometheus_spoofed gauge
+collectd_prometheus_spoofed{instance="edge1"} 1
+# HELP collectd_uptime Collectd exporter: 'uptime' Type: 'uptime' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_uptime gauge
+collectd_uptime{instance="edge1"} 60
+# HELP http_requests_total Series pushed to the collectd exporter in a Prometheus format.
+# TYPE http_requests_total counter
+http_requests_total{code="200",instance="edge1"} 1027
+# HELP node_load1 Series pushed to the collectd exporter in a Prometheus format.
+# TYPE node_load1 untyped
+node_load1{instance="edge1",job="node"} 0.5
+# HELP uptime Series pushed to the collectd exporter in a Prometheus format.
+# TYPE uptime gauge
+uptime{instance="edge1"} 30
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPushedSeriesConflicts(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	now := time.Now()
+	push := func(host, name, typ string) {
+		vl := api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: source.PrometheusPlugin, Type: name},
+			Time:       now,
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+			DSNames:    []string{"value"},
+		}
+		c.ingest(&vl, source.Info{MetricType: typ})
+	}
+
+	push("a", "go_goroutines", source.PrometheusGauge)
+	push("a", "collectd_last_push_timestamp_seconds", source.PrometheusGauge)
+	push("a", "jobs", source.PrometheusGauge)
+	push("b", "jobs", source.PrometheusCounter)
+	push("b", "jobs", source.PrometheusGauge)
+	// A series changing its own type replaces itself.
+	push("c", "queue", source.PrometheusGauge)
+	push("c", "queue", source.PrometheusCounter)
+
+	want := `
+# HELP jobs Series pushed to the collectd exporter in a Prometheus format.
+# TYPE jobs gauge
+jobs{instance="a"} 1
+jobs{instance="b"} 1
+# HELP queue Series pushed to the collectd exporter in a Prometheus format.
+# TYPE queue counter
+queue{instance="c"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(c.families.rejected.WithLabelValues(conflictReserved)); got != 2 {
+		t.Errorf("got %v series rejected as reserved, want 2", got)
+	}
+	if got := testutil.ToFloat64(c.families.rejected.WithLabelValues(conflictType)); got != 1 {
+		t.Errorf("got %v series rejected for their type, want 1", got)
+	}
+
+	// Once the other series are gone, the family may change its type.
+	c.delete(deleteRequest{valueLists: func(id api.Identifier) bool { return id.Host != "c" }})
+	push("d", "jobs", source.PrometheusCounter)
+	want = `
+# HELP jobs Series pushed to the collectd exporter in a Prometheus format.
+# TYPE jobs counter
+jobs{instance="d"} 1
+# HELP queue Series pushed to the collectd exporter in a Prometheus format.
+# TYPE queue counter
+queue{instance="c"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPushedSeriesLabelLimit(t *testing.T) {
+	c := newTestCollector(t, Options{MaxLabelLength: 4})
+	vl := api.ValueList{
+		Identifier: api.Identifier{Host: "a", Plugin: source.PrometheusPlugin, Type: "requests", TypeInstance: `{code="200"}`},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+		DSNames:    []string{"value"},
+	}
+	c.ingest(&vl, source.Info{MetricType: source.PrometheusGauge})
+
+	want := `
+# HELP requests Series pushed to the collectd exporter in a Prometheus format.
+# TYPE requests gauge
+requests{code="200",instance="a"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTap(t *testing.T) {
+	var (
+		tapped []api.ValueList
+		series int
+	)
+	c := newTestCollector(t, Options{Tap: func(vl api.ValueList, s prometheus.Collector) {
+		tapped = append(tapped, vl)
+		series += testutil.CollectAndCount(s)
+	}})
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "a", Plugin: "load", Type: "load"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.5), api.Gauge(0.25), api.Gauge(0.1)},
+		DSNames:    []string{"shortterm", "midterm", "longterm"},
+	})
+	if len(tapped) != 1 || tapped[0].Host != "a" {
+		t.Errorf("got tapped value lists %v", tapped)
+	}
+	if series != 3 {
+		t.Errorf("got %d tapped series, want 3", series)
+	}
+}
@@ -0,0 +1,724 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the mapping rules of the exporter's configuration file. It is
+// created by LoadConfig or ParseConfig.
+type Config struct {
+	Mappings             []mapping           `yaml:"mappings,omitempty"`
+	MetricRelabelConfigs []relabelRule       `yaml:"metric_relabel_configs,omitempty"`
+	ComputedMetrics      []computedMetric    `yaml:"computed_metrics,omitempty"`
+	Expiry               []expiryRule        `yaml:"expiry,omitempty"`
+	Debounce             []debounceRule      `yaml:"debounce,omitempty"`
+	Downsample           []downsampleRule    `yaml:"downsample,omitempty"`
+	Derive               []deriveRule        `yaml:"derive,omitempty"`
+	InstanceLabels       []instanceLabelRule `yaml:"instance_labels,omitempty"`
+
+	// HostMap maps host names, compared case-insensitively, to the name
+	// they are exported as with HostMap normalization.
+	HostMap map[string]string `yaml:"host_map,omitempty"`
+
+	// SecurityLevels maps collectd user names to the minimum security
+	// level ("None", "Sign" or "Encrypt") required for their packets. It
+	// is not used by the Collector but by binary protocol listeners.
+	SecurityLevels map[string]string `yaml:"security_levels,omitempty"`
+}
+
+// mapping customizes the conversion of the data sources it matches. Empty
+// match fields match everything; the first matching mapping is used.
+type mapping struct {
+	Plugin     string `yaml:"plugin,omitempty"`
+	Type       string `yaml:"type,omitempty"`
+	DataSource string `yaml:"data_source,omitempty"`
+
+	// Help replaces the generated HELP text of the metric.
+	Help string `yaml:"help,omitempty"`
+	// Histogram additionally accumulates the values into a histogram.
+	Histogram *histogramConfig `yaml:"histogram,omitempty"`
+
+	// Unit is the unit of the metric, e.g. "seconds", which is appended to
+	// its name unless already present.
+	Unit string `yaml:"unit,omitempty"`
+	// FromUnit is the unit collectd reports the values in, e.g. "jiffies".
+	// The values are converted to Unit.
+	FromUnit string `yaml:"from_unit,omitempty"`
+	// Scale multiplies the values, if FromUnit is not set.
+	Scale float64 `yaml:"scale,omitempty"`
+	// Offset is added to gauge values after converting or scaling them.
+	// Counters are not offset, as their rates would not change.
+	Offset float64 `yaml:"offset,omitempty"`
+}
+
+// unitFactors maps the units that can be converted to the factors of the
+// units they can be converted from.
+var unitFactors = map[string]map[string]float64{
+	"seconds": {
+		"nanoseconds":  1e-9,
+		"microseconds": 1e-6,
+		"milliseconds": 1e-3,
+		"jiffies":      1.0 / userHZ,
+		"minutes":      60,
+		"hours":        3600,
+	},
+	"bytes": {
+		"bits":      1.0 / 8,
+		"kilobytes": 1e3,
+		"kibibytes": 1 << 10,
+		"megabytes": 1e6,
+		"mebibytes": 1 << 20,
+	},
+	"bits":  {"bytes": 8},
+	"ratio": {"percent": 1e-2},
+}
+
+// unitRE matches valid units, which become part of metric names.
+var unitRE = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// validate checks the unit conversion of m. It is not implemented as
+// UnmarshalYAML so that unknown fields are reported with the mapping's type.
+func (m *mapping) validate() error {
+	if m.Unit != "" && !unitRE.MatchString(m.Unit) {
+		return fmt.Errorf("invalid unit %q", m.Unit)
+	}
+	if m.FromUnit != "" {
+		if m.Scale != 0 {
+			return fmt.Errorf("mapping must not set both from_unit and scale")
+		}
+		if _, ok := unitFactors[m.Unit][m.FromUnit]; !ok {
+			return fmt.Errorf("cannot convert from %q to %q", m.FromUnit, m.Unit)
+		}
+	}
+
+	return nil
+}
+
+// factor returns the factor converting values to the unit of m.
+func (m *mapping) factor() float64 {
+	if f, ok := unitFactors[m.Unit][m.FromUnit]; ok {
+		return f
+	}
+	if m.Scale != 0 {
+		return m.Scale
+	}
+	return 1
+}
+
+// withUnit appends unit to the metric name, ahead of a "_total" suffix,
+// unless the name already ends with it.
+func withUnit(name, unit string) string {
+	base, isTotal := strings.CutSuffix(name, "_total")
+	if !strings.HasSuffix(base, "_"+unit) {
+		base += "_" + unit
+	}
+	if isTotal {
+		return base + "_total"
+	}
+	return base
+}
+
+// histogramConfig configures a histogram maintained by the exporter, into
+// which every received value of a gauge is observed.
+type histogramConfig struct {
+	// Name of the histogram. Defaults to the gauge's name with a
+	// "_histogram" suffix.
+	Name    string    `yaml:"name,omitempty"`
+	Buckets []float64 `yaml:"buckets,omitempty"`
+
+	// NativeBucketFactor enables native histograms if greater than one.
+	// They are exposed when the scraper negotiates the protobuf format.
+	NativeBucketFactor     float64        `yaml:"native_bucket_factor,omitempty"`
+	NativeMaxBuckets       uint32         `yaml:"native_max_buckets,omitempty"`
+	NativeMinResetDuration model.Duration `yaml:"native_min_reset_duration,omitempty"`
+}
+
+// opts returns the prometheus.HistogramOpts for a histogram using h.
+func (h *histogramConfig) opts(name, help string, labels prometheus.Labels) prometheus.HistogramOpts {
+	return prometheus.HistogramOpts{
+		Name:                            name,
+		Help:                            help,
+		ConstLabels:                     labels,
+		Buckets:                         h.Buckets,
+		NativeHistogramBucketFactor:     h.NativeBucketFactor,
+		NativeHistogramMaxBucketNumber:  h.NativeMaxBuckets,
+		NativeHistogramMinResetDuration: time.Duration(h.NativeMinResetDuration),
+	}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (h *histogramConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain histogramConfig
+	if err := unmarshal((*plain)(h)); err != nil {
+		return err
+	}
+	if h.Name != "" && !model.IsValidMetricName(model.LabelValue(h.Name)) {
+		return fmt.Errorf("invalid histogram name %q", h.Name)
+	}
+	if h.NativeBucketFactor != 0 && h.NativeBucketFactor <= 1 {
+		return fmt.Errorf("native_bucket_factor must be greater than 1")
+	}
+	if len(h.Buckets) == 0 && h.NativeBucketFactor == 0 {
+		return fmt.Errorf("histogram without buckets")
+	}
+	for i := 1; i < len(h.Buckets); i++ {
+		if h.Buckets[i] <= h.Buckets[i-1] {
+			return fmt.Errorf("histogram buckets must be in increasing order")
+		}
+	}
+
+	return nil
+}
+
+// computedMetric is an additional gauge calculated from the data sources of
+// each value list it matches, e.g. "used / (used + free) * 100".
+type computedMetric struct {
+	Plugin string `yaml:"plugin,omitempty"`
+	Type   string `yaml:"type,omitempty"`
+	Name   string `yaml:"name"`
+	Help   string `yaml:"help,omitempty"`
+	Expr   string `yaml:"expr"`
+
+	expr expr
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (m *computedMetric) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain computedMetric
+	if err := unmarshal((*plain)(m)); err != nil {
+		return err
+	}
+	if !model.IsValidMetricName(model.LabelValue(m.Name)) {
+		return fmt.Errorf("invalid computed metric name %q", m.Name)
+	}
+
+	var err error
+	if m.expr, err = parseExpr(m.Expr); err != nil {
+		return fmt.Errorf("invalid expression for computed metric %q: %w", m.Name, err)
+	}
+	if m.Help == "" {
+		m.Help = fmt.Sprintf("Collectd exporter: computed from '%s' Type: '%s' Expr: '%s'", m.Plugin, m.Type, m.Expr)
+	}
+
+	return nil
+}
+
+// matches returns whether m is computed for vl.
+func (m *computedMetric) matches(vl api.ValueList) bool {
+	return (m.Plugin == "" || m.Plugin == vl.Plugin) && (m.Type == "" || m.Type == vl.Type)
+}
+
+// expiryMode determines when value lists matching an expiryRule expire.
+type expiryMode string
+
+const (
+	// expireTimeout expires value lists after a timeout.
+	expireTimeout expiryMode = "timeout"
+	// expireAfterScrape additionally expires value lists once they have
+	// been collected, so that each value is exposed at most once.
+	expireAfterScrape expiryMode = "expire-after-scrape"
+	// expireNever keeps the last value list indefinitely, for hosts that
+	// only push on change.
+	expireNever expiryMode = "never"
+)
+
+// identifierMatcher matches value lists by the fields of their identifier.
+// Empty fields match everything.
+type identifierMatcher struct {
+	Host           string `yaml:"host,omitempty"`
+	Plugin         string `yaml:"plugin,omitempty"`
+	PluginInstance string `yaml:"plugin_instance,omitempty"`
+	Type           string `yaml:"type,omitempty"`
+	TypeInstance   string `yaml:"type_instance,omitempty"`
+}
+
+// matches returns whether m applies to vl.
+func (m *identifierMatcher) matches(vl api.ValueList) bool {
+	return (m.Host == "" || m.Host == vl.Host) &&
+		(m.Plugin == "" || m.Plugin == vl.Plugin) &&
+		(m.PluginInstance == "" || m.PluginInstance == vl.PluginInstance) &&
+		(m.Type == "" || m.Type == vl.Type) &&
+		(m.TypeInstance == "" || m.TypeInstance == vl.TypeInstance)
+}
+
+// expiryRule overrides when the value lists it matches expire. The first
+// matching rule is used.
+type expiryRule struct {
+	identifierMatcher `yaml:",inline"`
+
+	// Mode defaults to expireTimeout.
+	Mode expiryMode `yaml:"mode,omitempty"`
+	// Timeout is the number of intervals after which a value list
+	// expires.
+	Timeout int `yaml:"timeout,omitempty"`
+	// MaxAge is the time after which a value list expires, regardless of
+	// its interval.
+	MaxAge model.Duration `yaml:"max_age,omitempty"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *expiryRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain expiryRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if r.Timeout < 0 || r.MaxAge < 0 {
+		return fmt.Errorf("negative timeout or max_age in expiry rule")
+	}
+	if r.Timeout != 0 && r.MaxAge != 0 {
+		return fmt.Errorf("expiry rule must not set both timeout and max_age")
+	}
+	switch r.Mode {
+	case "":
+		r.Mode = expireTimeout
+		fallthrough
+	case expireTimeout:
+		if r.Timeout == 0 && r.MaxAge == 0 {
+			return fmt.Errorf("expiry rule must set timeout or max_age")
+		}
+	case expireAfterScrape:
+	case expireNever:
+		if r.Timeout != 0 || r.MaxAge != 0 {
+			return fmt.Errorf("expiry rule with mode %q must not set timeout or max_age", r.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown expiry mode %q, must be %q, %q or %q", r.Mode, expireTimeout, expireAfterScrape, expireNever)
+	}
+
+	return nil
+}
+
+// debounceRule skips updates of the value lists it matches whose values did
+// not change, for up to MaxAge since the last update that was kept. The first
+// matching rule is used.
+type debounceRule struct {
+	identifierMatcher `yaml:",inline"`
+
+	MaxAge model.Duration `yaml:"max_age"`
+}
+
+// downsampleRule limits how often the value lists it matches are kept, so
+// that senders with short intervals are exposed at MinInterval. The first
+// matching rule is used.
+type downsampleRule struct {
+	identifierMatcher `yaml:",inline"`
+
+	MinInterval model.Duration `yaml:"min_interval"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *downsampleRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain downsampleRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if r.MinInterval <= 0 {
+		return fmt.Errorf("downsample rule must set a positive min_interval")
+	}
+
+	return nil
+}
+
+// deriveMode determines how the DERIVE data sources matching a deriveRule are
+// exported.
+type deriveMode string
+
+const (
+	// deriveCounter exports DERIVE values as counters, so that decreases
+	// look like counter resets.
+	deriveCounter deriveMode = "counter"
+	// deriveGauge exports DERIVE values as gauges, for data sources that
+	// may legitimately decrease.
+	deriveGauge deriveMode = "gauge"
+	// deriveClamp exports DERIVE values as counters that do not increase
+	// while the value decreases, clamping their rate at zero.
+	deriveClamp deriveMode = "clamp"
+)
+
+// deriveRule sets how the DERIVE data sources it matches are exported. The
+// first matching rule is used.
+type deriveRule struct {
+	identifierMatcher `yaml:",inline"`
+	DataSource        string `yaml:"data_source,omitempty"`
+
+	Mode deriveMode `yaml:"mode"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *deriveRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain deriveRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	switch r.Mode {
+	case deriveCounter, deriveGauge, deriveClamp:
+	default:
+		return fmt.Errorf("unknown derive mode %q, must be %q, %q or %q", r.Mode, deriveCounter, deriveGauge, deriveClamp)
+	}
+
+	return nil
+}
+
+// instanceField names the field of an identifier an instanceLabelRule
+// extracts labels from.
+type instanceField string
+
+const (
+	fieldPluginInstance instanceField = "plugin_instance"
+	fieldTypeInstance   instanceField = "type_instance"
+)
+
+// instanceLabelRule exports the named capture groups of Regex, matched
+// against the plugin or type instance of the value lists it matches, as
+// labels in place of the label holding the instance. The first matching rule
+// for each field is used.
+type instanceLabelRule struct {
+	identifierMatcher `yaml:",inline"`
+
+	Source instanceField  `yaml:"source"`
+	Regex  anchoredRegexp `yaml:"regex"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *instanceLabelRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain instanceLabelRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	switch r.Source {
+	case fieldPluginInstance, fieldTypeInstance:
+	default:
+		return fmt.Errorf("unknown instance label source %q, must be %q or %q", r.Source, fieldPluginInstance, fieldTypeInstance)
+	}
+	if r.Regex.Regexp == nil {
+		return fmt.Errorf("instance label rule without regex")
+	}
+	names := 0
+	for _, name := range r.Regex.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, "__") || name == "instance" {
+			return fmt.Errorf("invalid label name %q in instance label regex", name)
+		}
+		names++
+	}
+	if names == 0 {
+		return fmt.Errorf("instance label regex %q without named capture groups", r.Regex.original)
+	}
+
+	return nil
+}
+
+// extract returns the labels captured from value, or nil if Regex does not
+// match it. Empty captures are omitted.
+func (r *instanceLabelRule) extract(value string) prometheus.Labels {
+	match := r.Regex.FindStringSubmatch(value)
+	if match == nil {
+		return nil
+	}
+	labels := prometheus.Labels{}
+	for i, name := range r.Regex.SubexpNames() {
+		if name != "" && match[i] != "" {
+			labels[name] = match[i]
+		}
+	}
+	return labels
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *debounceRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain debounceRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if r.MaxAge <= 0 {
+		return fmt.Errorf("debounce rule must set a positive max_age")
+	}
+
+	return nil
+}
+
+// relabelAction is the action of a relabelRule.
+type relabelAction string
+
+const (
+	relabelKeep relabelAction = "keep"
+	relabelDrop relabelAction = "drop"
+)
+
+// relabelRule keeps or drops converted series based on their metric name and
+// labels, like the "keep" and "drop" actions of Prometheus'
+// metric_relabel_configs. The metric name is available as "__name__".
+type relabelRule struct {
+	SourceLabels []string       `yaml:"source_labels"`
+	Separator    string         `yaml:"separator,omitempty"`
+	Regex        anchoredRegexp `yaml:"regex,omitempty"`
+	Action       relabelAction  `yaml:"action"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *relabelRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain relabelRule
+	rule := plain{
+		Separator: ";",
+		Regex:     mustAnchoredRegexp("(.*)"),
+	}
+	if err := unmarshal(&rule); err != nil {
+		return err
+	}
+	if len(rule.SourceLabels) == 0 {
+		return fmt.Errorf("relabel rule without source_labels")
+	}
+	switch rule.Action {
+	case relabelKeep, relabelDrop:
+	default:
+		return fmt.Errorf("unsupported relabel action %q, must be %q or %q", rule.Action, relabelKeep, relabelDrop)
+	}
+
+	*r = relabelRule(rule)
+	return nil
+}
+
+// keeps returns whether the series with the given name and labels passes r.
+func (r *relabelRule) keeps(name string, labels prometheus.Labels) bool {
+	values := make([]string, len(r.SourceLabels))
+	for i, l := range r.SourceLabels {
+		if l == "__name__" {
+			values[i] = name
+		} else {
+			values[i] = labels[l]
+		}
+	}
+	matches := r.Regex.MatchString(strings.Join(values, r.Separator))
+
+	return matches == (r.Action == relabelKeep)
+}
+
+// anchoredRegexp is a regular expression that has to match the whole input.
+type anchoredRegexp struct {
+	*regexp.Regexp
+	original string
+}
+
+func mustAnchoredRegexp(s string) anchoredRegexp {
+	return anchoredRegexp{
+		Regexp:   regexp.MustCompile("^(?:" + s + ")$"),
+		original: s,
+	}
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (re *anchoredRegexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	r, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return err
+	}
+	*re = anchoredRegexp{Regexp: r, original: s}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (re anchoredRegexp) MarshalYAML() (interface{}, error) {
+	return re.original, nil
+}
+
+// LoadConfig reads and parses the configuration file at path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfig(data)
+}
+
+// ParseConfig parses a YAML configuration. Unknown fields are rejected.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	for _, m := range cfg.Mappings {
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for user, level := range cfg.SecurityLevels {
+		switch strings.ToLower(level) {
+		case "none", "sign", "encrypt":
+		default:
+			return nil, fmt.Errorf("unknown security level %q for user %q", level, user)
+		}
+	}
+
+	return cfg, nil
+}
+
+// matches returns whether m applies to the data source with the given index
+// of vl.
+func (m *mapping) matches(vl api.ValueList, index int) bool {
+	return (m.Plugin == "" || m.Plugin == vl.Plugin) &&
+		(m.Type == "" || m.Type == vl.Type) &&
+		(m.DataSource == "" || m.DataSource == vl.DSName(index))
+}
+
+// mapping returns the first mapping applying to the data source with the
+// given index of vl, or nil if there is none.
+func (c *Config) mapping(vl api.ValueList, index int) *mapping {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Mappings {
+		if c.Mappings[i].matches(vl, index) {
+			return &c.Mappings[i]
+		}
+	}
+
+	return nil
+}
+
+// keepSeries returns whether the converted series with the given name and
+// labels passes all metric_relabel_configs.
+func (c *Config) keepSeries(name string, labels prometheus.Labels) bool {
+	if c == nil {
+		return true
+	}
+	for i := range c.MetricRelabelConfigs {
+		if !c.MetricRelabelConfigs[i].keeps(name, labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// computedMetrics returns the computed metrics applying to vl.
+func (c *Config) computedMetrics(vl api.ValueList) []*computedMetric {
+	if c == nil {
+		return nil
+	}
+	var ms []*computedMetric
+	for i := range c.ComputedMetrics {
+		if c.ComputedMetrics[i].matches(vl) {
+			ms = append(ms, &c.ComputedMetrics[i])
+		}
+	}
+
+	return ms
+}
+
+// expiry returns the first expiry rule applying to vl, or nil if there is
+// none.
+func (c *Config) expiry(vl api.ValueList) *expiryRule {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Expiry {
+		if c.Expiry[i].matches(vl) {
+			return &c.Expiry[i]
+		}
+	}
+
+	return nil
+}
+
+// downsample returns the first downsample rule matching vl, or nil.
+func (c *Config) downsample(vl api.ValueList) *downsampleRule {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Downsample {
+		if c.Downsample[i].matches(vl) {
+			return &c.Downsample[i]
+		}
+	}
+
+	return nil
+}
+
+// derive returns the first derive rule applying to the data source with the
+// given index of vl, or nil if there is none.
+func (c *Config) derive(vl api.ValueList, index int) *deriveRule {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Derive {
+		r := &c.Derive[i]
+		if r.matches(vl) && (r.DataSource == "" || r.DataSource == vl.DSName(index)) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// debounce returns the first debounce rule matching vl, or nil.
+func (c *Config) debounce(vl api.ValueList) *debounceRule {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Debounce {
+		if c.Debounce[i].matches(vl) {
+			return &c.Debounce[i]
+		}
+	}
+
+	return nil
+}
+
+// instanceLabels returns the labels extracted from the plugin and type
+// instance of vl by the first instance label rule matching each, or nil if
+// none does.
+func (c *Config) instanceLabels(vl api.ValueList) (pluginInstance, typeInstance prometheus.Labels) {
+	if c == nil {
+		return nil, nil
+	}
+	for i := range c.InstanceLabels {
+		r := &c.InstanceLabels[i]
+		if !r.matches(vl) {
+			continue
+		}
+		switch {
+		case r.Source == fieldPluginInstance && pluginInstance == nil && vl.PluginInstance != "":
+			pluginInstance = r.extract(vl.PluginInstance)
+		case r.Source == fieldTypeInstance && typeInstance == nil && vl.TypeInstance != "":
+			typeInstance = r.extract(vl.TypeInstance)
+		}
+	}
+
+	return pluginInstance, typeInstance
+}
+
+// expiresAfterScrape reports whether any expiry rule uses the
+// expire-after-scrape mode.
+func (c *Config) expiresAfterScrape() bool {
+	return c != nil && slices.ContainsFunc(c.Expiry, func(r expiryRule) bool { return r.Mode == expireAfterScrape })
+}
@@ -0,0 +1,487 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+mappings:
+  - plugin: df
+    type: df_complex
+    help: Disk space in bytes.
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Mappings) != 1 || cfg.Mappings[0].Help != "Disk space in bytes." {
+		t.Errorf("unexpected mappings: %+v", cfg.Mappings)
+	}
+
+	path = writeConfig(t, "mappings:\n  - plugn: df\n")
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected error for unknown field")
+	}
+
+	if _, err := ParseConfig([]byte("security_levels:\n  alice: Encrypt\n  bob: sign\n")); err != nil {
+		t.Errorf("valid security levels: %v", err)
+	}
+	if _, err := ParseConfig([]byte("security_levels:\n  alice: Maximum\n")); err == nil {
+		t.Error("expected error for unknown security level")
+	}
+}
+
+func TestKeepSeries(t *testing.T) {
+	path := writeConfig(t, `
+metric_relabel_configs:
+  - source_labels: [__name__, interface]
+    regex: collectd_interface_.*;lo
+    action: drop
+  - source_labels: [df]
+    regex: tmpfs-.*
+    action: drop
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		labels prometheus.Labels
+		want   bool
+	}{
+		{"collectd_interface_if_octets_rx_total", prometheus.Labels{"interface": "lo"}, false},
+		{"collectd_interface_if_octets_rx_total", prometheus.Labels{"interface": "eth0"}, true},
+		{"collectd_df_complex", prometheus.Labels{"df": "tmpfs-run", "type": "free"}, false},
+		{"collectd_df_complex", prometheus.Labels{"df": "root", "type": "free"}, true},
+		{"collectd_load_shortterm", prometheus.Labels{}, true},
+	}
+
+	for _, c := range cases {
+		if got := cfg.keepSeries(c.name, c.labels); got != c.want {
+			t.Errorf("keepSeries(%q, %v): got %v, want %v", c.name, c.labels, got, c.want)
+		}
+	}
+
+	for _, content := range []string{
+		"metric_relabel_configs:\n  - source_labels: [a]\n    action: replace\n",
+		"metric_relabel_configs:\n  - action: drop\n",
+		"metric_relabel_configs:\n  - source_labels: [a]\n    regex: '('\n    action: drop\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("expected error loading %q", content)
+		}
+	}
+}
+
+func TestComputedMetrics(t *testing.T) {
+	path := writeConfig(t, `
+computed_metrics:
+  - plugin: df
+    type: df
+    name: collectd_df_used_ratio
+    expr: used / (used + free)
+`)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vl := api.ValueList{
+		Identifier: api.Identifier{Plugin: "df", Type: "df"},
+		DSNames:    []string{"used", "free"},
+		Values:     []api.Value{api.Gauge(25), api.Gauge(75)},
+	}
+	computed := cfg.computedMetrics(vl)
+	if len(computed) != 1 {
+		t.Fatalf("got %d computed metrics, want 1", len(computed))
+	}
+	got, err := computed[0].expr.eval(map[string]float64{"used": 25, "free": 75})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0.25 {
+		t.Errorf("got %v, want 0.25", got)
+	}
+
+	vl.Plugin = "memory"
+	if computed := cfg.computedMetrics(vl); len(computed) != 0 {
+		t.Errorf("got %d computed metrics for non-matching value list, want 0", len(computed))
+	}
+
+	for _, content := range []string{
+		"computed_metrics:\n  - name: 'invalid name'\n    expr: used\n",
+		"computed_metrics:\n  - name: ratio\n    expr: 'used /'\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("expected error loading %q", content)
+		}
+	}
+}
+
+func TestHistogramConfig(t *testing.T) {
+	for _, content := range []string{
+		"mappings:\n  - histogram: {buckets: [1, 10]}\n",
+		"mappings:\n  - histogram: {native_bucket_factor: 1.1, native_max_buckets: 100}\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, content)); err != nil {
+			t.Errorf("loading %q: %v", content, err)
+		}
+	}
+
+	for _, content := range []string{
+		"mappings:\n  - histogram: {}\n",
+		"mappings:\n  - histogram: {buckets: [10, 1]}\n",
+		"mappings:\n  - histogram: {native_bucket_factor: 0.5}\n",
+		"mappings:\n  - histogram: {name: 'a-b', buckets: [1]}\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("expected error loading %q", content)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+expiry:
+  - plugin: smart
+    max_age: 2h
+  - host: db1
+    plugin: disk
+    plugin_instance: sda
+    timeout: 10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		id   api.Identifier
+		want time.Duration
+	}{
+		{api.Identifier{Host: "db1", Plugin: "smart", Type: "smart_temperature"}, 2 * time.Hour},
+		{api.Identifier{Host: "db1", Plugin: "disk", PluginInstance: "sda", Type: "disk_ops"}, 100 * time.Second},
+		{api.Identifier{Host: "db1", Plugin: "disk", PluginInstance: "sdb", Type: "disk_ops"}, 20 * time.Second},
+	}
+	for _, tc := range cases {
+		vl := api.ValueList{Identifier: tc.id, Time: now, Interval: 10 * time.Second}
+		if c.expired(vl, now.Add(tc.want)) || !c.expired(vl, now.Add(tc.want+time.Second)) {
+			t.Errorf("%v: want timeout %v", tc.id, tc.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"expiry:\n  - plugin: smart\n",
+		"expiry:\n  - plugin: smart\n    timeout: 2\n    max_age: 1h\n",
+		"expiry:\n  - plugin: smart\n    timeout: -1\n",
+		"expiry:\n  - plugin: smart\n    mode: never\n    timeout: 2\n",
+		"expiry:\n  - plugin: smart\n    mode: sometimes\n",
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestMappingUnits(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+mappings:
+  - plugin: cpu
+    type: cpu
+    unit: seconds
+    from_unit: jiffies
+  - plugin: ping
+    type: ping
+    unit: seconds
+    from_unit: milliseconds
+    histogram:
+      buckets: [0.01, 0.1]
+  - plugin: interface
+    type: if_octets
+    data_source: rx
+    unit: bits
+    scale: 8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+	now := time.Now()
+	for _, vl := range []*api.ValueList{
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "user"}, Values: []api.Value{api.Derive(250)}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "ping", Type: "ping"}, Values: []api.Value{api.Gauge(20)}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}, Values: []api.Value{api.Derive(10), api.Derive(10)}, DSNames: []string{"rx", "tx"}},
+	} {
+		vl.Time, vl.Interval = now, 10*time.Second
+		c.Ingest(vl)
+	}
+
+	want := `
+# HELP collectd_cpu_seconds_total Collectd exporter: 'cpu' Type: 'cpu' Dstype: 'api.Derive' Dsname: 'value'
+# TYPE collectd_cpu_seconds_total counter
+collectd_cpu_seconds_total{cpu="0",instance="example.com",type="user"} 2.5
+# HELP collectd_interface_if_octets_rx_bits_total Collectd exporter: 'interface' Type: 'if_octets' Dstype: 'api.Derive' Dsname: 'rx'
+# TYPE collectd_interface_if_octets_rx_bits_total counter
+collectd_interface_if_octets_rx_bits_total{instance="example.com",interface="eth0"} 80
+# HELP collectd_interface_if_octets_tx_total Collectd exporter: 'interface' Type: 'if_octets' Dstype: 'api.Derive' Dsname: 'tx'
+# TYPE collectd_interface_if_octets_tx_total counter
+collectd_interface_if_octets_tx_total{instance="example.com",interface="eth0"} 10
+# HELP collectd_ping_seconds Collectd exporter: 'ping' Type: 'ping' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_ping_seconds gauge
+collectd_ping_seconds{instance="example.com"} 0.02
+# HELP collectd_ping_seconds_histogram Collectd exporter: 'ping' Type: 'ping' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_ping_seconds_histogram histogram
+collectd_ping_seconds_histogram_bucket{instance="example.com",le="0.01"} 0
+collectd_ping_seconds_histogram_bucket{instance="example.com",le="0.1"} 1
+collectd_ping_seconds_histogram_bucket{instance="example.com",le="+Inf"} 1
+collectd_ping_seconds_histogram_sum{instance="example.com"} 0.02
+collectd_ping_seconds_histogram_count{instance="example.com"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+	if md := c.Metadata("collectd_ping_seconds")["collectd_ping_seconds"]; len(md) != 1 || md[0].Unit != "seconds" {
+		t.Errorf("got metadata %+v, want unit seconds", md)
+	}
+
+	for _, invalid := range []string{
+		"mappings:\n  - plugin: cpu\n    unit: Seconds\n",
+		"mappings:\n  - plugin: cpu\n    unit: seconds\n    from_unit: bytes\n",
+		"mappings:\n  - plugin: cpu\n    unit: seconds\n    from_unit: jiffies\n    scale: 0.01\n",
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestMappingOffset(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+mappings:
+  - plugin: sensors
+    type: temperature
+    scale: 0.5
+    offset: -100
+    histogram:
+      buckets: [50]
+  - plugin: interface
+    offset: 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+	now := time.Now()
+	for _, vl := range []*api.ValueList{
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "sensors", Type: "temperature"}, Values: []api.Value{api.Gauge(300)}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "interface", Type: "if_errors"}, Values: []api.Value{api.Derive(10)}},
+	} {
+		vl.Time, vl.Interval = now, 10*time.Second
+		c.Ingest(vl)
+	}
+
+	// Counters are not offset.
+	want := `
+# HELP collectd_interface_if_errors_total Collectd exporter: 'interface' Type: 'if_errors' Dstype: 'api.Derive' Dsname: 'value'
+# TYPE collectd_interface_if_errors_total counter
+collectd_interface_if_errors_total{instance="example.com"} 10
+# HELP collectd_sensors_temperature Collectd exporter: 'sensors' Type: 'temperature' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_sensors_temperature gauge
+collectd_sensors_temperature{instance="example.com"} 50
+# HELP collectd_sensors_temperature_histogram Collectd exporter: 'sensors' Type: 'temperature' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_sensors_temperature_histogram histogram
+collectd_sensors_temperature_histogram_bucket{instance="example.com",le="50"} 1
+collectd_sensors_temperature_histogram_bucket{instance="example.com",le="+Inf"} 1
+collectd_sensors_temperature_histogram_sum{instance="example.com"} 50
+collectd_sensors_temperature_histogram_count{instance="example.com"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithUnit(t *testing.T) {
+	for _, tc := range []struct{ name, unit, want string }{
+		{"collectd_ping", "seconds", "collectd_ping_seconds"},
+		{"collectd_cpu_total", "seconds", "collectd_cpu_seconds_total"},
+		{"collectd_uptime_seconds", "seconds", "collectd_uptime_seconds"},
+		{"collectd_io_seconds_total", "seconds", "collectd_io_seconds_total"},
+	} {
+		if got := withUnit(tc.name, tc.unit); got != tc.want {
+			t.Errorf("withUnit(%q, %q): got %q, want %q", tc.name, tc.unit, got, tc.want)
+		}
+	}
+}
+
+func TestInstanceLabels(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+instance_labels:
+  - plugin: interface
+    source: plugin_instance
+    regex: '(?P<device>[^-]+)-vlan(?P<vlan>\d+)'
+  - plugin: disk
+    source: type_instance
+    regex: '(?P<operation>read|write)(?:_(?P<unit>\w+))?'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+	now := time.Now()
+	for _, vl := range []*api.ValueList{
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "eth0-vlan100", Type: "if_errors"}, Values: []api.Value{api.Derive(1)}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "lo", Type: "if_errors"}, Values: []api.Value{api.Derive(2)}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "disk", PluginInstance: "sda", Type: "gauge", TypeInstance: "read_bytes"}, Values: []api.Value{api.Gauge(3)}},
+		{Identifier: api.Identifier{Host: "example.com", Plugin: "disk", PluginInstance: "sda", Type: "gauge", TypeInstance: "write"}, Values: []api.Value{api.Gauge(4)}},
+	} {
+		vl.Time, vl.Interval = now, 10*time.Second
+		c.Ingest(vl)
+	}
+
+	want := `
+# HELP collectd_disk_gauge Collectd exporter: 'disk' Type: 'gauge' Dstype: 'api.Gauge' Dsname: 'value'
+# TYPE collectd_disk_gauge gauge
+collectd_disk_gauge{disk="sda",instance="example.com",operation="read",unit="bytes"} 3
+collectd_disk_gauge{disk="sda",instance="example.com",operation="write"} 4
+# HELP collectd_interface_if_errors_total Collectd exporter: 'interface' Type: 'if_errors' Dstype: 'api.Derive' Dsname: 'value'
+# TYPE collectd_interface_if_errors_total counter
+collectd_interface_if_errors_total{device="eth0",instance="example.com",vlan="100"} 1
+collectd_interface_if_errors_total{instance="example.com",interface="lo"} 2
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	for _, invalid := range []string{
+		"instance_labels:\n  - source: plugin_instance\n",
+		"instance_labels:\n  - source: host\n    regex: '(?P<a>.*)'\n",
+		"instance_labels:\n  - source: type_instance\n    regex: '(.*)'\n",
+		"instance_labels:\n  - source: type_instance\n    regex: '(?P<instance>.*)'\n",
+		"instance_labels:\n  - source: type_instance\n    regex: '(?P<__name__>.*)'\n",
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestDebounceExpiry(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+debounce:
+  - plugin: df
+    max_age: 5m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+
+	// Debounced value lists are refreshed every max_age at least.
+	now := time.Unix(1700000000, 0)
+	vl := api.ValueList{Identifier: api.Identifier{Plugin: "df", Type: "df_complex"}, Time: now, Interval: 10 * time.Second}
+	if want := 5*time.Minute + 20*time.Second; c.expired(vl, now.Add(want)) || !c.expired(vl, now.Add(want+time.Second)) {
+		t.Errorf("want timeout %v", want)
+	}
+
+	for _, invalid := range []string{
+		"debounce:\n  - plugin: df\n",
+		"debounce:\n  - plugin: df\n    max_age: -1m\n",
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestExpiryModes(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+expiry:
+  - plugin: exec
+    mode: expire-after-scrape
+  - plugin: snmp
+    mode: never
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+	long := time.Now().Add(-time.Hour)
+	for _, vl := range []api.ValueList{
+		{Identifier: api.Identifier{Host: "a", Plugin: "exec", Type: "gauge"}, Time: time.Now()},
+		{Identifier: api.Identifier{Host: "a", Plugin: "snmp", Type: "gauge"}, Time: long},
+		{Identifier: api.Identifier{Host: "a", Plugin: "load", Type: "gauge"}, Time: long},
+	} {
+		vl.Interval = 10 * time.Second
+		vl.Values = []api.Value{api.Gauge(1)}
+		c.Ingest(&vl)
+	}
+
+	collect := func() []string {
+		ch := make(chan prometheus.Metric, 10)
+		c.collectSeries(context.Background(), ch, nil, time.Now())
+		close(ch)
+		var names []string
+		for m := range ch {
+			names = append(names, m.Desc().String())
+		}
+		return names
+	}
+	if got := collect(); len(got) != 2 {
+		t.Errorf("first collection: got %v, want exec and snmp series", got)
+	}
+	if got := collect(); len(got) != 1 {
+		t.Errorf("second collection: got %v, want snmp series", got)
+	}
+
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "a", Plugin: "exec", Type: "gauge"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(2)},
+	})
+	if got := collect(); len(got) != 2 {
+		t.Errorf("after new value: got %v, want exec and snmp series", got)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// conversion holds everything the value lists of one identifier are
+// converted to except for their values. It is computed when a value list is
+// received whose data sources or enricher labels differ from the previous
+// one, so that scrapes only have to fill in the values.
+type conversion struct {
+	// extra are the enricher labels the conversion was computed with.
+	extra   prometheus.Labels
+	dsNames []string
+	types   []reflect.Type
+	// metricType is the metric type of a pushed series, see metricType.
+	metricType string
+
+	// labels are the labels of all series of the value list.
+	labels prometheus.Labels
+	series []convertedSeries
+}
+
+// convertedSeries is the conversion of one data source.
+type convertedSeries struct {
+	name string
+	help string
+	// labels are the labels of the series, which only differ from those
+	// of the value list in the data source label, see Options.DSLabel.
+	labels prometheus.Labels
+	// key identifies the series, see seriesKey.
+	key string
+	// scale converts the value to the unit of the series, and offset is
+	// added to gauges afterwards.
+	scale, offset float64
+	// desc is nil if the series is dropped by the relabeling rules.
+	desc *prometheus.Desc
+}
+
+// convert returns the conversion of vl, enriched with extra. prev, the
+// conversion of the previous value list of the same identifier, is returned
+// if it still applies.
+func (c *Collector) convert(vl api.ValueList, extra prometheus.Labels, prev *conversion) *conversion {
+	if prev.matches(vl, extra) {
+		return prev
+	}
+
+	conv := &conversion{
+		extra:      extra,
+		dsNames:    slices.Clone(vl.DSNames),
+		types:      make([]reflect.Type, len(vl.Values)),
+		metricType: metricType(vl),
+		labels:     c.labels(vl, extra),
+		series:     make([]convertedSeries, len(vl.Values)),
+	}
+	dsLabelled := c.dsLabelled(vl)
+	for i, v := range vl.Values {
+		conv.types[i] = reflect.TypeOf(v)
+		name, labels := c.name(vl, i), conv.labels
+		if dsLabelled {
+			labels = maps.Clone(conv.labels)
+			labels[c.opts.DSLabel] = vl.DSName(i)
+		}
+		conv.series[i] = convertedSeries{
+			name:   name,
+			help:   c.help(vl, i),
+			labels: labels,
+			key:    seriesKey(name, labels),
+			scale:  c.scale(vl, i),
+			offset: c.offset(vl, i),
+		}
+		if c.opts.Config.keepSeries(name, labels) {
+			conv.series[i].desc = prometheus.NewDesc(name, conv.series[i].help, nil, labels)
+		}
+	}
+	return conv
+}
+
+// matches reports whether conv is the conversion of vl enriched with extra,
+// given that vl has the identifier conv was computed for.
+func (conv *conversion) matches(vl api.ValueList, extra prometheus.Labels) bool {
+	if conv == nil || len(conv.types) != len(vl.Values) || conv.metricType != metricType(vl) || !slices.Equal(conv.dsNames, vl.DSNames) || !maps.Equal(conv.extra, extra) {
+		return false
+	}
+	for i, v := range vl.Values {
+		if reflect.TypeOf(v) != conv.types[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// seriesNamed returns the number of exported series of conv, which may be
+// nil, named name.
+func (conv *conversion) seriesNamed(name string) int {
+	if conv == nil {
+		return 0
+	}
+	n := 0
+	for _, s := range conv.series {
+		if s.desc != nil && s.name == name {
+			n++
+		}
+	}
+	return n
+}
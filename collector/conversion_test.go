@@ -0,0 +1,63 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestConversion(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+metric_relabel_configs:
+  - source_labels: [__name__]
+    regex: collectd_interface_if_octets_tx_total
+    action: drop
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestCollector(t, Options{Config: cfg})
+	vl := api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Derive(1), api.Derive(2)},
+		DSNames:    []string{"rx", "tx"},
+	}
+
+	conv := c.convert(vl, nil, nil)
+	if len(conv.series) != 2 || conv.series[0].name != "collectd_interface_if_octets_rx_total" || conv.series[0].desc == nil {
+		t.Fatalf("got series %+v", conv.series)
+	}
+	if conv.series[1].desc != nil {
+		t.Errorf("series %s not dropped", conv.series[1].name)
+	}
+
+	vl.Values = []api.Value{api.Derive(3), api.Derive(4)}
+	if got := c.convert(vl, nil, conv); got != conv {
+		t.Error("conversion not reused for new values")
+	}
+	extra := prometheus.Labels{"env": "prod"}
+	if got := c.convert(vl, extra, conv); got == conv || got.labels["env"] != "prod" {
+		t.Errorf("got labels %v for changed enricher labels", got.labels)
+	}
+	vl.Values = []api.Value{api.Gauge(3), api.Gauge(4)}
+	if got := c.convert(vl, nil, conv); got == conv || got.series[0].name != "collectd_interface_if_octets_rx" {
+		t.Errorf("got series %+v for changed value types", got.series)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/collectd_exporter/source"
+)
+
+// takeoverIntervals is the number of intervals after which another sender
+// takes over an identifier whose sender went silent.
+const takeoverIntervals = 2
+
+// senderDedupe keeps the value lists of each identifier from a single sender,
+// so that redundant relays forwarding the same host do not make its values
+// alternate between their copies. Another sender takes over once the current
+// one has not sent the identifier for takeoverIntervals.
+type senderDedupe struct {
+	senders map[api.Identifier]senderState
+
+	conflicts prometheus.Counter
+	takeovers prometheus.Counter
+}
+
+// senderState is the sender an identifier is kept from.
+type senderState struct {
+	sender string
+	seen   time.Time
+}
+
+func newSenderDedupe() *senderDedupe {
+	return &senderDedupe{
+		senders: map[api.Identifier]senderState{},
+		conflicts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_sender_conflicts_total",
+				Help: "Number of received value lists dropped because another sender provides their identifier.",
+			},
+		),
+		takeovers: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_sender_takeovers_total",
+				Help: "Number of identifiers taken over by another sender after their sender went silent.",
+			},
+		),
+	}
+}
+
+// keep returns whether vl, received from src at now, is from the sender its
+// identifier is kept from. It must only be called from Run().
+func (d *senderDedupe) keep(vl api.ValueList, src source.Info, now time.Time) bool {
+	sender := senderKey(src)
+	s, ok := d.senders[vl.Identifier]
+	switch {
+	case !ok:
+	case s.sender == sender:
+	case now.Sub(s.seen) > takeoverIntervals*vl.Interval:
+		d.takeovers.Inc()
+	default:
+		d.conflicts.Inc()
+		return false
+	}
+	d.senders[vl.Identifier] = senderState{sender: sender, seen: now}
+	return true
+}
+
+// expire forgets the sender of id. It must only be called from Run().
+func (d *senderDedupe) expire(id api.Identifier) {
+	delete(d.senders, id)
+}
+
+// senderKey identifies the sender described by src.
+func senderKey(src source.Info) string {
+	key := src.Name
+	if src.Addr.IsValid() {
+		key += "/" + src.Addr.String()
+	}
+	return key
+}
+
+// Describe implements prometheus.Collector.
+func (d *senderDedupe) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.conflicts.Desc()
+	ch <- d.takeovers.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (d *senderDedupe) Collect(ch chan<- prometheus.Metric) {
+	ch <- d.conflicts
+	ch <- d.takeovers
+}
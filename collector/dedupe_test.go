@@ -0,0 +1,84 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/collectd_exporter/source"
+)
+
+func TestDedupeSenders(t *testing.T) {
+	c := newTestCollector(t, Options{DedupeSenders: true})
+	relay1 := source.Info{Name: "udp", Addr: netip.MustParseAddr("192.0.2.1")}
+	relay2 := source.Info{Name: "udp", Addr: netip.MustParseAddr("192.0.2.2")}
+	for i, src := range []source.Info{relay1, relay2, relay1, relay2} {
+		c.ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(i)},
+		}, src)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	want := `
+		# HELP collectd_exporter_sender_conflicts_total Number of received value lists dropped because another sender provides their identifier.
+		# TYPE collectd_exporter_sender_conflicts_total counter
+		collectd_exporter_sender_conflicts_total 2
+		# HELP collectd_load Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'value'
+		# TYPE collectd_load gauge
+		collectd_load{instance="example.com"} 2
+	`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want),
+		"collectd_exporter_sender_conflicts_total", "collectd_load"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSenderTakeover(t *testing.T) {
+	d := newSenderDedupe()
+	vl := api.ValueList{Identifier: api.Identifier{Plugin: "load", Type: "load"}, Interval: 10 * time.Second}
+	relay1 := source.Info{Name: "relay1"}
+	relay2 := source.Info{Name: "relay2"}
+	now := time.Unix(1700000000, 0)
+
+	if !d.keep(vl, relay1, now) {
+		t.Error("first sender dropped")
+	}
+	if d.keep(vl, relay2, now.Add(20*time.Second)) {
+		t.Error("second sender kept within two intervals")
+	}
+	if !d.keep(vl, relay2, now.Add(21*time.Second)) {
+		t.Error("second sender did not take over after two intervals")
+	}
+	if d.keep(vl, relay1, now.Add(22*time.Second)) {
+		t.Error("first sender kept after takeover")
+	}
+	if got := testutil.ToFloat64(d.takeovers); got != 1 {
+		t.Errorf("got %v takeovers, want 1", got)
+	}
+
+	d.expire(vl.Identifier)
+	if !d.keep(vl, relay1, now.Add(23*time.Second)) {
+		t.Error("first sender dropped after expiry")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/collectd_exporter/source"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Supported cloud providers of CloudEnricher.
+const (
+	CloudAWS = "aws"
+	CloudGCP = "gcp"
+)
+
+// Base URLs of the cloud metadata services, replaced in tests.
+var (
+	awsMetadataURL = "http://169.254.169.254"
+	gcpMetadataURL = "http://metadata.google.internal"
+)
+
+// Enricher adds labels to the series converted from a value list.
+type Enricher interface {
+	// Enrich returns the extra labels of the series converted from vl,
+	// which was received from src. Enrich is called from a single
+	// goroutine and must neither modify nor retain vl.
+	Enrich(vl *api.ValueList, src source.Info) prometheus.Labels
+}
+
+// EnricherFunc adapts a function to the Enricher interface.
+type EnricherFunc func(vl *api.ValueList, src source.Info) prometheus.Labels
+
+// Enrich implements Enricher.
+func (f EnricherFunc) Enrich(vl *api.ValueList, src source.Info) prometheus.Labels {
+	return f(vl, src)
+}
+
+// StaticEnricher adds the same labels to all series.
+type StaticEnricher prometheus.Labels
+
+// NewStaticEnricher returns a StaticEnricher adding labels. It is an error if
+// a label name is invalid.
+func NewStaticEnricher(labels map[string]string) (StaticEnricher, error) {
+	e := StaticEnricher(maps.Clone(labels))
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Enrich implements Enricher.
+func (e StaticEnricher) Enrich(*api.ValueList, source.Info) prometheus.Labels {
+	return prometheus.Labels(e)
+}
+
+// validate returns an error if the name of a label of e is invalid or
+// reserved for internal use.
+func (e StaticEnricher) validate() error {
+	for name := range e {
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// EnvEnricher returns an Enricher setting each label of vars to the value of
+// the environment variable it maps to. It is an error if a variable is not
+// set or a label name is invalid.
+func EnvEnricher(vars map[string]string) (StaticEnricher, error) {
+	labels := make(StaticEnricher, len(vars))
+	for name, env := range vars {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %q for label %q is not set", env, name)
+		}
+		labels[name] = value
+	}
+	if err := labels.validate(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// CloudEnricher returns an Enricher adding the cloud_provider, cloud_region,
+// cloud_availability_zone and cloud_account_id labels of the instance the
+// exporter runs on. They are queried once from the metadata service of the
+// given provider, which must be one of CloudAWS and CloudGCP.
+func CloudEnricher(ctx context.Context, client *http.Client, provider string) (StaticEnricher, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	ctx, span := tracer.Start(ctx, "collectd.cloud_metadata", trace.WithAttributes(
+		attribute.String("cloud.provider", provider),
+	))
+	defer span.End()
+
+	var (
+		e   StaticEnricher
+		err error
+	)
+	switch provider {
+	case CloudAWS:
+		e, err = awsEnricher(ctx, client)
+	case CloudGCP:
+		e, err = gcpEnricher(ctx, client)
+	default:
+		err = fmt.Errorf("unknown cloud provider %q", provider)
+	}
+	if err == nil {
+		err = e.validate()
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return e, err
+}
+
+// awsEnricher queries the EC2 instance identity document using IMDSv2.
+func awsEnricher(ctx context.Context, client *http.Client) (StaticEnricher, error) {
+	token, err := fetchMetadata(ctx, client, http.MethodPut, awsMetadataURL+"/latest/api/token",
+		"X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if err != nil {
+		return nil, err
+	}
+	doc, err := fetchMetadata(ctx, client, http.MethodGet, awsMetadataURL+"/latest/dynamic/instance-identity/document",
+		"X-aws-ec2-metadata-token", token)
+	if err != nil {
+		return nil, err
+	}
+
+	var identity struct {
+		AccountID        string `json:"accountId"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+	}
+	if err := json.Unmarshal([]byte(doc), &identity); err != nil {
+		return nil, fmt.Errorf("parsing instance identity document: %w", err)
+	}
+
+	return StaticEnricher{
+		"cloud_provider":          CloudAWS,
+		"cloud_region":            identity.Region,
+		"cloud_availability_zone": identity.AvailabilityZone,
+		"cloud_account_id":        identity.AccountID,
+	}, nil
+}
+
+// gcpEnricher queries the GCE metadata server.
+func gcpEnricher(ctx context.Context, client *http.Client) (StaticEnricher, error) {
+	project, err := fetchMetadata(ctx, client, http.MethodGet, gcpMetadataURL+"/computeMetadata/v1/project/project-id",
+		"Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+	// The zone has the form "projects/<number>/zones/<zone>".
+	zone, err := fetchMetadata(ctx, client, http.MethodGet, gcpMetadataURL+"/computeMetadata/v1/instance/zone",
+		"Metadata-Flavor", "Google")
+	if err != nil {
+		return nil, err
+	}
+	zone = zone[strings.LastIndexByte(zone, '/')+1:]
+	region := zone
+	if i := strings.LastIndexByte(zone, '-'); i != -1 {
+		region = zone[:i]
+	}
+
+	return StaticEnricher{
+		"cloud_provider":          CloudGCP,
+		"cloud_region":            region,
+		"cloud_availability_zone": zone,
+		"cloud_account_id":        project,
+	}, nil
+}
+
+// fetchMetadata performs a request against a metadata service with the given
+// header set and returns the response body.
+func fetchMetadata(ctx context.Context, client *http.Client, method, url, header, value string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(header, value)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: unexpected status %s", method, url, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
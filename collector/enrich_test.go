@@ -0,0 +1,178 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/collectd_exporter/source"
+)
+
+func TestEnrich(t *testing.T) {
+	c := newTestCollector(t, Options{
+		ConstLabels: prometheus.Labels{"dc": "eu1", "via": "overridden"},
+		Enrichers: []Enricher{
+			EnricherFunc(func(vl *api.ValueList, src source.Info) prometheus.Labels {
+				return prometheus.Labels{"via": src.Name, "instance": "ignored"}
+			}),
+		},
+		KeepExpired: true,
+	})
+	c.ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		DSNames:    []string{"shortterm"},
+		Values:     []api.Value{api.Gauge(0.5)},
+	}, source.Info{Name: "udp", Labels: map[string]string{"dc": "us1", "team": "db"}})
+
+	want := `
+# HELP collectd_load_shortterm Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'shortterm'
+# TYPE collectd_load_shortterm gauge
+collectd_load_shortterm{dc="eu1",instance="example.com",team="db",via="udp"} 0.5
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExportedBy(t *testing.T) {
+	c := newTestCollector(t, Options{
+		ExportedBy:  "exporter-1:9103",
+		Enrichers:   []Enricher{StaticEnricher{"exported_by": "overridden"}},
+		KeepExpired: true,
+	})
+	c.ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		DSNames:    []string{"shortterm"},
+		Values:     []api.Value{api.Gauge(0.5)},
+	}, source.Info{Name: "udp"})
+
+	want := `
+# HELP collectd_exporter_exported_by_info Address of the exporter given in the exported_by label of the converted series.
+# TYPE collectd_exporter_exported_by_info gauge
+collectd_exporter_exported_by_info{exported_by="exporter-1:9103"} 1
+# HELP collectd_load_shortterm Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'shortterm'
+# TYPE collectd_load_shortterm gauge
+collectd_load_shortterm{exported_by="exporter-1:9103",instance="example.com"} 0.5
+`
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c.Series(), c.Self())
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_exporter_exported_by_info", "collectd_load_shortterm"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvEnricher(t *testing.T) {
+	t.Setenv("COLLECTD_EXPORTER_TEST_DC", "eu1")
+
+	e, err := EnvEnricher(map[string]string{"dc": "COLLECTD_EXPORTER_TEST_DC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (StaticEnricher{"dc": "eu1"}); !reflect.DeepEqual(e, want) {
+		t.Errorf("got labels %v, want %v", e, want)
+	}
+
+	if _, err := EnvEnricher(map[string]string{"dc": "COLLECTD_EXPORTER_TEST_UNSET"}); err == nil {
+		t.Error("expected an error for an unset variable")
+	}
+	if _, err := EnvEnricher(map[string]string{"data-center": "COLLECTD_EXPORTER_TEST_DC"}); err == nil {
+		t.Error("expected an error for an invalid label name")
+	}
+}
+
+func TestNewStaticEnricher(t *testing.T) {
+	labels := map[string]string{"dc": "eu1"}
+	e, err := NewStaticEnricher(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (StaticEnricher{"dc": "eu1"}); !reflect.DeepEqual(e, want) {
+		t.Errorf("got labels %v, want %v", e, want)
+	}
+	if _, err := NewStaticEnricher(map[string]string{"1dc": "eu1"}); err == nil {
+		t.Error("expected an error for an invalid label name")
+	}
+	if _, err := NewStaticEnricher(map[string]string{"__dc": "eu1"}); err == nil {
+		t.Error("expected an error for a reserved label name")
+	}
+}
+
+func TestCloudEnricher(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("token"))
+	})
+	mux.HandleFunc("GET /latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"accountId":"123456789012","region":"eu-west-1","availabilityZone":"eu-west-1a"}`))
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/project/project-id", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example-project"))
+	})
+	mux.HandleFunc("GET /computeMetadata/v1/instance/zone", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("projects/123/zones/europe-west1-b"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	defer func(aws, gcp string) { awsMetadataURL, gcpMetadataURL = aws, gcp }(awsMetadataURL, gcpMetadataURL)
+	awsMetadataURL, gcpMetadataURL = srv.URL, srv.URL
+
+	cases := map[string]StaticEnricher{
+		CloudAWS: {
+			"cloud_provider":          "aws",
+			"cloud_region":            "eu-west-1",
+			"cloud_availability_zone": "eu-west-1a",
+			"cloud_account_id":        "123456789012",
+		},
+		CloudGCP: {
+			"cloud_provider":          "gcp",
+			"cloud_region":            "europe-west1",
+			"cloud_availability_zone": "europe-west1-b",
+			"cloud_account_id":        "example-project",
+		},
+	}
+	for provider, want := range cases {
+		got, err := CloudEnricher(context.Background(), srv.Client(), provider)
+		if err != nil {
+			t.Errorf("%s: %v", provider, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got labels %v, want %v", provider, got, want)
+		}
+	}
+
+	if _, err := CloudEnricher(context.Background(), srv.Client(), "unknown"); err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+}
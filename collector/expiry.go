@@ -0,0 +1,106 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"collectd.org/api"
+)
+
+// minGCInterval is the minimum delay between two garbage collections, so
+// that value lists expiring one after the other do not hold the lock
+// continuously. Collections run once the earliest cached value list expires,
+// but at least every Options.GCInterval to forget hosts.
+const minGCInterval = 10 * time.Second
+
+// deadline returns the time until which vl is valid, as configured by the
+// first matching expiry rule or Options.Timeout. It returns the zero time if
+// vl never expires. It is the only place deciding on expiry: garbage
+// collection, scrapes, snapshots and the inventory API all compare the
+// deadline to their time using expiredAt.
+func (c *Collector) deadline(vl api.ValueList) time.Time {
+	if c.opts.KeepExpired {
+		return time.Time{}
+	}
+	timeout := time.Duration(c.opts.Timeout) * vl.Interval
+	if r := c.opts.Config.expiry(vl); r != nil {
+		switch {
+		case r.Mode == expireNever:
+			return time.Time{}
+		case r.MaxAge != 0:
+			timeout = time.Duration(r.MaxAge)
+		case r.Timeout != 0:
+			timeout = time.Duration(r.Timeout) * vl.Interval
+		}
+	}
+	if r := c.opts.Config.debounce(vl); r != nil {
+		// Unchanged value lists are only kept every max_age.
+		timeout += time.Duration(r.MaxAge)
+	}
+	return vl.Time.Add(timeout)
+}
+
+// expiredAt returns whether a value list valid until deadline has expired at
+// now. A value list is still valid at its deadline.
+func expiredAt(deadline, now time.Time) bool {
+	return !deadline.IsZero() && now.After(deadline)
+}
+
+// expired returns whether vl has expired at now.
+func (c *Collector) expired(vl api.ValueList, now time.Time) bool {
+	return expiredAt(c.deadline(vl), now)
+}
+
+// gc removes the value lists expired at now from the cache and forgets the
+// hosts and identifiers not seen for Options.HostRetention. It returns the
+// earliest deadline of the remaining value lists, or the zero time if none
+// expires. It must only be called from Run().
+func (c *Collector) gc(now time.Time) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next time.Time
+	for id, vl := range c.valueLists {
+		deadline := c.deadline(vl)
+		switch {
+		case expiredAt(deadline, now):
+			c.remove(id, vl)
+		case !deadline.IsZero() && (next.IsZero() || deadline.Before(next)):
+			next = deadline
+		}
+	}
+	for host, h := range c.hosts {
+		if now.Sub(h.seen) > c.opts.HostRetention {
+			delete(c.hosts, host)
+			c.gaps.forgetHost(host)
+			c.skew.forgetHost(host)
+		}
+	}
+	c.gaps.forget(now.Add(-c.opts.HostRetention))
+	return next
+}
+
+// gcDelay returns the delay after now until the next garbage collection,
+// for the earliest deadline next returned by gc, with up to
+// Options.GCJitter of it added at random.
+func (c *Collector) gcDelay(next, now time.Time) time.Duration {
+	d := c.opts.GCInterval
+	if !next.IsZero() {
+		// Value lists expire after their deadline.
+		d = min(max(next.Sub(now)+time.Nanosecond, min(minGCInterval, d)), d)
+	}
+	return d + time.Duration(rand.Float64()*c.opts.GCJitter*float64(d))
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDeadline(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+expiry:
+  - plugin: smart
+    mode: never
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	load := api.ValueList{Identifier: api.Identifier{Host: "a", Plugin: "load", Type: "load"}, Time: now, Interval: 10 * time.Second}
+	smart := api.ValueList{Identifier: api.Identifier{Host: "a", Plugin: "smart", Type: "smart_temperature"}, Time: now, Interval: 10 * time.Second}
+
+	c := newTestCollector(t, Options{Config: cfg})
+	deadline := c.deadline(load)
+	if want := now.Add(20 * time.Second); !deadline.Equal(want) {
+		t.Errorf("got deadline %v, want %v", deadline, want)
+	}
+	if c.expired(load, deadline) || !c.expired(load, deadline.Add(time.Nanosecond)) {
+		t.Error("value list must be valid at and expire right after its deadline")
+	}
+	if d := c.deadline(smart); !d.IsZero() || c.expired(smart, now.Add(24*time.Hour)) {
+		t.Errorf("got deadline %v for a value list that never expires", d)
+	}
+
+	c = newTestCollector(t, Options{KeepExpired: true})
+	if d := c.deadline(load); !d.IsZero() || c.expired(load, now.Add(24*time.Hour)) {
+		t.Errorf("got deadline %v with KeepExpired", d)
+	}
+}
+
+// TestExpiryConsistency checks that garbage collection, scrapes and
+// snapshots agree on whether a value list has expired, also at its deadline.
+func TestExpiryConsistency(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	now := time.Now()
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "a", Plugin: "load", Type: "load"},
+		Time:       now,
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	}
+	c.Ingest(vl)
+	deadline := now.Add(20 * time.Second)
+
+	count := func(at time.Time) int {
+		ch := make(chan prometheus.Metric, 10)
+		c.collectSeries(context.Background(), ch, nil, at)
+		close(ch)
+		return len(ch)
+	}
+
+	s, err := c.buildSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range []time.Time{deadline, deadline.Add(time.Nanosecond)} {
+		expired := at.After(deadline)
+		if got := count(at); (got == 0) != expired {
+			t.Errorf("at %v: scrape got %d series", at.Sub(now), got)
+		}
+		c.snapshot.Store(s)
+		if got := count(at); (got == 0) != expired {
+			t.Errorf("at %v: snapshot scrape got %d series", at.Sub(now), got)
+		}
+		c.snapshot.Store(nil)
+
+		next := c.gc(at)
+		if _, ok := c.valueLists[vl.Identifier.String()]; ok == expired {
+			t.Errorf("at %v: garbage collection kept value list: %t", at.Sub(now), ok)
+		}
+		if !expired && !next.Equal(deadline) {
+			t.Errorf("got next deadline %v, want %v", next, deadline)
+		}
+		if expired && !next.IsZero() {
+			t.Errorf("got next deadline %v for an empty cache", next)
+		}
+	}
+}
+
+func TestGCDelay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := newTestCollector(t, Options{})
+	for _, tc := range []struct {
+		next time.Time
+		want time.Duration
+	}{
+		{time.Time{}, DefaultGCInterval},
+		{now, minGCInterval},
+		{now.Add(-time.Hour), minGCInterval},
+		{now.Add(30 * time.Second), 30*time.Second + time.Nanosecond},
+		{now.Add(time.Hour), DefaultGCInterval},
+	} {
+		if got := c.gcDelay(tc.next, now); got != tc.want {
+			t.Errorf("gcDelay(%v): got %v, want %v", tc.next.Sub(now), got, tc.want)
+		}
+	}
+
+	c = newTestCollector(t, Options{GCInterval: 30 * time.Second, GCJitter: 0.5})
+	for range 100 {
+		if got := c.gcDelay(now.Add(20*time.Second), now); got < 20*time.Second || got > 30*time.Second {
+			t.Fatalf("got delay %v, want between 20s and 30s", got)
+		}
+		if got := c.gcDelay(time.Time{}, now); got < 30*time.Second || got > 45*time.Second {
+			t.Fatalf("got delay %v, want between 30s and 45s", got)
+		}
+	}
+	c = newTestCollector(t, Options{GCInterval: time.Second})
+	if got := c.gcDelay(now, now); got != time.Second {
+		t.Errorf("got delay %v, want the GC interval below the minimum delay", got)
+	}
+
+	for _, jitter := range []float64{-0.1, 1.5} {
+		if _, err := New(nil, Options{GCJitter: jitter}); err == nil {
+			t.Errorf("jitter %v: expected error", jitter)
+		}
+	}
+}
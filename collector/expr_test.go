@@ -0,0 +1,65 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	vars := map[string]float64{"used": 30, "free": 70, "rx_2": 4}
+
+	cases := []struct {
+		expr string
+		want float64
+	}{
+		{"used / (used + free) * 100", 30},
+		{"used + free * 2", 170},
+		{"(used + free) * 2", 200},
+		{"-used + 1.5", -28.5},
+		{"free - used - 10", 30},
+		{"rx_2 / 8", 0.5},
+		{"  100  ", 100},
+	}
+
+	for _, c := range cases {
+		e, err := parseExpr(c.expr)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", c.expr, err)
+			continue
+		}
+		got, err := e.eval(vars)
+		if err != nil {
+			t.Errorf("eval(%q): %v", c.expr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("eval(%q): got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, s := range []string{"", "used +", "(used", "used free", "1..2", "used % 2"} {
+		if _, err := parseExpr(s); err == nil {
+			t.Errorf("parseExpr(%q): expected error", s)
+		}
+	}
+
+	e, err := parseExpr("used / reserved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.eval(vars); err == nil {
+		t.Error("expected error for unknown data source")
+	}
+}
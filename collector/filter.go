@@ -0,0 +1,65 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+
+	"collectd.org/api"
+)
+
+// Matcher accepts strings matching an include and not matching an exclude
+// regular expression. A nil expression is ignored.
+type Matcher struct {
+	include, exclude *regexp.Regexp
+}
+
+// NewMatcher compiles the include and exclude expressions, which are fully
+// anchored. Empty expressions are ignored.
+func NewMatcher(include, exclude string) (Matcher, error) {
+	var (
+		m   Matcher
+		err error
+	)
+	if include != "" {
+		if m.include, err = regexp.Compile("^(?:" + include + ")$"); err != nil {
+			return m, fmt.Errorf("invalid include expression %q: %w", include, err)
+		}
+	}
+	if exclude != "" {
+		if m.exclude, err = regexp.Compile("^(?:" + exclude + ")$"); err != nil {
+			return m, fmt.Errorf("invalid exclude expression %q: %w", exclude, err)
+		}
+	}
+
+	return m, nil
+}
+
+func (m Matcher) accepts(s string) bool {
+	if m.include != nil && !m.include.MatchString(s) {
+		return false
+	}
+	return m.exclude == nil || !m.exclude.MatchString(s)
+}
+
+// Filter decides which value lists are accepted by the collector, based on
+// their plugin, type and host. The zero value accepts everything.
+type Filter struct {
+	Plugins, Types, Hosts Matcher
+}
+
+func (f Filter) accepts(vl *api.ValueList) bool {
+	return f.Plugins.accepts(vl.Plugin) && f.Types.accepts(vl.Type) && f.Hosts.accepts(vl.Host)
+}
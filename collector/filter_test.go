@@ -0,0 +1,53 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+
+	"collectd.org/api"
+)
+
+func TestValueListFilter(t *testing.T) {
+	plugins, err := NewMatcher("", "processes|tcpconns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := NewMatcher(`web\d+`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := Filter{Plugins: plugins, Hosts: hosts}
+
+	cases := []struct {
+		id   api.Identifier
+		want bool
+	}{
+		{api.Identifier{Host: "web1", Plugin: "cpu", Type: "cpu"}, true},
+		{api.Identifier{Host: "web1", Plugin: "processes", Type: "ps_rss"}, false},
+		{api.Identifier{Host: "web1", Plugin: "processes_extra", Type: "ps_rss"}, true},
+		{api.Identifier{Host: "db1", Plugin: "cpu", Type: "cpu"}, false},
+		{api.Identifier{Host: "web1.example.com", Plugin: "cpu", Type: "cpu"}, false},
+	}
+
+	for _, c := range cases {
+		if got := f.accepts(&api.ValueList{Identifier: c.id}); got != c.want {
+			t.Errorf("accepts(%v): got %v, want %v", c.id, got, c.want)
+		}
+	}
+
+	if _, err := NewMatcher("(", ""); err == nil {
+		t.Error("expected error for invalid expression")
+	}
+}
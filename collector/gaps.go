@@ -0,0 +1,84 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"math"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gaps counts the intervals missed between consecutive value lists of the
+// same identifier, e.g. because packets were lost between collectd and the
+// exporter. The time of the last value list of each identifier is kept for
+// Options.HostRetention, beyond its expiry, so that outages longer than the
+// timeout are counted as well.
+type gaps struct {
+	last   map[api.Identifier]time.Time
+	missed *prometheus.CounterVec
+}
+
+func newGaps() *gaps {
+	return &gaps{
+		last: map[api.Identifier]time.Time{},
+		missed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_missed_intervals_total",
+				Help: "Number of intervals for which no value list was received, by host, detected from the gaps between consecutive value lists of the same identifier.",
+			},
+			[]string{"instance"},
+		),
+	}
+}
+
+// record counts the intervals missed before vl. Gaps are rounded to whole
+// intervals, so that jitter in the time collectd reads values is not counted.
+// Value lists older than the last one are ignored. It must only be called
+// from Run().
+func (g *gaps) record(vl api.ValueList) {
+	prev, ok := g.last[vl.Identifier]
+	if ok && !vl.Time.After(prev) {
+		return
+	}
+	g.last[vl.Identifier] = vl.Time
+	if !ok || vl.Interval <= 0 {
+		return
+	}
+	if missed := math.Round(float64(vl.Time.Sub(prev))/float64(vl.Interval)) - 1; missed > 0 {
+		g.missed.WithLabelValues(vl.Host).Add(missed)
+	}
+}
+
+// forget drops the identifiers whose last value list is older than before.
+// It must only be called from Run().
+func (g *gaps) forget(before time.Time) {
+	for id, t := range g.last {
+		if t.Before(before) {
+			delete(g.last, id)
+		}
+	}
+}
+
+// forgetHost drops the identifiers and the counter of host. It must only be
+// called from Run().
+func (g *gaps) forgetHost(host string) {
+	for id := range g.last {
+		if id.Host == host {
+			delete(g.last, id)
+		}
+	}
+	g.missed.DeleteLabelValues(host)
+}
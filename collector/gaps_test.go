@@ -0,0 +1,75 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMissedIntervals(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	c := newTestCollector(t, Options{})
+	ingest := func(host, plugin string, offset time.Duration) {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: plugin, Type: "gauge"},
+			Time:       start.Add(offset),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		})
+	}
+
+	// Jitter is not counted.
+	ingest("a", "cpu", 0)
+	ingest("a", "cpu", 11*time.Second)
+	ingest("a", "cpu", 19*time.Second)
+	// Two intervals are missed, longer than the value list's timeout.
+	ingest("a", "cpu", 50*time.Second)
+	// Late value lists are ignored.
+	ingest("a", "cpu", 40*time.Second)
+	// Other identifiers of the same host are tracked separately.
+	ingest("a", "memory", 45*time.Second)
+	ingest("a", "memory", 65*time.Second)
+	ingest("b", "cpu", 0)
+	ingest("b", "cpu", 10*time.Second)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c.Self())
+	want := `
+		# HELP collectd_exporter_missed_intervals_total Number of intervals for which no value list was received, by host, detected from the gaps between consecutive value lists of the same identifier.
+		# TYPE collectd_exporter_missed_intervals_total counter
+		collectd_exporter_missed_intervals_total{instance="a"} 3
+	`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_exporter_missed_intervals_total"); err != nil {
+		t.Error(err)
+	}
+
+	c.delete(deleteRequest{hosts: func(h string) bool { return h == "a" }})
+	if n := testutil.CollectAndCount(c.gaps.missed); n != 0 {
+		t.Errorf("got %d counters after deleting the host, want 0", n)
+	}
+	if len(c.gaps.last) != 1 {
+		t.Errorf("got identifiers %v after deleting the host", c.gaps.last)
+	}
+
+	c.gc(time.Now().Add(DefaultHostRetention + time.Hour))
+	if len(c.gaps.last) != 0 {
+		t.Errorf("got identifiers %v after the host retention", c.gaps.last)
+	}
+}
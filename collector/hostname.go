@@ -0,0 +1,58 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// newHostMap returns the host names to replace with the given policy, keyed
+// by their lower-case form, or nil if no names are replaced.
+func newHostMap(policy HostPolicy, cfg *Config) (map[string]string, error) {
+	switch policy {
+	case HostPreserve, HostLowercase:
+		return nil, nil
+	case HostMap:
+	default:
+		return nil, fmt.Errorf("unknown host normalization %q", policy)
+	}
+	if cfg == nil || len(cfg.HostMap) == 0 {
+		return nil, errors.New("host normalization \"map\" requires a host_map in the configuration file")
+	}
+	m := make(map[string]string, len(cfg.HostMap))
+	for from, to := range cfg.HostMap {
+		key := strings.ToLower(from)
+		if prev, ok := m[key]; ok && prev != to {
+			return nil, fmt.Errorf("host_map maps %q to both %q and %q", key, prev, to)
+		}
+		m[key] = to
+	}
+	return m, nil
+}
+
+// normalizeHost returns host as it is cached and exported according to
+// Options.HostNormalization.
+func (c *Collector) normalizeHost(host string) string {
+	switch {
+	case c.opts.HostNormalization == HostLowercase:
+		return strings.ToLower(host)
+	case c.hostMap != nil:
+		if to, ok := c.hostMap[strings.ToLower(host)]; ok {
+			return to
+		}
+	}
+	return host
+}
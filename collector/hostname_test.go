@@ -0,0 +1,69 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestHostNormalization(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+host_map:
+  WEB01: web01.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policy HostPolicy
+		want   []string
+	}{
+		{HostPreserve, []string{"DB01", "WEB01", "web01"}},
+		{HostLowercase, []string{"db01", "web01"}},
+		{HostMap, []string{"DB01", "web01.example.com"}},
+	} {
+		c := newTestCollector(t, Options{HostNormalization: tc.policy, Config: cfg})
+		for _, host := range []string{"WEB01", "web01", "DB01"} {
+			c.Ingest(&api.ValueList{
+				Identifier: api.Identifier{Host: host, Plugin: "load", Type: "gauge"},
+				Time:       time.Now(),
+				Interval:   10 * time.Second,
+				Values:     []api.Value{api.Gauge(1)},
+			})
+		}
+		var hosts []string
+		for _, h := range c.Hosts() {
+			hosts = append(hosts, h.Name)
+		}
+		slices.Sort(hosts)
+		if !slices.Equal(hosts, tc.want) {
+			t.Errorf("%s: got hosts %v, want %v", tc.policy, hosts, tc.want)
+		}
+	}
+
+	if _, err := New(nil, Options{HostNormalization: HostMap}); err == nil {
+		t.Error("expected error for the map normalization without a host_map")
+	}
+	cfg.HostMap["web01"] = "web01.example.org"
+	if _, err := New(nil, Options{HostNormalization: HostMap, Config: cfg}); err == nil {
+		t.Error("expected error for conflicting host_map entries")
+	}
+	if _, err := New(nil, Options{HostNormalization: "upper"}); err == nil {
+		t.Error("expected error for an unknown normalization")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// intervals counts the cached value lists by interval, from which a scrape
+// interval matching the cadence of collectd is suggested.
+type intervals struct {
+	counts map[time.Duration]int
+	desc   *prometheus.Desc
+}
+
+func newIntervals() *intervals {
+	return &intervals{
+		counts: map[time.Duration]int{},
+		desc: prometheus.NewDesc(
+			"collectd_exporter_suggested_scrape_interval_seconds",
+			"Shortest interval of the cached value lists. Scraping more often exports no new values, scraping less often misses some.",
+			nil, nil,
+		),
+	}
+}
+
+// add counts vl. c.mu must be held.
+func (i *intervals) add(vl api.ValueList) {
+	i.counts[vl.Interval]++
+}
+
+// remove stops counting vl. c.mu must be held.
+func (i *intervals) remove(vl api.ValueList) {
+	if i.counts[vl.Interval]--; i.counts[vl.Interval] <= 0 {
+		delete(i.counts, vl.Interval)
+	}
+}
+
+// suggested returns the shortest interval of the cached value lists, or 0 if
+// there are none. c.mu must be held.
+func (i *intervals) suggested() time.Duration {
+	var shortest time.Duration
+	for interval := range i.counts {
+		if interval > 0 && (shortest == 0 || interval < shortest) {
+			shortest = interval
+		}
+	}
+	return shortest
+}
+
+// collectSuggestedInterval sends the suggested scrape interval to ch, unless
+// no value lists are cached.
+func (c *Collector) collectSuggestedInterval(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	suggested := c.intervals.suggested()
+	c.mu.Unlock()
+
+	if suggested > 0 {
+		ch <- prometheus.MustNewConstMetric(c.intervals.desc, prometheus.GaugeValue, suggested.Seconds())
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSuggestedScrapeInterval(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	ingest := func(host string, interval time.Duration) {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "gauge"},
+			Time:       time.Now(),
+			Interval:   interval,
+			Values:     []api.Value{api.Gauge(1)},
+		})
+	}
+	suggested := func() int {
+		t.Helper()
+		return testutil.CollectAndCount(collectorFunc(c.collectSuggestedInterval))
+	}
+
+	if n := suggested(); n != 0 {
+		t.Errorf("got %d suggested intervals without value lists", n)
+	}
+	ingest("a", 10*time.Second)
+	ingest("b", time.Minute)
+	if got := c.intervals.suggested(); got != 10*time.Second {
+		t.Errorf("got suggested interval %v, want 10s", got)
+	}
+	// The interval of a host changes.
+	ingest("a", 30*time.Second)
+	if got := c.intervals.suggested(); got != 30*time.Second {
+		t.Errorf("got suggested interval %v, want 30s", got)
+	}
+	c.delete(deleteRequest{valueLists: func(id api.Identifier) bool { return id.Host == "a" }})
+	if got := c.intervals.suggested(); got != time.Minute {
+		t.Errorf("got suggested interval %v after deleting a value list, want 1m", got)
+	}
+	if n := suggested(); n != 1 {
+		t.Errorf("got %d suggested intervals, want 1", n)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Host describes a host value lists were received from within the host
+// retention period.
+type Host struct {
+	Name string `json:"host"`
+	// LastSeen is the time the last value list of the host was received.
+	LastSeen time.Time `json:"last_seen"`
+	// LastUpdate is the time of the host's most recent unexpired value
+	// list, as reported by collectd. It is nil if all have expired.
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	// Series is the number of series currently converted from the host's
+	// value lists.
+	Series int `json:"series"`
+	// Plugins lists the plugins of the host's unexpired value lists.
+	Plugins []string `json:"plugins"`
+}
+
+// Series describes a series converted from a cached value list.
+type Series struct {
+	Name       string            `json:"name"`
+	Labels     prometheus.Labels `json:"labels"`
+	Identifier string            `json:"identifier"`
+	// Time is the time of the value list as reported by collectd.
+	Time time.Time `json:"time"`
+}
+
+// Hosts returns the hosts value lists were received from, sorted by name.
+func (c *Collector) Hosts() []Host {
+	hosts := map[string]*Host{}
+	c.mu.Lock()
+	for name, h := range c.hosts {
+		hosts[name] = &Host{Name: name, LastSeen: h.seen, Plugins: []string{}}
+	}
+	c.mu.Unlock()
+
+	for _, s := range c.inventory() {
+		h, ok := hosts[s.vl.Host]
+		if !ok {
+			// Expired from the host retention period in the meantime.
+			continue
+		}
+		h.Series++
+		if h.LastUpdate == nil || s.vl.Time.After(*h.LastUpdate) {
+			t := s.vl.Time
+			h.LastUpdate = &t
+		}
+		if !slices.Contains(h.Plugins, s.vl.Plugin) {
+			h.Plugins = append(h.Plugins, s.vl.Plugin)
+		}
+	}
+
+	list := make([]Host, 0, len(hosts))
+	for _, h := range hosts {
+		slices.Sort(h.Plugins)
+		list = append(list, *h)
+	}
+	slices.SortFunc(list, func(a, b Host) int { return cmp.Compare(a.Name, b.Name) })
+	return list
+}
+
+// ListSeries returns the series converted from the unexpired value lists of
+// host, or of all hosts if host is empty, sorted by name and identifier.
+// Histograms and computed metrics are not included.
+func (c *Collector) ListSeries(host string) []Series {
+	var list []Series
+	for _, s := range c.inventory() {
+		if host != "" && s.vl.Host != host {
+			continue
+		}
+		list = append(list, Series{
+			Name:       s.name,
+			Labels:     s.labels,
+			Identifier: s.vl.Identifier.String(),
+			Time:       s.vl.Time,
+		})
+	}
+	slices.SortFunc(list, func(a, b Series) int {
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Identifier, b.Identifier))
+	})
+	return list
+}
+
+// Metadata describes a metric converted from value lists, in the format of
+// the Prometheus metadata API extended by the collectd origin.
+type Metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+	// Plugin and CollectdType are the collectd plugin and type of the value
+	// lists the metric is converted from.
+	Plugin       string `json:"plugin"`
+	CollectdType string `json:"collectd_type"`
+}
+
+// Metadata returns the metadata of the metrics converted from the unexpired
+// value lists, by metric name. If name is not empty, only the metadata of the
+// metric of that name is returned. Histograms and computed metrics are not
+// included.
+func (c *Collector) Metadata(name string) map[string][]Metadata {
+	metadata := map[string][]Metadata{}
+	for _, s := range c.inventory() {
+		if name != "" && s.name != name {
+			continue
+		}
+		_, valueType, err := convertValueOf(s.vl, s.index)
+		if err != nil {
+			continue
+		}
+		md := Metadata{
+			Type:         "gauge",
+			Help:         s.help,
+			Plugin:       s.vl.Plugin,
+			CollectdType: s.vl.Type,
+		}
+		switch valueType {
+		case prometheus.CounterValue:
+			md.Type = "counter"
+		case prometheus.UntypedValue:
+			md.Type = "unknown"
+		}
+		if m := c.opts.Config.mapping(s.vl, s.index); m != nil {
+			md.Unit = m.Unit
+		}
+		if !slices.Contains(metadata[s.name], md) {
+			metadata[s.name] = append(metadata[s.name], md)
+		}
+	}
+	for _, mds := range metadata {
+		slices.SortFunc(mds, func(a, b Metadata) int {
+			return cmp.Or(cmp.Compare(a.Plugin, b.Plugin), cmp.Compare(a.CollectdType, b.CollectdType), cmp.Compare(a.Type, b.Type), cmp.Compare(a.Help, b.Help))
+		})
+	}
+	return metadata
+}
+
+// inventorySeries is a series along with the value list and index of the
+// data source it is converted from.
+type inventorySeries struct {
+	name   string
+	help   string
+	labels prometheus.Labels
+	vl     api.ValueList
+	index  int
+}
+
+// inventory returns the series converted from the unexpired value lists,
+// without their values.
+func (c *Collector) inventory() []inventorySeries {
+	now := time.Now()
+	var series []inventorySeries
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, vl := range c.valueLists {
+		if c.expired(vl, now) {
+			continue
+		}
+		for i, s := range c.conversions[id].series {
+			if s.desc != nil {
+				series = append(series, inventorySeries{name: s.name, help: s.help, labels: s.labels, vl: vl, index: i})
+			}
+		}
+	}
+	return series
+}
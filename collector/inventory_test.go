@@ -0,0 +1,97 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInventory(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	now := time.Now().Truncate(time.Second)
+	for _, vl := range []api.ValueList{
+		{Identifier: api.Identifier{Host: "b.example.com", Plugin: "load", Type: "load"}, Time: now, DSNames: []string{"shortterm", "midterm"}},
+		{Identifier: api.Identifier{Host: "a.example.com", Plugin: "memory", Type: "memory", TypeInstance: "free"}, Time: now.Add(-time.Second)},
+		{Identifier: api.Identifier{Host: "a.example.com", Plugin: "load", Type: "load"}, Time: now.Add(-time.Hour), DSNames: []string{"shortterm", "midterm"}},
+	} {
+		vl.Interval = 10 * time.Second
+		vl.Values = make([]api.Value, max(len(vl.DSNames), 1))
+		for i := range vl.Values {
+			vl.Values[i] = api.Gauge(1)
+		}
+		c.Ingest(&vl)
+	}
+
+	hosts := c.Hosts()
+	if len(hosts) != 2 {
+		t.Fatalf("got hosts %+v", hosts)
+	}
+	// The load value list of a.example.com has expired.
+	if h := hosts[0]; h.Name != "a.example.com" || h.Series != 1 || h.LastUpdate == nil || !h.LastUpdate.Equal(now.Add(-time.Second)) || !reflect.DeepEqual(h.Plugins, []string{"memory"}) {
+		t.Errorf("got host %+v", h)
+	}
+	if h := hosts[1]; h.Name != "b.example.com" || h.Series != 2 || !reflect.DeepEqual(h.Plugins, []string{"load"}) {
+		t.Errorf("got host %+v", h)
+	}
+
+	want := []Series{{
+		Name:       "collectd_memory",
+		Labels:     prometheus.Labels{"instance": "a.example.com", "memory": "free"},
+		Identifier: "a.example.com/memory/memory-free",
+		Time:       now.Add(-time.Second),
+	}}
+	if got := c.ListSeries("a.example.com"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %+v, want %+v", got, want)
+	}
+	if got := c.ListSeries(""); len(got) != 3 {
+		t.Errorf("got %d series, want 3", len(got))
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	for _, vl := range []api.ValueList{
+		{Identifier: api.Identifier{Host: "a", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}, Values: []api.Value{api.Derive(1), api.Derive(2)}, DSNames: []string{"rx", "tx"}},
+		{Identifier: api.Identifier{Host: "b", Plugin: "interface", PluginInstance: "eth1", Type: "if_octets"}, Values: []api.Value{api.Derive(1), api.Derive(2)}, DSNames: []string{"rx", "tx"}},
+		{Identifier: api.Identifier{Host: "a", Plugin: "load", Type: "load"}, Values: []api.Value{api.Gauge(1)}},
+	} {
+		vl.Time = time.Now()
+		vl.Interval = 10 * time.Second
+		c.Ingest(&vl)
+	}
+
+	md := c.Metadata("")
+	if len(md) != 3 {
+		t.Errorf("got metadata of %d metrics, want 3", len(md))
+	}
+	want := map[string][]Metadata{
+		"collectd_interface_if_octets_rx_total": {{
+			Type:         "counter",
+			Help:         "Collectd exporter: 'interface' Type: 'if_octets' Dstype: 'api.Derive' Dsname: 'rx'",
+			Plugin:       "interface",
+			CollectdType: "if_octets",
+		}},
+	}
+	if got := c.Metadata("collectd_interface_if_octets_rx_total"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got metadata %+v, want %+v", got, want)
+	}
+	if got := c.Metadata("collectd_load")["collectd_load"]; len(got) != 1 || got[0].Type != "gauge" {
+		t.Errorf("got metadata %+v", got)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Approximate sizes in bytes of the parts of cached value lists, on 64-bit
+// platforms.
+const (
+	// entryOverhead covers the map entries of a value list in the cache,
+	// its conversion and the fixed fields of both.
+	entryOverhead = 512
+	// stringOverhead is the size of a string header.
+	stringOverhead = 16
+	// valueOverhead is the size of an api.Value interface and its data.
+	valueOverhead = 24
+	// seriesOverhead is the size of a convertedSeries and its description.
+	seriesOverhead = 256
+)
+
+// evictionTarget is the fraction of Options.MaxMemoryBytes the cache is
+// reduced to once it exceeds the limit, so that eviction does not run on
+// every received value list.
+const evictionTarget = 0.9
+
+// memory tracks the approximate memory consumed by the cached value lists,
+// by identifier and by host.
+type memory struct {
+	sizes map[string]int
+	hosts map[string]int
+	total int
+
+	totalDesc *prometheus.Desc
+	hostDesc  *prometheus.Desc
+	evicted   prometheus.Counter
+}
+
+func newMemory() *memory {
+	return &memory{
+		sizes: map[string]int{},
+		hosts: map[string]int{},
+		totalDesc: prometheus.NewDesc(
+			"collectd_exporter_cache_memory_bytes",
+			"Approximate memory consumed by the cached value lists and their conversions in bytes.",
+			nil, nil,
+		),
+		hostDesc: prometheus.NewDesc(
+			"collectd_exporter_host_cache_memory_bytes",
+			"Approximate memory consumed by the cached value lists of a host and their conversions in bytes.",
+			[]string{"instance"}, nil,
+		),
+		evicted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_evicted_value_lists_total",
+				Help: "Number of cached value lists evicted to stay within the memory limit.",
+			},
+		),
+	}
+}
+
+// set accounts size bytes to the value list vl with the given ID, replacing
+// its previous size. c.mu must be held.
+func (m *memory) set(id string, vl api.ValueList, size int) {
+	m.remove(id, vl)
+	m.sizes[id] = size
+	m.hosts[vl.Host] += size
+	m.total += size
+}
+
+// remove stops accounting the value list vl with the given ID. c.mu must be
+// held.
+func (m *memory) remove(id string, vl api.ValueList) {
+	size, ok := m.sizes[id]
+	if !ok {
+		return
+	}
+	delete(m.sizes, id)
+	m.total -= size
+	if m.hosts[vl.Host] -= size; m.hosts[vl.Host] <= 0 {
+		delete(m.hosts, vl.Host)
+	}
+}
+
+// valueListSize returns the approximate memory consumed by the cached value
+// list vl with the given ID and its conversion.
+func valueListSize(id string, vl api.ValueList, conv *conversion) int {
+	size := entryOverhead + stringSize(id) +
+		stringSize(vl.Host) + stringSize(vl.Plugin) + stringSize(vl.PluginInstance) +
+		stringSize(vl.Type) + stringSize(vl.TypeInstance) +
+		len(vl.Values)*valueOverhead
+	for _, name := range vl.DSNames {
+		size += stringSize(name)
+	}
+	if conv == nil {
+		return size
+	}
+	for name, value := range conv.labels {
+		size += stringSize(name) + stringSize(value)
+	}
+	for _, s := range conv.series {
+		// The key contains the name and labels of the series.
+		size += seriesOverhead + stringSize(s.help) + stringSize(s.key)
+	}
+	return size
+}
+
+func stringSize(s string) int {
+	return stringOverhead + len(s)
+}
+
+// evict removes the value lists least recently updated by collectd until the
+// cache consumes less than evictionTarget of max bytes, if it exceeds max. It
+// must only be called from Run().
+func (c *Collector) evict(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.memory.total <= max {
+		return
+	}
+
+	ids := make([]string, 0, len(c.valueLists))
+	for id := range c.valueLists {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		return cmp.Or(c.valueLists[a].Time.Compare(c.valueLists[b].Time), cmp.Compare(a, b))
+	})
+	target := int(float64(max) * evictionTarget)
+	for _, id := range ids {
+		if c.memory.total <= target {
+			break
+		}
+		c.remove(id, c.valueLists[id])
+		c.memory.evicted.Inc()
+	}
+}
+
+// collectMemory sends the memory consumed by the cache, in total and by host,
+// and the number of evicted value lists to ch.
+func (c *Collector) collectMemory(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	total := c.memory.total
+	hosts := maps.Clone(c.memory.hosts)
+	c.mu.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.memory.totalDesc, prometheus.GaugeValue, float64(total))
+	for host, size := range hosts {
+		m, err := prometheus.NewConstMetric(c.memory.hostDesc, prometheus.GaugeValue, float64(size), host)
+		if err != nil {
+			c.logger.Error("Error creating host metric", "instance", host, "err", err)
+			continue
+		}
+		ch <- m
+	}
+	ch <- c.memory.evicted
+}
+
+// describe sends the descriptions of the metrics of m to ch.
+func (m *memory) describe(ch chan<- *prometheus.Desc) {
+	ch <- m.totalDesc
+	ch <- m.hostDesc
+	ch <- m.evicted.Desc()
+}
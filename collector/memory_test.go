@@ -0,0 +1,68 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Now()
+	vl := func(host string, age time.Duration) *api.ValueList {
+		return &api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "load"},
+			Time:       now.Add(-age),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1), api.Gauge(1), api.Gauge(1)},
+			DSNames:    []string{"shortterm", "midterm", "longterm"},
+		}
+	}
+
+	c := newTestCollector(t, Options{})
+	c.Ingest(vl("a.example.com", 0))
+	c.Ingest(vl("b.example.com", 0))
+	size := c.memory.sizes["a.example.com/load/load"]
+	if size <= entryOverhead || c.memory.total != 2*size || c.memory.hosts["b.example.com"] != size {
+		t.Fatalf("got size %d, total %d, hosts %v", size, c.memory.total, c.memory.hosts)
+	}
+	// Updates replace the previous size.
+	c.Ingest(vl("a.example.com", 0))
+	if c.memory.total != 2*size {
+		t.Errorf("got total %d after update, want %d", c.memory.total, 2*size)
+	}
+	c.mu.Lock()
+	c.remove("a.example.com/load/load", c.valueLists["a.example.com/load/load"])
+	c.mu.Unlock()
+	if _, ok := c.memory.hosts["a.example.com"]; ok || c.memory.total != size {
+		t.Errorf("got total %d, hosts %v after removal", c.memory.total, c.memory.hosts)
+	}
+
+	// Exceeding the limit evicts the value lists least recently updated,
+	// until the cache is below 90% of it.
+	c = newTestCollector(t, Options{MaxMemoryBytes: 3*size + size/4})
+	for i, host := range []string{"c.example.com", "a.example.com", "b.example.com"} {
+		c.Ingest(vl(host, time.Duration(3-i)*time.Minute))
+	}
+	c.Ingest(vl("d.example.com", 0))
+	if len(c.valueLists) != 2 || c.valueLists["b.example.com/load/load"].Host == "" || c.valueLists["d.example.com/load/load"].Host == "" {
+		t.Errorf("got value lists %v, want b and d", c.valueLists)
+	}
+	if got := testutil.ToFloat64(c.memory.evicted); got != 2 {
+		t.Errorf("got %v evicted value lists, want 2", got)
+	}
+}
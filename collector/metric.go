@@ -0,0 +1,344 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/collectd_exporter/source"
+)
+
+var metric_name_re = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// newName converts one data source of a value list to a string representation
+// prefixed with namespace.
+func newName(namespace string, vl api.ValueList, index int) string {
+	return seriesName(namespace, vl, index, true)
+}
+
+// seriesName is newName, except that the data source name is only appended
+// if withDS is set.
+func seriesName(namespace string, vl api.ValueList, index int, withDS bool) string {
+	if pushed(vl) {
+		return metric_name_re.ReplaceAllString(vl.Type, "_")
+	}
+	var name string
+	if vl.Plugin == vl.Type {
+		name = namespace + "_" + vl.Type
+	} else {
+		name = namespace + "_" + vl.Plugin + "_" + vl.Type
+	}
+	if dsname := vl.DSName(index); withDS && dsname != "value" {
+		name += "_" + dsname
+	}
+	switch vl.Values[index].(type) {
+	case api.Counter, api.Derive:
+		name += "_total"
+	}
+
+	return metric_name_re.ReplaceAllString(name, "_")
+}
+
+// newLabels converts the plugin and type instance of vl to a set of
+// prometheus.Labels. The plugin instance is exported as a label named after
+// the plugin, which policy renames if that name is used by another label.
+// The label set formatted by source.FormatLabelSet in the type instance of
+// series pushed in a Prometheus format is exported as those labels instead.
+func newLabels(vl api.ValueList, policy CollisionPolicy) prometheus.Labels {
+	if set, ok := labelSet(vl); ok {
+		labels := prometheus.Labels{}
+		for name, value := range set {
+			if name != "instance" && !strings.HasPrefix(name, "__") {
+				labels[name] = value
+			}
+		}
+		labels["instance"] = vl.Host
+		return labels
+	}
+	pluginInstance, typeInstance := instanceLabelNames(vl, policy)
+
+	labels := prometheus.Labels{}
+	if vl.PluginInstance != "" {
+		labels[pluginInstance] = vl.PluginInstance
+	}
+	if vl.TypeInstance != "" {
+		labels[typeInstance] = vl.TypeInstance
+	}
+	labels["instance"] = vl.Host
+
+	return labels
+}
+
+// labelSet returns the labels of vl if it was pushed in a Prometheus format.
+func labelSet(vl api.ValueList) (map[string]string, bool) {
+	if !pushed(vl) {
+		return nil, false
+	}
+	if vl.TypeInstance == "" {
+		return map[string]string{}, true
+	}
+	return source.ParseLabelSet(vl.TypeInstance)
+}
+
+// instanceLabelNames returns the names of the labels newLabels exports the
+// plugin and type instance of vl as.
+func instanceLabelNames(vl api.ValueList, policy CollisionPolicy) (pluginInstance, typeInstance string) {
+	pluginLabel := vl.Plugin
+	if reservedLabels[pluginLabel] {
+		switch policy {
+		case CollisionPrefix:
+			pluginLabel = "plugin_" + vl.Plugin
+		case CollisionPluginInstance:
+			pluginLabel = "plugin_instance"
+		}
+	}
+	if vl.PluginInstance == "" {
+		return pluginLabel, pluginLabel
+	}
+	return pluginLabel, "type"
+}
+
+// reservedLabels are the label names newLabels uses regardless of the plugin.
+var reservedLabels = map[string]bool{"instance": true, "type": true}
+
+// labelsCollide returns whether the label named after the plugin of vl would
+// override or be overridden by another label converted from vl.
+func labelsCollide(vl api.ValueList) bool {
+	if vl.PluginInstance == "" && vl.TypeInstance == "" {
+		return false
+	}
+	switch vl.Plugin {
+	case "instance":
+		return true
+	case "type":
+		return vl.PluginInstance != "" && vl.TypeInstance != ""
+	}
+	return false
+}
+
+// typeUnits maps collectd types to the unit of their values, for the HELP
+// text of data sources without a unit in their mapping.
+var typeUnits = map[string]string{
+	"bytes":          "bytes",
+	"df_complex":     "bytes",
+	"disk_octets":    "bytes",
+	"if_octets":      "bytes",
+	"io_octets":      "bytes",
+	"memory":         "bytes",
+	"swap":           "bytes",
+	"total_bytes":    "bytes",
+	"disk_time":      "milliseconds",
+	"disk_io_time":   "milliseconds",
+	"ping":           "milliseconds",
+	"delay":          "seconds",
+	"duration":       "seconds",
+	"response_time":  "seconds",
+	"timeleft":       "seconds",
+	"uptime":         "seconds",
+	"percent":        "percent",
+	"percent_bytes":  "percent",
+	"percent_inodes": "percent",
+	"humidity":       "percent",
+	"temperature":    "degrees Celsius",
+	"frequency":      "hertz",
+	"voltage":        "volts",
+	"current":        "amperes",
+	"power":          "watts",
+	"fanspeed":       "revolutions per minute",
+}
+
+// dsUnits maps data source names to the unit they imply, for types missing
+// from typeUnits.
+var dsUnits = map[string]string{
+	"bytes":   "bytes",
+	"octets":  "bytes",
+	"seconds": "seconds",
+	"percent": "percent",
+}
+
+// newHelp returns the HELP text for one data source of a value list. A help
+// text from the mapping configuration takes precedence. Otherwise, if the
+// type is in types.db, the text describes the data source with its type,
+// unit and range, e.g. "'df' plugin, type 'df_complex', data source 'value':
+// gauge in bytes, at least 0." The unit is that of the mapping, if it sets
+// one, or implied by the type or data source name. Without a types.db entry,
+// a generic text naming the collectd identifier is returned.
+func newHelp(vl api.ValueList, index int, cfg *Config, typesDB *api.TypesDB) string {
+	m := cfg.mapping(vl, index)
+	if m != nil && m.Help != "" {
+		return m.Help
+	}
+
+	var src *api.DataSource
+	if typesDB != nil {
+		if ds, ok := typesDB.DataSet(vl.Type); ok && index < len(ds.Sources) {
+			src = &ds.Sources[index]
+		}
+	}
+	if src == nil {
+		return fmt.Sprintf("Collectd exporter: '%s' Type: '%s' Dstype: '%T' Dsname: '%s'",
+			vl.Plugin, vl.Type, vl.Values[index], vl.DSName(index))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "'%s' plugin, type '%s', data source '%s': %s", vl.Plugin, vl.Type, src.Name, dsTypeName(src.Type))
+	unit := typeUnits[vl.Type]
+	if unit == "" {
+		unit = dsUnits[src.Name]
+	}
+	if m != nil && m.Unit != "" {
+		unit = m.Unit
+	}
+	if unit != "" {
+		fmt.Fprintf(&b, " in %s", unit)
+	}
+	switch minSet, maxSet := !math.IsNaN(src.Min), !math.IsNaN(src.Max); {
+	case minSet && maxSet:
+		fmt.Fprintf(&b, ", between %s and %s", formatBound(src.Min), formatBound(src.Max))
+	case minSet:
+		fmt.Fprintf(&b, ", at least %s", formatBound(src.Min))
+	case maxSet:
+		fmt.Fprintf(&b, ", at most %s", formatBound(src.Max))
+	}
+	b.WriteByte('.')
+	return b.String()
+}
+
+// dsTypeName returns the name of a data source type as written in types.db,
+// in lower case, e.g. "derive" for api.Derive.
+func dsTypeName(t reflect.Type) string {
+	return strings.ToLower(t.Name())
+}
+
+// dsLabelHelp returns the HELP text shared by the series of all data sources
+// of vl if their names are exported as a label. It omits the data source
+// name and range, which may differ between them.
+func dsLabelHelp(vl api.ValueList, index int, cfg *Config) string {
+	if m := cfg.mapping(vl, index); m != nil && m.Help != "" {
+		return m.Help
+	}
+	return fmt.Sprintf("Collectd exporter: '%s' Type: '%s' Dstype: '%T'", vl.Plugin, vl.Type, vl.Values[index])
+}
+
+// formatBound formats a types.db minimum or maximum, using "U" for undefined
+// bounds as types.db does.
+func formatBound(f float64) string {
+	if math.IsNaN(f) {
+		return "U"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// newMetric converts one data source of a value list to a Prometheus metric
+// with the given description, multiplying its value by scale and adding
+// offset to gauges. Counters are given the created timestamp created, unless
+// it is zero.
+func newMetric(vl api.ValueList, index int, desc *prometheus.Desc, scale, offset float64, created time.Time) (prometheus.Metric, error) {
+	value, valueType, err := convertValueOf(vl, index)
+	if err != nil {
+		return nil, err
+	}
+	value *= scale
+	if valueType == prometheus.GaugeValue {
+		value += offset
+	}
+
+	if valueType == prometheus.CounterValue && !created.IsZero() {
+		return prometheus.NewConstMetricWithCreatedTimestamp(desc, valueType, value, created)
+	}
+	return prometheus.NewConstMetric(desc, valueType, value)
+}
+
+// counterCreated returns the created timestamps of the counters of vl, given
+// prev, the previous value list of the same identifier, and its created
+// timestamps. Counters are created when they are first received and when
+// they are reset. The timestamps of other data sources are zero.
+func counterCreated(vl, prev api.ValueList, prevCreated []time.Time) []time.Time {
+	created := make([]time.Time, len(vl.Values))
+	for i := range vl.Values {
+		value, valueType, err := convertValueOf(vl, i)
+		if err != nil || valueType != prometheus.CounterValue {
+			continue
+		}
+		created[i] = vl.Time
+		if len(prev.Values) != len(vl.Values) || len(prevCreated) != len(vl.Values) || prevCreated[i].IsZero() {
+			continue
+		}
+		if p, _, err := convertValue(prev.Values[i]); err == nil && value >= p {
+			created[i] = prevCreated[i]
+		}
+	}
+	return created
+}
+
+// withExemplar attaches an exemplar identifying the originating host and time
+// to m if it is a counter. The value is multiplied by scale as in newMetric.
+// m is returned unchanged otherwise.
+func withExemplar(m prometheus.Metric, vl api.ValueList, index int, scale float64) prometheus.Metric {
+	value, valueType, err := convertValueOf(vl, index)
+	if err != nil || valueType != prometheus.CounterValue {
+		return m
+	}
+
+	em, err := prometheus.NewMetricWithExemplars(m, prometheus.Exemplar{
+		Value:     value * scale,
+		Labels:    prometheus.Labels{"host": vl.Host},
+		Timestamp: vl.Time,
+	})
+	if err != nil {
+		// The exemplar is invalid, e.g. because the host name is too long.
+		return m
+	}
+	return em
+}
+
+// convertValueOf returns the numeric value and Prometheus value type of one
+// data source of vl. Unlike convertValue, it takes the metric type of pushed
+// series into account.
+func convertValueOf(vl api.ValueList, index int) (float64, prometheus.ValueType, error) {
+	value, valueType, err := convertValue(vl.Values[index])
+	if err != nil || !pushed(vl) {
+		return value, valueType, err
+	}
+	switch metricType(vl) {
+	case source.PrometheusCounter:
+		valueType = prometheus.CounterValue
+	case source.PrometheusUntyped:
+		valueType = prometheus.UntypedValue
+	}
+	return value, valueType, nil
+}
+
+// convertValue returns the numeric value and Prometheus value type of v.
+func convertValue(v api.Value) (float64, prometheus.ValueType, error) {
+	switch v := v.(type) {
+	case api.Gauge:
+		return float64(v), prometheus.GaugeValue, nil
+	case api.Derive:
+		return float64(v), prometheus.CounterValue, nil
+	case api.Counter:
+		return float64(v), prometheus.CounterValue, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown value type: %T", v)
+	}
+}
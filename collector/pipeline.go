@@ -0,0 +1,583 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the built-in pipeline stages.
+const (
+	StageFilter      = "filter"
+	StageLabelLimits = "label_limits"
+	StageCounterWrap = "counter_wrap"
+	StageDerive      = "derive"
+	StageRates       = "rates"
+	StageBounds      = "bounds"
+	StageDebounce    = "debounce"
+	StageDownsample  = "downsample"
+)
+
+// DefaultPipeline is the order in which value lists pass the built-in stages.
+var DefaultPipeline = []string{StageFilter, StageLabelLimits, StageDownsample, StageCounterWrap, StageDerive, StageRates, StageBounds, StageDebounce}
+
+// Stage is a step of the pipeline received value lists pass through before
+// they are cached and converted. Stages are only called from a single
+// goroutine and need no locking.
+type Stage interface {
+	// Process may modify vl. Values must not be changed in place, as the
+	// slice may be shared with the sender; replace it instead. vl is
+	// reused once processed and must not be retained. Process returns
+	// false to drop vl.
+	Process(vl *api.ValueList) bool
+}
+
+// StageFunc adapts a function to the Stage interface.
+type StageFunc func(vl *api.ValueList) bool
+
+// Process implements Stage.
+func (f StageFunc) Process(vl *api.ValueList) bool {
+	return f(vl)
+}
+
+// Expirer is implemented by stages keeping state per value list. Expire is
+// called when the value list with the given identifier expires from the
+// cache, from the same goroutine as Process.
+type Expirer interface {
+	Expire(id api.Identifier)
+}
+
+// pipeline runs value lists through a sequence of stages.
+type pipeline struct {
+	names  []string
+	stages []Stage
+
+	dropped  *prometheus.CounterVec
+	duration *prometheus.CounterVec
+}
+
+// newPipeline builds the pipeline configured by opts. Built-in stages that
+// are disabled by opts are skipped.
+func newPipeline(opts Options, builtin map[string]Stage) (*pipeline, error) {
+	names := opts.Pipeline
+	if names == nil {
+		names = DefaultPipeline
+	}
+
+	p := &pipeline{
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_pipeline_dropped_value_lists_total",
+				Help: "Number of value lists dropped, by pipeline stage.",
+			},
+			[]string{"stage"},
+		),
+		duration: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_pipeline_stage_seconds_total",
+				Help: "Time spent processing value lists, by pipeline stage.",
+			},
+			[]string{"stage"},
+		),
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("pipeline stage %q listed twice", name)
+		}
+		seen[name] = true
+
+		s, ok := opts.Stages[name]
+		if !ok {
+			s, ok = builtin[name]
+		}
+		if !ok {
+			if _, known := builtinStages[name]; !known {
+				return nil, fmt.Errorf("unknown pipeline stage %q", name)
+			}
+			continue
+		}
+
+		p.names = append(p.names, name)
+		p.stages = append(p.stages, s)
+		p.dropped.WithLabelValues(name)
+		p.duration.WithLabelValues(name)
+	}
+
+	return p, nil
+}
+
+// builtinStages lists the names of the built-in stages, which may be
+// disabled.
+var builtinStages = map[string]struct{}{
+	StageFilter:      {},
+	StageLabelLimits: {},
+	StageCounterWrap: {},
+	StageDerive:      {},
+	StageRates:       {},
+	StageBounds:      {},
+	StageDebounce:    {},
+	StageDownsample:  {},
+}
+
+// process runs vl through all stages. It returns false if a stage dropped
+// vl.
+func (p *pipeline) process(vl *api.ValueList) bool {
+	for i, s := range p.stages {
+		start := time.Now()
+		keep := s.Process(vl)
+		p.duration.WithLabelValues(p.names[i]).Add(time.Since(start).Seconds())
+		if !keep {
+			p.dropped.WithLabelValues(p.names[i]).Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// expire notifies all stages keeping state that id expired.
+func (p *pipeline) expire(id api.Identifier) {
+	for _, s := range p.stages {
+		if e, ok := s.(Expirer); ok {
+			e.Expire(id)
+		}
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (p *pipeline) Collect(ch chan<- prometheus.Metric) {
+	p.dropped.Collect(ch)
+	p.duration.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (p *pipeline) Describe(ch chan<- *prometheus.Desc) {
+	p.dropped.Describe(ch)
+	p.duration.Describe(ch)
+}
+
+// filterStage drops value lists rejected by a Filter.
+type filterStage struct {
+	filter   Filter
+	filtered prometheus.Counter
+}
+
+// Process implements Stage.
+func (s filterStage) Process(vl *api.ValueList) bool {
+	if !s.filter.accepts(vl) {
+		s.filtered.Inc()
+		return false
+	}
+	return true
+}
+
+// labelLimitStage shortens plugin and type instances longer than max bytes,
+// which are converted to label values, or drops their value lists.
+type labelLimitStage struct {
+	max       int
+	policy    LabelLimitPolicy
+	truncated *prometheus.CounterVec
+}
+
+// Process implements Stage.
+func (s labelLimitStage) Process(vl *api.ValueList) bool {
+	// The type instance of pushed series holds their labels, which must
+	// remain parseable.
+	if pushed(*vl) {
+		return true
+	}
+	for _, instance := range []*string{&vl.PluginInstance, &vl.TypeInstance} {
+		if len(*instance) <= s.max {
+			continue
+		}
+		s.truncated.WithLabelValues(string(s.policy)).Inc()
+		switch s.policy {
+		case LabelLimitDrop:
+			return false
+		case LabelLimitHash:
+			h := fnv.New64a()
+			h.Write([]byte(*instance))
+			*instance = fmt.Sprintf("%016x", h.Sum64())
+		default:
+			*instance = truncate(*instance, s.max)
+		}
+	}
+	return true
+}
+
+// truncate returns the longest prefix of s of at most n bytes that does not
+// end within a UTF-8 sequence.
+func truncate(s string, n int) string {
+	s = s[:n]
+	for len(s) > 0 {
+		r, size := utf8.DecodeLastRuneInString(s)
+		if r != utf8.RuneError || size != 1 {
+			break
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// counterState tracks a single COUNTER data source across updates in order to
+// detect 32-bit wrap-arounds.
+type counterState struct {
+	seen   bool
+	last   api.Counter
+	offset api.Counter
+}
+
+// correct returns v with all wrap-arounds seen so far added to it. A wrap is
+// assumed when a value that fits into 32 bits drops by more than half of the
+// 32-bit range; smaller drops are passed through as counter resets.
+func (s *counterState) correct(v api.Counter) api.Counter {
+	if s.seen && v < s.last && s.last <= math.MaxUint32 && s.last-v > math.MaxUint32/2 {
+		s.offset += math.MaxUint32 + 1
+	}
+	s.seen = true
+	s.last = v
+
+	return v + s.offset
+}
+
+// wrapStage replaces COUNTER values with their wrap-corrected equivalents.
+type wrapStage struct {
+	counters map[api.Identifier][]counterState
+}
+
+// Process implements Stage.
+func (s *wrapStage) Process(vl *api.ValueList) bool {
+	states := s.counters[vl.Identifier]
+	if len(states) != len(vl.Values) {
+		states = make([]counterState, len(vl.Values))
+		s.counters[vl.Identifier] = states
+	}
+
+	values := make([]api.Value, len(vl.Values))
+	for i, v := range vl.Values {
+		if counter, ok := v.(api.Counter); ok {
+			v = states[i].correct(counter)
+		}
+		values[i] = v
+	}
+	vl.Values = values
+	return true
+}
+
+// Expire implements Expirer.
+func (s *wrapStage) Expire(id api.Identifier) {
+	delete(s.counters, id)
+}
+
+// previousValues holds the values of the last update of a value list, as
+// needed to compute rates.
+type previousValues struct {
+	time   time.Time
+	values []api.Value
+}
+
+// history remembers the previous values of value lists.
+type history map[api.Identifier]previousValues
+
+// swap stores the values of vl and returns the previously stored values, if
+// they are usable for computing rates.
+func (h history) swap(vl *api.ValueList) (previousValues, bool) {
+	prev, ok := h[vl.Identifier]
+	h[vl.Identifier] = previousValues{time: vl.Time, values: vl.Values}
+	return prev, ok && len(prev.values) == len(vl.Values)
+}
+
+// rate returns the per-second rate between the DERIVE or COUNTER values prev
+// and cur, which were recorded d apart. NaN is returned if no rate can be
+// computed, e.g. because a COUNTER was reset.
+func rate(prev, cur api.Value, d time.Duration) float64 {
+	if d <= 0 {
+		return math.NaN()
+	}
+
+	switch cur := cur.(type) {
+	case api.Derive:
+		if p, ok := prev.(api.Derive); ok {
+			return float64(cur-p) / d.Seconds()
+		}
+	case api.Counter:
+		if p, ok := prev.(api.Counter); ok && cur >= p {
+			return float64(cur-p) / d.Seconds()
+		}
+	}
+
+	return math.NaN()
+}
+
+// deriveState tracks a single DERIVE data source across updates in order to
+// detect decreases.
+type deriveState struct {
+	seen bool
+	last api.Derive
+	// value is the exported value in the clamp mode.
+	value api.Derive
+}
+
+// deriveStage converts the DERIVE data sources matching a derive rule as set
+// by its mode, and counts their decreases, which counters must not have.
+// Running it before the rates stage computes rates from the clamped values.
+type deriveStage struct {
+	config    *Config
+	states    map[api.Identifier][]deriveState
+	decreases *prometheus.CounterVec
+}
+
+// Process implements Stage.
+func (s *deriveStage) Process(vl *api.ValueList) bool {
+	var values []api.Value
+	for i, v := range vl.Values {
+		d, ok := v.(api.Derive)
+		if !ok {
+			continue
+		}
+		r := s.config.derive(*vl, i)
+		if r == nil {
+			continue
+		}
+
+		states := s.states[vl.Identifier]
+		if len(states) != len(vl.Values) {
+			states = make([]deriveState, len(vl.Values))
+			s.states[vl.Identifier] = states
+		}
+		st := &states[i]
+		delta := d - st.last
+		if !st.seen {
+			st.value, delta = d, 0
+		}
+		if delta < 0 {
+			s.decreases.WithLabelValues(vl.Type, string(r.Mode)).Inc()
+			delta = 0
+		}
+		st.seen, st.last = true, d
+		st.value += delta
+
+		if r.Mode == deriveCounter {
+			continue
+		}
+		if values == nil {
+			values = make([]api.Value, len(vl.Values))
+			copy(values, vl.Values)
+		}
+		switch r.Mode {
+		case deriveGauge:
+			values[i] = api.Gauge(d)
+		case deriveClamp:
+			values[i] = st.value
+		}
+	}
+	if values != nil {
+		vl.Values = values
+	}
+	return true
+}
+
+// Expire implements Expirer.
+func (s *deriveStage) Expire(id api.Identifier) {
+	delete(s.states, id)
+}
+
+// rateStage replaces DERIVE and COUNTER values with per-second rates since
+// the previous update, exported as gauges. Values without a usable
+// predecessor are set to NaN, as collectd does.
+type rateStage struct {
+	previous history
+}
+
+// Process implements Stage.
+func (s *rateStage) Process(vl *api.ValueList) bool {
+	prev, hasPrev := s.previous.swap(vl)
+
+	values := make([]api.Value, len(vl.Values))
+	for i, v := range vl.Values {
+		if _, isGauge := v.(api.Gauge); isGauge {
+			values[i] = v
+			continue
+		}
+		if !hasPrev {
+			values[i] = api.Gauge(math.NaN())
+			continue
+		}
+		values[i] = api.Gauge(rate(prev.values[i], v, vl.Time.Sub(prev.time)))
+	}
+	vl.Values = values
+	return true
+}
+
+// Expire implements Expirer.
+func (s *rateStage) Expire(id api.Identifier) {
+	delete(s.previous, id)
+}
+
+// boundsStage validates values against the minimum and maximum declared in
+// types.db. As in collectd, the range of DERIVE and COUNTER data sources
+// applies to their rate. Out-of-range gauges are clamped if requested; in all
+// other cases the value list is dropped.
+type boundsStage struct {
+	typesDB     *api.TypesDB
+	policy      BoundsPolicy
+	previous    history
+	outOfBounds *prometheus.CounterVec
+}
+
+// Process implements Stage.
+func (s *boundsStage) Process(vl *api.ValueList) bool {
+	// The metric names of pushed series are not collectd types.
+	if pushed(*vl) {
+		return true
+	}
+	prev, hasPrev := s.previous.swap(vl)
+
+	ds, ok := s.typesDB.DataSet(vl.Type)
+	if !ok || len(ds.Sources) != len(vl.Values) {
+		return true
+	}
+
+	var values []api.Value
+	for i, v := range vl.Values {
+		var f float64
+		switch v := v.(type) {
+		case api.Gauge:
+			f = float64(v)
+		default:
+			if !hasPrev {
+				continue
+			}
+			f = rate(prev.values[i], v, vl.Time.Sub(prev.time))
+		}
+
+		src := ds.Sources[i]
+		clamped := f
+		if f < src.Min {
+			clamped = src.Min
+		} else if f > src.Max {
+			clamped = src.Max
+		}
+		if clamped == f || math.IsNaN(f) {
+			continue
+		}
+
+		if _, isGauge := v.(api.Gauge); !isGauge || s.policy == BoundsDrop {
+			s.outOfBounds.WithLabelValues(vl.Type, string(BoundsDrop)).Inc()
+			return false
+		}
+		if values == nil {
+			values = make([]api.Value, len(vl.Values))
+			copy(values, vl.Values)
+		}
+		values[i] = api.Gauge(clamped)
+		s.outOfBounds.WithLabelValues(vl.Type, string(BoundsClamp)).Inc()
+	}
+	if values != nil {
+		vl.Values = values
+	}
+
+	return true
+}
+
+// Expire implements Expirer.
+func (s *boundsStage) Expire(id api.Identifier) {
+	delete(s.previous, id)
+}
+
+// downsampleStage drops value lists matching a downsample rule that arrive
+// less than the rule's min_interval after the last value list it kept,
+// allowing for half an interval of jitter. The interval of kept value lists
+// is raised to min_interval, so that they expire accordingly. Running it
+// before the rates stage computes rates over the downsampled interval.
+type downsampleStage struct {
+	config *Config
+	kept   map[api.Identifier]time.Time
+}
+
+// Process implements Stage.
+func (s *downsampleStage) Process(vl *api.ValueList) bool {
+	r := s.config.downsample(*vl)
+	if r == nil {
+		return true
+	}
+
+	minInterval := time.Duration(r.MinInterval)
+	if last, ok := s.kept[vl.Identifier]; ok && vl.Time.Sub(last)+vl.Interval/2 < minInterval {
+		return false
+	}
+	s.kept[vl.Identifier] = vl.Time
+	vl.Interval = max(vl.Interval, minInterval)
+	return true
+}
+
+// Expire implements Expirer.
+func (s *downsampleStage) Expire(id api.Identifier) {
+	delete(s.kept, id)
+}
+
+// debounceStage drops value lists matching a debounce rule whose interval and
+// values equal those of the last value list it kept, unless that is older
+// than the rule's max_age. It runs last so that unchanged rates are dropped
+// as well.
+type debounceStage struct {
+	config *Config
+	kept   map[api.Identifier]api.ValueList
+}
+
+// Process implements Stage.
+func (s *debounceStage) Process(vl *api.ValueList) bool {
+	r := s.config.debounce(*vl)
+	if r == nil {
+		return true
+	}
+
+	prev, ok := s.kept[vl.Identifier]
+	if ok && vl.Time.Sub(prev.Time) < time.Duration(r.MaxAge) && vl.Interval == prev.Interval && sameValues(prev.Values, vl.Values) {
+		return false
+	}
+	s.kept[vl.Identifier] = api.ValueList{Time: vl.Time, Interval: vl.Interval, Values: vl.Values}
+	return true
+}
+
+// Expire implements Expirer.
+func (s *debounceStage) Expire(id api.Identifier) {
+	delete(s.kept, id)
+}
+
+// sameValues returns whether a and b hold the same values of the same data
+// source types. NaN gauges are considered equal.
+func sameValues(a, b []api.Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == b[i] {
+			continue
+		}
+		x, xok := a[i].(api.Gauge)
+		y, yok := b[i].(api.Gauge)
+		if !xok || !yok || !math.IsNaN(float64(x)) || !math.IsNaN(float64(y)) {
+			return false
+		}
+	}
+	return true
+}
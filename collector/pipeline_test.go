@@ -0,0 +1,323 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// expiringStage records the identifiers it was told expired.
+type expiringStage struct {
+	expired []api.Identifier
+}
+
+func (s *expiringStage) Process(*api.ValueList) bool { return true }
+
+func (s *expiringStage) Expire(id api.Identifier) {
+	s.expired = append(s.expired, id)
+}
+
+func TestPipeline(t *testing.T) {
+	var order []string
+	record := func(name string) Stage {
+		return StageFunc(func(*api.ValueList) bool {
+			order = append(order, name)
+			return true
+		})
+	}
+	expiring := &expiringStage{}
+
+	filter, err := NewMatcher("", "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPipeline(Options{
+		// counter_wrap is disabled and skipped.
+		Pipeline: []string{"second", StageFilter, "first", StageCounterWrap, "expiring"},
+		Stages: map[string]Stage{
+			"first":    record("first"),
+			"second":   record("second"),
+			"expiring": expiring,
+		},
+	}, map[string]Stage{
+		StageFilter: filterStage{filter: Filter{Plugins: filter}, filtered: prometheus.NewCounter(prometheus.CounterOpts{Name: "filtered"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.process(&api.ValueList{Identifier: api.Identifier{Plugin: "cpu"}}) {
+		t.Error("value list dropped")
+	}
+	if p.process(&api.ValueList{Identifier: api.Identifier{Plugin: "ignored"}}) {
+		t.Error("filtered value list kept")
+	}
+	if want := []string{"second", "first", "second"}; strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Errorf("got stage order %v, want %v", order, want)
+	}
+
+	id := api.Identifier{Plugin: "cpu"}
+	p.expire(id)
+	if len(expiring.expired) != 1 || expiring.expired[0] != id {
+		t.Errorf("got expired identifiers %v, want [%v]", expiring.expired, id)
+	}
+
+	want := `
+# HELP collectd_exporter_pipeline_dropped_value_lists_total Number of value lists dropped, by pipeline stage.
+# TYPE collectd_exporter_pipeline_dropped_value_lists_total counter
+collectd_exporter_pipeline_dropped_value_lists_total{stage="expiring"} 0
+collectd_exporter_pipeline_dropped_value_lists_total{stage="filter"} 1
+collectd_exporter_pipeline_dropped_value_lists_total{stage="first"} 0
+collectd_exporter_pipeline_dropped_value_lists_total{stage="second"} 0
+`
+	if err := testutil.CollectAndCompare(p.dropped, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	for _, names := range [][]string{{"unknown"}, {StageFilter, StageFilter}} {
+		if _, err := newPipeline(Options{Pipeline: names}, nil); err == nil {
+			t.Errorf("pipeline %v: expected an error", names)
+		}
+	}
+}
+
+func TestRateStage(t *testing.T) {
+	s := &rateStage{previous: history{}}
+	now := time.Now()
+	id := api.Identifier{Plugin: "interface", Type: "if_octets"}
+
+	vl := &api.ValueList{Identifier: id, Time: now, Values: []api.Value{api.Derive(100), api.Gauge(1)}}
+	s.Process(vl)
+	if r := vl.Values[0].(api.Gauge); !math.IsNaN(float64(r)) {
+		t.Errorf("got rate %v without predecessor, want NaN", r)
+	}
+
+	vl = &api.ValueList{Identifier: id, Time: now.Add(10 * time.Second), Values: []api.Value{api.Derive(200), api.Gauge(2)}}
+	s.Process(vl)
+	if vl.Values[0] != api.Gauge(10) || vl.Values[1] != api.Gauge(2) {
+		t.Errorf("got values %v, want [10 2]", vl.Values)
+	}
+
+	s.Expire(id)
+	if len(s.previous) != 0 {
+		t.Errorf("previous values not expired: %v", s.previous)
+	}
+}
+
+func TestDownsampleStage(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+downsample:
+  - plugin: cpu
+    min_interval: 10s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &downsampleStage{config: cfg, kept: map[api.Identifier]time.Time{}}
+	now := time.Now()
+	cpu := api.Identifier{Plugin: "cpu", Type: "percent"}
+
+	var kept []time.Duration
+	for i := range 25 {
+		offset := time.Duration(i) * time.Second
+		vl := &api.ValueList{Identifier: cpu, Time: now.Add(offset), Interval: time.Second}
+		if s.Process(vl) {
+			kept = append(kept, offset)
+			if vl.Interval != 10*time.Second {
+				t.Errorf("got interval %v, want 10s", vl.Interval)
+			}
+		}
+	}
+	if want := []time.Duration{0, 10 * time.Second, 20 * time.Second}; !slices.Equal(kept, want) {
+		t.Errorf("kept value lists at %v, want %v", kept, want)
+	}
+
+	// Jitter of less than half an interval is tolerated.
+	vl := &api.ValueList{Identifier: cpu, Time: now.Add(29 * time.Second), Interval: 10 * time.Second}
+	if !s.Process(vl) {
+		t.Error("value list with jitter dropped")
+	}
+
+	load := &api.ValueList{Identifier: api.Identifier{Plugin: "load", Type: "load"}, Time: now, Interval: time.Second}
+	if !s.Process(load) || !s.Process(load) || load.Interval != time.Second {
+		t.Error("value list not matching any rule downsampled")
+	}
+
+	s.Expire(cpu)
+	if len(s.kept) != 0 {
+		t.Errorf("kept value lists not expired: %v", s.kept)
+	}
+}
+
+func TestDeriveStage(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+derive:
+  - type: if_octets
+    data_source: rx
+    mode: clamp
+  - type: if_octets
+    mode: gauge
+  - mode: counter
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &deriveStage{
+		config:    cfg,
+		states:    map[api.Identifier][]deriveState{},
+		decreases: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "decreases"}, []string{"type", "mode"}),
+	}
+	id := api.Identifier{Plugin: "interface", Type: "if_octets"}
+
+	var got [][]api.Value
+	for _, v := range []api.Derive{100, 150, 120, 130, 200} {
+		vl := &api.ValueList{Identifier: id, DSNames: []string{"rx", "tx"}, Values: []api.Value{v, v}}
+		s.Process(vl)
+		got = append(got, vl.Values)
+	}
+	want := [][]api.Value{
+		{api.Derive(100), api.Gauge(100)},
+		{api.Derive(150), api.Gauge(150)},
+		{api.Derive(150), api.Gauge(120)},
+		{api.Derive(160), api.Gauge(130)},
+		{api.Derive(230), api.Gauge(200)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+
+	other := &api.ValueList{Identifier: api.Identifier{Plugin: "tail", Type: "derive"}, Values: []api.Value{api.Derive(5)}}
+	s.Process(other)
+	other = &api.ValueList{Identifier: other.Identifier, Values: []api.Value{api.Derive(3)}}
+	if s.Process(other); other.Values[0] != api.Derive(3) {
+		t.Errorf("got value %v in the counter mode, want 3", other.Values[0])
+	}
+
+	for _, tc := range []struct {
+		typ, mode string
+		want      float64
+	}{
+		{"if_octets", "clamp", 1},
+		{"if_octets", "gauge", 1},
+		{"derive", "counter", 1},
+	} {
+		if got := testutil.ToFloat64(s.decreases.WithLabelValues(tc.typ, tc.mode)); got != tc.want {
+			t.Errorf("got %v decreases of %s in mode %s, want %v", got, tc.typ, tc.mode, tc.want)
+		}
+	}
+
+	s.Expire(id)
+	if _, ok := s.states[id]; ok {
+		t.Error("state not expired")
+	}
+
+	for _, invalid := range []string{
+		"derive:\n  - plugin: interface\n",
+		"derive:\n  - mode: rate\n",
+	} {
+		if _, err := ParseConfig([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestDebounceStage(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+debounce:
+  - plugin: df
+    max_age: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &debounceStage{config: cfg, kept: map[api.Identifier]api.ValueList{}}
+	now := time.Now()
+	df := api.Identifier{Plugin: "df", Type: "df_complex", TypeInstance: "used"}
+
+	cases := []struct {
+		id     api.Identifier
+		offset time.Duration
+		value  api.Value
+		keep   bool
+	}{
+		{df, 0, api.Gauge(1), true},
+		{df, 10 * time.Second, api.Gauge(1), false},
+		{df, 20 * time.Second, api.Gauge(2), true},
+		{df, 30 * time.Second, api.Derive(2), true},
+		{df, 40 * time.Second, api.Derive(2), false},
+		{df, 90 * time.Second, api.Derive(2), true},
+		{api.Identifier{Plugin: "load", Type: "load"}, 0, api.Gauge(1), true},
+		{api.Identifier{Plugin: "load", Type: "load"}, 10 * time.Second, api.Gauge(1), true},
+	}
+	for _, tc := range cases {
+		vl := &api.ValueList{Identifier: tc.id, Time: now.Add(tc.offset), Interval: 10 * time.Second, Values: []api.Value{tc.value}}
+		if keep := s.Process(vl); keep != tc.keep {
+			t.Errorf("%v at %v: got keep %v, want %v", tc.value, tc.offset, keep, tc.keep)
+		}
+	}
+
+	nan := &api.ValueList{Identifier: df, Time: now.Add(100 * time.Second), Interval: 10 * time.Second, Values: []api.Value{api.Gauge(math.NaN())}}
+	if !s.Process(nan) || s.Process(nan) {
+		t.Error("unchanged NaN not debounced")
+	}
+
+	s.Expire(df)
+	if len(s.kept) != 0 {
+		t.Errorf("kept value lists not expired: %v", s.kept)
+	}
+}
+
+func TestLabelLimitStage(t *testing.T) {
+	cases := []struct {
+		policy LabelLimitPolicy
+		in     string
+		want   string
+		keep   bool
+	}{
+		{LabelLimitTruncate, "short", "short", true},
+		{LabelLimitTruncate, "/var/lib/docker", "/var/lib/d", true},
+		{LabelLimitTruncate, "ääääää", "äääää", true},
+		{LabelLimitTruncate, "aääääää", "aääää", true},
+		{LabelLimitHash, "/var/lib/docker", "647d618ba1dcd1e8", true},
+		{LabelLimitDrop, "/var/lib/docker", "", false},
+	}
+	for _, tc := range cases {
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "long"}, []string{"action"})
+		s := labelLimitStage{max: 10, policy: tc.policy, truncated: counter}
+		vl := &api.ValueList{Identifier: api.Identifier{Plugin: "df", PluginInstance: "root", TypeInstance: tc.in}}
+		if keep := s.Process(vl); keep != tc.keep {
+			t.Errorf("%s %q: got keep %v", tc.policy, tc.in, keep)
+			continue
+		}
+		if tc.keep && (vl.TypeInstance != tc.want || vl.PluginInstance != "root") {
+			t.Errorf("%s %q: got %q, want %q", tc.policy, tc.in, vl.TypeInstance, tc.want)
+		}
+		want := 1.0
+		if len(tc.in) <= 10 {
+			want = 0
+		}
+		if got := testutil.ToFloat64(counter.WithLabelValues(string(tc.policy))); got != want {
+			t.Errorf("%s %q: got counter %v, want %v", tc.policy, tc.in, got, want)
+		}
+	}
+}
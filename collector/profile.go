@@ -0,0 +1,172 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Profile selects a built-in set of metric names and labels replacing the
+// default conversion of common plugins.
+type Profile string
+
+const (
+	// ProfileNone converts all value lists the default way.
+	ProfileNone Profile = "none"
+	// ProfileNode converts the value lists of the cpu, memory, df,
+	// interface, load and disk plugins to the metric names, labels and
+	// units of the node_exporter, so that its dashboards can be reused.
+	ProfileNode Profile = "node"
+)
+
+// profiles maps each Profile to its conversion function.
+var profiles = map[Profile]func(api.ValueList) (profiled, bool){
+	ProfileNone: func(api.ValueList) (profiled, bool) { return profiled{}, false },
+	ProfileNode: nodeProfile,
+}
+
+// profiled is the conversion of a value list given by a profile.
+type profiled struct {
+	// labels replace those converted from the identifier, except for the
+	// "instance" label holding the host.
+	labels prometheus.Labels
+	// names are the metric names of the data sources.
+	names []string
+	// scale converts the values to the unit of the metrics.
+	scale float64
+}
+
+// userHZ is the frequency of the jiffies the cpu plugin reports on Linux.
+const userHZ = 100
+
+// nodeProfile converts vl like the node_exporter names the equivalent
+// metric. Value lists it has no equivalent for, or whose data source types
+// do not match, e.g. because of --collector.store-rates, are not converted.
+func nodeProfile(vl api.ValueList) (profiled, bool) {
+	var p profiled
+	switch {
+	case vl.Plugin == "cpu" && vl.Type == "cpu" && vl.PluginInstance != "":
+		mode := vl.TypeInstance
+		switch mode {
+		case "wait":
+			mode = "iowait"
+		case "interrupt":
+			mode = "irq"
+		}
+		p = profiled{
+			labels: prometheus.Labels{"cpu": vl.PluginInstance, "mode": mode},
+			names:  []string{"node_cpu_seconds_total"},
+			scale:  1.0 / userHZ,
+		}
+
+	case vl.Plugin == "memory" && vl.Type == "memory":
+		field, ok := map[string]string{
+			"free":        "MemFree",
+			"buffered":    "Buffers",
+			"cached":      "Cached",
+			"slab_recl":   "SReclaimable",
+			"slab_unrecl": "SUnreclaim",
+		}[vl.TypeInstance]
+		if !ok {
+			return p, false
+		}
+		p = profiled{names: []string{"node_memory_" + field + "_bytes"}}
+
+	case vl.Plugin == "df" && vl.TypeInstance == "free" && (vl.Type == "df_complex" || vl.Type == "df_inodes"):
+		name := "node_filesystem_avail_bytes"
+		if vl.Type == "df_inodes" {
+			name = "node_filesystem_files_free"
+		}
+		p = profiled{
+			labels: prometheus.Labels{"mountpoint": mountpoint(vl.PluginInstance)},
+			names:  []string{name},
+		}
+
+	case vl.Plugin == "interface" && strings.HasPrefix(vl.Type, "if_"):
+		kind, ok := map[string]string{
+			"if_octets":  "bytes",
+			"if_packets": "packets",
+			"if_errors":  "errs",
+			"if_dropped": "drop",
+		}[vl.Type]
+		if !ok {
+			return p, false
+		}
+		p = profiled{
+			labels: prometheus.Labels{"device": vl.PluginInstance},
+			names:  dsNames(vl, map[string]string{"rx": "node_network_receive_" + kind + "_total", "tx": "node_network_transmit_" + kind + "_total"}),
+		}
+
+	case vl.Plugin == "load" && vl.Type == "load":
+		p = profiled{names: dsNames(vl, map[string]string{"shortterm": "node_load1", "midterm": "node_load5", "longterm": "node_load15"})}
+
+	case vl.Plugin == "disk":
+		p = profiled{labels: prometheus.Labels{"device": vl.PluginInstance}}
+		switch vl.Type {
+		case "disk_octets":
+			p.names = dsNames(vl, map[string]string{"read": "node_disk_read_bytes_total", "write": "node_disk_written_bytes_total"})
+		case "disk_ops":
+			p.names = dsNames(vl, map[string]string{"read": "node_disk_reads_completed_total", "write": "node_disk_writes_completed_total"})
+		case "disk_merged":
+			p.names = dsNames(vl, map[string]string{"read": "node_disk_reads_merged_total", "write": "node_disk_writes_merged_total"})
+		case "disk_io_time":
+			p.names = dsNames(vl, map[string]string{"io_time": "node_disk_io_time_seconds_total", "weighted_io_time": "node_disk_io_time_weighted_seconds_total"})
+			p.scale = 1.0 / 1000
+		}
+
+	default:
+		return p, false
+	}
+
+	if len(p.names) != len(vl.Values) {
+		return p, false
+	}
+	for i, name := range p.names {
+		_, valueType, err := convertValue(vl.Values[i])
+		if err != nil || strings.HasSuffix(name, "_total") != (valueType == prometheus.CounterValue) {
+			return p, false
+		}
+	}
+	if p.scale == 0 {
+		p.scale = 1
+	}
+	return p, true
+}
+
+// dsNames returns the names given by names for the data sources of vl, or
+// nil if any of them is missing.
+func dsNames(vl api.ValueList, names map[string]string) []string {
+	list := make([]string, len(vl.Values))
+	for i := range vl.Values {
+		name, ok := names[vl.DSName(i)]
+		if !ok {
+			return nil
+		}
+		list[i] = name
+	}
+	return list
+}
+
+// mountpoint reverts the plugin instance the df plugin reports for a file
+// system to its mount point, e.g. "root" to "/" and "var-lib" to "/var/lib".
+// Dashes in the original path cannot be told apart.
+func mountpoint(instance string) string {
+	if instance == "root" {
+		return "/"
+	}
+	return "/" + strings.ReplaceAll(instance, "-", "/")
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNodeProfile(t *testing.T) {
+	c := newTestCollector(t, Options{Profile: ProfileNode})
+	now := time.Now()
+	for _, vl := range []api.ValueList{
+		{Identifier: api.Identifier{Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "wait"}, Values: []api.Value{api.Derive(250)}},
+		{Identifier: api.Identifier{Plugin: "memory", Type: "memory", TypeInstance: "cached"}, Values: []api.Value{api.Gauge(1024)}},
+		{Identifier: api.Identifier{Plugin: "memory", Type: "memory", TypeInstance: "used"}, Values: []api.Value{api.Gauge(2048)}},
+		{Identifier: api.Identifier{Plugin: "df", PluginInstance: "var-lib", Type: "df_complex", TypeInstance: "free"}, Values: []api.Value{api.Gauge(4096)}},
+		{Identifier: api.Identifier{Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"}, Values: []api.Value{api.Derive(10), api.Derive(20)}, DSNames: []string{"rx", "tx"}},
+		{Identifier: api.Identifier{Plugin: "load", Type: "load"}, Values: []api.Value{api.Gauge(1), api.Gauge(0.5), api.Gauge(0.25)}, DSNames: []string{"shortterm", "midterm", "longterm"}},
+		{Identifier: api.Identifier{Plugin: "disk", PluginInstance: "sda", Type: "disk_io_time"}, Values: []api.Value{api.Derive(1500), api.Derive(3000)}, DSNames: []string{"io_time", "weighted_io_time"}},
+		// Rates cannot be exported as node_exporter counters.
+		{Identifier: api.Identifier{Plugin: "disk", PluginInstance: "sdb", Type: "disk_octets"}, Values: []api.Value{api.Gauge(1), api.Gauge(2)}, DSNames: []string{"read", "write"}},
+	} {
+		vl.Host = "example.com"
+		vl.Time = now
+		vl.Interval = 10 * time.Second
+		c.Ingest(&vl)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			value := m.GetGauge().GetValue()
+			if m.GetCounter() != nil {
+				value = m.GetCounter().GetValue()
+			}
+			got[fmt.Sprintf("%s{%s} %g", mf.GetName(), strings.Join(labels, ","), value)] = true
+		}
+	}
+
+	want := map[string]bool{
+		`node_cpu_seconds_total{cpu="0",instance="example.com",mode="iowait"} 2.5`:        true,
+		`node_memory_Cached_bytes{instance="example.com"} 1024`:                           true,
+		`collectd_memory{instance="example.com",memory="used"} 2048`:                      true,
+		`node_filesystem_avail_bytes{instance="example.com",mountpoint="/var/lib"} 4096`:  true,
+		`node_network_receive_bytes_total{device="eth0",instance="example.com"} 10`:       true,
+		`node_network_transmit_bytes_total{device="eth0",instance="example.com"} 20`:      true,
+		`node_load1{instance="example.com"} 1`:                                            true,
+		`node_load5{instance="example.com"} 0.5`:                                          true,
+		`node_load15{instance="example.com"} 0.25`:                                        true,
+		`node_disk_io_time_seconds_total{device="sda",instance="example.com"} 1.5`:        true,
+		`node_disk_io_time_weighted_seconds_total{device="sda",instance="example.com"} 3`: true,
+		`collectd_disk_disk_octets_read{disk="sdb",instance="example.com"} 1`:             true,
+		`collectd_disk_disk_octets_write{disk="sdb",instance="example.com"} 2`:            true,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("got series\n%s\nwant\n%s", sortedSeries(got), sortedSeries(want))
+	}
+
+	if _, err := New(nil, Options{Profile: "unknown"}); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestMountpoint(t *testing.T) {
+	for in, want := range map[string]string{"root": "/", "boot": "/boot", "var-lib": "/var/lib"} {
+		if got := mountpoint(in); got != want {
+			t.Errorf("mountpoint(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+// sortedSeries returns the series of set, one per line.
+func sortedSeries(set map[string]bool) string {
+	series := make([]string, 0, len(set))
+	for s := range set {
+		series = append(series, s)
+	}
+	slices.Sort(series)
+	return strings.Join(series, "\n")
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+
+	"collectd.org/api"
+	"collectd.org/meta"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricTypeMeta is the metadata key of cached value lists holding the metric
+// type of series pushed in a Prometheus format. ingest sets it from
+// source.Info.MetricType, replacing any metadata of the sender, so that
+// collectd value lists cannot pass for pushed series.
+const metricTypeMeta = "collectd_exporter:metric_type"
+
+// pushedHelp is the HELP text of series pushed in a Prometheus format.
+const pushedHelp = "Series pushed to the collectd exporter in a Prometheus format."
+
+// setMetricType marks vl as a pushed series of the given metric type, or as a
+// value list of collectd if it is empty.
+func setMetricType(vl *api.ValueList, typ string) {
+	vl.Meta = nil
+	if typ != "" {
+		vl.Meta = meta.Data{metricTypeMeta: meta.String(typ)}
+	}
+}
+
+// metricType returns the metric type of vl if it holds a series pushed in a
+// Prometheus format, see source.Info.MetricType, and the empty string
+// otherwise.
+func metricType(vl api.ValueList) string {
+	if e, ok := vl.Meta[metricTypeMeta]; ok {
+		return e.String()
+	}
+	return ""
+}
+
+// pushed returns whether vl holds a series pushed in a Prometheus format,
+// which is exported under its original name and metric type.
+func pushed(vl api.ValueList) bool {
+	return metricType(vl) != ""
+}
+
+// Reasons for rejecting series whose metric family conflicts with another
+// one.
+const (
+	// conflictReserved rejects pushed series named like the metrics of the
+	// exporter itself or the Go runtime.
+	conflictReserved = "reserved"
+	// conflictCollectd rejects pushed series named like series converted
+	// from collectd.
+	conflictCollectd = "collectd"
+	// conflictPushed rejects series converted from collectd named like
+	// pushed series.
+	conflictPushed = "pushed"
+	// conflictType rejects pushed series of another metric type than the
+	// other pushed series of the same name.
+	conflictType = "type"
+)
+
+// families tracks the metric families of the cached series, so that series
+// are rejected when they are received if they conflict with another family of
+// the same name, which would fail every scrape. Such conflicts only arise
+// with series pushed in a Prometheus format, which keep their names.
+type families struct {
+	reserved []string
+	names    map[string]*family
+
+	rejected *prometheus.CounterVec
+}
+
+// family is a metric family of cached series.
+type family struct {
+	// metricType is the metric type of pushed series, and empty for
+	// series converted from collectd.
+	metricType string
+	series     int
+}
+
+// newFamilies returns families reserving the names of the exporter's own
+// metrics, which start with namespace, and of the Go runtime.
+func newFamilies(namespace string) *families {
+	return &families{
+		reserved: []string{namespace + "_", "collectd_", "go_", "process_", "promhttp_"},
+		names:    map[string]*family{},
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_conflicting_series_total",
+				Help: "Number of series dropped because their metric family conflicts with another one of the same name, by reason.",
+			},
+			[]string{"reason"},
+		),
+	}
+}
+
+// allow returns whether the series of conv, replacing those of prev, which
+// may be nil, may be cached, and counts them as rejected otherwise.
+func (f *families) allow(conv, prev *conversion) bool {
+	if conv == prev {
+		return true
+	}
+	for _, s := range conv.series {
+		if s.desc == nil {
+			continue
+		}
+		if reason := f.conflict(s.name, conv.metricType, prev); reason != "" {
+			f.rejected.WithLabelValues(reason).Add(float64(len(conv.series)))
+			return false
+		}
+	}
+	return true
+}
+
+// conflict returns the reason a series named name of the given metric type
+// conflicts with the cached families, not counting the series of prev, or the
+// empty string if it does not.
+func (f *families) conflict(name, metricType string, prev *conversion) string {
+	if metricType != "" {
+		for _, prefix := range f.reserved {
+			if strings.HasPrefix(name, prefix) {
+				return conflictReserved
+			}
+		}
+	}
+	fam, ok := f.names[name]
+	if !ok || fam.series == prev.seriesNamed(name) {
+		return ""
+	}
+	switch {
+	case metricType == "" && fam.metricType != "":
+		return conflictPushed
+	case metricType != "" && fam.metricType == "":
+		return conflictCollectd
+	case metricType != fam.metricType:
+		return conflictType
+	}
+	return ""
+}
+
+// set replaces the series of prev with those of conv, either of which may be
+// nil. c.mu must be held.
+func (f *families) set(conv, prev *conversion) {
+	if conv == prev {
+		return
+	}
+	f.remove(prev)
+	if conv == nil {
+		return
+	}
+	for _, s := range conv.series {
+		if s.desc == nil {
+			continue
+		}
+		fam, ok := f.names[s.name]
+		if !ok {
+			fam = &family{metricType: conv.metricType}
+			f.names[s.name] = fam
+		}
+		fam.series++
+	}
+}
+
+// remove stops tracking the series of conv, which may be nil. c.mu must be
+// held.
+func (f *families) remove(conv *conversion) {
+	if conv == nil {
+		return
+	}
+	for _, s := range conv.series {
+		if s.desc == nil {
+			continue
+		}
+		if fam := f.names[s.name]; fam != nil {
+			if fam.series--; fam.series <= 0 {
+				delete(f.names, s.name)
+			}
+		}
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (f *families) Collect(ch chan<- prometheus.Metric) {
+	f.rejected.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (f *families) Describe(ch chan<- *prometheus.Desc) {
+	f.rejected.Describe(ch)
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// seriesQuota caps the number of series the cached value lists of each host
+// are converted to, see Options.MaxSeriesPerHost.
+type seriesQuota struct {
+	max    int
+	series map[string]int
+	hosts  map[string]int
+
+	exceeded *prometheus.CounterVec
+}
+
+func newSeriesQuota(max int) *seriesQuota {
+	return &seriesQuota{
+		max:    max,
+		series: map[string]int{},
+		hosts:  map[string]int{},
+		exceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_series_quota_exceeded_total",
+				Help: "Number of series dropped because their host exceeded --collector.max-series-per-host.",
+			},
+			[]string{"instance"},
+		),
+	}
+}
+
+// allow returns whether the value list vl with the given ID may be cached
+// with n series, and counts the series as dropped otherwise. Replacing a
+// cached value list only counts the difference in series against the quota.
+func (q *seriesQuota) allow(id string, vl api.ValueList, n int) bool {
+	if q.hosts[vl.Host]-q.series[id]+n <= q.max {
+		return true
+	}
+	q.exceeded.WithLabelValues(vl.Host).Add(float64(n))
+	return false
+}
+
+// set accounts n series to the value list vl with the given ID, replacing
+// its previous number. c.mu must be held.
+func (q *seriesQuota) set(id string, vl api.ValueList, n int) {
+	// Not removed first, which would delete the host's count of dropped
+	// series while it still has value lists.
+	q.hosts[vl.Host] += n - q.series[id]
+	q.series[id] = n
+}
+
+// remove stops accounting the value list vl with the given ID. Once the last
+// value list of its host is removed, the host's count of dropped series is
+// deleted, so that hosts that are gone are not exported forever. c.mu must
+// be held.
+func (q *seriesQuota) remove(id string, vl api.ValueList) {
+	n, ok := q.series[id]
+	if !ok {
+		return
+	}
+	delete(q.series, id)
+	if q.hosts[vl.Host] -= n; q.hosts[vl.Host] <= 0 {
+		delete(q.hosts, vl.Host)
+		q.exceeded.DeleteLabelValues(vl.Host)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (q *seriesQuota) Collect(ch chan<- prometheus.Metric) {
+	q.exceeded.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (q *seriesQuota) Describe(ch chan<- *prometheus.Desc) {
+	q.exceeded.Describe(ch)
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSeriesQuota(t *testing.T) {
+	c := newTestCollector(t, Options{MaxSeriesPerHost: 4})
+	ingest := func(host, instance string, values int) {
+		vl := &api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "curl_json", Type: "gauge", TypeInstance: instance},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+		}
+		for i := range values {
+			vl.Values = append(vl.Values, api.Gauge(1))
+			vl.DSNames = append(vl.DSNames, fmt.Sprint("v", i))
+		}
+		c.Ingest(vl)
+	}
+	for i := range 3 {
+		ingest("a.example.com", fmt.Sprint(i), 1)
+	}
+
+	// A value list with two series exceeds the quota of a.example.com,
+	// one with a single series does not.
+	ingest("a.example.com", "big", 2)
+	ingest("a.example.com", "3", 1)
+	ingest("a.example.com", "4", 1)
+	if got := c.quota.hosts["a.example.com"]; got != 4 || len(c.valueLists) != 4 {
+		t.Errorf("got %d series of %d value lists, want 4 of 4", got, len(c.valueLists))
+	}
+	if got := testutil.ToFloat64(c.quota.exceeded.WithLabelValues("a.example.com")); got != 3 {
+		t.Errorf("got %v dropped series, want 3", got)
+	}
+	// Cached value lists keep being updated, and other hosts have their
+	// own quota.
+	ingest("a.example.com", "0", 1)
+	ingest("b.example.com", "big", 2)
+	if got := c.quota.hosts["b.example.com"]; got != 2 || len(c.valueLists) != 5 {
+		t.Errorf("got %d series of b.example.com and %d value lists, want 2 and 5", got, len(c.valueLists))
+	}
+
+	// Removing value lists frees the quota.
+	c.delete(deleteRequest{valueLists: func(id api.Identifier) bool { return id.TypeInstance == "0" }})
+	ingest("a.example.com", "5", 1)
+	if got := c.quota.hosts["a.example.com"]; got != 4 || c.valueLists["a.example.com/curl_json/gauge-5"].Host == "" {
+		t.Errorf("got %d series of a.example.com after removal, want 4", got)
+	}
+
+	// The dropped series of a host are exported until its last value list
+	// is removed.
+	ingest("a.example.com", "6", 1)
+	if n := testutil.CollectAndCount(c.quota); n != 1 {
+		t.Errorf("got %d dropped series counters, want 1", n)
+	}
+	c.delete(deleteRequest{valueLists: func(id api.Identifier) bool { return id.Host == "a.example.com" }})
+	if n := testutil.CollectAndCount(c.quota); n != 0 {
+		t.Errorf("got %d dropped series counters after removing the host, want 0", n)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+)
+
+// Shard is one of Count disjoint parts of the exposition, numbered from 0.
+// Hosts are assigned to shards by consistent hashing of their name, so that
+// changing the number of shards moves as few hosts as possible.
+type Shard struct {
+	Index, Count int
+}
+
+// ParseShard parses a shard in the notation "N/M", the N-th of M shards.
+func ParseShard(s string) (Shard, error) {
+	var sh Shard
+	if _, err := fmt.Sscanf(s, "%d/%d", &sh.Index, &sh.Count); err != nil || fmt.Sprintf("%d/%d", sh.Index, sh.Count) != s {
+		return Shard{}, fmt.Errorf("invalid shard %q, want N/M", s)
+	}
+	if sh.Count < 1 || sh.Index < 0 || sh.Index >= sh.Count {
+		return Shard{}, fmt.Errorf("invalid shard %q, want 0 <= N < M", s)
+	}
+	return sh, nil
+}
+
+func (sh Shard) String() string {
+	return fmt.Sprintf("%d/%d", sh.Index, sh.Count)
+}
+
+// Contains returns whether the series of host belong to the shard.
+func (sh Shard) Contains(host string) bool {
+	if sh.Count <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	return jumpHash(h.Sum64(), sh.Count) == sh.Index
+}
+
+// jumpHash assigns key to one of n buckets with the jump consistent hash of
+// Lamping and Veach.
+func jumpHash(key uint64, n int) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+type shardKey struct{}
+
+// WithShard returns a copy of ctx limiting collections with it to the series
+// of the hosts in sh. The collector's own metrics are only exposed by the
+// first shard.
+func WithShard(ctx context.Context, sh Shard) context.Context {
+	return context.WithValue(ctx, shardKey{}, sh)
+}
+
+// shardFrom returns the shard stored in ctx by WithShard, or the whole
+// exposition.
+func shardFrom(ctx context.Context) Shard {
+	if sh, ok := ctx.Value(shardKey{}).(Shard); ok {
+		return sh
+	}
+	return Shard{Count: 1}
+}
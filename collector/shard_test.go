@@ -0,0 +1,116 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseShard(t *testing.T) {
+	for s, want := range map[string]Shard{
+		"0/1": {0, 1},
+		"2/3": {2, 3},
+	} {
+		if got, err := ParseShard(s); err != nil || got != want {
+			t.Errorf("ParseShard(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "1", "3/3", "-1/2", "0/0", "1/2x", " 1/2", "01/2"} {
+		if _, err := ParseShard(s); err == nil {
+			t.Errorf("ParseShard(%q) succeeded", s)
+		}
+	}
+}
+
+func TestShardContains(t *testing.T) {
+	const hosts = 1000
+	counts := make([]int, 4)
+	moved := 0
+	for i := range hosts {
+		host := fmt.Sprintf("host%d.example.com", i)
+		var in []int
+		for n := range counts {
+			if (Shard{n, len(counts)}).Contains(host) {
+				in = append(in, n)
+			}
+		}
+		if len(in) != 1 {
+			t.Fatalf("host %s is in shards %v, want exactly one", host, in)
+		}
+		counts[in[0]]++
+		// Adding a shard only moves hosts to the new shard.
+		if !(Shard{in[0], len(counts) + 1}).Contains(host) {
+			if !(Shard{len(counts), len(counts) + 1}).Contains(host) {
+				t.Errorf("host %s moved between existing shards", host)
+			}
+			moved++
+		}
+	}
+	for n, count := range counts {
+		if count < hosts/len(counts)/2 {
+			t.Errorf("shard %d has %d of %d hosts", n, count, hosts)
+		}
+	}
+	if moved > hosts/2 {
+		t.Errorf("adding a shard moved %d of %d hosts", moved, hosts)
+	}
+}
+
+func TestShardCollection(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	for i := range 20 {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: fmt.Sprintf("host%d", i), Plugin: "load", Type: "gauge"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		})
+	}
+
+	count := func(ctx context.Context, name string) int {
+		t.Helper()
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.WithContext(ctx))
+		n, err := testutil.GatherAndCount(reg, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	var series, hosts, self int
+	for n := range 3 {
+		ctx := WithShard(context.Background(), Shard{n, 3})
+		series += count(ctx, "collectd_load_gauge")
+		hosts += count(ctx, "collectd_host_last_seen_timestamp_seconds")
+		s := count(ctx, "collectd_last_push_timestamp_seconds")
+		if s != 0 && n != 0 {
+			t.Errorf("shard %d exposed the collector's own metrics", n)
+		}
+		self += s
+	}
+	if series != 20 || hosts != 20 {
+		t.Errorf("shards exposed %d series of %d hosts, want 20 of 20", series, hosts)
+	}
+	if self != 1 {
+		t.Errorf("shards exposed the collector's own metrics %d times, want once", self)
+	}
+}
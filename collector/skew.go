@@ -0,0 +1,59 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clockSkew compares the time of value lists to the time they are received,
+// to find hosts whose clock is off. Value lists are read by collectd before
+// they are sent, and the network plugin buffers them, so a value list may
+// lag behind by up to its interval without the host's clock being off.
+type clockSkew struct {
+	tolerance time.Duration
+	exceeded  *prometheus.CounterVec
+}
+
+func newClockSkew(tolerance time.Duration) *clockSkew {
+	return &clockSkew{
+		tolerance: tolerance,
+		exceeded: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_clock_skew_exceeded_total",
+				Help: "Number of value lists whose time was ahead of the exporter's clock, or behind it by more than their interval, by more than the clock skew tolerance, by host.",
+			},
+			[]string{"instance"},
+		),
+	}
+}
+
+// record returns the skew of vl, received at now, and counts it if it is out
+// of tolerance. A positive skew means the host's clock is ahead. It must only
+// be called from Run().
+func (s *clockSkew) record(vl api.ValueList, now time.Time) time.Duration {
+	skew := vl.Time.Sub(now)
+	if skew > s.tolerance || skew < -vl.Interval-s.tolerance {
+		s.exceeded.WithLabelValues(vl.Host).Inc()
+	}
+	return skew
+}
+
+// forgetHost drops the counter of host. It must only be called from Run().
+func (s *clockSkew) forgetHost(host string) {
+	s.exceeded.DeleteLabelValues(host)
+}
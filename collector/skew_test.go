@@ -0,0 +1,69 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClockSkew(t *testing.T) {
+	c := newTestCollector(t, Options{MaxClockSkew: 5 * time.Second})
+	ingest := func(host string, skew time.Duration) {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "gauge"},
+			Time:       time.Now().Add(skew),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		})
+	}
+
+	// Lagging behind by up to the interval and the tolerance is expected.
+	ingest("a", -14*time.Second)
+	ingest("a", 0)
+	// Ahead by more than the tolerance.
+	ingest("b", 30*time.Second)
+	// Behind by more than the interval and the tolerance.
+	ingest("c", -20*time.Second)
+	ingest("c", -time.Hour)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c.Self())
+	want := `
+		# HELP collectd_exporter_clock_skew_exceeded_total Number of value lists whose time was ahead of the exporter's clock, or behind it by more than their interval, by more than the clock skew tolerance, by host.
+		# TYPE collectd_exporter_clock_skew_exceeded_total counter
+		collectd_exporter_clock_skew_exceeded_total{instance="b"} 1
+		collectd_exporter_clock_skew_exceeded_total{instance="c"} 2
+	`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_exporter_clock_skew_exceeded_total"); err != nil {
+		t.Error(err)
+	}
+
+	for host, want := range map[string]time.Duration{"a": 0, "b": 30 * time.Second, "c": -time.Hour} {
+		if got := c.hosts[host].skew; (got - want).Abs() > time.Second {
+			t.Errorf("host %q: got skew %v, want %v", host, got, want)
+		}
+	}
+
+	c.delete(deleteRequest{hosts: func(h string) bool { return h == "b" }})
+	c.gc(time.Now().Add(DefaultHostRetention + time.Hour))
+	if n := testutil.CollectAndCount(c.skew.exceeded); n != 0 {
+		t.Errorf("got %d counters after forgetting the hosts, want 0", n)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// snapshot holds the series converted from the cache at one point in time.
+// It is immutable once built, so that scrapes can read it without locking.
+type snapshot struct {
+	time   time.Time
+	series []snapshotSeries
+}
+
+// snapshotSeries is a converted series along with the host of the value list
+// it was converted from.
+type snapshotSeries struct {
+	host string
+	// deadline is the expiry deadline of the value list, so that scrapes
+	// skip series expired since the snapshot was built.
+	deadline time.Time
+	metric   prometheus.Metric
+}
+
+// runSnapshots replaces the snapshot served by scrapes every
+// Options.SnapshotInterval until ctx is canceled.
+func (c *Collector) runSnapshots(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		if s, err := c.buildSnapshot(ctx); err == nil {
+			c.snapshot.Store(s)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildSnapshot converts the cached value lists to a new snapshot. The cache
+// is only locked while it is copied.
+func (c *Collector) buildSnapshot(ctx context.Context) (*snapshot, error) {
+	s := &snapshot{time: time.Now()}
+	if prev := c.snapshot.Load(); prev != nil {
+		s.series = make([]snapshotSeries, 0, len(prev.series))
+	}
+	err := c.convertSeries(ctx, nil, s.time, func(host string, deadline time.Time, m prometheus.Metric) {
+		s.series = append(s.series, snapshotSeries{host: host, deadline: deadline, metric: m})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := newTestCollector(t, Options{SnapshotInterval: time.Minute})
+	ingest := func(host string, v float64) {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "load"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(v)},
+		})
+	}
+	ingest("a", 1)
+
+	// Without a snapshot, the cache is converted on every scrape.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c.Series())
+	want := `
+		# HELP collectd_load Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'value'
+		# TYPE collectd_load gauge
+		collectd_load{instance="a"} 1
+	`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_load"); err != nil {
+		t.Error(err)
+	}
+
+	s, err := c.buildSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.snapshot.Store(s)
+	ingest("a", 2)
+	ingest("b", 3)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_load"); err != nil {
+		t.Errorf("scrape of snapshot: %v", err)
+	}
+
+	s, err = c.buildSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.snapshot.Store(s)
+	want = `
+		# HELP collectd_load Collectd exporter: 'load' Type: 'load' Dstype: 'api.Gauge' Dsname: 'value'
+		# TYPE collectd_load gauge
+		collectd_load{instance="a"} 2
+		collectd_load{instance="b"} 3
+	`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_load"); err != nil {
+		t.Errorf("scrape of new snapshot: %v", err)
+	}
+	if got := testutil.CollectAndCount(c.HostSeries(context.Background(), "b")); got != 1 {
+		t.Errorf("got %d series of host b, want 1", got)
+	}
+
+	cfg, err := ParseConfig([]byte(`
+expiry:
+  - plugin: exec
+    mode: expire-after-scrape
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(nil, Options{SnapshotInterval: time.Minute, Config: cfg}); err == nil {
+		t.Error("expected error for snapshots with expire-after-scrape")
+	}
+}
+
+// newBenchmarkCollector returns a collector caching n value lists of 100
+// hosts.
+func newBenchmarkCollector(b *testing.B, n int) *Collector {
+	c := newTestCollector(b, Options{})
+	for i := range n {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{
+				Host:           fmt.Sprintf("host%d.example.com", i%100),
+				Plugin:         "interface",
+				PluginInstance: fmt.Sprintf("eth%d", i/100),
+				Type:           "if_octets",
+			},
+			Time:     time.Now(),
+			Interval: time.Minute,
+			Values:   []api.Value{api.Derive(i), api.Derive(2 * i)},
+			DSNames:  []string{"rx", "tx"},
+		})
+	}
+	return c
+}
+
+// drain collects col, discarding the metrics.
+func drain(col prometheus.Collector) {
+	ch := make(chan prometheus.Metric, 1024)
+	go func() {
+		col.Collect(ch)
+		close(ch)
+	}()
+	for range ch {
+	}
+}
+
+func BenchmarkCollect(b *testing.B) {
+	for _, snapshot := range []bool{false, true} {
+		b.Run(fmt.Sprintf("snapshot=%t", snapshot), func(b *testing.B) {
+			c := newBenchmarkCollector(b, 10000)
+			if snapshot {
+				s, err := c.buildSnapshot(context.Background())
+				if err != nil {
+					b.Fatal(err)
+				}
+				c.snapshot.Store(s)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				drain(c.Series())
+			}
+		})
+	}
+}
+
+// BenchmarkWrite measures writes to the collector while Run processes
+// them.
+func BenchmarkWrite(b *testing.B) {
+	c := newBenchmarkCollector(b, 10000)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "host0.example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+		Interval:   time.Minute,
+		Values:     []api.Value{api.Derive(1), api.Derive(2)},
+		DSNames:    []string{"rx", "tx"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		vl.Time = time.Now()
+		if err := c.Write(ctx, vl); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteWhileScraping measures writes to the collector while it is
+// scraped continuously.
+func BenchmarkWriteWhileScraping(b *testing.B) {
+	for _, snapshot := range []bool{false, true} {
+		b.Run(fmt.Sprintf("snapshot=%t", snapshot), func(b *testing.B) {
+			c := newBenchmarkCollector(b, 10000)
+			if snapshot {
+				c.opts.SnapshotInterval = time.Second
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go c.Run(ctx)
+			go func() {
+				for ctx.Err() == nil {
+					drain(c.WithContext(ctx))
+				}
+			}()
+
+			vl := &api.ValueList{
+				Identifier: api.Identifier{Host: "host0.example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+				Interval:   time.Minute,
+				DSNames:    []string{"rx", "tx"},
+			}
+			b.ResetTimer()
+			for i := 1; i <= b.N; i++ {
+				vl.Time = time.Now()
+				vl.Values = []api.Value{api.Derive(i), api.Derive(2 * i)}
+				if err := c.Write(ctx, vl); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
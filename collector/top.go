@@ -0,0 +1,158 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+)
+
+const (
+	// TopWindow is the sliding window the value rates of Top are computed
+	// over.
+	TopWindow = 5 * time.Minute
+	// topBuckets is the number of buckets TopWindow is divided into.
+	topBuckets = 10
+)
+
+// Talker is a host or plugin along with the rate of values received from it
+// and the number of series converted from its value lists.
+type Talker struct {
+	Name            string  `json:"name"`
+	ValuesPerSecond float64 `json:"values_per_second"`
+	Series          int     `json:"series"`
+}
+
+// TopTalkers lists the hosts and plugins producing the most values per
+// second over TopWindow and the most series.
+type TopTalkers struct {
+	HostsByRate     []Talker `json:"hosts_by_rate"`
+	HostsBySeries   []Talker `json:"hosts_by_series"`
+	PluginsByRate   []Talker `json:"plugins_by_rate"`
+	PluginsBySeries []Talker `json:"plugins_by_series"`
+}
+
+// traffic counts the values received by host and plugin in the buckets of a
+// sliding window.
+type traffic struct {
+	mu      sync.Mutex
+	started time.Time
+	buckets [topBuckets]trafficBucket
+}
+
+// trafficBucket counts the values received in one slot of the window.
+type trafficBucket struct {
+	slot    int64
+	hosts   map[string]float64
+	plugins map[string]float64
+}
+
+func newTraffic(now time.Time) *traffic {
+	return &traffic{started: now}
+}
+
+// record counts the values of vl, received at now.
+func (t *traffic) record(vl api.ValueList, now time.Time) {
+	slot := now.UnixNano() / int64(TopWindow/topBuckets)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[slot%topBuckets]
+	if b.slot != slot || b.hosts == nil {
+		*b = trafficBucket{slot: slot, hosts: map[string]float64{}, plugins: map[string]float64{}}
+	}
+	b.hosts[vl.Host] += float64(len(vl.Values))
+	b.plugins[vl.Plugin] += float64(len(vl.Values))
+}
+
+// rates returns the values per second received by host and plugin over the
+// window ending at now, or since t was created if that is shorter.
+func (t *traffic) rates(now time.Time) (hosts, plugins map[string]float64) {
+	slot := now.UnixNano() / int64(TopWindow/topBuckets)
+	seconds := min(now.Sub(t.started), TopWindow).Seconds()
+	hosts, plugins = map[string]float64{}, map[string]float64{}
+	if seconds <= 0 {
+		return hosts, plugins
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.buckets {
+		if b.hosts == nil || b.slot <= slot-topBuckets {
+			continue
+		}
+		for host, n := range b.hosts {
+			hosts[host] += n / seconds
+		}
+		for plugin, n := range b.plugins {
+			plugins[plugin] += n / seconds
+		}
+	}
+	return hosts, plugins
+}
+
+// Top returns the n hosts and plugins producing the most values per second
+// over TopWindow and the most series from unexpired value lists. Value lists
+// are counted when received, even if the pipeline drops them.
+func (c *Collector) Top(n int) TopTalkers {
+	hostRates, pluginRates := c.traffic.rates(time.Now())
+	hostSeries, pluginSeries := map[string]int{}, map[string]int{}
+	for _, s := range c.inventory() {
+		hostSeries[s.vl.Host]++
+		pluginSeries[s.vl.Plugin]++
+	}
+
+	hosts := talkers(hostRates, hostSeries)
+	plugins := talkers(pluginRates, pluginSeries)
+	return TopTalkers{
+		HostsByRate:     topBy(hosts, n, func(t Talker) float64 { return t.ValuesPerSecond }),
+		HostsBySeries:   topBy(hosts, n, func(t Talker) float64 { return float64(t.Series) }),
+		PluginsByRate:   topBy(plugins, n, func(t Talker) float64 { return t.ValuesPerSecond }),
+		PluginsBySeries: topBy(plugins, n, func(t Talker) float64 { return float64(t.Series) }),
+	}
+}
+
+// talkers merges the rates and series counts by name.
+func talkers(rates map[string]float64, series map[string]int) []Talker {
+	byName := map[string]*Talker{}
+	for name, rate := range rates {
+		byName[name] = &Talker{Name: name, ValuesPerSecond: rate}
+	}
+	for name, n := range series {
+		if t, ok := byName[name]; ok {
+			t.Series = n
+		} else {
+			byName[name] = &Talker{Name: name, Series: n}
+		}
+	}
+
+	list := make([]Talker, 0, len(byName))
+	for _, t := range byName {
+		list = append(list, *t)
+	}
+	return list
+}
+
+// topBy returns the n talkers with the largest key, ties broken by name.
+// Talkers with a zero key are omitted.
+func topBy(list []Talker, n int, key func(Talker) float64) []Talker {
+	list = slices.DeleteFunc(slices.Clone(list), func(t Talker) bool { return key(t) == 0 })
+	slices.SortFunc(list, func(a, b Talker) int {
+		return cmp.Or(cmp.Compare(key(b), key(a)), cmp.Compare(a.Name, b.Name))
+	})
+	return list[:min(n, len(list))]
+}
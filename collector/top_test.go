@@ -0,0 +1,73 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestTrafficRates(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tr := newTraffic(start)
+	load := api.ValueList{Identifier: api.Identifier{Host: "a", Plugin: "load"}, Values: []api.Value{api.Gauge(1), api.Gauge(1), api.Gauge(1)}}
+	cpu := api.ValueList{Identifier: api.Identifier{Host: "b", Plugin: "cpu"}, Values: []api.Value{api.Derive(1)}}
+
+	tr.record(load, start.Add(10*time.Second))
+	tr.record(cpu, start.Add(20*time.Second))
+	hosts, plugins := tr.rates(start.Add(60 * time.Second))
+	if want := map[string]float64{"a": 3.0 / 60, "b": 1.0 / 60}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got host rates %v, want %v", hosts, want)
+	}
+	if want := map[string]float64{"load": 3.0 / 60, "cpu": 1.0 / 60}; !reflect.DeepEqual(plugins, want) {
+		t.Errorf("got plugin rates %v, want %v", plugins, want)
+	}
+
+	// Values age out of the window.
+	tr.record(cpu, start.Add(TopWindow))
+	hosts, _ = tr.rates(start.Add(TopWindow + 30*time.Second))
+	if want := map[string]float64{"b": 1 / TopWindow.Seconds()}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("got host rates %v after the window, want %v", hosts, want)
+	}
+}
+
+func TestTop(t *testing.T) {
+	c := newTestCollector(t, Options{})
+	now := time.Now()
+	for _, vl := range []*api.ValueList{
+		{Identifier: api.Identifier{Host: "a.example.com", Plugin: "load", Type: "load"}, Values: []api.Value{api.Gauge(1), api.Gauge(1), api.Gauge(1)}, DSNames: []string{"shortterm", "midterm", "longterm"}},
+		{Identifier: api.Identifier{Host: "b.example.com", Plugin: "cpu", Type: "cpu", TypeInstance: "user"}, Values: []api.Value{api.Derive(1)}},
+		{Identifier: api.Identifier{Host: "b.example.com", Plugin: "cpu", Type: "cpu", TypeInstance: "system"}, Values: []api.Value{api.Derive(1)}},
+	} {
+		vl.Time, vl.Interval = now, 10*time.Second
+		c.Ingest(vl)
+	}
+
+	top := c.Top(1)
+	if len(top.HostsByRate) != 1 || top.HostsByRate[0].Name != "a.example.com" || top.HostsByRate[0].ValuesPerSecond <= 0 {
+		t.Errorf("got hosts by rate %+v, want a.example.com", top.HostsByRate)
+	}
+	if want := []Talker{{Name: "load", ValuesPerSecond: top.PluginsByRate[0].ValuesPerSecond, Series: 3}}; !reflect.DeepEqual(top.PluginsByRate, want) {
+		t.Errorf("got plugins by rate %+v, want %+v", top.PluginsByRate, want)
+	}
+	if len(top.HostsBySeries) != 1 || top.HostsBySeries[0].Name != "a.example.com" || top.HostsBySeries[0].Series != 3 {
+		t.Errorf("got hosts by series %+v, want a.example.com with 3 series", top.HostsBySeries)
+	}
+	if top := c.Top(10); len(top.HostsBySeries) != 2 || top.HostsBySeries[1].Series != 2 || len(top.PluginsBySeries) != 2 {
+		t.Errorf("got %+v, want both hosts and plugins", top)
+	}
+}
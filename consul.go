@@ -0,0 +1,296 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// consulService is a service definition of the Consul agent API.
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port,omitempty"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   *consulCheck      `json:"Check,omitempty"`
+}
+
+// consulCheck is a TTL health check of a consulService.
+type consulCheck struct {
+	TTL                            string `json:"TTL"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+// consulRegistration registers the exporter, and optionally every collectd
+// host as a target of its own, as services with a Consul agent.
+type consulRegistration struct {
+	// Agent is the URL of the Consul agent's HTTP API.
+	Agent *url.URL
+	// Token is sent as ACL token, if set.
+	Token string
+	// Service describes the exporter. Its TTL check is passed while the
+	// collector is responsive.
+	Service consulService
+	// HostServiceName is the name of the services registered for every
+	// host, or empty to not register hosts.
+	HostServiceName string
+	MetricsPath     string
+	Client          *http.Client
+	Logger          *slog.Logger
+
+	hosts map[string]bool
+}
+
+// run registers the services and keeps them up to date until ctx is
+// canceled, after which they are deregistered. alive is used for the health
+// check, hosts lists the hosts to register.
+func (r *consulRegistration) run(ctx context.Context, ttl time.Duration, alive func(context.Context) error, hosts func() []collector.Host) {
+	r.hosts = map[string]bool{}
+	registered := false
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+	for {
+		if !registered {
+			if err := r.put(ctx, "/v1/agent/service/register", r.Service); err != nil {
+				r.Logger.Warn("Error registering with Consul", "err", err)
+			} else {
+				registered = true
+			}
+		}
+		if registered {
+			r.updateCheck(ctx, ttl, alive)
+		}
+		if registered && r.HostServiceName != "" {
+			r.syncHosts(ctx, hosts())
+		}
+
+		select {
+		case <-ctx.Done():
+			r.deregister(registered)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateCheck passes or fails the TTL check of the exporter's service,
+// depending on alive. If the agent lost the service, e.g. because it was
+// restarted, it is registered again.
+func (r *consulRegistration) updateCheck(ctx context.Context, ttl time.Duration, alive func(context.Context) error) {
+	checkCtx, cancel := context.WithTimeout(ctx, ttl/2)
+	err := alive(checkCtx)
+	cancel()
+
+	status, note := "pass", ""
+	if err != nil {
+		status, note = "fail", "collector unresponsive: "+err.Error()
+	}
+	p := "/v1/agent/check/" + status + "/" + url.PathEscape("service:"+r.Service.ID) + "?note=" + url.QueryEscape(note)
+	if err := r.put(ctx, p, nil); err != nil {
+		r.Logger.Warn("Error updating Consul health check", "err", err)
+		if err := r.put(ctx, "/v1/agent/service/register", r.Service); err != nil {
+			r.Logger.Warn("Error registering with Consul", "err", err)
+		}
+	}
+}
+
+// syncHosts registers services for hosts not registered yet and deregisters
+// those of hosts that are gone.
+func (r *consulRegistration) syncHosts(ctx context.Context, hosts []collector.Host) {
+	current := map[string]bool{}
+	for _, h := range hosts {
+		current[h.Name] = true
+		if r.hosts[h.Name] {
+			continue
+		}
+		if err := r.put(ctx, "/v1/agent/service/register", r.hostService(h.Name)); err != nil {
+			r.Logger.Warn("Error registering host with Consul", "host", h.Name, "err", err)
+			continue
+		}
+		r.hosts[h.Name] = true
+	}
+	for host := range r.hosts {
+		if current[host] {
+			continue
+		}
+		if err := r.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(r.hostService(host).ID), nil); err != nil {
+			r.Logger.Warn("Error deregistering host from Consul", "host", host, "err", err)
+			continue
+		}
+		delete(r.hosts, host)
+	}
+}
+
+// hostService returns the service definition of a collectd host, which is
+// scraped via its page on the exporter.
+func (r *consulRegistration) hostService(host string) consulService {
+	return consulService{
+		ID:      r.Service.ID + "-" + host,
+		Name:    r.HostServiceName,
+		Tags:    r.Service.Tags,
+		Address: r.Service.Address,
+		Port:    r.Service.Port,
+		Meta: map[string]string{
+			"collectd_host": host,
+			"metrics_path":  path.Join(r.MetricsPath, "host", host),
+		},
+	}
+}
+
+// deregister removes all registered services from the agent.
+func (r *consulRegistration) deregister(service bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for host := range r.hosts {
+		if err := r.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(r.hostService(host).ID), nil); err != nil {
+			r.Logger.Warn("Error deregistering host from Consul", "host", host, "err", err)
+		}
+	}
+	if service {
+		if err := r.put(ctx, "/v1/agent/service/deregister/"+url.PathEscape(r.Service.ID), nil); err != nil {
+			r.Logger.Warn("Error deregistering from Consul", "err", err)
+		}
+	}
+}
+
+// put sends a PUT request with body, if not nil, encoded as JSON to the agent
+// API at the path p, which may include a query.
+func (r *consulRegistration) put(ctx context.Context, p string, body any) error {
+	return consulPut(ctx, r.Client, r.Agent, r.Token, p, body, nil)
+}
+
+// consulError is the response of a Consul agent to a failed request.
+type consulError struct {
+	code   int
+	status string
+	msg    []byte
+}
+
+func (e *consulError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.msg)
+}
+
+// consulPut sends a PUT request with body, if not nil, encoded as JSON to the
+// API of the Consul agent at the path p, which may include a query. A JSON
+// response is decoded into out, if not nil. The ACL token is sent if set.
+func consulPut(ctx context.Context, client *http.Client, agent *url.URL, token, p string, body, out any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	u := strings.TrimSuffix(agent.String(), "/") + p
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &consulError{code: resp.StatusCode, status: resp.Status, msg: bytes.TrimSpace(msg)}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// splitServiceAddress splits the advertised address of the exporter into the
+// host and port of its Consul service. An empty host makes Consul use the
+// agent's address.
+func splitServiceAddress(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %q", addr)
+	}
+	return host, port, nil
+}
+
+// newConsulRegistration returns the Consul registration configured by the
+// command line flags. The service address defaults to the first TCP listen
+// address of the web server.
+func newConsulRegistration(flags *web.FlagConfig, logger *slog.Logger) (*consulRegistration, error) {
+	agent, err := url.Parse(*consulAddress)
+	if err != nil {
+		return nil, err
+	}
+	addr := *consulServiceAddr
+	if addr == "" {
+		addr = tcpListenAddress(flags)
+	}
+	host, port, err := splitServiceAddress(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service address: %w", err)
+	}
+	id := *consulServiceID
+	if id == "" {
+		id = *consulServiceName
+	}
+
+	r := &consulRegistration{
+		Agent: agent,
+		Token: os.Getenv("CONSUL_HTTP_TOKEN"),
+		Service: consulService{
+			ID:      id,
+			Name:    *consulServiceName,
+			Tags:    *consulTags,
+			Address: host,
+			Port:    port,
+			Check: &consulCheck{
+				TTL:                            consulCheckTTL.String(),
+				DeregisterCriticalServiceAfter: (10 * *consulCheckTTL).String(),
+			},
+		},
+		MetricsPath: *metricsPath,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Logger:      logger,
+	}
+	if *consulHosts {
+		r.HostServiceName = *consulServiceName + "-host"
+	}
+	return r, nil
+}
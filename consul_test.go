@@ -0,0 +1,141 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestConsulRegistration(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		services = map[string]consulService{}
+	)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodPut || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/v1/agent/service/register" {
+			var s consulService
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			services[s.ID] = s
+		}
+	}))
+	defer agent.Close()
+	agentURL, _ := url.Parse(agent.URL)
+
+	r := &consulRegistration{
+		Agent:           agentURL,
+		Token:           "secret",
+		Service:         consulService{ID: "collectd-exporter", Name: "collectd-exporter", Port: 9103, Check: &consulCheck{TTL: "20ms"}},
+		HostServiceName: "collectd-exporter-host",
+		MetricsPath:     "/metrics",
+		Client:          agent.Client(),
+		Logger:          promslog.NewNopLogger(),
+	}
+
+	hosts := []collector.Host{{Name: "a.example.com"}, {Name: "b.example.com"}}
+	var hostsMu sync.Mutex
+	alive := func(context.Context) error { return nil }
+	listHosts := func() []collector.Host {
+		hostsMu.Lock()
+		defer hostsMu.Unlock()
+		return hosts
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.run(ctx, 20*time.Millisecond, alive, listHosts)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	hostsMu.Lock()
+	hosts = hosts[:1]
+	hostsMu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, want := range []string{
+		"/v1/agent/check/pass/service:collectd-exporter",
+		"/v1/agent/service/deregister/collectd-exporter-b.example.com",
+		"/v1/agent/service/deregister/collectd-exporter-a.example.com",
+		"/v1/agent/service/deregister/collectd-exporter",
+	} {
+		if !slices.Contains(requests, want) {
+			t.Errorf("missing request %s in %v", want, requests)
+		}
+	}
+	host := services["collectd-exporter-a.example.com"]
+	if host.Name != "collectd-exporter-host" || host.Port != 9103 || host.Meta["metrics_path"] != "/metrics/host/a.example.com" {
+		t.Errorf("got host service %+v", host)
+	}
+}
+
+func TestConsulFailingCheck(t *testing.T) {
+	paths := make(chan string, 10)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case paths <- r.URL.Path:
+		default:
+		}
+	}))
+	defer agent.Close()
+	agentURL, _ := url.Parse(agent.URL)
+
+	r := &consulRegistration{
+		Agent:   agentURL,
+		Service: consulService{ID: "collectd-exporter", Name: "collectd-exporter"},
+		Client:  agent.Client(),
+		Logger:  promslog.NewNopLogger(),
+	}
+	r.updateCheck(context.Background(), time.Second, func(context.Context) error { return errors.New("hanging") })
+	if got := <-paths; got != "/v1/agent/check/fail/service:collectd-exporter" {
+		t.Errorf("got request %s", got)
+	}
+}
+
+func TestSplitServiceAddress(t *testing.T) {
+	if host, port, err := splitServiceAddress(":9103"); err != nil || host != "" || port != 9103 {
+		t.Errorf("got %q, %d, %v", host, port, err)
+	}
+	for _, invalid := range []string{"localhost", "localhost:http", "vsock://:9103"} {
+		if _, _, err := splitServiceAddress(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/common/expfmt"
+)
+
+// defaultPutvalInterval is used for PUTVAL lines without an interval option,
+// matching collectd's default "Interval" setting.
+const defaultPutvalInterval = 10 * time.Second
+
+// Input formats accepted by the convert command.
+const (
+	formatAuto   = "auto"
+	formatJSON   = "json"
+	formatPutval = "putval"
+)
+
+// writeSeries writes the series converted by c to w in the text exposition
+// format.
+func writeSeries(w io.Writer, c *collector.Collector) error {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(c.Series()); err != nil {
+		return err
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		return err
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readValueLists reads value lists in collectd's JSON format, as sent by the
+// write_http plugin, or as PUTVAL commands from r. The auto format picks JSON
+// if the input starts with "[" or "{".
+func readValueLists(r io.Reader, format string, typesDB *api.TypesDB) ([]*api.ValueList, error) {
+	br := bufio.NewReader(r)
+	if format == formatAuto {
+		format = formatPutval
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			if bytes.IndexByte([]byte(" \t\r\n"), b) != -1 {
+				continue
+			}
+			if b == '[' || b == '{' {
+				format = formatJSON
+			}
+			if err := br.UnreadByte(); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	switch format {
+	case formatJSON:
+		return readJSON(br)
+	case formatPutval:
+		return readPutval(br, typesDB)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// readJSON reads one or more JSON arrays of value lists, or single value
+// lists, from r.
+func readJSON(r io.Reader) ([]*api.ValueList, error) {
+	var valueLists []*api.ValueList
+
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return valueLists, nil
+			}
+			return nil, err
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			var vl api.ValueList
+			if err := json.Unmarshal(raw, &vl); err != nil {
+				return nil, err
+			}
+			valueLists = append(valueLists, &vl)
+			continue
+		}
+
+		var vls []*api.ValueList
+		if err := json.Unmarshal(raw, &vls); err != nil {
+			return nil, err
+		}
+		valueLists = append(valueLists, vls...)
+	}
+}
+
+// readPutval reads PUTVAL commands, one per line, from r. Empty lines and
+// lines starting with "#" are ignored.
+func readPutval(r io.Reader, typesDB *api.TypesDB) ([]*api.ValueList, error) {
+	var (
+		valueLists []*api.ValueList
+		lineNo     int
+	)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		vls, err := parsePutval(line, typesDB, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		valueLists = append(valueLists, vls...)
+	}
+
+	return valueLists, s.Err()
+}
+
+// parsePutval parses a PUTVAL command as described in collectd-unixsock(5).
+// The data source types are looked up in typesDB; values of types unknown to
+// it are parsed as gauges. The time "N" is replaced by now.
+func parsePutval(line string, typesDB *api.TypesDB, now time.Time) ([]*api.ValueList, error) {
+	fields, err := splitPutval(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 3 || !strings.EqualFold(fields[0], "PUTVAL") {
+		return nil, errors.New("expected \"PUTVAL <identifier> [<option>=<value>...] <time>:<value>[:<value>...]\"")
+	}
+
+	id, err := api.ParseIdentifier(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	var sources []api.DataSource
+	if typesDB != nil {
+		if ds, ok := typesDB.DataSet(id.Type); ok {
+			sources = ds.Sources
+		}
+	}
+
+	interval := defaultPutvalInterval
+	var valueLists []*api.ValueList
+	for _, field := range fields[2:] {
+		if option, value, ok := strings.Cut(field, "="); ok {
+			if option != "interval" {
+				// Other options, such as meta data, do not affect the
+				// conversion.
+				continue
+			}
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds <= 0 {
+				return nil, fmt.Errorf("invalid interval %q", value)
+			}
+			interval = time.Duration(seconds * float64(time.Second))
+			continue
+		}
+
+		vl, err := parsePutvalValues(field, sources)
+		if err != nil {
+			return nil, err
+		}
+		if vl.Time.IsZero() {
+			vl.Time = now
+		}
+		vl.Identifier = id
+		vl.Interval = interval
+		valueLists = append(valueLists, vl)
+	}
+	if len(valueLists) == 0 {
+		return nil, errors.New("no values")
+	}
+
+	return valueLists, nil
+}
+
+// parsePutvalValues parses a "<time>:<value>[:<value>...]" value list. A zero
+// time is returned for "N".
+func parsePutvalValues(field string, sources []api.DataSource) (*api.ValueList, error) {
+	parts := strings.Split(field, ":")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid value list %q", field)
+	}
+	if sources != nil && len(parts)-1 != len(sources) {
+		return nil, fmt.Errorf("got %d values, types.db defines %d data sources", len(parts)-1, len(sources))
+	}
+
+	vl := &api.ValueList{}
+	if parts[0] != "N" {
+		seconds, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", parts[0])
+		}
+		sec, frac := math.Modf(seconds)
+		vl.Time = time.Unix(int64(sec), int64(frac*1e9))
+	}
+
+	for i, s := range parts[1:] {
+		var typ reflect.Type
+		if sources != nil {
+			typ = sources[i].Type
+			vl.DSNames = append(vl.DSNames, sources[i].Name)
+		}
+
+		v, err := parsePutvalValue(s, typ)
+		if err != nil {
+			return nil, err
+		}
+		vl.Values = append(vl.Values, v)
+	}
+
+	return vl, nil
+}
+
+// parsePutvalValue parses a single value of the given data source type. A
+// nil type is treated as a gauge.
+func parsePutvalValue(s string, typ reflect.Type) (api.Value, error) {
+	switch typ {
+	case reflect.TypeOf(api.Derive(0)):
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DERIVE value %q", s)
+		}
+		return api.Derive(v), nil
+	case reflect.TypeOf(api.Counter(0)):
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid COUNTER value %q", s)
+		}
+		return api.Counter(v), nil
+	default:
+		if s == "U" {
+			return api.Gauge(math.NaN()), nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GAUGE value %q", s)
+		}
+		return api.Gauge(v), nil
+	}
+}
+
+// splitPutval splits line at whitespace, honoring double-quoted fields as
+// used for identifiers containing spaces.
+func splitPutval(line string) ([]string, error) {
+	var (
+		fields  []string
+		current strings.Builder
+		quoted  bool
+		inField bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(line):
+			i++
+			current.WriteByte(line[i])
+		case c == '"':
+			quoted, inField = !quoted, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteByte(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+
+	return fields, nil
+}
+
+// runConvert reads value lists from path, or standard input if path is "-",
+// converts them with c and prints the result to stdout.
+func runConvert(c *collector.Collector, path, format string, typesDB *api.TypesDB) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	vls, err := readValueLists(in, format, typesDB)
+	if err != nil {
+		return err
+	}
+	for _, vl := range vls {
+		c.Ingest(vl)
+	}
+
+	return writeSeries(os.Stdout, c)
+}
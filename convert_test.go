@@ -0,0 +1,138 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/collectd_exporter/collector"
+)
+
+func TestParsePutval(t *testing.T) {
+	typesDB, err := api.NewTypesDB(strings.NewReader("if_octets rx:DERIVE:0:U, tx:DERIVE:0:U\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+
+	cases := []struct {
+		line string
+		want []*api.ValueList
+		err  bool
+	}{
+		{
+			line: `PUTVAL "example.com/interface-eth0/if_octets" interval=20 1600000000.5:1:2`,
+			want: []*api.ValueList{{
+				Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+				Time:       time.Unix(1600000000, 5e8),
+				Interval:   20 * time.Second,
+				DSNames:    []string{"rx", "tx"},
+				Values:     []api.Value{api.Derive(1), api.Derive(2)},
+			}},
+		},
+		{
+			line: `PUTVAL example.com/load/load N:0.5:U:1 N:1:1:1`,
+			want: []*api.ValueList{
+				{
+					Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+					Time:       now,
+					Interval:   defaultPutvalInterval,
+					Values:     []api.Value{api.Gauge(0.5), api.Gauge(-1), api.Gauge(1)},
+				},
+				{
+					Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+					Time:       now,
+					Interval:   defaultPutvalInterval,
+					Values:     []api.Value{api.Gauge(1), api.Gauge(1), api.Gauge(1)},
+				},
+			},
+		},
+		{line: `PUTVAL "example.com/interface/if_octets" N:1`, err: true},
+		{line: `PUTVAL "example.com/interface/if_octets" N:1.5:2`, err: true},
+		{line: `PUTVAL example.com/load N:1`, err: true},
+		{line: `PUTVAL "example.com/load/load N:1`, err: true},
+		{line: `GETVAL example.com/load/load`, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parsePutval(c.line, typesDB, now)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.line, err)
+			continue
+		}
+
+		// NaN never compares equal, replace it for the comparison.
+		for _, vl := range got {
+			for i, v := range vl.Values {
+				if g, ok := v.(api.Gauge); ok && math.IsNaN(float64(g)) {
+					vl.Values[i] = api.Gauge(-1)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestReadValueLists(t *testing.T) {
+	inputs := map[string]string{
+		"json": `[{"values":[42],"dstypes":["derive"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+			`"host":"example.com","plugin":"cpu","plugin_instance":"0","type":"cpu","type_instance":"user"}]`,
+		"putval": "# A comment.\n\nPUTVAL example.com/cpu-0/cpu-user interval=10 1700000000:42\n",
+	}
+	typesDB, err := api.NewTypesDB(strings.NewReader("cpu value:DERIVE:0:U\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, input := range inputs {
+		vls, err := readValueLists(strings.NewReader(input), formatAuto, typesDB)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		c, err := collector.New(nil, collector.Options{KeepExpired: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, vl := range vls {
+			c.Ingest(vl)
+		}
+		var out bytes.Buffer
+		if err := writeSeries(&out, c); err != nil {
+			t.Fatal(err)
+		}
+
+		want := `# HELP collectd_cpu_total Collectd exporter: 'cpu' Type: 'cpu' Dstype: 'api.Derive' Dsname: 'value'
+# TYPE collectd_cpu_total counter
+collectd_cpu_total{cpu="0",instance="example.com",type="user"} 42
+`
+		if out.String() != want {
+			t.Errorf("%s: got output\n%s\nwant\n%s", name, out.String(), want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// dryRunPrinter returns a collector.Options.Tap printing the series converted
+// from every value list to w, one sample per line in the text exposition
+// format without HELP and TYPE comments. Samples are given the time of their
+// value list as timestamp.
+func dryRunPrinter(w io.Writer, logger *slog.Logger) func(api.ValueList, prometheus.Collector) {
+	return func(vl api.ValueList, series prometheus.Collector) {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(series)
+		mfs, err := reg.Gather()
+		if err != nil {
+			logger.Warn("Error converting value list", "identifier", vl.Identifier.String(), "err", err)
+		}
+
+		var buf bytes.Buffer
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				if m.TimestampMs == nil {
+					ms := vl.Time.UnixMilli()
+					m.TimestampMs = &ms
+				}
+			}
+			if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+				logger.Warn("Error formatting series", "name", mf.GetName(), "err", err)
+			}
+		}
+		var out bytes.Buffer
+		for _, line := range bytes.SplitAfter(buf.Bytes(), []byte("\n")) {
+			if !bytes.HasPrefix(line, []byte("#")) {
+				out.Write(line)
+			}
+		}
+		if _, err := w.Write(out.Bytes()); err != nil {
+			logger.Warn("Error printing series", "err", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestDryRunPrinter(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := collector.New(nil, collector.Options{Tap: dryRunPrinter(&buf, promslog.NewNopLogger())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "idle"},
+		Time:       time.UnixMilli(1700000000000),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Derive(1234)},
+		DSNames:    []string{"value"},
+	})
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.UnixMilli(1700000001000),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(0.5), api.Gauge(0.25)},
+		DSNames:    []string{"shortterm", "midterm"},
+	})
+
+	want := `collectd_cpu_total{cpu="0",instance="example.com",type="idle"} 1234 1700000000000
+collectd_load_midterm{instance="example.com"} 0.25 1700000001000
+collectd_load_shortterm{instance="example.com"} 0.5 1700000001000
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sink is a named destination of received value lists.
+type sink struct {
+	name string
+	w    api.Writer
+}
+
+// fanout writes every value list to all of its sinks in order, such as the
+// cache, relays and the recording. A sink failing does not prevent writing
+// to the others. It implements prometheus.Collector.
+type fanout struct {
+	sinks []sink
+
+	valueLists  *prometheus.CounterVec
+	writeErrors *prometheus.CounterVec
+	duration    *prometheus.CounterVec
+}
+
+// newFanout returns a fanout without sinks.
+func newFanout() *fanout {
+	return &fanout{
+		valueLists: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_sink_value_lists_total",
+				Help: "Number of value lists written, by sink.",
+			},
+			[]string{"sink"},
+		),
+		writeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_sink_write_errors_total",
+				Help: "Number of value lists that could not be written, by sink.",
+			},
+			[]string{"sink"},
+		),
+		duration: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_sink_write_seconds_total",
+				Help: "Time spent writing value lists, by sink.",
+			},
+			[]string{"sink"},
+		),
+	}
+}
+
+// add adds w as a sink with the given name, which is used as the "sink"
+// label of the metrics. add must not be called once value lists are written.
+func (f *fanout) add(name string, w api.Writer) {
+	f.sinks = append(f.sinks, sink{name: name, w: w})
+	f.valueLists.WithLabelValues(name)
+	f.writeErrors.WithLabelValues(name)
+	f.duration.WithLabelValues(name)
+}
+
+// Write implements api.Writer. It returns the first error of any sink.
+func (f *fanout) Write(ctx context.Context, vl *api.ValueList) error {
+	var firstErr error
+	for _, s := range f.sinks {
+		start := time.Now()
+		err := s.w.Write(ctx, vl)
+		f.duration.WithLabelValues(s.name).Add(time.Since(start).Seconds())
+		f.valueLists.WithLabelValues(s.name).Inc()
+		if err != nil {
+			f.writeErrors.WithLabelValues(s.name).Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Collect implements prometheus.Collector.
+func (f *fanout) Collect(ch chan<- prometheus.Metric) {
+	f.valueLists.Collect(ch)
+	f.writeErrors.Collect(ch)
+	f.duration.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (f *fanout) Describe(ch chan<- *prometheus.Desc) {
+	f.valueLists.Describe(ch)
+	f.writeErrors.Describe(ch)
+	f.duration.Describe(ch)
+}
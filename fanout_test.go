@@ -0,0 +1,62 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFanout(t *testing.T) {
+	errDown := errors.New("relay down")
+	var cached []*api.ValueList
+	f := newFanout()
+	f.add("relay", api.WriterFunc(func(context.Context, *api.ValueList) error {
+		return errDown
+	}))
+	f.add("cache", api.WriterFunc(func(_ context.Context, vl *api.ValueList) error {
+		cached = append(cached, vl)
+		return nil
+	}))
+
+	vl := &api.ValueList{Identifier: api.Identifier{Plugin: "load", Type: "load"}}
+	if err := f.Write(context.Background(), vl); !errors.Is(err, errDown) {
+		t.Errorf("got error %v, want %v", err, errDown)
+	}
+	if len(cached) != 1 || cached[0] != vl {
+		t.Errorf("failing sink prevented writing to the others, got %v", cached)
+	}
+
+	want := `
+# HELP collectd_exporter_sink_value_lists_total Number of value lists written, by sink.
+# TYPE collectd_exporter_sink_value_lists_total counter
+collectd_exporter_sink_value_lists_total{sink="cache"} 1
+collectd_exporter_sink_value_lists_total{sink="relay"} 1
+# HELP collectd_exporter_sink_write_errors_total Number of value lists that could not be written, by sink.
+# TYPE collectd_exporter_sink_write_errors_total counter
+collectd_exporter_sink_write_errors_total{sink="cache"} 0
+collectd_exporter_sink_write_errors_total{sink="relay"} 1
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(f)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_exporter_sink_value_lists_total", "collectd_exporter_sink_write_errors_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// leaderLock is a lock held by at most one exporter of a high-availability
+// pair at a time.
+type leaderLock interface {
+	// acquire takes the lock, or renews it if it is held already, and
+	// returns whether it is held.
+	acquire(ctx context.Context) (bool, error)
+	// release gives up the lock, if it is held.
+	release(ctx context.Context) error
+}
+
+// leaderElection makes the exporter the leader of a high-availability pair
+// while it holds a lock. Both exporters receive the same value lists, but
+// only the leader exposes the converted series, so that they are not
+// scraped twice.
+type leaderElection struct {
+	lock     leaderLock
+	interval time.Duration
+	logger   *slog.Logger
+	leader   atomic.Bool
+	gauge    prometheus.Gauge
+}
+
+// newLeaderElection returns the leader election configured by the command
+// line flags. The exporter is identified in the lock by its address.
+func newLeaderElection(flags *web.FlagConfig, logger *slog.Logger) (*leaderElection, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	holder := exporterAddress(tcpListenAddress(flags), hostname)
+
+	var lock leaderLock
+	switch {
+	case *haLockFile != "" && *haConsulLockKey != "":
+		return nil, errors.New("--ha.lock-file and --ha.consul-lock-key are mutually exclusive")
+	case *haLockFile != "":
+		if lock, err = newFileLock(*haLockFile); err != nil {
+			return nil, err
+		}
+	case *consulAddress == "":
+		return nil, errors.New("--ha.consul-lock-key requires --consul.address")
+	default:
+		agent, err := url.Parse(*consulAddress)
+		if err != nil {
+			return nil, err
+		}
+		lock = &consulLock{
+			Agent:  agent,
+			Token:  os.Getenv("CONSUL_HTTP_TOKEN"),
+			Key:    strings.TrimPrefix(*haConsulLockKey, "/"),
+			Holder: holder,
+			TTL:    *haLeaseDuration,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return &leaderElection{
+		lock:     lock,
+		interval: *haLeaseDuration / 3,
+		logger:   logger,
+		gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "collectd_exporter_leader",
+			Help: "Whether the exporter is the leader of its high-availability pair and exposes the converted series.",
+		}),
+	}, nil
+}
+
+// run tries to acquire the lock every interval until ctx is canceled, after
+// which the lock is released, so that the standby takes over right away. The
+// exporter stands by while the state of the lock is unknown.
+func (e *leaderElection) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		held, err := e.lock.acquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			e.logger.Warn("Error acquiring the leader lock", "err", err)
+		}
+		e.set(held && err == nil)
+
+		select {
+		case <-ctx.Done():
+			e.set(false)
+			rctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := e.lock.release(rctx); err != nil {
+				e.logger.Warn("Error releasing the leader lock", "err", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *leaderElection) set(leader bool) {
+	if e.leader.Swap(leader) != leader {
+		if leader {
+			e.logger.Info("Became the leader, exposing converted series")
+		} else {
+			e.logger.Info("Standing by, not exposing converted series")
+		}
+	}
+	if leader {
+		e.gauge.Set(1)
+	} else {
+		e.gauge.Set(0)
+	}
+}
+
+// gate returns collect while the exporter is the leader, and standby
+// otherwise.
+func (e *leaderElection) gate(collect, standby func(context.Context) prometheus.Collector) func(context.Context) prometheus.Collector {
+	return func(ctx context.Context) prometheus.Collector {
+		if e.leader.Load() {
+			return collect(ctx)
+		}
+		return standby(ctx)
+	}
+}
+
+// gateHandler serves h while the exporter is the leader, and an empty
+// response otherwise.
+func (e *leaderElection) gateHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !e.leader.Load() {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// consulLock is a leaderLock on a key of the Consul KV store, held by a
+// session that is renewed on every acquisition. If the exporter dies, the
+// session expires after TTL and the standby takes over.
+type consulLock struct {
+	Agent  *url.URL
+	Token  string
+	Key    string
+	Holder string
+	TTL    time.Duration
+	Client *http.Client
+
+	session string
+}
+
+// acquire implements leaderLock.
+func (l *consulLock) acquire(ctx context.Context) (bool, error) {
+	if l.session != "" {
+		err := l.put(ctx, "/v1/session/renew/"+url.PathEscape(l.session), nil, nil)
+		var cerr *consulError
+		if errors.As(err, &cerr) && cerr.code == http.StatusNotFound {
+			// The session expired, e.g. because the agent was
+			// unreachable, and with it the lock.
+			l.session = ""
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if l.session == "" {
+		var session struct{ ID string }
+		err := l.put(ctx, "/v1/session/create", map[string]string{
+			"Name":      "collectd_exporter leader " + l.Holder,
+			"TTL":       l.TTL.String(),
+			"Behavior":  "release",
+			"LockDelay": "0s",
+		}, &session)
+		if err != nil {
+			return false, err
+		}
+		l.session = session.ID
+	}
+	var held bool
+	err := l.put(ctx, "/v1/kv/"+l.Key+"?acquire="+url.QueryEscape(l.session), l.Holder, &held)
+	return held, err
+}
+
+// release implements leaderLock.
+func (l *consulLock) release(ctx context.Context) error {
+	if l.session == "" {
+		return nil
+	}
+	// Destroying the session releases the lock.
+	err := l.put(ctx, "/v1/session/destroy/"+url.PathEscape(l.session), nil, nil)
+	l.session = ""
+	return err
+}
+
+func (l *consulLock) put(ctx context.Context, p string, body, out any) error {
+	return consulPut(ctx, l.Client, l.Agent, l.Token, p, body, out)
+}
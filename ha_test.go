@@ -0,0 +1,234 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader.lock")
+	a, err := newFileLock(path)
+	if err != nil {
+		t.Skip(err)
+	}
+	b, _ := newFileLock(path)
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		lock leaderLock
+		want bool
+	}{
+		{a, true},
+		{b, false},
+		{a, true},
+	} {
+		if held, err := step.lock.acquire(ctx); err != nil || held != step.want {
+			t.Fatalf("got held %t, %v, want %t", held, err, step.want)
+		}
+	}
+	if err := a.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := b.acquire(ctx); err != nil || !held {
+		t.Errorf("standby did not take over the released lock: %t, %v", held, err)
+	}
+	b.release(ctx)
+}
+
+// fakeConsulKV implements the session and KV lock endpoints of a Consul agent.
+type fakeConsulKV struct {
+	mu       sync.Mutex
+	sessions map[string]bool
+	holder   map[string]string
+	next     int
+}
+
+func (f *fakeConsulKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch p := r.URL.Path; {
+	case p == "/v1/session/create":
+		f.next++
+		id := strings.Repeat("s", f.next)
+		f.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(p, "/v1/session/renew/"):
+		if !f.sessions[strings.TrimPrefix(p, "/v1/session/renew/")] {
+			http.Error(w, "session not found", http.StatusNotFound)
+		}
+	case strings.HasPrefix(p, "/v1/session/destroy/"):
+		f.expire(strings.TrimPrefix(p, "/v1/session/destroy/"))
+	case strings.HasPrefix(p, "/v1/kv/"):
+		key, session := strings.TrimPrefix(p, "/v1/kv/"), r.URL.Query().Get("acquire")
+		if !f.sessions[session] {
+			http.Error(w, "invalid session", http.StatusInternalServerError)
+			return
+		}
+		if f.holder[key] == "" {
+			f.holder[key] = session
+		}
+		json.NewEncoder(w).Encode(f.holder[key] == session)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// expire invalidates a session, releasing its locks.
+func (f *fakeConsulKV) expire(session string) {
+	delete(f.sessions, session)
+	for key, s := range f.holder {
+		if s == session {
+			delete(f.holder, key)
+		}
+	}
+}
+
+func TestConsulLock(t *testing.T) {
+	kv := &fakeConsulKV{sessions: map[string]bool{}, holder: map[string]string{}}
+	agent := httptest.NewServer(kv)
+	defer agent.Close()
+	agentURL, _ := url.Parse(agent.URL)
+	newLock := func(holder string) *consulLock {
+		return &consulLock{Agent: agentURL, Key: "service/collectd-exporter/leader", Holder: holder, TTL: 15 * time.Second, Client: agent.Client()}
+	}
+	a, b := newLock("a:9103"), newLock("b:9103")
+	ctx := context.Background()
+
+	if held, err := a.acquire(ctx); err != nil || !held {
+		t.Fatalf("leader did not acquire the lock: %t, %v", held, err)
+	}
+	if held, err := b.acquire(ctx); err != nil || held {
+		t.Fatalf("standby acquired the held lock: %t, %v", held, err)
+	}
+	if held, err := a.acquire(ctx); err != nil || !held {
+		t.Fatalf("leader did not renew the lock: %t, %v", held, err)
+	}
+
+	// The session of the leader expires, e.g. while it was partitioned.
+	kv.mu.Lock()
+	kv.expire(a.session)
+	kv.mu.Unlock()
+	if held, err := b.acquire(ctx); err != nil || !held {
+		t.Fatalf("standby did not take over the expired lock: %t, %v", held, err)
+	}
+	if held, err := a.acquire(ctx); err != nil || held {
+		t.Fatalf("former leader acquired the lock with a new session: %t, %v", held, err)
+	}
+
+	if err := b.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := a.acquire(ctx); err != nil || !held {
+		t.Errorf("lock not acquired after release: %t, %v", held, err)
+	}
+}
+
+// fakeLock is a leaderLock held while held is set.
+type fakeLock struct {
+	mu       sync.Mutex
+	held     bool
+	released chan struct{}
+}
+
+func (l *fakeLock) acquire(context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held, nil
+}
+
+func (l *fakeLock) release(context.Context) error {
+	close(l.released)
+	return nil
+}
+
+func TestLeaderElection(t *testing.T) {
+	lock := &fakeLock{released: make(chan struct{})}
+	e := &leaderElection{
+		lock:     lock,
+		interval: time.Millisecond,
+		logger:   promslog.NewNopLogger(),
+		gauge:    prometheus.NewGauge(prometheus.GaugeOpts{Name: "leader"}),
+	}
+	series := prometheus.NewGauge(prometheus.GaugeOpts{Name: "series"})
+	collect := e.gate(
+		func(context.Context) prometheus.Collector { return series },
+		func(context.Context) prometheus.Collector { return prometheus.NewRegistry() },
+	)
+	count := func() int { return testutil.CollectAndCount(collect(context.Background())) }
+	waitFor := func(leader bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); e.leader.Load() != leader; {
+			if time.Now().After(deadline) {
+				t.Fatalf("leader state did not change to %t", leader)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.run(ctx)
+	}()
+	if n := count(); n != 0 {
+		t.Errorf("standby exposed %d series", n)
+	}
+
+	lock.mu.Lock()
+	lock.held = true
+	lock.mu.Unlock()
+	waitFor(true)
+	if n := count(); n != 1 {
+		t.Errorf("leader exposed %d series, want 1", n)
+	}
+	if v := testutil.ToFloat64(e.gauge); v != 1 {
+		t.Errorf("got leader gauge %v, want 1", v)
+	}
+	rec := httptest.NewRecorder()
+	e.gateHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("series")) })).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/host/a", nil))
+	if rec.Body.String() != "series" {
+		t.Errorf("leader got body %q", rec.Body)
+	}
+
+	cancel()
+	<-done
+	select {
+	case <-lock.released:
+	default:
+		t.Error("lock not released on shutdown")
+	}
+	if n := count(); n != 0 {
+		t.Errorf("exporter exposed %d series after shutting down", n)
+	}
+	rec = httptest.NewRecorder()
+	e.gateHandler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/host/a", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("standby got status %d and body %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileLock is a leaderLock on a file, held using flock(2) for as long as the
+// exporter keeps it open. The kernel releases it when the exporter dies.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+func newFileLock(path string) (leaderLock, error) {
+	return &fileLock{path: path}, nil
+}
+
+// acquire implements leaderLock.
+func (l *fileLock) acquire(context.Context) (bool, error) {
+	if l.f != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	l.f = f
+	return true, nil
+}
+
+// release implements leaderLock.
+func (l *fileLock) release(context.Context) error {
+	if l.f == nil {
+		return nil
+	}
+	// Closing the file releases the lock.
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/collectd_exporter/collector"
+)
+
+// hostMetricsHandler serves the series of the host named by the "host" path
+// value, so that every collectd host can be scraped as a target of its own.
+// Hosts without series are answered with 404 Not Found, which Prometheus
+// reports as the target being down. See handlerFor for createdLines.
+func hostMetricsHandler(c *collector.Collector, opts promhttp.HandlerOpts, createdLines bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(c.HostSeries(ctx, r.PathValue("host")))
+		// Gather only once, as series may expire after being scraped.
+		mfs, err := reg.Gather()
+		if err == nil && len(mfs) == 0 {
+			http.Error(w, "no series for host", http.StatusNotFound)
+			return
+		}
+		gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, err })
+		handlerFor(gatherer, opts, createdLines).ServeHTTP(w, r)
+	})
+}
+
+// sdTargetGroup is a target group in the format of Prometheus' HTTP service
+// discovery.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler serves the hosts known to c as targets for Prometheus' HTTP
+// service discovery. Each target refers to the host's page below
+// metricsPath on the address the discovery request was sent to.
+func sdHandler(c *collector.Collector, metricsPath string, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		groups := []sdTargetGroup{}
+		for _, h := range c.Hosts() {
+			groups = append(groups, sdTargetGroup{
+				Targets: []string{r.Host},
+				Labels: map[string]string{
+					"__scheme__":       scheme,
+					"__metrics_path__": path.Join(metricsPath, "host", h.Name),
+					"instance":         h.Name,
+				},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(groups); err != nil {
+			logger.Debug("Error writing service discovery response", "err", err)
+		}
+	})
+}
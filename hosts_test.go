@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestHostMetricsHandler(t *testing.T) {
+	c, err := collector.New(nil, collector.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: "load", Type: "load"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		})
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics/host/{host}", hostMetricsHandler(c, promhttp.HandlerOpts{}, false))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/host/a.example.com", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `collectd_load{instance="a.example.com"} 1`) || strings.Contains(body, "b.example.com") {
+		t.Errorf("got body %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/host/c.example.com", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for unknown host, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestSDHandler(t *testing.T) {
+	c, err := collector.New(nil, collector.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sdHandler(c, "/metrics", promslog.NewNopLogger())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://exporter:9103/sd", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "[]" {
+		t.Errorf("got %s without hosts, want []", got)
+	}
+
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "a.example.com", Plugin: "load", Type: "load"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://exporter:9103/sd", nil))
+	want := `[{"targets":["exporter:9103"],"labels":{"__metrics_path__":"/metrics/host/a.example.com","__scheme__":"http","instance":"a.example.com"}}]`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q", ct)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"collectd.org/network"
+)
+
+// maxPacketSize is the size of the largest UDP packet.
+const maxPacketSize = 65535
+
+// listener is a binary protocol listener given by --collectd.listen-address.
+type listener struct {
+	addr          string
+	readBuffer    int
+	packetSize    int
+	securityLevel network.SecurityLevel
+	iface         string
+	device        string
+}
+
+// parsePrefixes parses a comma-separated list of networks in CIDR notation.
+// Single addresses are accepted as networks of their own.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseListener parses a listen address optionally followed by
+// comma-separated options overriding the global defaults, e.g.
+// "239.192.74.66:25826,security-level=Sign,udp-buffer=1048576".
+func parseListener(s string, defaults listener) (listener, error) {
+	fields := strings.Split(s, ",")
+	l := defaults
+	l.addr = fields[0]
+	if l.addr == "" {
+		return l, fmt.Errorf("%q: missing address", s)
+	}
+
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return l, fmt.Errorf("%q: expected option=value, got %q", s, field)
+		}
+
+		var err error
+		switch name {
+		case "udp-buffer":
+			l.readBuffer, err = strconv.Atoi(value)
+		case "packet-size":
+			l.packetSize, err = strconv.Atoi(value)
+		case "security-level":
+			l.securityLevel, err = parseSecurityLevel(value)
+		case "interface":
+			l.iface = value
+		case "device":
+			l.device = value
+		default:
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			return l, fmt.Errorf("%q: %w", s, err)
+		}
+	}
+	if l.packetSize < 1 || l.packetSize > maxPacketSize {
+		return l, fmt.Errorf("%q: packet size must be between 1 and %d", s, maxPacketSize)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"collectd.org/network"
+)
+
+func TestParseListener(t *testing.T) {
+	defaults := listener{readBuffer: 1024, packetSize: 1452, securityLevel: network.Sign}
+
+	cases := []struct {
+		in   string
+		want listener
+		err  bool
+	}{
+		{in: ":25826", want: listener{addr: ":25826", readBuffer: 1024, packetSize: 1452, securityLevel: network.Sign}},
+		{
+			in:   "[::1]:25826,security-level=Encrypt,udp-buffer=4096,packet-size=8952,interface=eth1,device=eth0",
+			want: listener{addr: "[::1]:25826", readBuffer: 4096, packetSize: 8952, securityLevel: network.Encrypt, iface: "eth1", device: "eth0"},
+		},
+		{in: "", err: true},
+		{in: ":25826,udp-buffer", err: true},
+		{in: ":25826,udp-buffer=large", err: true},
+		{in: ":25826,packet-size=jumbo", err: true},
+		{in: ":25826,packet-size=65536", err: true},
+		{in: ":25826,security-level=Maximum", err: true},
+		{in: ":25826,unknown=1", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseListener(c.in, defaults)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: got %+v, want %+v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestParsePrefixes(t *testing.T) {
+	got, err := parsePrefixes("10.0.0.0/8, 192.168.1.1/24,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := parsePrefixes(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
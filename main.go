@@ -15,24 +15,33 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
+	"math"
 	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"collectd.org/api"
 	"collectd.org/network"
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/pion/dtls/v3"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	versioncollector "github.com/prometheus/client_golang/prometheus/collectors/version"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/collectd_exporter/source"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/promslog"
 	"github.com/prometheus/common/promslog/flag"
 	"github.com/prometheus/common/version"
@@ -40,313 +49,819 @@ import (
 	"github.com/prometheus/exporter-toolkit/web/kingpinflag"
 )
 
-// timeout specifies the number of iterations after which a metric times out,
-// i.e. becomes stale and is removed from collectdCollector.valueLists. It is
-// modeled and named after the top-level "Timeout" setting of collectd.
-const timeout = 2
-
 var (
-	collectdAddress  = kingpin.Flag("collectd.listen-address", "Network address on which to accept collectd binary network packets, e.g. \":25826\".").Default("").String()
-	collectdBuffer   = kingpin.Flag("collectd.udp-buffer", "Size of the receive buffer of the socket used by collectd binary protocol receiver.").Default("0").Int()
-	collectdAuth     = kingpin.Flag("collectd.auth-file", "File mapping user names to pre-shared keys (passwords).").Default("").String()
-	collectdSecurity = kingpin.Flag("collectd.security-level", "Minimum required security level for accepted packets. Must be one of \"None\", \"Sign\" and \"Encrypt\".").Default("None").String()
-	collectdTypesDB  = kingpin.Flag("collectd.typesdb-file", "Collectd types.db file for datasource names mapping. Needed only if using a binary network protocol.").Default("").String()
-	metricsPath      = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
-	collectdPostPath = kingpin.Flag("web.collectd-push-path", "Path under which to accept POST requests from collectd.").Default("/collectd-post").String()
-	lastPush         = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "collectd_last_push_timestamp_seconds",
-			Help: "Unix timestamp of the last received collectd metrics push in seconds.",
-		},
-	)
-	metric_name_re = regexp.MustCompile("[^a-zA-Z0-9_:]")
+	collectdAddress    = kingpin.Flag("collectd.listen-address", "Network address on which to accept collectd binary network packets, e.g. \":25826\". Can be repeated. Options overriding --collectd.udp-buffer, --collectd.packet-size, --collectd.security-level, --collectd.multicast-interface and --collectd.bind-device may follow the address, e.g. \":25826,udp-buffer=1048576,security-level=Encrypt\".").Strings()
+	collectdBuffer     = kingpin.Flag("collectd.udp-buffer", "Target size of the receive buffer of the socket used by collectd binary protocol receiver. If the system limits it, the buffer is raised as far as permitted and a warning is logged. 0 keeps the system default.").Default("0").Int()
+	packetSize         = kingpin.Flag("collectd.packet-size", "Size of the largest binary protocol packet accepted. Must be at least collectd's MaxPacketSize; larger packets are dropped.").Default(strconv.Itoa(network.DefaultBufferSize)).Int()
+	multicastInterface = kingpin.Flag("collectd.multicast-interface", "Network interface on which to join multicast groups given by --collectd.listen-address, e.g. \"eth1\". Defaults to the system's default interface.").Default("").String()
+	bindDevice         = kingpin.Flag("collectd.bind-device", "Network interface to bind the sockets given by --collectd.listen-address to, so that only packets received on it are accepted. Linux only.").Default("").String()
+	collectdAuth       = kingpin.Flag("collectd.auth-file", "File mapping user names to pre-shared keys (passwords).").Default("").String()
+	authDir            = kingpin.Flag("collectd.auth-dir", "Directory holding one file per user name containing its pre-shared key, e.g. a mounted Kubernetes secret. Files are re-read when they change. Consulted after --collectd.auth-file.").Default("").String()
+	authEnvPrefix      = kingpin.Flag("collectd.auth-env-prefix", "Prefix of environment variables holding pre-shared keys, followed by the user name, e.g. \"COLLECTD_PASSWORD_\". Consulted after --collectd.auth-dir.").Default("").String()
+	allowedSources     = kingpin.Flag("collectd.allowed-sources", "Comma-separated networks in CIDR notation, e.g. \"10.0.0.0/8,192.168.1.0/24\", from which binary protocol packets are accepted. Packets from other addresses are dropped before parsing. Empty accepts all.").Default("").String()
+	authFailureLog     = kingpin.Flag("collectd.auth-failure-log-interval", "Log packets failing signature verification or decryption at warn level, at most once per interval for each sender. 0 disables logging.").Default("0").Duration()
+	quarantineSize     = kingpin.Flag("collectd.quarantine-size", "Number of recent payloads that could not be converted to value lists, kept for inspection via /debug/invalid-payloads. 0 only counts them.").Default("0").Int()
+	collectdSecurity   = kingpin.Flag("collectd.security-level", "Minimum required security level for accepted packets. Must be one of \"None\", \"Sign\" and \"Encrypt\".").Default("None").String()
+	dtlsAddress        = kingpin.Flag("collectd.dtls-listen-address", "Network address on which to accept collectd binary network packets over DTLS, e.g. \":25827\".").Default("").String()
+	dtlsCertFile       = kingpin.Flag("collectd.dtls-cert-file", "Certificate presented to DTLS clients, in PEM format.").Default("").String()
+	dtlsKeyFile        = kingpin.Flag("collectd.dtls-key-file", "Private key of the DTLS certificate, in PEM format.").Default("").String()
+	dtlsClientCAFile   = kingpin.Flag("collectd.dtls-client-ca-file", "CA certificates in PEM format. If set, DTLS clients must present a certificate signed by one of them.").Default("").String()
+	graphiteAddress    = kingpin.Flag("graphite.listen-address", "Address on which to accept values in the Graphite plaintext protocol over TCP and UDP, as sent by collectd's write_graphite plugin, e.g. \":2003\".").Default("").String()
+	graphiteTemplate   = kingpin.Flag("graphite.template", "Template mapping the components of Graphite paths to collectd identifiers. See the README.").Default(source.DefaultGraphiteTemplate).String()
+	restartBackoff     = kingpin.Flag("collectd.max-restart-backoff", "Maximum delay before restarting a listener that failed, e.g. because its network interface went away. 0 terminates the exporter instead.").Default("1m").Duration()
+	relayAddresses     = kingpin.Flag("collectd.relay-address", "Address of a collectd server to forward all received value lists to using the binary network protocol. Can be repeated.").Strings()
+	relaySecurity      = kingpin.Flag("collectd.relay-security-level", "Security level for forwarded packets. Must be one of \"None\", \"Sign\" and \"Encrypt\".").Default("None").String()
+	relayUsername      = kingpin.Flag("collectd.relay-username", "User name used to sign or encrypt forwarded packets.").Default("").String()
+	relayPasswordFile  = kingpin.Flag("collectd.relay-password-file", "File containing the password used to sign or encrypt forwarded packets.").Default("").String()
+	relayPasswordEnv   = kingpin.Flag("collectd.relay-password-env", "Environment variable containing the password used to sign or encrypt forwarded packets. Takes precedence over --collectd.relay-password-file.").Default("").String()
+	relayFlushInterval = kingpin.Flag("collectd.relay-flush-interval", "Maximum time forwarded value lists are buffered before being sent.").Default("1s").Duration()
+	unknownTypeTTL     = kingpin.Flag("collectd.unknown-type-ttl", "Time after which a type missing from the types.db that is no longer received is forgotten. Value lists of such types are logged once per type until then, and listed on /debug/unknown-types.").Default("1h").Duration()
+	collectdTypesDB    = kingpin.Flag("collectd.typesdb-file", "Collectd types.db file for datasource names mapping. Needed only if using a binary network protocol. Can be repeated, later files take precedence.").Strings()
+	counterWrap        = kingpin.Flag("collector.counter-wrap-detection", "Detect wrap-arounds of 32-bit COUNTER values and correct them, so that exported counters keep increasing.").Default("false").Bool()
+	typesDBBounds      = kingpin.Flag("collector.typesdb-bounds", "What to do with values outside of the minimum and maximum declared in the types.db file. One of \"ignore\", \"drop\" and \"clamp\".").Default(string(collector.BoundsIgnore)).Enum(string(collector.BoundsIgnore), string(collector.BoundsDrop), string(collector.BoundsClamp))
+	labelCollisions    = kingpin.Flag("collector.label-collisions", "How to name the label holding the plugin instance of the \"instance\" and \"type\" plugins, which collides with the host or type instance label. One of \"overwrite\", \"prefix\" (plugin_<plugin>) and \"plugin-instance\".").Default(string(collector.CollisionOverwrite)).Enum(string(collector.CollisionOverwrite), string(collector.CollisionPrefix), string(collector.CollisionPluginInstance))
+	hostNormalization  = kingpin.Flag("collector.host-normalization", "How to normalize host names before they are exported as the instance label, e.g. so that WEB01 and web01 are one host. One of \"preserve\", \"lowercase\" and \"map\", which replaces the host names listed in the host_map of --config.file regardless of their case.").Default(string(collector.HostPreserve)).Enum(string(collector.HostPreserve), string(collector.HostLowercase), string(collector.HostMap))
+	maxLabelLength     = kingpin.Flag("collector.max-label-length", "Maximum length in bytes of label values converted from plugin and type instances. 0 means no limit.").Default("0").Int()
+	longLabels         = kingpin.Flag("collector.long-labels", "What to do with plugin and type instances longer than --collector.max-label-length. One of \"truncate\", \"hash\" and \"drop\".").Default(string(collector.LabelLimitTruncate)).Enum(string(collector.LabelLimitTruncate), string(collector.LabelLimitHash), string(collector.LabelLimitDrop))
+	profile            = kingpin.Flag("collector.profile", "Built-in naming profile for common plugins. One of \"none\" and \"node\" (node_exporter names, labels and units for the cpu, memory, df, interface, load and disk plugins).").Default(string(collector.ProfileNone)).Enum(string(collector.ProfileNone), string(collector.ProfileNode))
+	dsLabel            = kingpin.Flag("collector.ds-label", "Name of a label holding the data source name of value lists with several data sources of the same type, e.g. \"ds\", instead of appending it to the metric name. Empty appends it.").Default("").String()
+	identifierMode     = kingpin.Flag("collector.identifier", "Expose the collectd identifier of converted series. One of \"none\", \"label\" (an identifier label on all series) and \"info\" (a collectd_identifier_info metric per value list).").Default(string(collector.IdentifierNone)).Enum(string(collector.IdentifierNone), string(collector.IdentifierLabel), string(collector.IdentifierInfo))
+	hostRetention      = kingpin.Flag("collector.host-retention", "How long to export the time the last value list was received from a host that stopped sending.").Default(collector.DefaultHostRetention.String()).Duration()
+	defaultInterval    = kingpin.Flag("collector.default-interval", "Interval assumed for value lists received without one, e.g. pushed by scripts. 0 expires them immediately.").Default("10s").Duration()
+	maxHostSeries      = kingpin.Flag("collector.max-series-per-host", "Maximum number of series the cached value lists of one host are converted to. Value lists of new identifiers exceeding it are dropped and counted in collectd_exporter_series_quota_exceeded_total. 0 means no limit.").Default("0").Int()
+	maxMemory          = kingpin.Flag("collector.max-memory-bytes", "Approximate maximum memory consumed by cached value lists, e.g. \"512MB\". Once exceeded, the value lists least recently updated are evicted. 0 means no limit.").Default("0").Bytes()
+	accountingLimit    = kingpin.Flag("collector.accounting-limit", "Number of plugins and hosts the received values and bytes are counted for individually, e.g. to find the hosts sending the most data. Further plugins and hosts are counted as \""+collector.AccountingOther+"\". 0 disables the accounting.").Default("0").Int()
+	gcInterval         = kingpin.Flag("collector.gc-interval", "Maximum interval between two removals of expired value lists from the cache. They are removed earlier once the first cached value list expires, but never more often than every 10 seconds.").Default(collector.DefaultGCInterval.String()).Duration()
+	gcJitter           = kingpin.Flag("collector.gc-jitter", "Maximum fraction of the delay until the next removal of expired value lists added at random, so that the removals do not coincide with scrapes. Between 0 and 1.").Default("0.1").Float64()
+	maxClockSkew       = kingpin.Flag("collector.max-clock-skew", "Difference between the time of a value list and the time it is received, beyond its interval for value lists lagging behind, above which it is counted in collectd_exporter_clock_skew_exceeded_total.").Default(collector.DefaultMaxClockSkew.String()).Duration()
+	snapshotInterval   = kingpin.Flag("collector.snapshot-interval", "Interval in which the cache is converted to a snapshot served by scrapes, so that scrapes do not compete with ingestion. 0 converts the cache on every scrape.").Default("0s").Duration()
+	storeRates         = kingpin.Flag("collector.store-rates", "Convert DERIVE and COUNTER values to per-second rates and export them as gauges, like collectd's StoreRates option.").Default("false").Bool()
+	includePlugins     = kingpin.Flag("collector.include-plugins", "Regexp of collectd plugins to accept. Value lists of other plugins are dropped.").Default("").String()
+	excludePlugins     = kingpin.Flag("collector.exclude-plugins", "Regexp of collectd plugins to drop.").Default("").String()
+	includeTypes       = kingpin.Flag("collector.include-types", "Regexp of collectd types to accept. Value lists of other types are dropped.").Default("").String()
+	excludeTypes       = kingpin.Flag("collector.exclude-types", "Regexp of collectd types to drop.").Default("").String()
+	includeHosts       = kingpin.Flag("collector.include-hosts", "Regexp of collectd hosts to accept. Value lists of other hosts are dropped.").Default("").String()
+	excludeHosts       = kingpin.Flag("collector.exclude-hosts", "Regexp of collectd hosts to drop.").Default("").String()
+	pipeline           = kingpin.Flag("collector.pipeline", "Comma-separated order of the processing stages received value lists pass through. Stages disabled by other flags are skipped.").Default(strings.Join(collector.DefaultPipeline, ",")).String()
+	staticLabels       = kingpin.Flag("collector.label", "Label to add to all converted series, as name=value. Can be repeated.").StringMap()
+	envLabels          = kingpin.Flag("collector.env-label", "Label to add to all converted series, set to the value of an environment variable, as name=VARIABLE. Can be repeated.").StringMap()
+	cloudMetadata      = kingpin.Flag("collector.cloud-metadata", "Cloud provider whose metadata service is queried at startup for the region, zone and account labels added to all converted series. One of \"aws\" and \"gcp\".").Default("").Enum("", collector.CloudAWS, collector.CloudGCP)
+	exemplars          = kingpin.Flag("collector.exemplars", "Attach exemplars with the originating host and time to counters. Enables the OpenMetrics exposition format, which is required to expose them.").Default("false").Bool()
+	dedupeSenders      = kingpin.Flag("collector.dedupe-senders", "Keep the value lists of each identifier from a single source and address when redundant relays forward the same hosts. Another sender takes over after two intervals of silence.").Default("false").Bool()
+	exportedByLabel    = kingpin.Flag("collector.exported-by-label", "Add an exported_by label holding the host name and port of the exporter to all converted series, to tell exporters behind one load-balanced address apart. The host name replaces an unspecified host of the first --web.listen-address.").Default("false").Bool()
+	createdTimestamps  = kingpin.Flag("collector.created-timestamps", "Expose the time counters were first received, or last reset, as their created timestamp. Enables the OpenMetrics exposition format, in which they are sent as _created samples.").Default("false").Bool()
+	dryRun             = kingpin.Flag("dry-run", "Print every converted sample to stdout as it is received, with the time of its value list, instead of exposing the converted series under --web.telemetry-path. Useful to check changes of the configuration against live traffic.").Default("false").Bool()
+	logSample          = kingpin.Flag("log.sample-values", "Fraction of received value lists to log at info level with their source and resulting metric names, e.g. \"1/1000\". 0 disables logging.").Default("0").String()
+	tracingEndpoint    = kingpin.Flag("tracing.endpoint", "OTLP/HTTP endpoint to export OpenTelemetry traces to, e.g. \"http://localhost:4318\". Empty disables tracing.").Default("").String()
+	tracingSample      = kingpin.Flag("tracing.sample-ratio", "Fraction of traces to sample, e.g. \"1/100\". Traces propagated by clients follow the client's decision.").Default("1/100").String()
+	consulAddress      = kingpin.Flag("consul.address", "URL of a Consul agent to register the exporter with, e.g. \"http://localhost:8500\". The ACL token is read from CONSUL_HTTP_TOKEN. Empty disables registration.").Default("").String()
+	consulServiceName  = kingpin.Flag("consul.service-name", "Name of the exporter's Consul service.").Default("collectd-exporter").String()
+	consulServiceID    = kingpin.Flag("consul.service-id", "ID of the exporter's Consul service. Defaults to the service name.").Default("").String()
+	consulServiceAddr  = kingpin.Flag("consul.service-address", "Address under which Prometheus reaches the exporter, as host:port. Defaults to the first --web.listen-address.").Default("").String()
+	consulTags         = kingpin.Flag("consul.tag", "Tag of the Consul services. Can be repeated.").Strings()
+	consulCheckTTL     = kingpin.Flag("consul.check-ttl", "TTL of the Consul health check, which the exporter passes while it is processing value lists.").Default("30s").Duration()
+	consulHosts        = kingpin.Flag("consul.register-hosts", "Also register a service named after --consul.service-name with a \"-host\" suffix for every collectd host, to scrape hosts individually.").Default("false").Bool()
+	haLockFile         = kingpin.Flag("ha.lock-file", "File locked by the leader of an active/standby pair of exporters receiving the same value lists, on one host or a shared file system. Only the leader exposes the converted series. Empty disables the election, unless --ha.consul-lock-key is set.").Default("").String()
+	haConsulLockKey    = kingpin.Flag("ha.consul-lock-key", "Key in the Consul KV store locked by the leader of an active/standby pair of exporters, using the agent of --consul.address. Only the leader exposes the converted series.").Default("").String()
+	haLeaseDuration    = kingpin.Flag("ha.lease-duration", "Time after which a Consul lock of a leader that stopped renewing it is released. The lock is renewed, or tried to be acquired by the standby, every third of it.").Default("15s").Duration()
+	configFile         = kingpin.Flag("config.file", "Path to a YAML configuration file with mapping rules.").Default("").String()
+	metricsPath        = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
+	collectdPostPath   = kingpin.Flag("web.collectd-push-path", "Path under which to accept POST requests from collectd.").Default("/collectd-post").String()
+	pushLabels         = kingpin.Flag("web.collectd-push-allowed-labels", "Comma-separated names of the labels senders may add to pushed value lists via the \"labels\" query parameter or the "+source.LabelsHeader+" header, e.g. \"dc,team\". Empty rejects such labels.").Default("").String()
+	pushQueueSize      = kingpin.Flag("web.collectd-push-queue-size", "Number of pushed value lists to buffer, so that pushes are answered with 202 Accepted before the value lists are processed. Value lists beyond it are rejected. 0 processes them before answering.").Default("0").Int()
+	pushWorkers        = kingpin.Flag("web.collectd-push-workers", "Number of workers processing the value lists buffered by --web.collectd-push-queue-size.").Default("2").Int()
+	webSocketPath      = kingpin.Flag("web.collectd-websocket-path", "Path under which to accept WebSocket connections streaming value lists in collectd's JSON format. Empty disables WebSocket ingestion.").Default("").String()
+	influxWritePath    = kingpin.Flag("web.influx-write-path", "Path under which to accept POST requests in the InfluxDB line protocol, e.g. \"/write\". Empty disables the InfluxDB endpoint.").Default("").String()
+	promPushPath       = kingpin.Flag("web.prometheus-push-path", "Path under which to accept POST requests in the Prometheus text exposition format or the remote-write protocol, e.g. \"/api/v1/write\". Empty disables the Prometheus endpoint.").Default("").String()
+	proxyProtocol      = kingpin.Flag("web.proxy-protocol", "Require a PROXY protocol header on all HTTP connections, as sent by L4 load balancers such as HAProxy, and use the client address it carries. Only enable it if every client connects through such a proxy.").Default("false").Bool()
+	selfMetricsPath    = kingpin.Flag("web.self-metrics-path", "Path under which to expose the exporter's own metrics, e.g. \"/metrics/self\", instead of along with the converted metrics. Empty exposes them under --web.telemetry-path.").Default("").String()
+	disableRuntime     = kingpin.Flag("web.disable-runtime-metrics", "Do not expose the Go runtime and process metrics of the exporter.").Default("false").Bool()
+	accessLogs         = kingpin.Flag("web.access-log", "Log every HTTP request, e.g. scrapes and pushes, with its status, duration and sizes at info level.").Default("false").Bool()
+	enableAdminAPI     = kingpin.Flag("web.enable-admin-api", "Enable the API endpoints deleting cached hosts and value lists.").Default("false").Bool()
+	compression        = kingpin.Flag("web.compression", "Encoding to offer for the responses of the metrics and host pages, in order of preference: \"zstd\", \"gzip\" or \"identity\". Can be repeated. Responses to clients accepting none of them are not compressed. Defaults to identity, gzip and zstd.").Enums(string(promhttp.Identity), string(promhttp.Gzip), string(promhttp.Zstd))
+	maxSeries          = kingpin.Flag("web.max-series", "Maximum number of series converted from collectd per scrape of the metrics page. Larger scrapes fail, naming the number of shards to split them into with the shard=N/M query parameter. 0 means no limit.").Default("0").Int()
+	maxResponseBytes   = kingpin.Flag("web.max-response-bytes", "Maximum size of the responses of the metrics and host pages as sent, i.e. after compression, e.g. \"50MB\". Larger responses are aborted, failing the scrape instead of returning truncated series. 0 means no limit.").Default("0").Bytes()
+	maxScrapes         = kingpin.Flag("web.max-concurrent-scrapes", "Maximum number of scrapes of the metrics and host pages served at the same time. Further scrapes are rejected with 503 Service Unavailable. 0 means no limit.").Default("0").Int()
+	shutdownScrape     = kingpin.Flag("web.shutdown-scrape-wait", "Maximum time to wait on shutdown, after all received value lists have been processed, for a final scrape. 0 shuts down without waiting.").Default("0").Duration()
+	shutdownTimeout    = kingpin.Flag("web.shutdown-timeout", "Maximum time to wait on shutdown for HTTP requests in flight.").Default("10s").Duration()
+	pushAddress        = kingpin.Flag("web.collectd-push-listen-address", "Address on which to serve --web.collectd-push-path instead of --web.listen-address, e.g. \":9104\". Empty serves both on --web.listen-address.").Default("").String()
+	pushConfigFile     = kingpin.Flag("web.collectd-push-config-file", "Path to configuration file that can enable TLS or authentication for --web.collectd-push-listen-address. See: https://github.com/prometheus/exporter-toolkit/blob/master/docs/web-configuration.md").Default("").String()
+	recordFile         = kingpin.Flag("record.file", "File to append all received value lists to, for later use with the replay command.").Default("").String()
+	remoteWriteURL     = kingpin.Flag("remote-write.url", "Prometheus remote write endpoint to send the converted series to, e.g. \"http://localhost:9090/api/v1/write\". Expired series are marked stale. Empty disables remote write.").Default("").String()
+	remoteWriteEvery   = kingpin.Flag("remote-write.interval", "Interval in which to send the converted series to --remote-write.url.").Default("15s").Duration()
 )
 
-// newName converts one data source of a value list to a string representation.
-func newName(vl api.ValueList, index int) string {
-	var name string
-	if vl.Plugin == vl.Type {
-		name = "collectd_" + vl.Type
-	} else {
-		name = "collectd_" + vl.Plugin + "_" + vl.Type
-	}
-	if dsname := vl.DSName(index); dsname != "value" {
-		name += "_" + dsname
-	}
-	switch vl.Values[index].(type) {
-	case api.Counter, api.Derive:
-		name += "_total"
+// loadTypesDB parses and merges the types.db files at paths.
+func loadTypesDB(paths []string) (*api.TypesDB, error) {
+	var typesDB *api.TypesDB
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		db, err := api.NewTypesDB(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if typesDB == nil {
+			typesDB = db
+		} else {
+			typesDB.Merge(db)
+		}
 	}
 
-	return metric_name_re.ReplaceAllString(name, "_")
+	return typesDB, nil
+}
+
+// parseSecurityLevel parses the name of a collectd security level.
+func parseSecurityLevel(s string) (network.SecurityLevel, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return network.None, nil
+	case "sign":
+		return network.Sign, nil
+	case "encrypt":
+		return network.Encrypt, nil
+	default:
+		return network.None, fmt.Errorf("unknown security level %q", s)
+	}
 }
 
-// newLabels converts the plugin and type instance of vl to a set of prometheus.Labels.
-func newLabels(vl api.ValueList) prometheus.Labels {
-	labels := prometheus.Labels{}
-	if vl.PluginInstance != "" {
-		labels[vl.Plugin] = vl.PluginInstance
+// startRelays connects to the downstream collectd servers given by
+// --collectd.relay-address.
+func startRelays(ctx context.Context, logger *slog.Logger) ([]*relay, error) {
+	if len(*relayAddresses) == 0 {
+		return nil, nil
 	}
-	if vl.TypeInstance != "" {
-		if vl.PluginInstance == "" {
-			labels[vl.Plugin] = vl.TypeInstance
-		} else {
-			labels["type"] = vl.TypeInstance
+
+	opts := network.ClientOptions{Username: *relayUsername}
+	var err error
+	if opts.SecurityLevel, err = parseSecurityLevel(*relaySecurity); err != nil {
+		return nil, err
+	}
+	if opts.SecurityLevel != network.None {
+		if opts.Password, err = readSecret(*relayPasswordEnv, *relayPasswordFile); err != nil {
+			return nil, fmt.Errorf("reading relay password: %w", err)
+		}
+	}
+
+	relays := make([]*relay, 0, len(*relayAddresses))
+	for _, address := range *relayAddresses {
+		r, err := newRelay(ctx, address, opts, *relayFlushInterval, logger)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to relay %q: %w", address, err)
 		}
+		logger.Info("Relaying value lists", "address", address)
+		relays = append(relays, r)
 	}
-	labels["instance"] = vl.Host
 
-	return labels
+	return relays, nil
 }
 
-// newDesc converts one data source of a value list to a Prometheus description.
-func newDesc(vl api.ValueList, index int) *prometheus.Desc {
-	help := fmt.Sprintf("Collectd exporter: '%s' Type: '%s' Dstype: '%T' Dsname: '%s'",
-		vl.Plugin, vl.Type, vl.Values[index], vl.DSName(index))
+// loadDTLSConfig returns the DTLS server configuration given by the
+// --collectd.dtls-* flags. The certificate is reloaded when its files change.
+func loadDTLSConfig() (*dtls.Config, error) {
+	certs, err := newCertReloader(*dtlsCertFile, *dtlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &dtls.Config{
+		GetCertificate: func(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.certificate()
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+
+	if *dtlsClientCAFile != "" {
+		pem, err := os.ReadFile(*dtlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", *dtlsClientCAFile)
+		}
+		cfg.ClientAuth = dtls.RequireAndVerifyClientCert
+	}
 
-	return prometheus.NewDesc(newName(vl, index), help, []string{}, newLabels(vl))
+	return cfg, nil
 }
 
-// newMetric converts one data source of a value list to a Prometheus metric.
-func newMetric(vl api.ValueList, index int) (prometheus.Metric, error) {
-	var value float64
-	var valueType prometheus.ValueType
-
-	switch v := vl.Values[index].(type) {
-	case api.Gauge:
-		value = float64(v)
-		valueType = prometheus.GaugeValue
-	case api.Derive:
-		value = float64(v)
-		valueType = prometheus.CounterValue
-	case api.Counter:
-		value = float64(v)
-		valueType = prometheus.CounterValue
+// parseOpts returns the options for parsing binary protocol packets given by
+// the --collectd.* flags.
+func parseOpts(typesDB *api.TypesDB) (network.ParseOpts, error) {
+	opts := network.ParseOpts{TypesDB: typesDB}
+	var lookups passwordLookups
+	if *collectdAuth != "" {
+		lookups = append(lookups, network.NewAuthFile(*collectdAuth))
+	}
+	if *authDir != "" {
+		lookups = append(lookups, newSecretDir(*authDir))
+	}
+	if *authEnvPrefix != "" {
+		lookups = append(lookups, envPasswords(*authEnvPrefix))
+	}
+	switch len(lookups) {
+	case 0:
+	case 1:
+		opts.PasswordLookup = lookups[0]
 	default:
-		return nil, fmt.Errorf("unknown value type: %T", v)
+		opts.PasswordLookup = lookups
 	}
 
-	return prometheus.NewConstMetric(newDesc(vl, index), valueType, value)
+	var err error
+	opts.SecurityLevel, err = parseSecurityLevel(*collectdSecurity)
+	return opts, err
 }
 
-type collectdCollector struct {
-	ch         chan api.ValueList
-	valueLists map[string]api.ValueList
-	mu         *sync.Mutex
-	logger     *slog.Logger
-}
-
-func newCollectdCollector(logger *slog.Logger) *collectdCollector {
-	c := &collectdCollector{
-		ch:         make(chan api.ValueList),
-		valueLists: make(map[string]api.ValueList),
-		mu:         &sync.Mutex{},
-		logger:     logger,
+// loadEnrichers returns the enrichers configured by the --collector.*label and
+// --collector.cloud-metadata flags.
+func loadEnrichers(ctx context.Context) ([]collector.Enricher, error) {
+	var enrichers []collector.Enricher
+	if len(*staticLabels) > 0 {
+		e, err := collector.NewStaticEnricher(*staticLabels)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, e)
+	}
+	if len(*envLabels) > 0 {
+		e, err := collector.EnvEnricher(*envLabels)
+		if err != nil {
+			return nil, err
+		}
+		enrichers = append(enrichers, e)
+	}
+	if *cloudMetadata != "" {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		e, err := collector.CloudEnricher(ctx, nil, *cloudMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("querying %s metadata: %w", *cloudMetadata, err)
+		}
+		enrichers = append(enrichers, e)
 	}
-	go c.processSamples()
-	return c
+	return enrichers, nil
 }
 
-func (c *collectdCollector) collectdPost(w http.ResponseWriter, r *http.Request) {
-	data, err := io.ReadAll(r.Body)
+// parseRatio parses a fraction between 0 and 1, given as a decimal number or
+// as "n/m".
+func parseRatio(s string) (float64, error) {
+	var (
+		r   float64
+		err error
+	)
+	if n, m, ok := strings.Cut(s, "/"); ok {
+		var num, den float64
+		if num, err = strconv.ParseFloat(n, 64); err == nil {
+			den, err = strconv.ParseFloat(m, 64)
+		}
+		if err == nil && den == 0 {
+			err = errors.New("division by zero")
+		}
+		r = num / den
+	} else {
+		r, err = strconv.ParseFloat(s, 64)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, fmt.Errorf("invalid ratio %q: %w", s, err)
 	}
-
-	var valueLists []*api.ValueList
-	if err := json.Unmarshal(data, &valueLists); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if r < 0 || r > 1 || math.IsNaN(r) {
+		return 0, fmt.Errorf("ratio %q is not between 0 and 1", s)
 	}
+	return r, nil
+}
 
-	for _, vl := range valueLists {
-		err := c.Write(r.Context(), vl)
-		if err != nil {
-			c.logger.Debug("error writing collectd post", "error", err)
+// parseLabelNames parses comma-separated label names.
+func parseLabelNames(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !model.LabelName(name).IsValidLegacy() {
+			return nil, fmt.Errorf("invalid label name %q", name)
 		}
+		names = append(names, name)
 	}
+	return names, nil
 }
 
-func (c *collectdCollector) processSamples() {
-	ticker := time.NewTicker(time.Minute).C
-	for {
-		select {
-		case vl := <-c.ch:
-			id := vl.Identifier.String()
-			c.mu.Lock()
-			c.valueLists[id] = vl
-			c.mu.Unlock()
-
-		case <-ticker:
-			// Garbage collect expired value lists.
-			now := time.Now()
-			c.mu.Lock()
-			for id, vl := range c.valueLists {
-				validUntil := vl.Time.Add(timeout * vl.Interval)
-				if validUntil.Before(now) {
-					delete(c.valueLists, id)
-				}
-			}
-			c.mu.Unlock()
-		}
+// runReplayPcap parses the collectd packets sent to port in the capture at
+// path, converts them with c and prints the result to stdout.
+func runReplayPcap(c *collector.Collector, path string, port uint16, typesDB *api.TypesDB, logger *slog.Logger) error {
+	opts, err := parseOpts(typesDB)
+	if err != nil {
+		return err
 	}
-}
 
-// Collect implements prometheus.Collector.
-func (c collectdCollector) Collect(ch chan<- prometheus.Metric) {
-	ch <- lastPush
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	c.mu.Lock()
-	valueLists := make([]api.ValueList, 0, len(c.valueLists))
-	for _, vl := range c.valueLists {
-		valueLists = append(valueLists, vl)
+	r, err := newPcapReader(f)
+	if err != nil {
+		return err
 	}
-	c.mu.Unlock()
 
-	now := time.Now()
-	for _, vl := range valueLists {
-		validUntil := vl.Time.Add(timeout * vl.Interval)
-		if validUntil.Before(now) {
+	var packets, valueLists, malformed int
+	for {
+		pkt, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if port != 0 && pkt.Dst.Port() != port {
 			continue
 		}
+		packets++
 
-		for i := range vl.Values {
-			m, err := newMetric(vl, i)
-			if err != nil {
-				c.logger.Error("Error converting collectd data type to a Prometheus metric", "err", err)
-				continue
-			}
-
-			ch <- m
+		vls, err := network.Parse(pkt.Payload, opts)
+		if err != nil {
+			malformed++
+			logger.Warn("Error parsing packet", "time", pkt.Time, "src", pkt.Src, "dst", pkt.Dst, "size", len(pkt.Payload), "err", err)
+			continue
+		}
+		for _, vl := range vls {
+			valueLists++
+			c.Ingest(vl)
 		}
 	}
-}
+	logger.Info("Finished reading capture", "file", path, "packets", packets, "malformed", malformed, "value_lists", valueLists)
 
-// Describe implements prometheus.Collector.
-func (c collectdCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- lastPush.Desc()
+	return writeSeries(os.Stdout, c)
 }
 
-// Write writes "vl" to the collector's channel, to be (asynchronously)
-// processed by processSamples(). It implements api.Writer.
-func (c collectdCollector) Write(_ context.Context, vl *api.ValueList) error {
-	lastPush.Set(float64(time.Now().UnixNano()) / 1e9)
-	c.ch <- *vl
-
-	return nil
+func init() {
+	prometheus.MustRegister(versioncollector.NewCollector("collectd_exporter"))
 }
 
-func startCollectdServer(ctx context.Context, w api.Writer, logger *slog.Logger) {
-	if *collectdAddress == "" {
+func main() {
+	promslogConfig := &promslog.Config{}
+	toolkitFlags := kingpinflag.AddFlags(kingpin.CommandLine, ":9103")
+	flag.AddFlags(kingpin.CommandLine, promslogConfig)
+	kingpin.Version(version.Print("collectd_exporter"))
+	kingpin.HelpFlag.Short('h')
+	kingpin.Command("serve", "Run the exporter. This is the default command.").Default()
+	replayCmd := kingpin.Command("replay", "Run the exporter and feed it the value lists of a file recorded with --record.file.")
+	replayFile := replayCmd.Arg("file", "Recording to replay.").Required().ExistingFile()
+	replaySpeed := replayCmd.Flag("replay.speed", "Replay speed relative to the recording. 0 replays as fast as possible.").Default("1").Float64()
+	replayPcapCmd := kingpin.Command("replay-pcap", "Convert the collectd packets in a pcap file and print the resulting series.")
+	replayPcapFile := replayPcapCmd.Arg("file", "Packet capture to convert.").Required().ExistingFile()
+	replayPcapPort := replayPcapCmd.Flag("pcap.port", "UDP destination port of collectd packets. 0 accepts all UDP packets.").Default("25826").Uint16()
+	convertCmd := kingpin.Command("convert", "Convert value lists in collectd's JSON or PUTVAL format and print the resulting series.")
+	convertFile := convertCmd.Arg("file", "File to convert, \"-\" reads standard input.").Default("-").String()
+	convertFormat := convertCmd.Flag("convert.format", "Input format. \"auto\" detects JSON by a leading \"[\" or \"{\".").Default(formatAuto).Enum(formatAuto, formatJSON, formatPutval)
+	checkConfigCmd := kingpin.Command("check-config", "Validate the types.db, configuration and web configuration files and exit.")
+	command := kingpin.Parse()
+	logger := promslog.New(promslogConfig)
+
+	if command == checkConfigCmd.FullCommand() {
+		if !checkConfig(os.Stdout, *collectdTypesDB, *configFile, *toolkitFlags.WebConfigFile, *pushConfigFile) {
+			os.Exit(1)
+		}
 		return
 	}
 
-	srv := network.Server{
-		Addr:   *collectdAddress,
-		Writer: w,
+	if *disableRuntime {
+		prometheus.Unregister(collectors.NewGoCollector())
+		prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	}
 
-	if *collectdAuth != "" {
-		srv.PasswordLookup = network.NewAuthFile(*collectdAuth)
+	ctx, logger, serviceStopped, err := startService(context.Background(), logger)
+	if err != nil {
+		logger.Error("Error starting Windows service", "err", err)
+		os.Exit(1)
 	}
+	ctx, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-	if *collectdTypesDB != "" {
-		file, err := os.Open(*collectdTypesDB)
+	stopTracing := func(context.Context) error { return nil }
+	if *tracingEndpoint != "" {
+		ratio, err := parseRatio(*tracingSample)
 		if err != nil {
-			logger.Error("Can't open types.db file", "types", *collectdTypesDB, "err", err)
+			logger.Error("Invalid --tracing.sample-ratio", "err", err)
 			os.Exit(1)
 		}
-		defer file.Close()
-
-		typesDB, err := api.NewTypesDB(file)
-		if err != nil {
-			logger.Error("Error in parsing types.db file", "types", *collectdTypesDB, "err", err)
+		if stopTracing, err = setupTracing(ctx, *tracingEndpoint, ratio); err != nil {
+			logger.Error("Error setting up tracing", "err", err)
 			os.Exit(1)
 		}
-		srv.TypesDB = typesDB
 	}
 
-	switch strings.ToLower(*collectdSecurity) {
-	case "", "none":
-		srv.SecurityLevel = network.None
-	case "sign":
-		srv.SecurityLevel = network.Sign
-	case "encrypt":
-		srv.SecurityLevel = network.Encrypt
-	default:
-		logger.Error("Unknown security level provided. Must be one of \"None\", \"Sign\" and \"Encrypt\"", "level", *collectdSecurity)
+	logger.Info("Starting collectd_exporter", "version", version.Info())
+	logger.Info("Build context", "context", version.BuildContext())
+
+	var (
+		typesDB *api.TypesDB
+		cfg     *collector.Config
+		filter  collector.Filter
+	)
+	if len(*collectdTypesDB) > 0 {
+		if typesDB, err = loadTypesDB(*collectdTypesDB); err != nil {
+			logger.Error("Error loading types.db file", "types", *collectdTypesDB, "err", err)
+			os.Exit(1)
+		}
+	}
+	if *configFile != "" {
+		if cfg, err = collector.LoadConfig(*configFile); err != nil {
+			logger.Error("Error loading configuration file", "file", *configFile, "err", err)
+			os.Exit(1)
+		}
+	}
+	if filter.Plugins, err = collector.NewMatcher(*includePlugins, *excludePlugins); err != nil {
+		logger.Error("Invalid plugin filter", "err", err)
+		os.Exit(1)
+	}
+	if filter.Types, err = collector.NewMatcher(*includeTypes, *excludeTypes); err != nil {
+		logger.Error("Invalid type filter", "err", err)
+		os.Exit(1)
+	}
+	if filter.Hosts, err = collector.NewMatcher(*includeHosts, *excludeHosts); err != nil {
+		logger.Error("Invalid host filter", "err", err)
 		os.Exit(1)
 	}
 
-	laddr, err := net.ResolveUDPAddr("udp", *collectdAddress)
+	enrichers, err := loadEnrichers(ctx)
 	if err != nil {
-		logger.Error("Failed to resolve binary protocol listening UDP address", "address", *collectdAddress, "err", err)
+		logger.Error("Error configuring labels", "err", err)
 		os.Exit(1)
 	}
 
-	if laddr.IP != nil && laddr.IP.IsMulticast() {
-		srv.Conn, err = net.ListenMulticastUDP("udp", nil, laddr)
-	} else {
-		srv.Conn, err = net.ListenUDP("udp", laddr)
+	opts := collector.Options{
+		CounterWrap:       *counterWrap,
+		StoreRates:        *storeRates,
+		TypesDB:           typesDB,
+		Bounds:            collector.BoundsPolicy(*typesDBBounds),
+		Config:            cfg,
+		Filter:            filter,
+		Exemplars:         *exemplars,
+		CreatedTimestamps: *createdTimestamps,
+		Pipeline:          strings.Split(*pipeline, ","),
+		Enrichers:         enrichers,
+		LabelCollisions:   collector.CollisionPolicy(*labelCollisions),
+		HostNormalization: collector.HostPolicy(*hostNormalization),
+		Identifier:        collector.IdentifierMode(*identifierMode),
+		Profile:           collector.Profile(*profile),
+		DSLabel:           *dsLabel,
+		HostRetention:     *hostRetention,
+		GCInterval:        *gcInterval,
+		GCJitter:          *gcJitter,
+		MaxClockSkew:      *maxClockSkew,
+		DefaultInterval:   *defaultInterval,
+		MaxLabelLength:    *maxLabelLength,
+		LabelLimit:        collector.LabelLimitPolicy(*longLabels),
+		SnapshotInterval:  *snapshotInterval,
+		AccountingLimit:   *accountingLimit,
+		MaxMemoryBytes:    int(*maxMemory),
+		MaxSeriesPerHost:  *maxHostSeries,
+		DedupeSenders:     *dedupeSenders,
 	}
-	if err != nil {
-		logger.Error("Failed to create a socket for a binary protocol server", "err", err)
+	if opts.LogSample, err = parseRatio(*logSample); err != nil {
+		logger.Error("Invalid --log.sample-values", "err", err)
 		os.Exit(1)
 	}
-	if *collectdBuffer > 0 {
-		if err = srv.Conn.SetReadBuffer(*collectdBuffer); err != nil {
-			logger.Error("Failed to adjust a read buffer of the socket", "err", err)
+	if *exportedByLabel {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logger.Error("Error getting the host name for the exported_by label", "err", err)
 			os.Exit(1)
 		}
+		opts.ExportedBy = exporterAddress(tcpListenAddress(toolkitFlags), hostname)
 	}
 
-	go func() {
-		if err := srv.ListenAndWrite(ctx); err != nil {
-			logger.Error("Error starting collectd server", "err", err)
+	// Offline conversions export all value lists regardless of their age,
+	// and print the series once done.
+	offline := command == replayPcapCmd.FullCommand() || command == convertCmd.FullCommand()
+	opts.KeepExpired = offline
+	if *dryRun && !offline {
+		opts.Tap = dryRunPrinter(os.Stdout, logger)
+	}
+	c, err := collector.New(logger, opts)
+	if err != nil {
+		logger.Error("Error creating collector", "err", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case replayPcapCmd.FullCommand():
+		if err := runReplayPcap(c, *replayPcapFile, *replayPcapPort, typesDB, logger); err != nil {
+			logger.Error("Error replaying packet capture", "file", *replayPcapFile, "err", err)
 			os.Exit(1)
 		}
-	}()
-}
-
-func init() {
-	prometheus.MustRegister(versioncollector.NewCollector("collectd_exporter"))
-}
-
-func main() {
-	promslogConfig := &promslog.Config{}
-	toolkitFlags := kingpinflag.AddFlags(kingpin.CommandLine, ":9103")
-	flag.AddFlags(kingpin.CommandLine, promslogConfig)
-	kingpin.Version(version.Print("collectd_exporter"))
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-	logger := promslog.New(promslogConfig)
-
-	logger.Info("Starting collectd_exporter", "version", version.Info())
-	logger.Info("Build context", "context", version.BuildContext())
+		return
+	case convertCmd.FullCommand():
+		if err := runConvert(c, *convertFile, *convertFormat, typesDB); err != nil {
+			logger.Error("Error converting value lists", "file", *convertFile, "err", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	c := newCollectdCollector(logger)
-	prometheus.MustRegister(c)
+	// Once ctx is done, input stops. The collector, relays and recorder
+	// keep running until all value lists received so far are processed.
+	runCtx, stopRun := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopRun()
+	go c.Run(runCtx)
 
-	startCollectdServer(context.Background(), c, logger)
+	relays, err := startRelays(runCtx, logger)
+	if err != nil {
+		logger.Error("Error starting relays", "err", err)
+		os.Exit(1)
+	}
+	writer := newFanout()
+	writer.add("cache", c)
+	for _, r := range relays {
+		writer.add("relay:"+r.address, r)
+	}
+	var rec *recorder
+	if *recordFile != "" {
+		rec, err = newRecorder(runCtx, *recordFile, logger)
+		if err != nil {
+			logger.Error("Error opening recording file", "file", *recordFile, "err", err)
+			os.Exit(1)
+		}
+		writer.add("recording", rec)
+	}
+	prometheus.MustRegister(writer)
+	var rw *remoteWriter
+	if *remoteWriteURL != "" {
+		series := prometheus.NewRegistry()
+		series.MustRegister(c.Series())
+		rw = newRemoteWriter(runCtx, *remoteWriteURL, *remoteWriteEvery, series, logger)
+		prometheus.MustRegister(rw)
+		logger.Info("Sending series via remote write", "url", *remoteWriteURL, "interval", *remoteWriteEvery)
+	}
 
+	sources := source.NewGroup(logger)
+	if *restartBackoff > 0 {
+		sources.RestartOnFailure(min(time.Second, *restartBackoff), *restartBackoff)
+	}
+	popts, err := parseOpts(typesDB)
+	if err != nil {
+		logger.Error("Unknown security level provided. Must be one of \"None\", \"Sign\" and \"Encrypt\"", "level", *collectdSecurity)
+		os.Exit(1)
+	}
+	userLevels := map[string]network.SecurityLevel{}
+	if cfg != nil {
+		for user, level := range cfg.SecurityLevels {
+			// Validated by collector.LoadConfig.
+			userLevels[user], _ = parseSecurityLevel(level)
+		}
+	}
+	allowed, err := parsePrefixes(*allowedSources)
+	if err != nil {
+		logger.Error("Invalid allowed sources", "err", err)
+		os.Exit(1)
+	}
+	allowedLabels, err := parseLabelNames(*pushLabels)
+	if err != nil {
+		logger.Error("Invalid allowed push labels", "err", err)
+		os.Exit(1)
+	}
+	udpMetrics := source.NewUDPMetrics()
+	authFailures := source.NewAuthFailures(logger, *authFailureLog)
+	quarantine := source.NewQuarantine(*quarantineSize)
+	unknownTypes := source.NewUnknownTypes(*unknownTypeTTL)
+	prometheus.MustRegister(udpMetrics, authFailures, quarantine, unknownTypes)
+	var listeners []listener
+	for _, address := range *collectdAddress {
+		if address == "" {
+			continue
+		}
+		l, err := parseListener(address, listener{readBuffer: *collectdBuffer, packetSize: *packetSize, securityLevel: popts.SecurityLevel, iface: *multicastInterface, device: *bindDevice})
+		if err != nil {
+			logger.Error("Invalid listen address", "err", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, l)
+	}
+	for _, l := range listeners {
+		// Keep the plain name for the common case of a single listener.
+		name := "udp"
+		if len(listeners) > 1 {
+			name += ":" + l.addr
+		}
+		lopts := popts
+		lopts.SecurityLevel = l.securityLevel
+		udp := &source.UDP{
+			Addr:               l.addr,
+			Interface:          l.iface,
+			Device:             l.device,
+			ReadBuffer:         l.readBuffer,
+			PacketSize:         l.packetSize,
+			ParseOpts:          lopts,
+			UserSecurityLevels: userLevels,
+			AllowedSources:     allowed,
+			Metrics:            udpMetrics,
+			AuthFailures:       authFailures,
+			Quarantine:         quarantine,
+			UnknownTypes:       unknownTypes,
+			Logger:             logger,
+		}
+		if err := udp.Listen(); err != nil {
+			logger.Error("Error listening for collectd packets", "address", l.addr, "err", err)
+			os.Exit(1)
+		}
+		sources.Add(name, udp)
+	}
+	if *dtlsAddress != "" {
+		cfg, err := loadDTLSConfig()
+		if err != nil {
+			logger.Error("Error loading DTLS configuration", "err", err)
+			os.Exit(1)
+		}
+		d := &source.DTLS{
+			Addr:         *dtlsAddress,
+			Config:       cfg,
+			ParseOpts:    network.ParseOpts{TypesDB: typesDB},
+			Quarantine:   quarantine,
+			UnknownTypes: unknownTypes,
+			Logger:       logger,
+		}
+		if err := d.Listen(); err != nil {
+			logger.Error("Error listening for DTLS connections", "address", *dtlsAddress, "err", err)
+			os.Exit(1)
+		}
+		sources.Add("dtls", d)
+	}
+	if *graphiteAddress != "" {
+		g := &source.Graphite{
+			Addr:       *graphiteAddress,
+			Template:   *graphiteTemplate,
+			Quarantine: quarantine,
+			Logger:     logger,
+		}
+		if err := g.Listen(); err != nil {
+			logger.Error("Error listening for Graphite connections", "address", *graphiteAddress, "err", err)
+			os.Exit(1)
+		}
+		sources.Add("graphite", g)
+	}
+	// The push path shares the metrics server unless it has its own address.
+	pushMux := http.DefaultServeMux
+	if *pushAddress != "" {
+		pushMux = http.NewServeMux()
+	}
 	if *collectdPostPath != "" {
-		http.HandleFunc(*collectdPostPath, c.collectdPost)
+		h := &source.HTTP{
+			Mux:           pushMux,
+			Path:          *collectdPostPath,
+			Logger:        logger,
+			AllowedLabels: allowedLabels,
+			Quarantine:    quarantine,
+		}
+		if *pushQueueSize > 0 {
+			h.Queue = source.NewQueue(*pushQueueSize, *pushWorkers)
+			prometheus.MustRegister(h.Queue)
+		}
+		sources.Add("http", h)
+	}
+	if *webSocketPath != "" {
+		sources.Add("websocket", &source.WebSocket{
+			Mux:           pushMux,
+			Path:          *webSocketPath,
+			Logger:        logger,
+			AllowedLabels: allowedLabels,
+			Quarantine:    quarantine,
+		})
+	}
+	if *influxWritePath != "" {
+		sources.Add("influx", &source.Influx{
+			Mux:        pushMux,
+			Path:       *influxWritePath,
+			Logger:     logger,
+			Quarantine: quarantine,
+		})
+	}
+	if *promPushPath != "" {
+		sources.Add("prometheus", &source.Prometheus{
+			Mux:        pushMux,
+			Path:       *promPushPath,
+			Logger:     logger,
+			Quarantine: quarantine,
+		})
+	}
+	if command == replayCmd.FullCommand() {
+		sources.Add("replay", replaySource{path: *replayFile, speed: *replaySpeed, logger: logger})
 	}
+	prometheus.MustRegister(sources)
+	sourcesDone := make(chan struct{})
+	go func() {
+		defer close(sourcesDone)
+		if err := sources.Run(ctx, writer); err != nil {
+			logger.Error("Error receiving value lists", "err", err)
+			os.Exit(1)
+		}
+	}()
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	// The collector is not registered with the default registry, so that
+	// every scrape collects it with its own context.
+	var scrapeSem chan struct{}
+	if *maxScrapes > 0 {
+		scrapeSem = make(chan struct{}, *maxScrapes)
+	}
+	// With a separate path for the exporter's own metrics, the metrics path
+	// only serves those converted from collectd.
+	gatherer, collect := prometheus.Gatherer(prometheus.DefaultGatherer), c.WithContext
+	if *selfMetricsPath != "" {
+		gatherer, collect = prometheus.Gatherers{}, c.ConvertedWithContext
+		self := prometheus.NewRegistry()
+		self.MustRegister(c.Self())
+		http.Handle(*selfMetricsPath, promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, self}, promhttp.HandlerOpts{}))
+	}
+	// In dry-run mode, the converted series are printed instead.
+	if *dryRun {
+		collect = func(context.Context) prometheus.Collector { return c.Self() }
+		if *selfMetricsPath != "" {
+			collect = func(context.Context) prometheus.Collector { return prometheus.NewRegistry() }
+		}
+	}
+	// Only the leader of an active/standby pair exposes converted series.
+	haDone := make(chan struct{})
+	var election *leaderElection
+	if *haLockFile != "" || *haConsulLockKey != "" {
+		election, err = newLeaderElection(toolkitFlags, logger)
+		if err != nil {
+			logger.Error("Invalid leader election configuration", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(election.gauge)
+		standby := func(context.Context) prometheus.Collector { return c.Self() }
+		if *selfMetricsPath != "" {
+			standby = func(context.Context) prometheus.Collector { return prometheus.NewRegistry() }
+		}
+		collect = election.gate(collect, standby)
+		// The lock is released once the final scrape has been served.
+		go func() {
+			defer close(haDone)
+			election.run(runCtx)
+		}()
+	} else {
+		close(haDone)
+	}
+	metricsOpts := promhttp.HandlerOpts{
+		EnableOpenMetrics: *exemplars || *createdTimestamps,
+	}
+	for _, e := range *compression {
+		metricsOpts.OfferedCompressions = append(metricsOpts.OfferedCompressions, promhttp.Compression(e))
+	}
+	tooLarge := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "collectd_exporter_scrapes_too_large_total",
+		Help: "Number of scrapes aborted because the response exceeded --web.max-response-bytes.",
+	})
+	prometheus.MustRegister(tooLarge)
+	responseTooLarge := func(r *http.Request) {
+		tooLarge.Inc()
+		logger.Warn("Aborting scrape exceeding the maximum response size", "path", r.URL.Path, "max_bytes", int64(*maxResponseBytes))
+	}
+	scrapes := &scrapeWaiter{handler: traceHandler("collectd.scrape", promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		limitScrapes(limitResponse(metricsHandler(gatherer, collect, metricsOpts, *createdTimestamps, *maxSeries), int64(*maxResponseBytes), responseTooLarge), scrapeSem),
+	))}
+	http.Handle(*metricsPath, scrapes)
+	if *enableAdminAPI && *toolkitFlags.WebConfigFile == "" {
+		logger.Warn("The admin API is enabled without authentication, anyone able to connect can delete cached value lists")
+	}
+	registerAPI(http.DefaultServeMux, c, *enableAdminAPI, logger)
+	registerStatusAPI(http.DefaultServeMux, flagValues(kingpin.CommandLine), cfg, logger)
+	registerQuarantineAPI(http.DefaultServeMux, quarantine, logger)
+	registerUnknownTypesAPI(http.DefaultServeMux, unknownTypes, logger)
+	http.Handle("GET /sd", sdHandler(c, *metricsPath, logger))
+	http.Handle("GET /-/healthy", healthHandler(sources))
+	var hostMetrics http.Handler = limitResponse(hostMetricsHandler(c, metricsOpts, *createdTimestamps), int64(*maxResponseBytes), responseTooLarge)
+	if election != nil {
+		hostMetrics = election.gateHandler(hostMetrics)
+	}
+	http.Handle("GET "+path.Join(*metricsPath, "host")+"/{host}", traceHandler("collectd.scrape", limitScrapes(hostMetrics, scrapeSem)))
 	if *metricsPath != "/" {
-
+		// Push endpoints on their own address are not reachable from the
+		// landing page.
+		var pushLinks []web.LandingLinks
+		if *pushAddress == "" {
+			for _, l := range []web.LandingLinks{
+				{Address: *collectdPostPath, Text: "collectd push", Description: "Accepts POST requests in collectd's JSON format"},
+				{Address: *webSocketPath, Text: "collectd WebSocket", Description: "Accepts WebSocket connections streaming collectd's JSON format"},
+				{Address: *influxWritePath, Text: "InfluxDB write", Description: "Accepts POST requests in the InfluxDB line protocol"},
+				{Address: *promPushPath, Text: "Prometheus push", Description: "Accepts POST requests in the Prometheus text format or remote-write protocol"},
+			} {
+				if l.Address != "" {
+					pushLinks = append(pushLinks, l)
+				}
+			}
+		}
 		landingConfig := web.LandingConfig{
 			Name:        "collectd_exporter",
 			Description: "Prometheus Collectd Exporter",
 			Version:     version.Info(),
-			Links: []web.LandingLinks{
-				{
-					Address: *metricsPath,
-					Text:    "Metrics",
-				},
-			},
+			Links:       landingLinks(*metricsPath, *selfMetricsPath, *quarantineSize > 0, pushLinks),
 		}
 		landingPage, err := web.NewLandingPage(landingConfig)
 		if err != nil {
@@ -356,9 +871,111 @@ func main() {
 		http.Handle("/", landingPage)
 	}
 
+	// Bind all sockets before telling systemd the exporter is ready.
 	srv := &http.Server{}
-	if err := web.ListenAndServe(srv, toolkitFlags, logger); err != nil {
+	if *accessLogs {
+		srv.Handler = accessLog(http.DefaultServeMux, logger)
+	}
+	serveErr, err := startServer(srv, toolkitFlags, *proxyProtocol, logger)
+	if err != nil {
+		logger.Error("Error starting HTTP server", "err", err)
+		os.Exit(1)
+	}
+	var pushSrv *http.Server
+	var pushErr <-chan error
+	if *pushAddress != "" {
+		pushSrv = &http.Server{Handler: pushMux}
+		if *accessLogs {
+			pushSrv.Handler = accessLog(pushMux, logger)
+		}
+		noSystemdSocket := false
+		pushFlags := &web.FlagConfig{
+			WebListenAddresses: &[]string{*pushAddress},
+			WebSystemdSocket:   &noSystemdSocket,
+			WebConfigFile:      pushConfigFile,
+		}
+		if pushErr, err = startServer(pushSrv, pushFlags, *proxyProtocol, logger); err != nil {
+			logger.Error("Error starting HTTP server for pushes", "err", err)
+			os.Exit(1)
+		}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("Error notifying systemd", "err", err)
+	}
+	interval, err := watchdogInterval()
+	if err != nil {
+		logger.Warn("Not sending watchdog pings", "err", err)
+	}
+	if interval > 0 {
+		go runWatchdog(runCtx, interval, c.Ping, logger)
+	}
+	consulDone := make(chan struct{})
+	if *consulAddress != "" {
+		reg, err := newConsulRegistration(toolkitFlags, logger)
+		if err != nil {
+			logger.Error("Invalid Consul configuration", "err", err)
+			os.Exit(1)
+		}
+		go func() {
+			defer close(consulDone)
+			reg.run(ctx, *consulCheckTTL, c.Ping, c.Hosts)
+		}()
+	} else {
+		close(consulDone)
+	}
+
+	select {
+	case <-ctx.Done():
+	case err := <-serveErr:
 		logger.Error("Error starting HTTP server", "err", err)
 		os.Exit(1)
+	case err := <-pushErr:
+		logger.Error("Error starting HTTP server for pushes", "err", err)
+		os.Exit(1)
+	}
+
+	logger.Info("Shutting down, processing value lists received so far")
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger.Warn("Error notifying systemd", "err", err)
+	}
+	<-sourcesDone
+	// Run responds once the last value list written to c is stored.
+	if err := c.Ping(runCtx); err != nil {
+		logger.Warn("Error waiting for the collector", "err", err)
+	}
+	for _, r := range relays {
+		r.Close()
+	}
+	if rec != nil {
+		rec.Close()
+	}
+	if rw != nil {
+		rw.Close()
+	}
+	if *shutdownScrape > 0 {
+		logger.Info("Waiting for a final scrape", "timeout", *shutdownScrape)
+		wctx, cancel := context.WithTimeout(context.Background(), *shutdownScrape)
+		if err := scrapes.wait(wctx); err != nil {
+			logger.Warn("No final scrape before shutting down", "err", err)
+		}
+		cancel()
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		logger.Warn("Error shutting down HTTP server", "err", err)
+	}
+	if pushSrv != nil {
+		if err := pushSrv.Shutdown(sctx); err != nil {
+			logger.Warn("Error shutting down HTTP server for pushes", "err", err)
+		}
+	}
+	<-consulDone
+	if err := stopTracing(sctx); err != nil {
+		logger.Warn("Error flushing traces", "err", err)
 	}
+	stopRun()
+	<-haDone
+	logger.Info("Shut down")
+	serviceStopped()
 }
@@ -14,137 +14,51 @@
 package main
 
 import (
-	"reflect"
+	"slices"
 	"testing"
-
-	"collectd.org/api"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
-func TestNewName(t *testing.T) {
+func TestParseRatio(t *testing.T) {
 	cases := []struct {
-		vl    api.ValueList
-		index int
-		want  string
+		in   string
+		want float64
+		err  bool
 	}{
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "cpu",
-				Type:   "cpu",
-			},
-			DSNames: []string{"value"},
-			Values:  []api.Value{api.Derive(0)},
-		}, 0, "collectd_cpu_total"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "dns",
-				Type:   "dns_qtype",
-			},
-			DSNames: []string{"value"},
-			Values:  []api.Value{api.Derive(0)},
-		}, 0, "collectd_dns_dns_qtype_total"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "df",
-				Type:   "df",
-			},
-			DSNames: []string{"used", "free"},
-			Values:  []api.Value{api.Gauge(0), api.Gauge(1)},
-		}, 0, "collectd_df_used"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "df",
-				Type:   "df",
-			},
-			DSNames: []string{"used", "free"},
-			Values:  []api.Value{api.Gauge(0), api.Gauge(1)},
-		}, 1, "collectd_df_free"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "cpu",
-				Type:   "percent",
-			},
-			DSNames: []string{"value"},
-			Values:  []api.Value{api.Gauge(0)},
-		}, 0, "collectd_cpu_percent"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "interface",
-				Type:   "if_octets",
-			},
-			DSNames: []string{"rx", "tx"},
-			Values:  []api.Value{api.Counter(0), api.Counter(1)},
-		}, 0, "collectd_interface_if_octets_rx_total"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "interface",
-				Type:   "if_octets",
-			},
-			DSNames: []string{"rx", "tx"},
-			Values:  []api.Value{api.Counter(0), api.Counter(1)},
-		}, 1, "collectd_interface_if_octets_tx_total"},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Plugin: "docker",
-				Type:   "cpu.percent",
-			},
-			DSNames: []string{"value"},
-			Values:  []api.Value{api.Gauge(0)},
-		}, 0, "collectd_docker_cpu_percent"},
+		{in: "0", want: 0},
+		{in: "1/1000", want: 0.001},
+		{in: "0.5", want: 0.5},
+		{in: "1/0", err: true},
+		{in: "2/1", err: true},
+		{in: "-0.1", err: true},
+		{in: "one/ten", err: true},
 	}
-
 	for _, c := range cases {
-		got := newName(c.vl, c.index)
+		got, err := parseRatio(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.in, err)
+			continue
+		}
 		if got != c.want {
-			t.Errorf("newName(%v): got %q, want %q", c.vl, got, c.want)
+			t.Errorf("%q: got %v, want %v", c.in, got, c.want)
 		}
 	}
 }
 
-func TestNewLabels(t *testing.T) {
-	cases := []struct {
-		vl   api.ValueList
-		want prometheus.Labels
-	}{
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Host:           "example.com",
-				Plugin:         "cpu",
-				PluginInstance: "0",
-				Type:           "cpu",
-				TypeInstance:   "user",
-			},
-		}, prometheus.Labels{
-			"cpu":      "0",
-			"type":     "user",
-			"instance": "example.com",
-		}},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Host:         "example.com",
-				Plugin:       "df",
-				Type:         "df_complex",
-				TypeInstance: "used",
-			},
-		}, prometheus.Labels{
-			"df":       "used",
-			"instance": "example.com",
-		}},
-		{api.ValueList{
-			Identifier: api.Identifier{
-				Host:   "example.com",
-				Plugin: "load",
-				Type:   "load",
-			},
-		}, prometheus.Labels{
-			"instance": "example.com",
-		}},
+func TestParseLabelNames(t *testing.T) {
+	got, err := parseLabelNames("dc, team,")
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	for _, c := range cases {
-		got := newLabels(c.vl)
-		if !reflect.DeepEqual(got, c.want) {
-			t.Errorf("newLabels(%v): got %v, want %v", c.vl, got, c.want)
-		}
+	if want := []string{"dc", "team"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := parseLabelNames("dc,team-name"); err == nil {
+		t.Error("expected an error for an invalid label name")
 	}
 }
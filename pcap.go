@@ -0,0 +1,223 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// Link-layer header types, see https://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	ipProtoUDP    = 17
+)
+
+// maxPcapRecord guards against allocating huge buffers for corrupt captures.
+const maxPcapRecord = 1 << 18
+
+// udpPacket is a UDP datagram read from a packet capture.
+type udpPacket struct {
+	Time    time.Time
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Payload []byte
+}
+
+// pcapReader reads UDP datagrams from a file in the classic libpcap format.
+// Fragmented IP packets and the pcapng format are not supported.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+}
+
+// newPcapReader reads the pcap file header from r.
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading pcap header: %w", err)
+	}
+
+	p := &pcapReader{r: r}
+	switch magic := binary.LittleEndian.Uint32(hdr[0:4]); magic {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nanos = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nanos = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng files are not supported, convert with \"editcap -F pcap\"")
+	default:
+		return nil, fmt.Errorf("not a pcap file (magic %#08x)", magic)
+	}
+	// The upper bits of the link type field may carry an FCS length.
+	p.linkType = p.order.Uint32(hdr[20:24]) & 0x0fffffff
+
+	switch p.linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL, linkTypeIPv4, linkTypeIPv6, linkTypeSLL2:
+	default:
+		return nil, fmt.Errorf("unsupported link type %d", p.linkType)
+	}
+	return p, nil
+}
+
+// Next returns the next UDP datagram in the capture, skipping all other
+// frames. It returns io.EOF at the end of the capture.
+func (p *pcapReader) Next() (udpPacket, error) {
+	for {
+		var hdr [16]byte
+		if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return udpPacket{}, fmt.Errorf("reading record header: %w", err)
+			}
+			return udpPacket{}, err
+		}
+		sec, frac := p.order.Uint32(hdr[0:4]), p.order.Uint32(hdr[4:8])
+		if !p.nanos {
+			frac *= 1000
+		}
+
+		length := p.order.Uint32(hdr[8:12])
+		if length > maxPcapRecord {
+			return udpPacket{}, fmt.Errorf("record length %d exceeds %d bytes", length, maxPcapRecord)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			return udpPacket{}, fmt.Errorf("reading record: %w", err)
+		}
+
+		pkt, ok := p.decode(data)
+		if !ok {
+			continue
+		}
+		pkt.Time = time.Unix(int64(sec), int64(frac))
+		return pkt, nil
+	}
+}
+
+// decode strips the link-layer and IP headers from a captured frame.
+func (p *pcapReader) decode(data []byte) (udpPacket, bool) {
+	var etherType uint16
+	switch p.linkType {
+	case linkTypeNull:
+		// The address family is in the byte order of the capturing host.
+		if len(data) < 4 {
+			return udpPacket{}, false
+		}
+		family := binary.LittleEndian.Uint32(data)
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 10, 24, 28, 30:
+			etherType = etherTypeIPv6
+		}
+		data = data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return udpPacket{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		for etherType == etherTypeVLAN && len(data) >= 4 {
+			etherType, data = binary.BigEndian.Uint16(data[2:4]), data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return udpPacket{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[14:16]), data[16:]
+	case linkTypeSLL2:
+		if len(data) < 20 {
+			return udpPacket{}, false
+		}
+		etherType, data = binary.BigEndian.Uint16(data[0:2]), data[20:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		if len(data) == 0 {
+			return udpPacket{}, false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	}
+
+	var (
+		src, dst netip.Addr
+		udp      []byte
+	)
+	switch etherType {
+	case etherTypeIPv4:
+		if len(data) < 20 {
+			return udpPacket{}, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		fragment := binary.BigEndian.Uint16(data[6:8])
+		// Skip non-UDP packets as well as fragments: neither the "more
+		// fragments" flag nor a fragment offset may be set.
+		if data[9] != ipProtoUDP || fragment&0x3fff != 0 || len(data) < ihl {
+			return udpPacket{}, false
+		}
+		src, dst = netip.AddrFrom4([4]byte(data[12:16])), netip.AddrFrom4([4]byte(data[16:20]))
+		udp = data[ihl:]
+	case etherTypeIPv6:
+		// Extension headers are not supported.
+		if len(data) < 40 || data[6] != ipProtoUDP {
+			return udpPacket{}, false
+		}
+		src, dst = netip.AddrFrom16([16]byte(data[8:24])), netip.AddrFrom16([16]byte(data[24:40]))
+		udp = data[40:]
+	default:
+		return udpPacket{}, false
+	}
+
+	if len(udp) < 8 {
+		return udpPacket{}, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:6]))
+	if length < 8 || length > len(udp) {
+		// Truncated by the snapshot length.
+		return udpPacket{}, false
+	}
+
+	return udpPacket{
+		Src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(udp[0:2])),
+		Dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(udp[2:4])),
+		Payload: udp[8:length],
+	}, true
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+)
+
+// ethernetFrame wraps payload in Ethernet, IP and transport headers. Checksums
+// are left empty.
+func ethernetFrame(src, dst netip.AddrPort, proto byte, payload []byte) []byte {
+	transport := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(transport[0:2], src.Port())
+	binary.BigEndian.PutUint16(transport[2:4], dst.Port())
+	binary.BigEndian.PutUint16(transport[4:6], uint16(8+len(payload)))
+	transport = append(transport, payload...)
+
+	frame := make([]byte, 14)
+	var ip []byte
+	if src.Addr().Is4() {
+		binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(transport)))
+		ip[9] = proto
+		copy(ip[12:16], src.Addr().AsSlice())
+		copy(ip[16:20], dst.Addr().AsSlice())
+	} else {
+		binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(transport)))
+		ip[6] = proto
+		copy(ip[8:24], src.Addr().AsSlice())
+		copy(ip[24:40], dst.Addr().AsSlice())
+	}
+
+	return append(append(frame, ip...), transport...)
+}
+
+func TestPcapReader(t *testing.T) {
+	vl := &api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1), api.Gauge(2), api.Gauge(3)},
+	}
+	buf := network.NewBuffer(0)
+	if err := buf.Write(context.Background(), vl); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := buf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v4src, v4dst := netip.MustParseAddrPort("192.0.2.1:40000"), netip.MustParseAddrPort("192.0.2.2:25826")
+	v6src, v6dst := netip.MustParseAddrPort("[2001:db8::1]:40000"), netip.MustParseAddrPort("[2001:db8::2]:25826")
+	frames := [][]byte{
+		ethernetFrame(v4src, v4dst, ipProtoUDP, payload),
+		ethernetFrame(v4src, v4dst, 6, payload), // TCP, skipped.
+		ethernetFrame(v6src, v6dst, ipProtoUDP, payload),
+	}
+
+	var capture bytes.Buffer
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeEthernet)
+	capture.Write(hdr)
+	for i, frame := range frames {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec[0:4], uint32(1700000000+i))
+		binary.LittleEndian.PutUint32(rec[4:8], 500)
+		binary.LittleEndian.PutUint32(rec[8:12], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(rec[12:16], uint32(len(frame)))
+		capture.Write(rec)
+		capture.Write(frame)
+	}
+
+	r, err := newPcapReader(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []udpPacket{
+		{Time: time.Unix(1700000000, 500000), Src: v4src, Dst: v4dst},
+		{Time: time.Unix(1700000002, 500000), Src: v6src, Dst: v6dst},
+	}
+	for _, w := range want {
+		pkt, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pkt.Time.Equal(w.Time) || pkt.Src != w.Src || pkt.Dst != w.Dst {
+			t.Errorf("got packet %v %v -> %v, want %v %v -> %v", pkt.Time, pkt.Src, pkt.Dst, w.Time, w.Src, w.Dst)
+		}
+
+		vls, err := network.Parse(pkt.Payload, network.ParseOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vls) != 1 || vls[0].Identifier != vl.Identifier {
+			t.Errorf("got value lists %v, want %v", vls, vl)
+		}
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("got error %v, want io.EOF", err)
+	}
+
+	if _, err := newPcapReader(bytes.NewReader([]byte("not a packet capture"))); err == nil {
+		t.Error("expected an error for invalid input")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout limits the time a client may take to send the PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every header of version 2 of the PROXY protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections starting with a PROXY protocol header,
+// as sent by HAProxy and other L4 load balancers, and reports the client
+// address given by the header as their remote address. Both versions of
+// the protocol are supported. Connections without a valid header fail.
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept implements net.Listener. The header is read on the first call of
+// Read or RemoteAddr, so that slow clients do not block Accept.
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection accepted by a proxyListener.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read implements net.Conn.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr implements net.Conn. It returns the address of the proxy if the
+// header does not carry the client's.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the PROXY protocol header.
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	var addr netip.AddrPort
+	sig, err := c.r.Peek(len(proxyV2Signature))
+	switch {
+	case err != nil:
+	case bytes.Equal(sig, proxyV2Signature):
+		addr, err = readProxyV2(c.r)
+	default:
+		addr, err = readProxyV1(c.r)
+	}
+	if err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header from %s: %w", c.Conn.RemoteAddr(), err)
+		return
+	}
+	if addr.IsValid() {
+		c.remote = net.TCPAddrFromAddrPort(addr)
+	}
+}
+
+// readProxyV1 reads a header of version 1 of the PROXY protocol, such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n". It returns an invalid
+// address for connections of unknown protocols.
+func readProxyV1(r *bufio.Reader) (netip.AddrPort, error) {
+	// The header is at most 107 bytes long.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return netip.AddrPort{}, errors.New("header not terminated by CRLF")
+	}
+
+	fields := strings.Split(header, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return netip.AddrPort{}, errors.New("missing PROXY signature")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return netip.AddrPort{}, nil
+	case "TCP4", "TCP6":
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return netip.AddrPort{}, fmt.Errorf("malformed header %q", header)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// readProxyV2 reads a header of version 2 of the PROXY protocol. It returns
+// an invalid address for local connections, e.g. health checks of the
+// proxy, and for address families other than TCP or UDP over IPv4 and IPv6.
+func readProxyV2(r *bufio.Reader) (netip.AddrPort, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return netip.AddrPort{}, err
+	}
+	verCmd, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if verCmd>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return netip.AddrPort{}, nil
+	case 1: // PROXY
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown command %d", verCmd&0xf)
+	}
+
+	var size int
+	switch family >> 4 {
+	case 1: // AF_INET
+		size = 4
+	case 2: // AF_INET6
+		size = 16
+	default:
+		return netip.AddrPort{}, nil
+	}
+	if len(body) < 2*size+4 {
+		return netip.AddrPort{}, errors.New("truncated addresses")
+	}
+	addr, _ := netip.AddrFromSlice(body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return netip.AddrPortFrom(addr, port), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyConn(t *testing.T) {
+	v2 := string(proxyV2Signature) + "\x21\x11\x00\x0c" + // PROXY, TCP over IPv4
+		"\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\xdc\x04\x01\xbb"
+
+	for _, tc := range []struct {
+		header, want string
+		fails        bool
+	}{
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", want: "192.0.2.1:56324"},
+		{header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{header: "PROXY UNKNOWN\r\n", want: "proxy"},
+		{header: v2, want: "192.0.2.1:56324"},
+		{header: string(proxyV2Signature) + "\x20\x00\x00\x00", want: "proxy"}, // LOCAL
+		{header: "GET / HTTP/1.1\r\n", fails: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", fails: true},
+		{header: "PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n", fails: true},
+		{header: string(proxyV2Signature) + "\x21\x11\x00\x04\xc0\x00\x02\x01", fails: true},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, tc.header+"data")
+			client.Close()
+		}()
+		conn := &proxyConn{Conn: pipeConn{server}, r: bufio.NewReader(server)}
+
+		got := conn.RemoteAddr().String()
+		data, err := io.ReadAll(conn)
+		server.Close()
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.header)
+			}
+			continue
+		}
+		if err != nil || string(data) != "data" {
+			t.Errorf("%q: got data %q, error %v", tc.header, data, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: got remote address %s, want %s", tc.header, got, tc.want)
+		}
+	}
+}
+
+// pipeConn is a net.Pipe connection with the address of a proxy.
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "proxy" }
+
+func TestProxyListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote <- r.RemoteAddr
+	})}
+	go srv.Serve(proxyListener{l})
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 9103\r\nGET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-remote; got != "192.0.2.1:56324" {
+		t.Errorf("got remote address %s, want 192.0.2.1:56324", got)
+	}
+
+	// Connections without a header are closed.
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if data, _ := io.ReadAll(conn); strings.Contains(string(data), "200 OK") {
+		t.Errorf("got response %q without PROXY header", data)
+	}
+}
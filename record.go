@@ -0,0 +1,176 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+)
+
+// record is one line of a recording: a value list and the time it was
+// received by the exporter.
+type record struct {
+	Received  time.Time      `json:"received"`
+	ValueList *api.ValueList `json:"value_list"`
+}
+
+// recorder appends all value lists written to it to a file, one JSON encoded
+// record per line.
+type recorder struct {
+	mu  sync.Mutex
+	buf *bufio.Writer
+	enc *json.Encoder
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newRecorder opens path for appending. Buffered records are written to disk
+// every second and when ctx is done or the recorder is closed.
+func newRecorder(ctx context.Context, path string, logger *slog.Logger) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{
+		buf:  bufio.NewWriter(f),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	r.enc = json.NewEncoder(r.buf)
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.flush(); err != nil {
+					logger.Error("Error writing recording", "file", path, "err", err)
+				}
+				continue
+			case <-ctx.Done():
+			case <-r.stop:
+			}
+
+			if err := r.flush(); err != nil {
+				logger.Error("Error writing recording", "file", path, "err", err)
+			}
+			f.Close()
+			return
+		}
+	}()
+
+	return r, nil
+}
+
+// Close writes all buffered records to disk and closes the file.
+func (r *recorder) Close() {
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+func (r *recorder) flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Flush()
+}
+
+// Write implements api.Writer.
+func (r *recorder) Write(_ context.Context, vl *api.ValueList) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(record{Received: time.Now(), ValueList: vl})
+}
+
+// replay writes the records read from in to w, reproducing the original
+// spacing between them divided by speed. A speed of zero replays as fast as
+// possible. The times of the value lists are shifted so that they appear to
+// have been received just now.
+func replay(ctx context.Context, in io.Reader, w api.Writer, speed float64) (int, error) {
+	dec := json.NewDecoder(in)
+
+	var (
+		n     int
+		first time.Time
+		start = time.Now()
+	)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("reading record %d: %w", n+1, err)
+		}
+		if rec.ValueList == nil {
+			continue
+		}
+
+		if n == 0 {
+			first = rec.Received
+		}
+		if speed > 0 {
+			offset := time.Duration(float64(rec.Received.Sub(first)) / speed)
+			select {
+			case <-time.After(time.Until(start.Add(offset))):
+			case <-ctx.Done():
+				return n, ctx.Err()
+			}
+		}
+		rec.ValueList.Time = rec.ValueList.Time.Add(time.Since(rec.Received))
+
+		if err := w.Write(ctx, rec.ValueList); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// replaySource is a source.Source replaying a recording.
+type replaySource struct {
+	path   string
+	speed  float64
+	logger *slog.Logger
+}
+
+// Start implements source.Source. Errors while replaying are logged, as the
+// exporter keeps serving the value lists replayed so far.
+func (r replaySource) Start(ctx context.Context, w api.Writer) error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("opening recording: %w", err)
+	}
+	defer f.Close()
+
+	r.logger.Info("Replaying recording", "file", r.path, "speed", r.speed)
+	n, err := replay(ctx, f, w, r.speed)
+	if err != nil {
+		r.logger.Error("Error replaying recording", "file", r.path, "err", err)
+		return nil
+	}
+	r.logger.Info("Finished replaying recording", "file", r.path, "value_lists", n)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	// Pretend the value lists were recorded a day ago.
+	past := time.Now().Add(-24 * time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := newRecorder(ctx, path, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := []api.ValueList{
+		{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+			Time:       past,
+			Interval:   10 * time.Second,
+			DSNames:    []string{"shortterm", "midterm", "longterm"},
+			Values:     []api.Value{api.Gauge(1), api.Gauge(2), api.Gauge(3)},
+		},
+		{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "user"},
+			Time:       past,
+			Interval:   10 * time.Second,
+			DSNames:    []string{"value"},
+			Values:     []api.Value{api.Derive(42)},
+		},
+	}
+	for i := range recorded {
+		if err := rec.Write(ctx, &recorded[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recording bytes.Buffer
+	enc := json.NewEncoder(&recording)
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatal(err)
+		}
+		r.Received = past
+		if err := enc.Encode(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var replayed []*api.ValueList
+	w := api.WriterFunc(func(_ context.Context, vl *api.ValueList) error {
+		replayed = append(replayed, vl)
+		return nil
+	})
+	n, err := replay(ctx, &recording, w, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(recorded) || len(replayed) != len(recorded) {
+		t.Fatalf("replayed %d value lists, want %d", n, len(recorded))
+	}
+
+	for i, vl := range replayed {
+		if vl.Identifier != recorded[i].Identifier {
+			t.Errorf("got identifier %v, want %v", vl.Identifier, recorded[i].Identifier)
+		}
+		if vl.Values[0] != recorded[i].Values[0] {
+			t.Errorf("got values %v, want %v", vl.Values, recorded[i].Values)
+		}
+		// The JSON format rounds times, so allow for a little skew.
+		if d := time.Since(vl.Time); d < -time.Second || d > time.Minute {
+			t.Errorf("replayed time %v is not close to now", vl.Time)
+		}
+	}
+}
+
+func TestRecorderClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := newRecorder(context.Background(), path, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vl := api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	}
+	if err := rec.Write(context.Background(), &vl); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing writes buffered records without waiting for the next flush.
+	rec.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"host":"example.com"`) {
+		t.Errorf("got recording %q", data)
+	}
+}
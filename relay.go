@@ -0,0 +1,87 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+)
+
+// relay forwards value lists to a downstream collectd server using the binary
+// network protocol.
+type relay struct {
+	address string
+	client  *network.Client
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newRelay connects to the collectd server at address. Buffered value lists
+// are sent at least every flushInterval until ctx is done or the relay is
+// closed.
+func newRelay(ctx context.Context, address string, opts network.ClientOptions, flushInterval time.Duration, logger *slog.Logger) (*relay, error) {
+	client, err := network.Dial(address, opts)
+	if err != nil {
+		return nil, err
+	}
+	r := &relay{
+		address: address,
+		client:  client,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.client.Flush(); err != nil {
+					logger.Debug("Error flushing value lists to relay", "address", r.address, "err", err)
+				}
+				continue
+			case <-ctx.Done():
+			case <-r.stop:
+			}
+
+			if err := r.client.Close(); err != nil {
+				logger.Debug("Error closing relay", "address", r.address, "err", err)
+			}
+			return
+		}
+	}()
+
+	return r, nil
+}
+
+// Close sends all buffered value lists and closes the connection.
+func (r *relay) Close() {
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+// Write implements api.Writer.
+func (r *relay) Write(ctx context.Context, vl *api.ValueList) error {
+	return r.client.Write(ctx, vl)
+}
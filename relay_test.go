@@ -0,0 +1,80 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/common/promslog"
+)
+
+type passwordLookupFunc func(string) (string, error)
+
+func (f passwordLookupFunc) Password(user string) (string, error) {
+	return f(user)
+}
+
+func TestRelay(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := network.ClientOptions{SecurityLevel: network.Sign, Username: "alice", Password: "secret"}
+	r, err := newRelay(ctx, conn.LocalAddr().String(), opts, 10*time.Millisecond, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Unix(1700000000, 0),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1), api.Gauge(2), api.Gauge(3)},
+	}
+	if err := r.Write(ctx, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, network.DefaultBufferSize)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vls, err := network.Parse(buf[:n], network.ParseOpts{
+		SecurityLevel: network.Sign,
+		PasswordLookup: passwordLookupFunc(func(string) (string, error) {
+			return "secret", nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vls) != 1 || vls[0].Identifier != want.Identifier || len(vls[0].Values) != 3 {
+		t.Errorf("got %v, want %v", vls, want)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// staleNaN is the NaN value Prometheus uses to mark a series as stale.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// remoteLabel is a label of a series sent via remote write.
+type remoteLabel struct {
+	name, value string
+}
+
+// remoteSeries is a single sample of a series sent via remote write.
+type remoteSeries struct {
+	labels    []remoteLabel // sorted by name, including __name__
+	value     float64
+	timestamp int64 // milliseconds since the epoch
+}
+
+// key identifies the series regardless of its sample.
+func (s remoteSeries) key() string {
+	var b strings.Builder
+	for _, l := range s.labels {
+		b.WriteString(l.name)
+		b.WriteByte(0xff)
+		b.WriteString(l.value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// remoteWriter periodically sends the series gathered from a gatherer to a
+// Prometheus remote-write endpoint. Series that were sent before but are no
+// longer gathered, e.g. because they expired, are sent once more with a
+// staleness marker so that they end immediately instead of after the lookback
+// delta of the receiving server.
+type remoteWriter struct {
+	url      string
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	logger   *slog.Logger
+
+	// sent holds the series of the last successful request by key.
+	sent map[string]remoteSeries
+
+	samples      prometheus.Counter
+	staleMarkers prometheus.Counter
+	failures     prometheus.Counter
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newRemoteWriter sends the series of gatherer to url every interval until ctx
+// is done or the writer is closed.
+func newRemoteWriter(ctx context.Context, url string, interval time.Duration, gatherer prometheus.Gatherer, logger *slog.Logger) *remoteWriter {
+	w := &remoteWriter{
+		url:      url,
+		client:   &http.Client{Timeout: interval},
+		gatherer: gatherer,
+		logger:   logger,
+		sent:     map[string]remoteSeries{},
+		samples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "collectd_exporter_remote_write_samples_total",
+			Help: "Number of samples successfully sent via remote write, excluding staleness markers.",
+		}),
+		staleMarkers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "collectd_exporter_remote_write_stale_markers_total",
+			Help: "Number of staleness markers successfully sent via remote write for series that are no longer exported.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "collectd_exporter_remote_write_failed_requests_total",
+			Help: "Number of remote write requests that failed.",
+		}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.write(ctx)
+				continue
+			case <-ctx.Done():
+			case <-w.stop:
+				// Send the values received since the last request.
+				w.write(context.Background())
+			}
+			return
+		}
+	}()
+
+	return w
+}
+
+// Close sends the current series once more and stops the writer.
+func (w *remoteWriter) Close() {
+	w.closeOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// Describe implements prometheus.Collector.
+func (w *remoteWriter) Describe(ch chan<- *prometheus.Desc) {
+	w.samples.Describe(ch)
+	w.staleMarkers.Describe(ch)
+	w.failures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (w *remoteWriter) Collect(ch chan<- prometheus.Metric) {
+	w.samples.Collect(ch)
+	w.staleMarkers.Collect(ch)
+	w.failures.Collect(ch)
+}
+
+// write gathers the current series and sends them together with staleness
+// markers for the series that disappeared since the last successful request.
+func (w *remoteWriter) write(ctx context.Context) {
+	mfs, err := w.gatherer.Gather()
+	if err != nil {
+		// A partial result would mark the missing series as stale.
+		w.logger.Warn("Error gathering series for remote write", "err", err)
+		w.failures.Inc()
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	series := flattenFamilies(mfs, now)
+	current := make(map[string]remoteSeries, len(series))
+	for _, s := range series {
+		current[s.key()] = s
+	}
+	var stale int
+	for k, s := range w.sent {
+		if _, ok := current[k]; ok {
+			continue
+		}
+		series = append(series, remoteSeries{labels: s.labels, value: staleNaN, timestamp: now})
+		stale++
+	}
+	if len(series) == 0 {
+		return
+	}
+
+	if err := w.send(ctx, encodeWriteRequest(series)); err != nil {
+		w.logger.Warn("Error sending series via remote write", "url", w.url, "err", err)
+		w.failures.Inc()
+		return
+	}
+	w.sent = current
+	w.samples.Add(float64(len(series) - stale))
+	w.staleMarkers.Add(float64(stale))
+}
+
+// send posts a snappy compressed, protobuf encoded WriteRequest.
+func (w *remoteWriter) send(ctx context.Context, req []byte) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(snappy.Encode(nil, req)))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("User-Agent", "collectd_exporter")
+	r.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// flattenFamilies converts metric families to the series of the text
+// exposition format: histograms and summaries are split into their _bucket,
+// _sum and _count or quantile series. Samples without a timestamp get now.
+func flattenFamilies(mfs []*dto.MetricFamily, now int64) []remoteSeries {
+	var series []remoteSeries
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...remoteLabel) {
+				labels := make([]remoteLabel, 0, len(m.GetLabel())+len(extra)+1)
+				labels = append(labels, remoteLabel{model.MetricNameLabel, name})
+				for _, lp := range m.GetLabel() {
+					labels = append(labels, remoteLabel{lp.GetName(), lp.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, remoteSeries{labels: labels, value: value, timestamp: ts})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), remoteLabel{model.BucketLabel, formatFloat(b.GetUpperBound())})
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), remoteLabel{model.BucketLabel, "+Inf"})
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), remoteLabel{model.QuantileLabel, formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			default:
+				add(name, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series
+}
+
+// formatFloat formats le and quantile label values like the text exposition
+// format.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest protobuf
+// message of the remote write 1.0 protocol, one sample per time series.
+func encodeWriteRequest(series []remoteSeries) []byte {
+	var req, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/promslog"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// decodeWriteRequest decodes a WriteRequest to "name{label=value,...} value"
+// lines, with "stale" for staleness markers.
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	t.Helper()
+
+	// fields returns the length-delimited fields of b by number.
+	fields := func(b []byte) map[protowire.Number][][]byte {
+		m := map[protowire.Number][][]byte{}
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			var v []byte
+			switch typ {
+			case protowire.BytesType:
+				v, n = protowire.ConsumeBytes(b)
+			case protowire.Fixed64Type:
+				n = protowire.ConsumeFieldValue(num, typ, b)
+				v = b[:n]
+			default:
+				n = protowire.ConsumeFieldValue(num, typ, b)
+			}
+			if n < 0 {
+				t.Fatal(protowire.ParseError(n))
+			}
+			b = b[n:]
+			m[num] = append(m[num], v)
+		}
+		return m
+	}
+
+	var lines []string
+	for _, ts := range fields(b)[1] {
+		f := fields(ts)
+		var name string
+		var labels []string
+		for _, l := range f[1] {
+			lf := fields(l)
+			n, v := string(lf[1][0]), string(lf[2][0])
+			if n == "__name__" {
+				name = v
+				continue
+			}
+			labels = append(labels, n+"="+v)
+		}
+		for _, s := range f[2] {
+			value := "stale"
+			raw, _ := protowire.ConsumeFixed64(fields(s)[1][0])
+			if raw != math.Float64bits(staleNaN) {
+				value = formatFloat(math.Float64frombits(raw))
+			}
+			lines = append(lines, name+"{"+strings.Join(labels, ",")+"} "+value)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestRemoteWriter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests [][]string
+		fail     bool
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if got := r.Header.Get("Content-Encoding"); got != "snappy" {
+			t.Errorf("got Content-Encoding %q, want snappy", got)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests = append(requests, decodeWriteRequest(t, req))
+	}))
+	defer ts.Close()
+
+	gauge := func(name string, value float64, labels ...string) *dto.MetricFamily {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum(), Metric: []*dto.Metric{m}}
+	}
+	var families []*dto.MetricFamily
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	})
+
+	w := newRemoteWriter(context.Background(), ts.URL, time.Hour, gatherer, promslog.NewNopLogger())
+	defer w.Close()
+
+	families = []*dto.MetricFamily{
+		gauge("collectd_load_shortterm", 1, "instance", "a"),
+		gauge("collectd_load_shortterm", 2, "instance", "b"),
+		{
+			Name: proto.String("collectd_latency_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{
+				SampleCount: proto.Uint64(3),
+				SampleSum:   proto.Float64(1.5),
+				Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)}},
+			}}},
+		},
+	}
+	w.write(context.Background())
+
+	// Instance b expired. The failed request must not forget it.
+	families = families[:1]
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	w.write(context.Background())
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	w.write(context.Background())
+
+	// Nothing changed, so nothing is marked stale again.
+	w.write(context.Background())
+
+	mu.Lock()
+	got := requests
+	mu.Unlock()
+	want := [][]string{
+		{
+			"collectd_latency_seconds_bucket{le=+Inf} 3",
+			"collectd_latency_seconds_bucket{le=0.5} 2",
+			"collectd_latency_seconds_count{} 3",
+			"collectd_latency_seconds_sum{} 1.5",
+			"collectd_load_shortterm{instance=a} 1",
+			"collectd_load_shortterm{instance=b} 2",
+		},
+		{
+			"collectd_latency_seconds_bucket{le=+Inf} stale",
+			"collectd_latency_seconds_bucket{le=0.5} stale",
+			"collectd_latency_seconds_count{} stale",
+			"collectd_latency_seconds_sum{} stale",
+			"collectd_load_shortterm{instance=a} 1",
+			"collectd_load_shortterm{instance=b} stale",
+		},
+		{
+			"collectd_load_shortterm{instance=a} 1",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests\n%q\nwant\n%q", got, want)
+	}
+
+	if got := testutil.ToFloat64(w.samples); got != 8 {
+		t.Errorf("got %v samples, want 8", got)
+	}
+	if got := testutil.ToFloat64(w.staleMarkers); got != 5 {
+		t.Errorf("got %v stale markers, want 5", got)
+	}
+	if got := testutil.ToFloat64(w.failures); got != 1 {
+		t.Errorf("got %v failed requests, want 1", got)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/collectd_exporter/collector"
+	"github.com/prometheus/common/expfmt"
+)
+
+// metricsHandler serves the metrics of g along with those of the collector
+// returned by collect for the context of each scrape, such as
+// Collector.WithContext, so that series are only converted for as long as the
+// scrape lasts. See handlerFor for createdLines.
+//
+// The shard=N/M query parameter limits a scrape to the hosts of one shard,
+// see collector.Shard, so that several Prometheus servers can split the
+// series between them. The metrics of g are only served by the first shard.
+// Unless maxSeries is 0, scrapes of more than maxSeries series from collect
+// fail, naming the number of shards needed.
+func metricsHandler(g prometheus.Gatherer, collect func(context.Context) prometheus.Collector, opts promhttp.HandlerOpts, createdLines bool, maxSeries int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		own, shard := g, collector.Shard{Count: 1}
+		if s := r.URL.Query().Get("shard"); s != "" {
+			var err error
+			if shard, err = collector.ParseShard(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ctx = collector.WithShard(ctx, shard)
+			if shard.Index > 0 {
+				own = prometheus.Gatherers{}
+			}
+		}
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collect(ctx))
+		var series prometheus.Gatherer = reg
+		if maxSeries > 0 {
+			series = seriesLimit{Gatherer: reg, max: maxSeries, shards: shard.Count}
+		}
+		handlerFor(prometheus.Gatherers{own, series}, opts, createdLines).ServeHTTP(w, r)
+	})
+}
+
+// seriesLimit is a Gatherer failing if it gathers more than max series, the
+// series of one of shards shards.
+type seriesLimit struct {
+	prometheus.Gatherer
+	max, shards int
+}
+
+// Gather implements prometheus.Gatherer.
+func (l seriesLimit) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := l.Gatherer.Gather()
+	n := 0
+	for _, mf := range mfs {
+		n += len(mf.Metric)
+	}
+	if n > l.max {
+		return nil, fmt.Errorf("%d series exceed the limit of %d, split the scrape into at least %d shards with the query parameter shard=N/M", n, l.max, l.shards*((n+l.max-1)/l.max))
+	}
+	return mfs, err
+}
+
+// handlerFor returns promhttp.HandlerFor(g, opts), except that OpenMetrics
+// responses include the _created samples of counters if createdLines is
+// set, which promhttp does not support.
+func handlerFor(g prometheus.Gatherer, opts promhttp.HandlerOpts, createdLines bool) http.Handler {
+	h := promhttp.HandlerFor(g, opts)
+	if !createdLines || !opts.EnableOpenMetrics {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+		if format.FormatType() != expfmt.TypeOpenMetrics {
+			h.ServeHTTP(w, r)
+			return
+		}
+		mfs, err := g.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", string(format))
+		var out io.Writer = w
+		switch negotiateCompression(r.Header.Get("Accept-Encoding"), opts.OfferedCompressions) {
+		case promhttp.Gzip:
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		case promhttp.Zstd:
+			z, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Encoding", "zstd")
+			defer z.Close()
+			out = z
+		}
+		enc := expfmt.NewEncoder(out, format, expfmt.WithCreatedLines())
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				return
+			}
+		}
+		if closer, ok := enc.(expfmt.Closer); ok {
+			closer.Close()
+		}
+	})
+}
+
+// defaultCompressions are the encodings promhttp offers by default.
+var defaultCompressions = []promhttp.Compression{promhttp.Identity, promhttp.Gzip, promhttp.Zstd}
+
+// negotiateCompression returns the encoding of offers, or of
+// defaultCompressions if offers is empty, that the client prefers according
+// to its Accept-Encoding header, like promhttp: the offer accepted with the
+// highest quality, the earliest of those accepted equally. Identity is
+// returned if the client accepts none of them.
+func negotiateCompression(acceptEncoding string, offers []promhttp.Compression) promhttp.Compression {
+	if len(offers) == 0 {
+		offers = defaultCompressions
+	}
+	best, bestQ := promhttp.Identity, 0.0
+	for _, offer := range offers {
+		for _, spec := range strings.Split(acceptEncoding, ",") {
+			value, params, _ := strings.Cut(spec, ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			if value = strings.TrimSpace(value); q > bestQ && (value == "*" || value == string(offer)) {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+// limitResponse aborts responses of next that exceed max bytes as sent, i.e.
+// after compression, by closing the connection, so that the scrape fails
+// instead of returning truncated series. exceeded is called once a response
+// is aborted. 0 does not limit responses.
+func limitResponse(next http.Handler, max int64, exceeded func(r *http.Request)) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&limitedResponseWriter{ResponseWriter: w, max: max, exceeded: func() { exceeded(r) }}, r)
+	})
+}
+
+// limitedResponseWriter aborts the response once more than max bytes are
+// written to it.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	n, max   int64
+	exceeded func()
+}
+
+// Write implements http.ResponseWriter.
+func (w *limitedResponseWriter) Write(b []byte) (int, error) {
+	if w.n += int64(len(b)); w.n > w.max {
+		// Deferred writes, e.g. closing a compressor, panic again.
+		if w.exceeded != nil {
+			w.exceeded()
+			w.exceeded = nil
+		}
+		panic(http.ErrAbortHandler)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// scrapeContext returns the context of the scrape r, which is done once the
+// client disconnects or the timeout Prometheus sends along has passed.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), time.Duration(timeout*float64(time.Second)))
+}
+
+// limitScrapes limits the number of scrapes handled by next at the same time
+// to cap(sem). Scrapes beyond the limit are rejected with 503 Service
+// Unavailable. A nil sem does not limit scrapes.
+func limitScrapes(next http.Handler, sem chan struct{}) http.Handler {
+	if sem == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		default:
+			http.Error(w, "too many concurrent scrapes", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,260 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/collectd_exporter/collector"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	c, err := collector.New(nil, collector.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Ingest(&api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	})
+	h := metricsHandler(prometheus.DefaultGatherer, c.WithContext, promhttp.HandlerOpts{}, false, 0)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `collectd_load{instance="example.com"} 1`) || !strings.Contains(body, "go_goroutines") {
+		t.Errorf("got body %s", body)
+	}
+
+	// The series of an aborted scrape are not converted.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+	body = rec.Body.String()
+	if strings.Contains(body, "collectd_load") || !strings.Contains(body, "collectd_exporter_aborted_collections_total 1") {
+		t.Errorf("got body %s", body)
+	}
+}
+
+func TestMetricsHandlerShards(t *testing.T) {
+	c, err := collector.New(nil, collector.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		c.Ingest(&api.ValueList{
+			Identifier: api.Identifier{Host: fmt.Sprintf("host%d", i), Plugin: "load", Type: "load"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		})
+	}
+	scrape := func(h http.Handler, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	h := metricsHandler(prometheus.DefaultGatherer, c.WithContext, promhttp.HandlerOpts{}, false, 0)
+	series := 0
+	for n, target := range []string{"/metrics?shard=0/2", "/metrics?shard=1/2"} {
+		rec := scrape(h, target)
+		body := rec.Body.String()
+		series += strings.Count(body, "collectd_load{")
+		if own := strings.Contains(body, "go_goroutines"); own != (n == 0) {
+			t.Errorf("shard %d exposed the exporter's own metrics: %t", n, own)
+		}
+	}
+	if series != 10 {
+		t.Errorf("shards exposed %d series, want 10", series)
+	}
+	if rec := scrape(h, "/metrics?shard=2/2"); rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid shard", rec.Code)
+	}
+
+	// The converted series of 10 hosts exceed the limit of 30 series.
+	h = metricsHandler(prometheus.DefaultGatherer, c.ConvertedWithContext, promhttp.HandlerOpts{}, false, 30)
+	if rec := scrape(h, "/metrics"); rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "at least 2 shards") {
+		t.Errorf("got status %d and body %s for too many series", rec.Code, rec.Body)
+	}
+	if rec := scrape(h, "/metrics?shard=0/4"); rec.Code != http.StatusOK {
+		t.Errorf("got status %d and body %s for a shard", rec.Code, rec.Body)
+	}
+}
+
+func TestScrapeContext(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "2.5")
+	ctx, cancel := scrapeContext(r)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > 2500*time.Millisecond || time.Until(deadline) < 2*time.Second {
+		t.Errorf("got deadline %v, %v, want in 2.5s", deadline, ok)
+	}
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "invalid")
+	ctx, cancel = scrapeContext(r)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("got deadline for invalid timeout")
+	}
+}
+
+func TestLimitScrapes(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := limitScrapes(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), make(chan struct{}, 1))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d beyond limit, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	close(release)
+	<-done
+	go func() { <-started }()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d after scrape finished, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestHandlerForCreatedLines(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	packets := prometheus.NewCounter(prometheus.CounterOpts{Name: "packets_total", Help: "Packets."})
+	packets.Inc()
+	reg.MustRegister(packets)
+	h := handlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true}, true)
+
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"application/openmetrics-text; version=1.0.0", "packets_created "},
+		{"text/plain", "packets_total 1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", tc.accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if body := rec.Body.String(); !strings.Contains(body, tc.want) {
+			t.Errorf("accept %s: got body %s, want %q", tc.accept, body, tc.want)
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	zstdFirst := []promhttp.Compression{promhttp.Zstd, promhttp.Gzip}
+	for _, tc := range []struct {
+		acceptEncoding string
+		offers         []promhttp.Compression
+		want           promhttp.Compression
+	}{
+		{"", nil, promhttp.Identity},
+		{"gzip", nil, promhttp.Gzip},
+		{"gzip, zstd", nil, promhttp.Gzip},
+		{"gzip, zstd", zstdFirst, promhttp.Zstd},
+		{"gzip;q=0.5, zstd", nil, promhttp.Zstd},
+		{"zstd;q=0", zstdFirst, promhttp.Identity},
+		{"*", zstdFirst, promhttp.Zstd},
+		{"br", zstdFirst, promhttp.Identity},
+	} {
+		if got := negotiateCompression(tc.acceptEncoding, tc.offers); got != tc.want {
+			t.Errorf("%q, %v: got %s, want %s", tc.acceptEncoding, tc.offers, got, tc.want)
+		}
+	}
+}
+
+func TestHandlerForCreatedLinesCompression(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "packets_total", Help: "Packets."}))
+	h := handlerFor(reg, promhttp.HandlerOpts{
+		EnableOpenMetrics:   true,
+		OfferedCompressions: []promhttp.Compression{promhttp.Zstd, promhttp.Gzip},
+	}, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "zstd" {
+		t.Fatalf("got encoding %q, want zstd", enc)
+	}
+	dec, err := zstd.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	if body, err := io.ReadAll(dec); err != nil || !strings.Contains(string(body), "packets_created ") {
+		t.Errorf("got body %s, %v", body, err)
+	}
+}
+
+func TestLimitResponse(t *testing.T) {
+	var exceeded atomic.Int32
+	h := limitResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}), 8, func(*http.Request) { exceeded.Add(1) })
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/metrics?body=small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "small" {
+		t.Errorf("got body %q", body)
+	}
+
+	resp, err = srv.Client().Get(srv.URL + "/metrics?body=" + strings.Repeat("x", 4096))
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("response exceeding the limit was not aborted")
+	}
+	// The client retries requests aborted before the response headers.
+	if exceeded.Load() == 0 {
+		t.Error("exceeded response not reported")
+	}
+}
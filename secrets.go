@@ -0,0 +1,174 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"collectd.org/network"
+)
+
+// errNoPassword is returned for users without a password.
+var errNoPassword = errors.New("no password for user")
+
+// secretDir looks up passwords in a directory holding one file per user,
+// named like the user and containing the password, as mounted from a
+// Kubernetes secret. Files are re-read when they change, so that rotated
+// secrets take effect without a restart.
+type secretDir struct {
+	dir string
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+// cachedSecret is the content of a file along with its modification time.
+type cachedSecret struct {
+	modTime time.Time
+	value   string
+}
+
+// newSecretDir returns a secretDir reading the files in dir.
+func newSecretDir(dir string) *secretDir {
+	return &secretDir{dir: dir, cache: map[string]cachedSecret{}}
+}
+
+// Password implements network.PasswordLookup.
+func (d *secretDir) Password(user string) (string, error) {
+	// User names come from packets, so they must not escape the directory.
+	// Hidden files hold the bookkeeping of Kubernetes' atomic updates.
+	if user == "" || strings.ContainsAny(user, `/\`) || strings.HasPrefix(user, ".") {
+		return "", fmt.Errorf("%w %q", errNoPassword, user)
+	}
+	path := filepath.Join(d.dir, user)
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w %q", errNoPassword, user)
+	} else if err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.cache[user]; ok && s.modTime.Equal(fi.ModTime()) {
+		return s.value, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s := cachedSecret{modTime: fi.ModTime(), value: strings.TrimSpace(string(data))}
+	d.cache[user] = s
+	return s.value, nil
+}
+
+// envPasswords looks up the password of a user in the environment variable
+// named by the user with prefix prepended, e.g. COLLECTD_PASSWORD_alice.
+type envPasswords string
+
+// Password implements network.PasswordLookup.
+func (prefix envPasswords) Password(user string) (string, error) {
+	if password, ok := os.LookupEnv(string(prefix) + user); ok && user != "" {
+		return password, nil
+	}
+	return "", fmt.Errorf("%w %q", errNoPassword, user)
+}
+
+// passwordLookups asks each of its lookups in turn and returns the first
+// password found.
+type passwordLookups []network.PasswordLookup
+
+// Password implements network.PasswordLookup. It returns the error of the
+// last lookup if none has a password for user.
+func (l passwordLookups) Password(user string) (string, error) {
+	err := fmt.Errorf("%w %q", errNoPassword, user)
+	for _, lookup := range l {
+		var password string
+		if password, err = lookup.Password(user); err == nil {
+			return password, nil
+		}
+	}
+	return "", err
+}
+
+// readSecret returns the secret in the environment variable env if set, and
+// otherwise the content of file, without surrounding whitespace.
+func readSecret(env, file string) (string, error) {
+	if env != "" {
+		if secret, ok := os.LookupEnv(env); ok {
+			return secret, nil
+		}
+		return "", fmt.Errorf("environment variable %s not set", env)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// certReloader loads a certificate and its key from files, and loads them
+// again when either changes, so that renewed certificates are presented to
+// new clients without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// newCertReloader returns a certReloader for the given files, failing if they
+// cannot be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// certificate returns the current certificate. If the files changed but
+// cannot be loaded, e.g. while being rewritten, the previous certificate is
+// returned.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(name); err == nil {
+			modTimes[i] = fi.ModTime()
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert != nil && modTimes == r.modTimes {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert, r.modTimes = &cert, modTimes
+	return r.cert, nil
+}
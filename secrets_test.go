@@ -0,0 +1,174 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPasswordLookups(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "alice"), []byte("w0nderl4nd\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(t.TempDir(), "outside"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("COLLECTD_PASSWORD_bob", "bu1|der")
+	lookup := passwordLookups{newSecretDir(dir), envPasswords("COLLECTD_PASSWORD_")}
+
+	for _, tc := range []struct {
+		user, want string
+	}{
+		{"alice", "w0nderl4nd"},
+		{"bob", "bu1|der"},
+		{"carol", ""},
+		{"", ""},
+		{"../outside", ""},
+		{".", ""},
+	} {
+		got, err := lookup.Password(tc.user)
+		if got != tc.want || (err != nil) != (tc.want == "") {
+			t.Errorf("%q: got password %q, error %v, want %q", tc.user, got, err, tc.want)
+		}
+	}
+
+	// Rotated secrets are read again.
+	path := filepath.Join(dir, "alice")
+	if err := os.WriteFile(path, []byte("r4bb1t"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := lookup.Password("alice"); got != "r4bb1t" {
+		t.Errorf("got password %q, error %v after rotation, want r4bb1t", got, err)
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte(" from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RELAY_PASSWORD", "from env")
+
+	for _, tc := range []struct {
+		env, file, want string
+		fails           bool
+	}{
+		{file: file, want: "from file"},
+		{env: "RELAY_PASSWORD", file: file, want: "from env"},
+		{env: "UNSET_RELAY_PASSWORD", file: file, fails: true},
+		{file: file + ".missing", fails: true},
+	} {
+		got, err := readSecret(tc.env, tc.file)
+		if (err != nil) != tc.fails || got != tc.want {
+			t.Errorf("%q, %q: got %q, error %v, want %q", tc.env, tc.file, got, err, tc.want)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Error("expected error for missing files")
+	}
+
+	writeCert(t, certFile, keyFile, "first", time.Now())
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, r); got != "first" {
+		t.Errorf("got certificate %q, want first", got)
+	}
+
+	// Broken files keep the previous certificate, renewed ones replace it.
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(keyFile, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := commonName(t, r); got != "first" {
+		t.Errorf("got certificate %q with a broken key, want first", got)
+	}
+	writeCert(t, certFile, keyFile, "second", later.Add(time.Minute))
+	if got := commonName(t, r); got != "second" {
+		t.Errorf("got certificate %q after renewal, want second", got)
+	}
+}
+
+// writeCert writes a self-signed certificate for name and its key to the
+// given files and sets their modification time.
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// commonName returns the common name of the current certificate of r.
+func commonName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// serviceName is the name the exporter is expected to be registered with at
+// the service control manager. It is also used as the event log source.
+const serviceName = "collectd_exporter"
+
+// startService connects to the service control manager if the exporter runs
+// as a Windows service. The returned context is canceled once the service is
+// asked to stop, and the returned logger writes to the Windows event log. The
+// returned function must be called once the exporter has shut down; it
+// reports the service as stopped. Outside of a service, ctx and logger are
+// returned unchanged.
+func startService(ctx context.Context, logger *slog.Logger) (context.Context, *slog.Logger, func(), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("detecting service: %w", err)
+	}
+	if !isService {
+		return ctx, logger, func() {}, nil
+	}
+
+	// Registering the source fails if it already exists or without the
+	// necessary privileges. Events are logged either way, if less nicely
+	// formatted by the event viewer.
+	_ = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("opening event log: %w", err)
+	}
+	logger = slog.New(newEventLogHandler(elog, logger.Handler()))
+
+	ctx, cancel := context.WithCancel(ctx)
+	s := &service{stop: cancel, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(serviceName, s); err != nil {
+			logger.Error("Error running service", "err", err)
+			os.Exit(1)
+		}
+	}()
+	return ctx, logger, func() {
+		close(s.stopped)
+		<-done
+	}, nil
+}
+
+// service handles requests of the service control manager.
+type service struct {
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// Execute implements svc.Handler.
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	changes <- svc.Status{State: svc.StartPending}
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				s.stop()
+				<-s.stopped
+				return false, 0
+			}
+		case <-s.stopped:
+			// Shut down without a request, e.g. by a signal.
+			return false, 0
+		}
+	}
+}
+
+// eventLogHandler writes log records formatted by a slog.TextHandler to the
+// Windows event log, as informational, warning or error events depending on
+// their level.
+type eventLogHandler struct {
+	text    slog.Handler
+	enabled slog.Handler
+	w       *eventLogWriter
+}
+
+// newEventLogHandler returns a handler logging to elog. Records are logged if
+// enabled, usually the handler configured by the --log.* flags, enables their
+// level.
+func newEventLogHandler(elog *eventlog.Log, enabled slog.Handler) *eventLogHandler {
+	w := &eventLogWriter{log: elog}
+	return &eventLogHandler{
+		text: slog.NewTextHandler(w, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// Events are timestamped by the event log.
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+		enabled: enabled,
+		w:       w,
+	}
+}
+
+// Enabled implements slog.Handler.
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.enabled.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler.
+func (h *eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+
+	h.w.level = r.Level
+	return h.text.Handle(ctx, r)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &eventLogHandler{text: h.text.WithAttrs(attrs), enabled: h.enabled.WithAttrs(attrs), w: h.w}
+}
+
+// WithGroup implements slog.Handler.
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	return &eventLogHandler{text: h.text.WithGroup(name), enabled: h.enabled.WithGroup(name), w: h.w}
+}
+
+// eventLogWriter writes each formatted record as an event of the level of
+// the record being handled.
+type eventLogWriter struct {
+	mu    sync.Mutex
+	log   *eventlog.Log
+	level slog.Level
+}
+
+// Write implements io.Writer. slog.TextHandler writes each record at once.
+func (w *eventLogWriter) Write(b []byte) (int, error) {
+	const eventID = 1
+
+	msg := strings.TrimSuffix(string(b), "\n")
+	var err error
+	switch {
+	case w.level >= slog.LevelError:
+		err = w.log.Error(eventID, msg)
+	case w.level >= slog.LevelWarn:
+		err = w.log.Warning(eventID, msg)
+	default:
+		err = w.log.Info(eventID, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
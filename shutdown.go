@@ -0,0 +1,67 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// scrapeWaiter wraps the metrics handler, so that shutdown can wait for a
+// final scrape after all received value lists have been processed.
+type scrapeWaiter struct {
+	handler http.Handler
+
+	mu      sync.Mutex
+	waiting chan struct{}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *scrapeWaiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Only scrapes started after wait was called see the final state.
+	s.mu.Lock()
+	waiting := s.waiting
+	s.mu.Unlock()
+
+	s.handler.ServeHTTP(w, r)
+
+	if waiting == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.waiting == waiting {
+		close(waiting)
+		s.waiting = nil
+	}
+	s.mu.Unlock()
+}
+
+// wait blocks until a scrape started after calling wait has completed, or
+// ctx is done.
+func (s *scrapeWaiter) wait(ctx context.Context) error {
+	s.mu.Lock()
+	if s.waiting == nil {
+		s.waiting = make(chan struct{})
+	}
+	waiting := s.waiting
+	s.mu.Unlock()
+
+	select {
+	case <-waiting:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+)
+
+// maxAuthFailureSeries limits the number of address and user combinations
+// tracked by AuthFailures, as both are chosen by the sender. Failures beyond
+// it are accounted to the address and user "other".
+const maxAuthFailureSeries = 1000
+
+// Reasons of authentication failures.
+const (
+	authReasonSignature  = "signature"
+	authReasonDecryption = "decryption"
+)
+
+// AuthFailures counts binary protocol packets that failed signature
+// verification or decryption, by sender address and user name, and
+// optionally logs them. It implements prometheus.Collector and may be shared
+// by several sources.
+type AuthFailures struct {
+	logger      *slog.Logger
+	logInterval time.Duration
+
+	mu       sync.Mutex
+	failures *prometheus.CounterVec
+	logged   map[authKey]*authLog
+}
+
+// authKey identifies the sender of failed packets.
+type authKey struct {
+	addr, user string
+}
+
+// authLog tracks the rate limiting of log messages for one sender.
+type authLog struct {
+	last       time.Time
+	suppressed int
+}
+
+// NewAuthFailures returns a new AuthFailures. If logInterval is positive,
+// failures are logged at warn level, at most once per interval for each
+// sender. A nil logger discards all log messages.
+func NewAuthFailures(logger *slog.Logger, logInterval time.Duration) *AuthFailures {
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	return &AuthFailures{
+		logger:      logger,
+		logInterval: logInterval,
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_auth_failures_total",
+				Help: "Number of binary protocol packets that failed signature verification or decryption, by sender address, user and reason.",
+			},
+			[]string{"address", "user", "reason"},
+		),
+		logged: map[authKey]*authLog{},
+	}
+}
+
+// record accounts a packet from addr, signed or encrypted by user, that
+// failed for the given reason.
+func (a *AuthFailures) record(addr netip.Addr, user, reason string, err error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := authKey{addr: addr.String(), user: user}
+	l, ok := a.logged[key]
+	if !ok {
+		if len(a.logged) >= maxAuthFailureSeries {
+			key = authKey{addr: "other", user: "other"}
+			if l, ok = a.logged[key]; !ok {
+				l = &authLog{}
+				a.logged[key] = l
+			}
+		} else {
+			l = &authLog{}
+			a.logged[key] = l
+		}
+	}
+	a.failures.WithLabelValues(key.addr, key.user, reason).Inc()
+
+	if a.logInterval <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(l.last) < a.logInterval {
+		l.suppressed++
+		return
+	}
+	a.logger.Warn("Authentication failure", "address", addr, "user", user, "reason", reason, "err", err, "suppressed", l.suppressed)
+	l.last = now
+	l.suppressed = 0
+}
+
+// Collect implements prometheus.Collector.
+func (a *AuthFailures) Collect(ch chan<- prometheus.Metric) {
+	a.failures.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (a *AuthFailures) Describe(ch chan<- *prometheus.Desc) {
+	a.failures.Describe(ch)
+}
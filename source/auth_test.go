@@ -0,0 +1,55 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuthFailures(t *testing.T) {
+	var logs bytes.Buffer
+	a := NewAuthFailures(slog.New(slog.NewTextHandler(&logs, nil)), time.Hour)
+	errAuth := errors.New("SHA256 verification failure")
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		a.record(addr, "alice", authReasonSignature, errAuth)
+	}
+	if n := strings.Count(logs.String(), "Authentication failure"); n != 1 {
+		t.Errorf("got %d log messages, want 1 within the interval:\n%s", n, logs.String())
+	}
+
+	// Further senders beyond the limit are accounted to "other".
+	for i := 1; i <= maxAuthFailureSeries; i++ {
+		a.record(netip.AddrFrom4([4]byte{198, 51, byte(i >> 8), byte(i)}), "bob", authReasonDecryption, errAuth)
+	}
+	if n := testutil.CollectAndCount(a); n != maxAuthFailureSeries+1 {
+		t.Errorf("got %d series, want %d", n, maxAuthFailureSeries+1)
+	}
+
+	if v := testutil.ToFloat64(a.failures.WithLabelValues("192.0.2.1", "alice", authReasonSignature)); v != 3 {
+		t.Errorf("got %v failures of alice, want 3", v)
+	}
+	if v := testutil.ToFloat64(a.failures.WithLabelValues("other", "other", authReasonDecryption)); v != 1 {
+		t.Errorf("got %v failures of other senders, want 1", v)
+	}
+}
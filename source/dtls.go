@@ -0,0 +1,193 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/pion/dtls/v3"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// dtlsHandshakeTimeout limits the time a peer may take to complete the
+	// DTLS handshake.
+	dtlsHandshakeTimeout = 30 * time.Second
+	// dtlsIdleTimeout closes associations without traffic, so that the
+	// state of peers that went away without closing them is freed.
+	dtlsIdleTimeout = 5 * time.Minute
+)
+
+// DTLS receives value lists in collectd's binary network protocol over DTLS.
+// Every datagram carries one binary protocol packet, as with UDP, but
+// confidentiality and authentication are provided by DTLS instead of
+// collectd's pre-shared key scheme.
+type DTLS struct {
+	// Addr is the address to listen on, e.g. ":25827".
+	Addr string
+	// Config holds the server certificate and the client authentication
+	// policy. With client certificates, the common name of the verified
+	// certificate is passed on as Info.Username.
+	Config *dtls.Config
+	// ParseOpts controls the types.db used to parse packets.
+	ParseOpts network.ParseOpts
+	// Quarantine keeps packets that could not be parsed. May be nil.
+	Quarantine *Quarantine
+	// UnknownTypes accounts value lists of types missing from the
+	// types.db. May be nil.
+	UnknownTypes *UnknownTypes
+	// Logger receives handshake and parse errors. May be nil.
+	Logger *slog.Logger
+
+	// listener is the socket bound by Listen, or set by tests.
+	listener net.Listener
+}
+
+// Listen binds the socket without accepting connections yet. Start calls it
+// if necessary.
+func (d *DTLS) Listen() error {
+	if d.listener != nil {
+		return nil
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", d.Addr)
+	if err != nil {
+		return fmt.Errorf("resolving listen address: %w", err)
+	}
+	l, err := dtls.Listen("udp", laddr, d.Config)
+	if err != nil {
+		return fmt.Errorf("creating socket: %w", err)
+	}
+
+	d.listener = l
+	return nil
+}
+
+// Start implements Source.
+func (d *DTLS) Start(ctx context.Context, w api.Writer) error {
+	logger := d.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	if err := d.Listen(); err != nil {
+		return err
+	}
+	l := d.listener
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Bind a new socket if started again.
+			l.Close()
+			d.listener = nil
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.serve(ctx, conn.(*dtls.Conn), w, logger)
+		}()
+	}
+}
+
+// serve completes the handshake with a peer and writes the value lists it
+// sends to w until the association is closed.
+func (d *DTLS) serve(ctx context.Context, conn *dtls.Conn, w api.Writer, logger *slog.Logger) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	hctx, cancel := context.WithTimeout(ctx, dtlsHandshakeTimeout)
+	err := conn.HandshakeContext(hctx)
+	cancel()
+	if err != nil {
+		logger.Debug("DTLS handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+
+	var info Info
+	if addr, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		info.Addr = addr.Addr().Unmap()
+	}
+	if state, ok := conn.ConnectionState(); ok && len(state.PeerCertificates) > 0 {
+		if cert, err := x509.ParseCertificate(state.PeerCertificates[0]); err == nil {
+			info.Username = cert.Subject.CommonName
+		}
+	}
+	// Packets already received are written even once ctx is canceled.
+	wctx := NewContext(context.WithoutCancel(ctx), info)
+
+	buf := make([]byte, network.DefaultBufferSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(dtlsIdleTimeout)); err != nil {
+			return
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if ctx.Err() == nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				logger.Debug("Error reading from DTLS peer", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+
+		pctx, span := tracer.Start(wctx, "collectd.packet",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("network.peer.address", info.Addr.String()),
+				attribute.Int("collectd.packet.size", n),
+			),
+		)
+		valueLists, err := parsePacket(buf[:n], d.ParseOpts, d.UnknownTypes, logger)
+		if err != nil {
+			spanError(span, err)
+			span.End()
+			d.Quarantine.record("dtls", info, invalidClassParse, buf[:n], err)
+			logger.Debug("Error parsing packet", "remote", conn.RemoteAddr(), "err", err)
+			continue
+		}
+		span.SetAttributes(attribute.Int("collectd.value_lists", len(valueLists)))
+		pinfo := info
+		pinfo.Bytes = share(n, len(valueLists))
+		pctx = NewContext(pctx, pinfo)
+		for _, vl := range valueLists {
+			if err := w.Write(pctx, vl); err != nil {
+				logger.Debug("Error writing value list", "err", err)
+			}
+		}
+		span.End()
+	}
+}
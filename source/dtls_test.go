@@ -0,0 +1,140 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/pion/dtls/v3"
+)
+
+// selfSignedCert returns a self-signed certificate for the given common name.
+func selfSignedCert(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestDTLS(t *testing.T) {
+	serverCert, _ := selfSignedCert(t, "collectd_exporter")
+	clientCert, clientCA := selfSignedCert(t, "agent")
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA)
+
+	l, err := dtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, &dtls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   dtls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type received struct {
+		vl   *api.ValueList
+		info Info
+	}
+	ch := make(chan received, 1)
+	done := make(chan error)
+	go func() {
+		d := &DTLS{listener: l}
+		done <- d.Start(ctx, api.WriterFunc(func(ctx context.Context, vl *api.ValueList) error {
+			info, _ := FromContext(ctx)
+			ch <- received{vl, info}
+			return nil
+		}))
+	}()
+
+	conn, err := dtls.Dial("udp", l.Addr().(*net.UDPAddr), &dtls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := api.Identifier{Host: "example.com", Plugin: "load", Type: "load"}
+	buf := network.NewBuffer(0)
+	if err := buf.Write(ctx, &api.ValueList{
+		Identifier: want,
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := buf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-ch:
+		if r.vl.Identifier != want {
+			t.Errorf("got identifier %v, want %v", r.vl.Identifier, want)
+		}
+		if wantInfo := (Info{Addr: netip.MustParseAddr("127.0.0.1"), Username: "agent", Bytes: len(packet)}); !reflect.DeepEqual(r.info, wantInfo) {
+			t.Errorf("got source info %v, want %v", r.info, wantInfo)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for value list")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("got error %v after cancellation, want nil", err)
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/common/promslog"
+)
+
+// DefaultGraphiteTemplate matches the paths written by collectd's
+// write_graphite plugin with its default settings, e.g.
+// "example_com.cpu-0.cpu-idle" or "example_com.load.load.shortterm".
+const DefaultGraphiteTemplate = "host.plugin-plugin_instance.type-type_instance.ds"
+
+// graphiteIdleTimeout is the time after which idle Graphite connections are
+// closed.
+const graphiteIdleTimeout = 5 * time.Minute
+
+// Graphite receives values in the Graphite plaintext protocol, as sent by
+// collectd's write_graphite plugin, over TCP and UDP, so that agents can be
+// migrated to Prometheus without being reconfigured at once. Paths are mapped
+// back to collectd identifiers by a template.
+//
+// Each line carries a single value, so consecutive lines of the same
+// identifier and time, as written by write_graphite for the data sources of
+// a value list, are merged into one value list. As write_graphite sends
+// rates instead of counters by default, all values are gauges.
+type Graphite struct {
+	// Addr is the address to listen on for both TCP and UDP, e.g.
+	// ":2003".
+	Addr string
+	// Template maps the dot-separated components of paths to the fields
+	// of collectd identifiers. Each component is one of "host",
+	// "plugin", "plugin_instance", "type", "type_instance", "ds" (the data
+	// source name) or "*" (ignored, e.g. a prefix), or one of the
+	// compounds "plugin-plugin_instance" and "type-type_instance", whose
+	// instance follows the first hyphen and may be missing. A trailing
+	// "ds" is optional. Defaults to DefaultGraphiteTemplate.
+	Template string
+	// Quarantine keeps lines that could not be parsed. May be nil.
+	Quarantine *Quarantine
+	// Logger receives parse errors. May be nil.
+	Logger *slog.Logger
+
+	// template is parsed by Listen, which binds listener and conn.
+	template graphiteTemplate
+	listener net.Listener
+	conn     net.PacketConn
+}
+
+// Listen parses the template and binds the sockets without receiving from
+// them yet. Start calls it if necessary.
+func (g *Graphite) Listen() error {
+	if g.listener != nil {
+		return nil
+	}
+
+	tmpl := g.Template
+	if tmpl == "" {
+		tmpl = DefaultGraphiteTemplate
+	}
+	var err error
+	if g.template, err = parseGraphiteTemplate(tmpl); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", g.Addr)
+	if err != nil {
+		return fmt.Errorf("creating TCP socket: %w", err)
+	}
+	conn, err := net.ListenPacket("udp", g.Addr)
+	if err != nil {
+		l.Close()
+		return fmt.Errorf("creating UDP socket: %w", err)
+	}
+	g.listener, g.conn = l, conn
+	return nil
+}
+
+// Start implements Source.
+func (g *Graphite) Start(ctx context.Context, w api.Writer) error {
+	logger := g.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	if err := g.Listen(); err != nil {
+		return err
+	}
+	l, conn := g.listener, g.conn
+	// Bind new sockets if started again.
+	g.listener, g.conn = nil, nil
+	// Either socket failing stops the other.
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-sctx.Done()
+		l.Close()
+		conn.Close()
+	}()
+
+	var wg sync.WaitGroup
+	udpErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		udpErr <- g.servePackets(sctx, conn, w, logger)
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			cancel()
+			wg.Wait()
+			if uerr := <-udpErr; uerr != nil {
+				return uerr
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.serveConn(sctx, c, w, logger)
+		}()
+	}
+}
+
+// serveConn writes the values received on a TCP connection to w until the
+// connection is closed or idle for graphiteIdleTimeout.
+func (g *Graphite) serveConn(ctx context.Context, conn net.Conn, w api.Writer, logger *slog.Logger) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	info := Info{}
+	if addr, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+		info.Addr = addr.Addr().Unmap()
+	}
+	// Values already received are written even once ctx is canceled.
+	b := &graphiteBatch{g: g, w: w, info: info, ctx: context.WithoutCancel(ctx), logger: logger}
+	defer b.flush()
+
+	r := bufio.NewReader(conn)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(graphiteIdleTimeout)); err != nil {
+			return
+		}
+		line, err := r.ReadString('\n')
+		if line != "" {
+			b.add(line)
+		}
+		if err != nil {
+			var netErr net.Error
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				logger.Debug("Error reading from Graphite connection", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		// The data sources of a value list are sent together, so the
+		// value list is complete once no more data is buffered.
+		if r.Buffered() == 0 {
+			b.flush()
+		}
+	}
+}
+
+// servePackets writes the values received on conn to w until it is closed.
+func (g *Graphite) servePackets(ctx context.Context, conn net.PacketConn, w api.Writer, logger *slog.Logger) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		info := Info{}
+		if a, ok := addr.(*net.UDPAddr); ok {
+			info.Addr = a.AddrPort().Addr().Unmap()
+		}
+		b := &graphiteBatch{g: g, w: w, info: info, ctx: context.WithoutCancel(ctx), logger: logger}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			b.add(line)
+		}
+		b.flush()
+	}
+}
+
+// graphiteBatch merges consecutive lines of the same identifier and time
+// into a value list.
+type graphiteBatch struct {
+	g      *Graphite
+	w      api.Writer
+	info   Info
+	ctx    context.Context
+	logger *slog.Logger
+
+	vl    *api.ValueList
+	bytes int
+}
+
+// add adds the value of line to the pending value list, writing the value
+// list first if line belongs to another one.
+func (b *graphiteBatch) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	id, ds, value, t, err := b.g.template.parseLine(line)
+	if err != nil {
+		b.g.Quarantine.record("graphite", b.info, invalidClassParse, []byte(line), err)
+		b.logger.Debug("Error parsing Graphite line", "remote", b.info.Addr, "err", err)
+		return
+	}
+
+	if b.vl == nil || b.vl.Identifier != id || !b.vl.Time.Equal(t) || slices.Contains(b.vl.DSNames, ds) {
+		b.flush()
+		b.vl = &api.ValueList{Identifier: id, Time: t}
+	}
+	b.vl.Values = append(b.vl.Values, api.Gauge(value))
+	b.vl.DSNames = append(b.vl.DSNames, ds)
+	b.bytes += len(line) + 1
+}
+
+// flush writes the pending value list, if any.
+func (b *graphiteBatch) flush() {
+	if b.vl == nil {
+		return
+	}
+	info := b.info
+	info.Bytes = b.bytes
+	if err := b.w.Write(NewContext(b.ctx, info), b.vl); err != nil {
+		b.logger.Debug("Error writing value list", "err", err)
+	}
+	b.vl, b.bytes = nil, 0
+}
+
+// graphiteTemplate maps the components of Graphite paths to identifier
+// fields.
+type graphiteTemplate []graphiteField
+
+// graphiteField is a component of a graphiteTemplate. If instance is set,
+// the component holds name and instance separated by a hyphen.
+type graphiteField struct {
+	name, instance string
+}
+
+// Fields of graphite templates.
+const (
+	graphiteHost           = "host"
+	graphitePlugin         = "plugin"
+	graphitePluginInstance = "plugin_instance"
+	graphiteType           = "type"
+	graphiteTypeInstance   = "type_instance"
+	graphiteDS             = "ds"
+	graphiteIgnore         = "*"
+)
+
+// parseGraphiteTemplate parses a template, see Graphite.Template.
+func parseGraphiteTemplate(s string) (graphiteTemplate, error) {
+	var (
+		tmpl graphiteTemplate
+		seen = map[string]bool{}
+	)
+	for i, part := range strings.Split(s, ".") {
+		f := graphiteField{name: part}
+		if name, instance, ok := strings.Cut(part, "-"); ok {
+			f = graphiteField{name: name, instance: instance}
+			if !(name == graphitePlugin && instance == graphitePluginInstance) && !(name == graphiteType && instance == graphiteTypeInstance) {
+				return nil, fmt.Errorf("invalid Graphite template %q: unknown compound %q", s, part)
+			}
+		}
+		switch f.name {
+		case graphiteHost, graphitePlugin, graphitePluginInstance, graphiteType, graphiteTypeInstance:
+		case graphiteDS:
+			if i != strings.Count(s, ".") {
+				return nil, fmt.Errorf("invalid Graphite template %q: %q must be last", s, part)
+			}
+		case graphiteIgnore:
+			tmpl = append(tmpl, f)
+			continue
+		default:
+			return nil, fmt.Errorf("invalid Graphite template %q: unknown field %q", s, part)
+		}
+		for _, name := range []string{f.name, f.instance} {
+			if name == "" {
+				continue
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("invalid Graphite template %q: duplicate field %q", s, name)
+			}
+			seen[name] = true
+		}
+		tmpl = append(tmpl, f)
+	}
+	for _, name := range []string{graphiteHost, graphitePlugin, graphiteType} {
+		if !seen[name] {
+			return nil, fmt.Errorf("invalid Graphite template %q: missing field %q", s, name)
+		}
+	}
+	return tmpl, nil
+}
+
+// parseLine parses a line of the form "<path> <value> <timestamp>" and
+// returns the identifier and data source name given by the path.
+func (tmpl graphiteTemplate) parseLine(line string) (api.Identifier, string, float64, time.Time, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return api.Identifier{}, "", 0, time.Time{}, fmt.Errorf("malformed line %q", line)
+	}
+	id, ds, err := tmpl.parsePath(fields[0])
+	if err != nil {
+		return api.Identifier{}, "", 0, time.Time{}, err
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return api.Identifier{}, "", 0, time.Time{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return api.Identifier{}, "", 0, time.Time{}, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+	sec, frac := math.Modf(ts)
+	return id, ds, value, time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+// parsePath returns the identifier and data source name given by path. The
+// data source name defaults to "value".
+func (tmpl graphiteTemplate) parsePath(path string) (api.Identifier, string, error) {
+	parts := strings.Split(path, ".")
+	if len(parts) == len(tmpl)-1 && tmpl[len(tmpl)-1].name == graphiteDS {
+		tmpl = tmpl[:len(tmpl)-1]
+	}
+	if len(parts) != len(tmpl) {
+		return api.Identifier{}, "", fmt.Errorf("path %q does not match the template", path)
+	}
+
+	var id api.Identifier
+	ds := "value"
+	set := func(name, value string) {
+		switch name {
+		case graphiteHost:
+			id.Host = value
+		case graphitePlugin:
+			id.Plugin = value
+		case graphitePluginInstance:
+			id.PluginInstance = value
+		case graphiteType:
+			id.Type = value
+		case graphiteTypeInstance:
+			id.TypeInstance = value
+		case graphiteDS:
+			ds = value
+		}
+	}
+	for i, f := range tmpl {
+		if f.instance == "" {
+			set(f.name, parts[i])
+			continue
+		}
+		name, instance, _ := strings.Cut(parts[i], "-")
+		set(f.name, name)
+		set(f.instance, instance)
+	}
+	if id.Host == "" || id.Plugin == "" || id.Type == "" {
+		return api.Identifier{}, "", fmt.Errorf("path %q lacks a host, plugin or type", path)
+	}
+	return id, ds, nil
+}
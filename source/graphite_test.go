@@ -0,0 +1,150 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestGraphiteTemplate(t *testing.T) {
+	tmpl, err := parseGraphiteTemplate(DefaultGraphiteTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	separate, err := parseGraphiteTemplate("*.host.plugin.plugin_instance.type.type_instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		tmpl graphiteTemplate
+		path string
+		want api.Identifier
+		ds   string
+	}{
+		{tmpl, "example_com.cpu-0.cpu-idle", api.Identifier{Host: "example_com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "idle"}, "value"},
+		{tmpl, "example_com.load.load.shortterm", api.Identifier{Host: "example_com", Plugin: "load", Type: "load"}, "shortterm"},
+		{tmpl, "example_com.df-var-log.df_complex-free", api.Identifier{Host: "example_com", Plugin: "df", PluginInstance: "var-log", Type: "df_complex", TypeInstance: "free"}, "value"},
+		{separate, "collectd.example_com.cpu.0.cpu.idle", api.Identifier{Host: "example_com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "idle"}, "value"},
+		{tmpl, "example_com.load", api.Identifier{}, ""},
+		{tmpl, "example_com..load", api.Identifier{}, ""},
+	} {
+		id, ds, err := tc.tmpl.parsePath(tc.path)
+		if tc.ds == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.path)
+			}
+			continue
+		}
+		if err != nil || id != tc.want || ds != tc.ds {
+			t.Errorf("%s: got %v, %q, error %v, want %v, %q", tc.path, id, ds, err, tc.want, tc.ds)
+		}
+	}
+
+	for _, invalid := range []string{
+		"plugin.type",
+		"host.plugin.type.host",
+		"host.ds.plugin.type",
+		"host.plugin-type.type",
+		"host.plugin.type.unknown",
+	} {
+		if _, err := parseGraphiteTemplate(invalid); err == nil {
+			t.Errorf("%q: expected error", invalid)
+		}
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	q := NewQuarantine(10)
+	g := &Graphite{Addr: "127.0.0.1:0", Quarantine: q}
+	if err := g.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	tcpAddr, udpAddr := g.listener.Addr().String(), g.conn.LocalAddr().String()
+	w := &collectingWriter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- g.Start(ctx, w) }()
+
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "example_com.load.load.shortterm 0.5 1700000000\n"+
+		"example_com.load.load.midterm 0.25 1700000000\n"+
+		"not a valid line\n"+
+		"example_com.cpu-0.cpu-idle 99 1700000000\n")
+	conn.Close()
+	uconn, err := net.Dial("udp", udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	io.WriteString(uconn, "example_com.memory.memory-used 1024 1700000000.5\n")
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w.mu.Lock()
+		n := len(w.valueLists)
+		w.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d value lists, want 3", n)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*api.ValueList{
+		"example_com/load/load": {
+			Identifier: api.Identifier{Host: "example_com", Plugin: "load", Type: "load"},
+			Time:       time.Unix(1700000000, 0),
+			Values:     []api.Value{api.Gauge(0.5), api.Gauge(0.25)},
+			DSNames:    []string{"shortterm", "midterm"},
+		},
+		"example_com/cpu-0/cpu-idle": {
+			Identifier: api.Identifier{Host: "example_com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "idle"},
+			Time:       time.Unix(1700000000, 0),
+			Values:     []api.Value{api.Gauge(99)},
+			DSNames:    []string{"value"},
+		},
+		"example_com/memory/memory-used": {
+			Identifier: api.Identifier{Host: "example_com", Plugin: "memory", Type: "memory", TypeInstance: "used"},
+			Time:       time.Unix(1700000000, 5e8),
+			Values:     []api.Value{api.Gauge(1024)},
+			DSNames:    []string{"value"},
+		},
+	}
+	for i, vl := range w.valueLists {
+		if !reflect.DeepEqual(vl, want[vl.Identifier.String()]) {
+			t.Errorf("got value list %+v, want %+v", vl, want[vl.Identifier.String()])
+		}
+		if !w.infos[i].Addr.IsLoopback() {
+			t.Errorf("got source info %+v", w.infos[i])
+		}
+	}
+	if payloads := q.Payloads(); len(payloads) != 1 || payloads[0].Payload != "not a valid line" {
+		t.Errorf("got invalid payloads %+v", payloads)
+	}
+}
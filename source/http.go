@@ -0,0 +1,313 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"collectd.org/api"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LabelsHeader is the request header by which senders add labels to the
+// value lists of a request, like the "labels" query parameter.
+const LabelsHeader = "X-Prometheus-Labels"
+
+// HTTP accepts value lists in collectd's JSON format, as sent by the
+// write_http plugin, via POST requests to Path on Mux.
+type HTTP struct {
+	Mux    *http.ServeMux
+	Path   string
+	Logger *slog.Logger
+	// AllowedLabels are the names of the labels senders may add to the
+	// value lists of a request, as comma-separated name:value pairs in
+	// the "labels" query parameter or the LabelsHeader header. Requests
+	// with other labels are rejected.
+	AllowedLabels []string
+	// Queue, if set, buffers the value lists of requests, which are then
+	// answered with 202 Accepted before the value lists are written.
+	// Value lists that do not fit are rejected, with 503 Service
+	// Unavailable if none of a request fit.
+	Queue *Queue
+	// Quarantine keeps invalid requests and value lists. May be nil.
+	Quarantine *Quarantine
+}
+
+// Start implements Source. It registers the handler and blocks until ctx is
+// canceled and all requests in flight have been handled. Later requests are
+// rejected with 503 Service Unavailable, and value lists left in the Queue are
+// dropped. As handlers cannot be removed from a ServeMux, Start must only be
+// called once.
+func (h *HTTP) Start(ctx context.Context, w api.Writer) error {
+	var (
+		mu      sync.RWMutex
+		stopped bool
+	)
+	if h.Queue != nil {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.Queue.run(ctx, w)
+		}()
+		defer func() { <-done }()
+	}
+	handler := h.handler(w)
+	h.Mux.HandleFunc(h.Path, func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if stopped {
+			writePushError(w, http.StatusServiceUnavailable, pushError{Code: codeShuttingDown, Error: "shutting down"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	<-ctx.Done()
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	return nil
+}
+
+// Handler returns a handler accepting value lists in collectd's JSON format
+// and writing them to writer. Invalid value lists are rejected individually:
+// the response lists them by index with 207 Multi-Status, or with 400 Bad
+// Request if none was accepted. Rejected requests are answered with the same
+// JSON body, listing errors without an index. A nil logger discards all log
+// messages.
+func Handler(writer api.Writer, logger *slog.Logger) http.Handler {
+	return (&HTTP{Logger: logger}).handler(writer)
+}
+
+// handler returns the handler of h, writing value lists to writer.
+func (h *HTTP) handler(writer api.Writer) http.Handler {
+	logger := h.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "collectd.push", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		labels, err := requestLabels(r, h.AllowedLabels)
+		if err != nil {
+			spanError(span, err)
+			writePushError(w, http.StatusBadRequest, pushError{Code: codeInvalidLabels, Error: err.Error(), Field: "labels"})
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			spanError(span, err)
+			writePushError(w, http.StatusInternalServerError, pushError{Code: codeReadFailed, Error: err.Error()})
+			return
+		}
+
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			spanError(span, err)
+			h.Quarantine.record("http", requestInfo(r), invalidClassJSON, data, err)
+			writePushError(w, http.StatusBadRequest, pushError{Code: codeInvalidJSON, Error: err.Error()})
+			return
+		}
+		span.SetAttributes(
+			attribute.Int("http.request.body.size", len(data)),
+			attribute.Int("collectd.value_lists", len(items)),
+		)
+
+		info := requestInfo(r)
+		info.Bytes = share(len(data), len(items))
+		info.Labels = labels
+		ctx = NewContext(ctx, info)
+
+		write, accepted := writer.Write, http.StatusOK
+		if h.Queue != nil {
+			write, accepted = h.Queue.push, http.StatusAccepted
+		}
+		var (
+			resp pushResponse
+			full bool
+		)
+		for i, item := range items {
+			vl := &api.ValueList{}
+			var perr pushError
+			if err := json.Unmarshal(item, vl); err != nil {
+				h.Quarantine.record("http", info, invalidClassJSON, item, err)
+				perr = pushError{Code: codeInvalidJSON, Error: err.Error()}
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					perr.Field = typeErr.Field
+				}
+			} else if err := validateValueList(vl); err != nil {
+				h.Quarantine.record("http", info, invalidClassValueList, item, err)
+				perr = pushError{Code: codeInvalidValueList, Error: err.Error()}
+				var fieldErr *fieldError
+				if errors.As(err, &fieldErr) {
+					perr.Field = fieldErr.field
+				}
+			} else if err := write(ctx, vl); err != nil {
+				logger.Debug("error writing collectd post", "error", err)
+				perr = pushError{Code: codeWriteFailed, Error: err.Error()}
+				if errors.Is(err, errQueueFull) {
+					perr.Code, full = codeQueueFull, true
+				}
+			}
+			if perr.Code != "" {
+				perr.Index = &i
+				resp.Errors = append(resp.Errors, perr)
+				continue
+			}
+			resp.Accepted++
+		}
+		if len(resp.Errors) == 0 {
+			w.WriteHeader(accepted)
+			return
+		}
+
+		span.SetAttributes(attribute.Int("collectd.rejected_value_lists", len(resp.Errors)))
+		code := http.StatusMultiStatus
+		switch {
+		case resp.Accepted > 0:
+		case full:
+			code = http.StatusServiceUnavailable
+		default:
+			code = http.StatusBadRequest
+		}
+		writePushResponse(w, code, resp)
+	})
+}
+
+// Codes of pushError, telling errors of the sender, such as invalid
+// payloads, from those of the exporter.
+const (
+	codeInvalidLabels    = "invalid_labels"
+	codeInvalidJSON      = "invalid_json"
+	codeInvalidValueList = "invalid_value_list"
+	codeQueueFull        = "queue_full"
+	codeWriteFailed      = "write_failed"
+	codeReadFailed       = "read_failed"
+	codeShuttingDown     = "shutting_down"
+)
+
+// pushResponse is the body of responses to pushes that were rejected, or some
+// of whose value lists were.
+type pushResponse struct {
+	Accepted int         `json:"accepted"`
+	Errors   []pushError `json:"errors"`
+}
+
+// pushError describes why the value list at Index of a push, or the whole
+// push if Index is nil, was rejected. Field names the offending field, if
+// known.
+type pushError struct {
+	Index *int   `json:"index,omitempty"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	Field string `json:"field,omitempty"`
+}
+
+// writePushError answers a rejected push with err.
+func writePushError(w http.ResponseWriter, code int, err pushError) {
+	writePushResponse(w, code, pushResponse{Errors: []pushError{err}})
+}
+
+// writePushResponse writes resp as the JSON body of a response with the status
+// code.
+func writePushResponse(w http.ResponseWriter, code int, resp pushResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	// Errors writing the response are those of the connection.
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// fieldError is returned for a value list lacking a required field.
+type fieldError struct {
+	field, msg string
+}
+
+func (e *fieldError) Error() string {
+	return e.msg
+}
+
+// validateValueList returns a *fieldError if vl lacks fields required to
+// convert it.
+func validateValueList(vl *api.ValueList) error {
+	switch {
+	case vl.Plugin == "":
+		return &fieldError{"plugin", "missing plugin"}
+	case vl.Type == "":
+		return &fieldError{"type", "missing type"}
+	case len(vl.Values) == 0:
+		return &fieldError{"values", "no values"}
+	}
+	return nil
+}
+
+// requestInfo returns the Info of the sender of r.
+func requestInfo(r *http.Request) Info {
+	var info Info
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		info.Addr = addr.Addr().Unmap()
+	}
+	info.Username, _, _ = r.BasicAuth()
+	// write_http identifies itself as e.g. "collectd/5.12.0".
+	if v, ok := strings.CutPrefix(r.UserAgent(), "collectd/"); ok {
+		info.Version, _, _ = strings.Cut(v, " ")
+	}
+	return info
+}
+
+// requestLabels returns the labels added by the sender of r via the "labels"
+// query parameter and the LabelsHeader header, which take comma-separated
+// name:value pairs such as "dc:eu1,team:db". Labels of the query parameter
+// take precedence. It is an error if a label is not in allowed.
+func requestLabels(r *http.Request, allowed []string) (map[string]string, error) {
+	var labels map[string]string
+	for _, pairs := range []string{r.Header.Get(LabelsHeader), r.URL.Query().Get("labels")} {
+		if pairs == "" {
+			continue
+		}
+		for _, pair := range strings.Split(pairs, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("invalid label %q, must be name:value", pair)
+			}
+			if !slices.Contains(allowed, name) {
+				return nil, fmt.Errorf("label %q not allowed", name)
+			}
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[name] = value
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestHandler(t *testing.T) {
+	w := &collectingWriter{}
+	h := Handler(w, nil)
+
+	body := `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+		`"host":"example.com","plugin":"load","plugin_instance":"","type":"load","type_instance":""}]`
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader(body))
+	req.SetBasicAuth("collectd", "secret")
+	req.Header.Set("User-Agent", "collectd/5.12.0")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if len(w.valueLists) != 1 || w.valueLists[0].Host != "example.com" {
+		t.Errorf("got value lists %v", w.valueLists)
+	}
+	want := Info{Addr: netip.MustParseAddr("192.0.2.1"), Username: "collectd", Version: "5.12.0", Bytes: len(body)}
+	if len(w.infos) != 1 || !reflect.DeepEqual(w.infos[0], want) {
+		t.Errorf("got source info %v, want %v", w.infos, want)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader("not json")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	var resp pushResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid error response %q: %v", rec.Body, err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != codeInvalidJSON || resp.Errors[0].Index != nil {
+		t.Errorf("got error response %s", rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got content type %q", ct)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader(`[{"host":1}]`)))
+	wantBody := `{"accepted":0,"errors":[{"index":0,"code":"invalid_json","error":"json: cannot unmarshal number into Go struct field jsonValueList.host of type string","field":"host"}]}`
+	if got := strings.TrimSpace(rec.Body.String()); got != wantBody {
+		t.Errorf("got response %s, want %s", got, wantBody)
+	}
+}
+
+func TestHandlerPartialFailure(t *testing.T) {
+	w := &collectingWriter{}
+	h := Handler(w, nil)
+
+	valid := `{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+		`"host":"example.com","plugin":"load","plugin_instance":"","type":"load","type_instance":""}`
+	noPlugin := `{"values":[1],"dstypes":["gauge"],"host":"example.com","type":"load"}`
+	// Value lists without a host are accepted as before.
+	noHost := `{"values":[1],"dstypes":["gauge"],"plugin":"load","type":"load"}`
+	badType := `{"values":[1],"dstypes":["absolute"],"host":"example.com","plugin":"load","type":"load"}`
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader("["+noPlugin+","+valid+","+badType+","+noHost+"]")))
+	if rec.Code != http.StatusMultiStatus {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMultiStatus)
+	}
+	want := `{"accepted":2,"errors":[{"index":0,"code":"invalid_value_list","error":"missing plugin","field":"plugin"},{"index":2,"code":"invalid_json","error":"unexpected data source type: \"absolute\""}]}`
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		t.Errorf("got response %s, want %s", got, want)
+	}
+	if len(w.valueLists) != 2 || w.valueLists[0].Host != "example.com" || w.valueLists[1].Host != "" {
+		t.Errorf("got value lists %v", w.valueLists)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader("["+noPlugin+"]")))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing plugin") {
+		t.Errorf("got status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHandlerLabels(t *testing.T) {
+	w := &collectingWriter{}
+	h := (&HTTP{AllowedLabels: []string{"dc", "team"}}).handler(w)
+
+	body := `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+		`"host":"example.com","plugin":"load","plugin_instance":"","type":"load","type_instance":""}]`
+	req := httptest.NewRequest(http.MethodPost, "/collectd-post?labels=dc:eu1,team:db", strings.NewReader(body))
+	req.Header.Set(LabelsHeader, "dc:us1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	if want := map[string]string{"dc": "eu1", "team": "db"}; len(w.infos) != 1 || !reflect.DeepEqual(w.infos[0].Labels, want) {
+		t.Errorf("got source info %v, want labels %v", w.infos, want)
+	}
+
+	for _, labels := range []string{"env:prod", "dc", ":eu1"} {
+		req := httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader(body))
+		req.Header.Set(LabelsHeader, labels)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":"invalid_labels"`) {
+			t.Errorf("labels %q: got status %d, body %s", labels, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestHTTPStop(t *testing.T) {
+	mux := http.NewServeMux()
+	h := &HTTP{Mux: mux, Path: "/collectd-post"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- h.Start(ctx, &collectingWriter{}) }()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader("[]")))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"code":"shutting_down"`) {
+		t.Errorf("got status %d, body %s after stopping", rec.Code, rec.Body)
+	}
+}
+
+func TestHandlerTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	body := `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+		`"host":"example.com","plugin":"load","plugin_instance":"","type":"load","type_instance":""}]`
+	req := httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader(body))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Handler(&collectingWriter{}, nil).ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := spans.Ended()
+	if len(ended) != 1 || ended[0].Name() != "collectd.push" {
+		t.Fatalf("got spans %v", ended)
+	}
+	if got := ended[0].Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got parent trace %s, want the propagated one", got)
+	}
+	var lists int64
+	for _, a := range ended[0].Attributes() {
+		if a.Key == "collectd.value_lists" {
+			lists = a.Value.AsInt64()
+		}
+	}
+	if lists != 1 {
+		t.Errorf("got %d value lists in span attributes, want 1", lists)
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Influx accepts points in the InfluxDB line protocol via POST requests to
+// Path on Mux, like the /write endpoint of InfluxDB, so that agents of mixed
+// fleets can be consolidated onto one ingestion point.
+//
+// Points written by the collectd input of InfluxDB or Telegraf, which carry
+// a "type" tag, are converted back to collectd identifiers: the measurement
+// "<plugin>_<data source>" and the "instance", "type" and "type_instance"
+// tags give the identifier. Other points are converted to value lists of the
+// measurement as both plugin and type, with a data source per field and the
+// other tags as a label set in the type instance (see FormatLabelSet). The
+// "host" tag is required. Remaining tags of collectd points are added as
+// labels. All values are gauges, and string fields are ignored.
+type Influx struct {
+	Mux    *http.ServeMux
+	Path   string
+	Logger *slog.Logger
+	// Quarantine keeps lines that could not be parsed. May be nil.
+	Quarantine *Quarantine
+}
+
+// Start implements Source. It registers the handler and blocks until ctx is
+// canceled and all requests in flight have been handled. Later requests are
+// rejected with 503 Service Unavailable. As handlers cannot be removed from a
+// ServeMux, Start must only be called once.
+func (s *Influx) Start(ctx context.Context, w api.Writer) error {
+	var (
+		mu      sync.RWMutex
+		stopped bool
+	)
+	handler := s.handler(w)
+	s.Mux.HandleFunc(s.Path, func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if stopped {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	<-ctx.Done()
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	return nil
+}
+
+// influxPrecisions maps the values of the "precision" query parameter to the
+// unit of timestamps.
+var influxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// handler returns the handler of s, writing value lists to writer. Like
+// InfluxDB, it responds with 204 No Content, or with 400 Bad Request and an
+// error if any line is invalid, in which case the valid lines are still
+// written.
+func (s *Influx) handler(writer api.Writer) http.Handler {
+	logger := s.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "collectd.influx.write", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+		if !ok {
+			writeInfluxError(w, http.StatusBadRequest, fmt.Sprintf("invalid precision %q", r.URL.Query().Get("precision")), logger)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			spanError(span, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		info := requestInfo(r)
+		now := time.Now()
+		var (
+			points []influxValueList
+			errs   []error
+		)
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			vls, err := parseInfluxLine(line, precision, now)
+			if err != nil {
+				s.Quarantine.record("influx", info, invalidClassParse, []byte(line), err)
+				errs = append(errs, err)
+				continue
+			}
+			points = append(points, vls...)
+		}
+
+		valueLists := mergeInfluxValueLists(points)
+		span.SetAttributes(
+			attribute.Int("http.request.body.size", len(data)),
+			attribute.Int("collectd.value_lists", len(valueLists)),
+		)
+		info.Bytes = share(len(data), len(valueLists))
+		for _, p := range valueLists {
+			pinfo := info
+			pinfo.Labels = p.labels
+			if err := writer.Write(NewContext(ctx, pinfo), p.vl); err != nil {
+				logger.Debug("Error writing value list", "err", err)
+			}
+		}
+
+		if len(errs) > 0 {
+			err := errors.Join(errs...)
+			spanError(span, err)
+			writeInfluxError(w, http.StatusBadRequest, "partial write: "+err.Error(), logger)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// writeInfluxError writes an error response in the format of InfluxDB.
+func writeInfluxError(w http.ResponseWriter, code int, msg string, logger *slog.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
+		logger.Debug("Error writing InfluxDB response", "err", err)
+	}
+}
+
+// influxValueList is a value list converted from a point, with the labels
+// converted from its remaining tags.
+type influxValueList struct {
+	vl     *api.ValueList
+	labels map[string]string
+}
+
+// invalidLabelChars matches the characters not allowed in label names.
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// parseInfluxLine converts a line of the line protocol to value lists. Points
+// without a timestamp are given the time now.
+func parseInfluxLine(line string, precision time.Duration, now time.Time) ([]influxValueList, error) {
+	sections := splitUnescaped(line, ' ', -1)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("malformed line %q", line)
+	}
+	t := now
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		t = time.Unix(0, ts*int64(precision))
+	}
+
+	keys := splitUnescaped(sections[0], ',', -1)
+	measurement := unescapeInflux(keys[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("missing measurement in line %q", line)
+	}
+	tags := map[string]string{}
+	for _, tag := range keys[1:] {
+		kv := splitUnescaped(tag, '=', 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed tag %q", tag)
+		}
+		tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+	host := tags["host"]
+	if host == "" {
+		return nil, fmt.Errorf("missing host tag in line %q", line)
+	}
+	delete(tags, "host")
+
+	var (
+		names  []string
+		values []api.Value
+	)
+	for _, field := range splitUnescaped(sections[1], ',', -1) {
+		kv := splitUnescaped(field, '=', 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed field %q", field)
+		}
+		value, ok, err := parseInfluxValue(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, unescapeInflux(kv[0]))
+			values = append(values, api.Gauge(value))
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	if typ, ok := tags["type"]; ok {
+		// Written by a collectd input, one value list per field.
+		id := api.Identifier{
+			Host:           host,
+			Plugin:         measurement,
+			PluginInstance: tags["instance"],
+			Type:           typ,
+			TypeInstance:   tags["type_instance"],
+		}
+		for _, name := range []string{"instance", "type", "type_instance"} {
+			delete(tags, name)
+		}
+		labels := influxLabels(tags)
+		var vls []influxValueList
+		for i, name := range names {
+			vl := &api.ValueList{Identifier: id, Time: t, Values: []api.Value{values[i]}, DSNames: []string{name}}
+			if plugin, ds, ok := cutLast(measurement, "_"); ok && name == "value" {
+				vl.Plugin, vl.DSNames[0] = plugin, ds
+			}
+			vls = append(vls, influxValueList{vl: vl, labels: labels})
+		}
+		return vls, nil
+	}
+
+	// The tags are kept in the type instance, so that points of the same
+	// measurement with different tags have distinct identifiers.
+	return []influxValueList{{
+		vl: &api.ValueList{
+			Identifier: api.Identifier{
+				Host:         host,
+				Plugin:       measurement,
+				Type:         measurement,
+				TypeInstance: FormatLabelSet(influxLabels(tags)),
+			},
+			Time:    t,
+			Values:  values,
+			DSNames: names,
+		},
+	}}, nil
+}
+
+// influxLabels converts tags to labels, replacing characters not allowed in
+// label names. Tags whose names are reserved are dropped.
+func influxLabels(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(tags))
+	for name, value := range tags {
+		name = invalidLabelChars.ReplaceAllString(name, "_")
+		if name[0] >= '0' && name[0] <= '9' {
+			name = "_" + name
+		}
+		if strings.HasPrefix(name, "__") || name == "instance" || value == "" {
+			continue
+		}
+		labels[name] = value
+	}
+	return labels
+}
+
+// parseInfluxValue parses a field value. It returns false for strings, which
+// cannot be converted.
+func parseInfluxValue(s string) (float64, bool, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return 0, false, nil
+	case s == "t" || s == "T" || s == "true" || s == "True" || s == "TRUE":
+		return 1, true, nil
+	case s == "f" || s == "F" || s == "false" || s == "False" || s == "FALSE":
+		return 0, true, nil
+	case strings.HasSuffix(s, "i"):
+		i, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(i), err == nil, influxValueError(s, err)
+	case strings.HasSuffix(s, "u"):
+		u, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(u), err == nil, influxValueError(s, err)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil, influxValueError(s, err)
+}
+
+func influxValueError(s string, err error) error {
+	if err != nil {
+		return fmt.Errorf("invalid field value %q", s)
+	}
+	return nil
+}
+
+// splitUnescaped splits s at the occurrences of sep that are neither escaped
+// by a backslash nor inside a double-quoted string, into at most n parts if
+// n is positive.
+func splitUnescaped(s string, sep byte, n int) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted && (n <= 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the backslashes escaping commas, equal signs and
+// spaces in measurements, tags and field keys.
+func unescapeInflux(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ").Replace(s)
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// mergeInfluxValueLists merges the value lists of the same identifier, time
+// and labels, such as those of the data sources of a collectd value list,
+// keeping the order of their first occurrence.
+func mergeInfluxValueLists(vls []influxValueList) []influxValueList {
+	var (
+		merged []influxValueList
+		index  = map[string]int{}
+	)
+	for _, p := range vls {
+		key := fmt.Sprint(p.vl.Identifier.String(), p.vl.Time.UnixNano(), p.labels)
+		i, ok := index[key]
+		if !ok || slices.ContainsFunc(p.vl.DSNames, func(ds string) bool { return slices.Contains(merged[i].vl.DSNames, ds) }) {
+			index[key] = len(merged)
+			merged = append(merged, p)
+			continue
+		}
+		merged[i].vl.Values = append(merged[i].vl.Values, p.vl.Values...)
+		merged[i].vl.DSNames = append(merged[i].vl.DSNames, p.vl.DSNames...)
+	}
+	return merged
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+)
+
+func TestInfluxHandler(t *testing.T) {
+	q := NewQuarantine(10)
+	w := &collectingWriter{}
+	h := (&Influx{Quarantine: q}).handler(w)
+
+	body := `load_shortterm,host=example.com,type=load value=0.5 1700000000
+load_midterm,host=example.com,type=load value=0.25 1700000000
+cpu_value,host=example.com,instance=0,type=cpu,type_instance=idle value=99i 1700000000
+# comment
+disk\ io,host=example.com,dc=eu\,1,2nd=x,__name__=y read=1u,write=2.5,busy=true,model="a b, c" 1700000000
+no_host value=1 1700000000
+`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write?precision=s", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing host tag") {
+		t.Errorf("got response %d %q", rec.Code, rec.Body.String())
+	}
+
+	ts := time.Unix(1700000000, 0)
+	want := []*api.ValueList{
+		{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "load", Type: "load"},
+			Time:       ts,
+			Values:     []api.Value{api.Gauge(0.5), api.Gauge(0.25)},
+			DSNames:    []string{"shortterm", "midterm"},
+		},
+		{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: "0", Type: "cpu", TypeInstance: "idle"},
+			Time:       ts,
+			Values:     []api.Value{api.Gauge(99)},
+			DSNames:    []string{"value"},
+		},
+		{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "disk io", Type: "disk io", TypeInstance: `{_2nd="x",dc="eu,1"}`},
+			Time:       ts,
+			Values:     []api.Value{api.Gauge(1), api.Gauge(2.5), api.Gauge(1)},
+			DSNames:    []string{"read", "write", "busy"},
+		},
+	}
+	if !reflect.DeepEqual(w.valueLists, want) {
+		t.Errorf("got value lists %+v, want %+v", w.valueLists, want)
+	}
+	if payloads := q.Payloads(); len(payloads) != 1 || payloads[0].Payload != "no_host value=1 1700000000" {
+		t.Errorf("got invalid payloads %+v", payloads)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write?precision=d", strings.NewReader("")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for invalid precision", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader("m,host=h value=1\n")))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want 204", rec.Code)
+	}
+}
+
+func TestParseInfluxLine(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, line := range []string{
+		"m,host=h",
+		"m,host=h value=x",
+		"m,host=h value=1 x",
+		"m,host value=1",
+		",host=h value=1",
+		"m,host=h value=1 1 2",
+	} {
+		if _, err := parseInfluxLine(line, time.Nanosecond, now); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+
+	vls, err := parseInfluxLine(`m,host=h value=1,text="x=1 y"`, time.Millisecond, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vls) != 1 || !vls[0].vl.Time.Equal(now) || !reflect.DeepEqual(vls[0].vl.DSNames, []string{"value"}) {
+		t.Errorf("got %+v", vls)
+	}
+	vls, err = parseInfluxLine("m,host=h value=1 1500", time.Millisecond, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1, 5e8); !vls[0].vl.Time.Equal(want) {
+		t.Errorf("got time %v, want %v", vls[0].vl.Time, want)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"net/netip"
+)
+
+// Info describes where a value list was received from. Fields are left empty
+// if the transport does not provide them.
+type Info struct {
+	// Name is the name of the source in its Group.
+	Name string
+	// Addr is the address of the sender.
+	Addr netip.Addr
+	// Username is the user the sender authenticated as.
+	Username string
+	// Version is the collectd version of the sender, if known.
+	Version string
+	// Bytes is the size of the value list as received, approximated by an
+	// equal share of the packet or request it was part of.
+	Bytes int
+	// Labels are added to the series converted from the value list, as
+	// requested by the sender.
+	Labels map[string]string
+	// MetricType is the metric type of a value list converted from a
+	// series pushed in a Prometheus format, one of PrometheusCounter,
+	// PrometheusGauge and PrometheusUntyped. It is empty for value lists
+	// of collectd, so that they cannot pass for pushed series.
+	MetricType string
+}
+
+// share returns the share of each of count value lists in n bytes.
+func share(n, count int) int {
+	if count == 0 {
+		return 0
+	}
+	return n / count
+}
+
+type infoKey struct{}
+
+// NewContext returns a copy of ctx carrying info. Sources pass it to
+// api.Writer.Write so that writers can tell where a value list came from.
+func NewContext(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, infoKey{}, info)
+}
+
+// FromContext returns the Info stored in ctx by NewContext.
+func FromContext(ctx context.Context) (Info, bool) {
+	info, ok := ctx.Value(infoKey{}).(Info)
+	return info, ok
+}
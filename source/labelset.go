@@ -0,0 +1,117 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"slices"
+	"strings"
+)
+
+// FormatLabelSet returns labels in the notation of Prometheus sorted by name,
+// e.g. `{device="sda",mode="ro"}`, or the empty string if there are none.
+// The Prometheus source uses it as the type instance of the value lists of
+// pushed series, so that series differing only in their labels have distinct
+// identifiers. The Collector exports the labels of such type instances
+// instead of the type instance.
+func FormatLabelSet(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		labelValueEscaper.WriteString(&b, labels[name])
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ParseLabelSet parses a label set formatted by FormatLabelSet. It returns
+// false if s is not one.
+func ParseLabelSet(s string) (map[string]string, bool) {
+	rest, ok := strings.CutPrefix(s, "{")
+	if !ok || !strings.HasSuffix(rest, "}") {
+		return nil, false
+	}
+	labels := map[string]string{}
+	for rest != "}" {
+		if len(labels) > 0 {
+			if rest, ok = strings.CutPrefix(rest, ","); !ok {
+				return nil, false
+			}
+		}
+		name, value, ok := strings.Cut(rest, `="`)
+		if !ok || !validLabelName(name) {
+			return nil, false
+		}
+		var b strings.Builder
+		for {
+			if value == "" {
+				return nil, false
+			}
+			c := value[0]
+			value = value[1:]
+			if c == '"' {
+				break
+			}
+			if c == '\\' {
+				if value == "" {
+					return nil, false
+				}
+				switch value[0] {
+				case '\\', '"':
+					c = value[0]
+				case 'n':
+					c = '\n'
+				default:
+					return nil, false
+				}
+				value = value[1:]
+			}
+			b.WriteByte(c)
+		}
+		labels[name] = b.String()
+		rest = value
+	}
+	if len(labels) == 0 {
+		return nil, false
+	}
+	return labels, true
+}
+
+// validLabelName returns whether name is a valid Prometheus label name.
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			return false
+		}
+	}
+	return true
+}
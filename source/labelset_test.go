@@ -0,0 +1,52 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabelSet(t *testing.T) {
+	labels := map[string]string{"mode": "idle", "device": `C:\ "sys"` + "\n", "_1": ""}
+	s := FormatLabelSet(labels)
+	if want := `{_1="",device="C:\\ \"sys\"\n",mode="idle"}`; s != want {
+		t.Errorf("got %s, want %s", s, want)
+	}
+	if got, ok := ParseLabelSet(s); !ok || !reflect.DeepEqual(got, labels) {
+		t.Errorf("got %v, %t, want %v", got, ok, labels)
+	}
+	if s := FormatLabelSet(nil); s != "" {
+		t.Errorf("got %q for no labels", s)
+	}
+
+	for _, s := range []string{
+		"",
+		"idle",
+		"{}",
+		"{a}",
+		`{a="b"`,
+		`{a="b",}`,
+		`{a="b"c="d"}`,
+		`{1a="b"}`,
+		`{a-b="c"}`,
+		`{a="b\x"}`,
+		`{a="b}`,
+		`{a="b"} `,
+	} {
+		if labels, ok := ParseLabelSet(s); ok {
+			t.Errorf("%q: got label set %v", s, labels)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Prometheus accepts series pushed via POST requests to Path on Mux, either
+// in the Prometheus text exposition format or as snappy-compressed
+// remote-write requests, so that hosts migrating off collectd can push
+// through the same gateway.
+//
+// Every sample is converted to a value list of the plugin PrometheusPlugin,
+// see there, and written along with its metric type in Info.MetricType, so
+// that the Collector exports it under the original metric name and type. The host is taken from the "instance" label, or from the "instance"
+// query parameter if the series has none. Histograms and summaries are
+// flattened to their bucket, quantile, sum and count series, the bucket, sum
+// and count series being counters. Remote-write requests carry no metric
+// types, except in metadata sent along with the series: series without
+// metadata are counters if their name ends in "_total" and untyped
+// otherwise. Native histograms and stale markers are dropped.
+type Prometheus struct {
+	Mux    *http.ServeMux
+	Path   string
+	Logger *slog.Logger
+	// Quarantine keeps payloads and series that could not be converted.
+	// May be nil.
+	Quarantine *Quarantine
+}
+
+// Start implements Source. It registers the handler and blocks until ctx is
+// canceled and all requests in flight have been handled. Later requests are
+// rejected with 503 Service Unavailable. As handlers cannot be removed from a
+// ServeMux, Start must only be called once.
+func (s *Prometheus) Start(ctx context.Context, w api.Writer) error {
+	var (
+		mu      sync.RWMutex
+		stopped bool
+	)
+	handler := s.handler(w)
+	s.Mux.HandleFunc(s.Path, func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		if stopped {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	<-ctx.Done()
+	mu.Lock()
+	stopped = true
+	mu.Unlock()
+	return nil
+}
+
+// Value lists of series pushed in the Prometheus formats have the plugin
+// PrometheusPlugin. Their type is the metric name and their type instance
+// their remaining labels formatted by FormatLabelSet. They have a single
+// api.Gauge value, as the values of counters need not be integers. The metric
+// type, one of PrometheusCounter, PrometheusGauge and PrometheusUntyped, is
+// passed in Info.MetricType rather than in the identifier, which any collectd
+// sender could forge.
+const (
+	PrometheusPlugin  = "prometheus"
+	PrometheusCounter = "counter"
+	PrometheusGauge   = "gauge"
+	PrometheusUntyped = "untyped"
+)
+
+// promSample is a sample of a pushed series. The metric name is kept in the
+// __name__ label, and typ is its metric type, e.g. PrometheusCounter. A zero
+// t means the sample carried no timestamp.
+type promSample struct {
+	labels map[string]string
+	typ    string
+	value  float64
+	t      time.Time
+}
+
+// handler returns the handler of s, writing value lists to writer. It
+// responds with 204 No Content, or with 400 Bad Request and an error if any
+// series is invalid, in which case the valid series are still written.
+func (s *Prometheus) handler(writer api.Writer) http.Handler {
+	logger := s.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "collectd.prometheus.push", trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var interval time.Duration
+		if v := r.URL.Query().Get("interval"); v != "" {
+			d, err := model.ParseDuration(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid interval %q", v), http.StatusBadRequest)
+				return
+			}
+			interval = time.Duration(d)
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			spanError(span, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		info := requestInfo(r)
+		format := "text"
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		var samples []promSample
+		if mediaType == "application/x-protobuf" {
+			format = "remote_write"
+			samples, err = parseRemoteWrite(data)
+		} else {
+			samples, err = parsePromText(data)
+		}
+		span.SetAttributes(
+			attribute.String("collectd.prometheus.format", format),
+			attribute.Int("http.request.body.size", len(data)),
+		)
+		if err != nil {
+			s.Quarantine.record("prometheus", info, invalidClassParse, data, err)
+			spanError(span, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		var (
+			valueLists []*api.ValueList
+			types      []string
+			errs       []error
+		)
+		for _, sample := range samples {
+			vl, err := promValueList(sample, r.URL.Query().Get("instance"), interval, now)
+			if err != nil {
+				s.Quarantine.record("prometheus", info, invalidClassValueList, []byte(FormatLabelSet(sample.labels)), err)
+				errs = append(errs, err)
+				continue
+			}
+			if vl != nil {
+				valueLists = append(valueLists, vl)
+				types = append(types, sample.typ)
+			}
+		}
+
+		span.SetAttributes(attribute.Int("collectd.value_lists", len(valueLists)))
+		info.Bytes = share(len(data), len(valueLists))
+		for i, vl := range valueLists {
+			info.MetricType = types[i]
+			if err := writer.Write(NewContext(ctx, info), vl); err != nil {
+				logger.Debug("Error writing value list", "err", err)
+			}
+		}
+
+		if len(errs) > 0 {
+			err := errors.Join(errs...)
+			spanError(span, err)
+			http.Error(w, "partial write: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// staleNaN is the bit pattern Prometheus marks stale series with.
+const staleNaN = 0x7ff0000000000002
+
+// promValueList converts a sample to a value list. Series without an
+// "instance" label are given the host instance. Stale markers are dropped,
+// returning nil.
+func promValueList(s promSample, instance string, interval time.Duration, now time.Time) (*api.ValueList, error) {
+	labels := make(map[string]string, len(s.labels))
+	for name, value := range s.labels {
+		labels[name] = value
+	}
+	name := labels[model.MetricNameLabel]
+	if name == "" {
+		return nil, fmt.Errorf("missing metric name in series %s", FormatLabelSet(s.labels))
+	}
+	if math.Float64bits(s.value) == staleNaN {
+		return nil, nil
+	}
+	host := labels[model.InstanceLabel]
+	if host == "" {
+		host = instance
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing instance of series %s", FormatLabelSet(s.labels))
+	}
+	delete(labels, model.MetricNameLabel)
+	delete(labels, model.InstanceLabel)
+	t := s.t
+	if t.IsZero() {
+		t = now
+	}
+	return &api.ValueList{
+		Identifier: api.Identifier{
+			Host:         host,
+			Plugin:       PrometheusPlugin,
+			Type:         name,
+			TypeInstance: FormatLabelSet(labels),
+		},
+		Time:     t,
+		Interval: interval,
+		Values:   []api.Value{api.Gauge(s.value)},
+		DSNames:  []string{"value"},
+	}, nil
+}
+
+// parsePromText parses the text exposition format, flattening histograms and
+// summaries.
+func parsePromText(data []byte) ([]promSample, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var samples []promSample
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		mf := families[name]
+		for _, m := range mf.GetMetric() {
+			add := func(suffix, typ string, value float64, extra ...string) {
+				labels := map[string]string{model.MetricNameLabel: name + suffix}
+				for _, lp := range m.GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					labels[extra[i]] = extra[i+1]
+				}
+				var t time.Time
+				if m.TimestampMs != nil {
+					t = time.UnixMilli(m.GetTimestampMs())
+				}
+				samples = append(samples, promSample{labels: labels, typ: typ, value: value, t: t})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", PrometheusCounter, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", PrometheusGauge, m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add("", PrometheusGauge, q.GetValue(), model.QuantileLabel, formatFloat(q.GetQuantile()))
+				}
+				add("_sum", PrometheusCounter, m.GetSummary().GetSampleSum())
+				add("_count", PrometheusCounter, float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				buckets := m.GetHistogram().GetBucket()
+				for _, b := range buckets {
+					add("_bucket", PrometheusCounter, float64(b.GetCumulativeCount()), model.BucketLabel, formatFloat(b.GetUpperBound()))
+				}
+				if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), 1) {
+					add("_bucket", PrometheusCounter, float64(m.GetHistogram().GetSampleCount()), model.BucketLabel, "+Inf")
+				}
+				add("_sum", PrometheusCounter, m.GetHistogram().GetSampleSum())
+				add("_count", PrometheusCounter, float64(m.GetHistogram().GetSampleCount()))
+			default:
+				add("", PrometheusUntyped, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return samples, nil
+}
+
+// formatFloat formats the value of a "le" or "quantile" label like
+// Prometheus.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// parseRemoteWrite parses a snappy-compressed remote-write request of the
+// Prometheus remote-write protocol 1.0.
+func parseRemoteWrite(data []byte) ([]promSample, error) {
+	data, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding snappy: %w", err)
+	}
+	var samples []promSample
+	families := map[string]uint64{}
+	err = consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1: // WriteRequest.timeseries
+			series, err := parseTimeSeries(v)
+			samples = append(samples, series...)
+			return err
+		case 3: // WriteRequest.metadata
+			var (
+				name string
+				t    uint64
+			)
+			err := consumeProtoFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					t, _ = protowire.ConsumeVarint(v)
+				case num == 2 && typ == protowire.BytesType:
+					name = string(v)
+				}
+				return nil
+			})
+			families[name] = t
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding remote-write request: %w", err)
+	}
+	for i := range samples {
+		samples[i].typ = remoteWriteType(samples[i].labels[model.MetricNameLabel], families)
+	}
+	return samples, nil
+}
+
+// Metric types of the metadata of remote-write requests.
+const (
+	remoteWriteCounter        = 1
+	remoteWriteGauge          = 2
+	remoteWriteHistogram      = 3
+	remoteWriteGaugeHistogram = 4
+	remoteWriteSummary        = 5
+	remoteWriteInfo           = 6
+	remoteWriteStateSet       = 7
+)
+
+// remoteWriteType returns the metric type of the series named name, given the
+// metric types of the families in the metadata of a remote-write request.
+func remoteWriteType(name string, families map[string]uint64) string {
+	switch families[name] {
+	case remoteWriteCounter:
+		return PrometheusCounter
+	case remoteWriteGauge, remoteWriteSummary, remoteWriteInfo, remoteWriteStateSet:
+		// The series of a summary named after the family are its
+		// quantiles.
+		return PrometheusGauge
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		family, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		switch families[family] {
+		case remoteWriteHistogram, remoteWriteSummary:
+			return PrometheusCounter
+		case remoteWriteGaugeHistogram:
+			return PrometheusGauge
+		}
+	}
+	if strings.HasSuffix(name, "_total") {
+		return PrometheusCounter
+	}
+	return PrometheusUntyped
+}
+
+// parseTimeSeries parses a TimeSeries message of a remote-write request.
+func parseTimeSeries(b []byte) ([]promSample, error) {
+	labels := map[string]string{}
+	var samples []promSample
+	err := consumeProtoFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1: // labels
+			var name, value string
+			err := consumeProtoFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					name = string(v)
+				case num == 2 && typ == protowire.BytesType:
+					value = string(v)
+				}
+				return nil
+			})
+			labels[name] = value
+			return err
+		case 2: // samples
+			var s promSample
+			err := consumeProtoFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(v)
+					s.value = math.Float64frombits(bits)
+				case num == 2 && typ == protowire.VarintType:
+					ms, _ := protowire.ConsumeVarint(v)
+					s.t = time.UnixMilli(int64(ms))
+				}
+				return nil
+			})
+			samples = append(samples, s)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The labels may follow the samples.
+	for i := range samples {
+		samples[i].labels = labels
+	}
+	return samples, nil
+}
+
+// consumeProtoFields calls f with every field of the protobuf message b, and
+// the contents of bytes fields or the encoded value of other fields.
+func consumeProtoFields(b []byte, f func(protowire.Number, protowire.Type, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		v := b[:n]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		if err := f(num, typ, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPrometheusText(t *testing.T) {
+	q := NewQuarantine(10)
+	w := &collectingWriter{}
+	h := (&Prometheus{Quarantine: q}).handler(w)
+
+	body := `# TYPE http_requests_total counter
+http_requests_total{code="200",instance="web1:9100"} 1027 1700000000000
+http_requests_total{code="500",instance="web1:9100"} 3 1700000000000
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2 1700000000000
+latency_seconds_bucket{le="+Inf"} 3 1700000000000
+latency_seconds_sum 0.5 1700000000000
+latency_seconds_count 3 1700000000000
+# TYPE temperature_celsius gauge
+temperature_celsius 21.5 1700000000000
+`
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/push?instance=edge1&interval=30s", strings.NewReader(body)))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got response %d %q", rec.Code, rec.Body.String())
+	}
+
+	ts := time.UnixMilli(1700000000000)
+	vl := func(host, name, labels string, value float64) *api.ValueList {
+		return &api.ValueList{
+			Identifier: api.Identifier{Host: host, Plugin: PrometheusPlugin, Type: name, TypeInstance: labels},
+			Time:       ts,
+			Interval:   30 * time.Second,
+			Values:     []api.Value{api.Gauge(value)},
+			DSNames:    []string{"value"},
+		}
+	}
+	want := []*api.ValueList{
+		vl("web1:9100", "http_requests_total", `{code="200"}`, 1027),
+		vl("web1:9100", "http_requests_total", `{code="500"}`, 3),
+		vl("edge1", "latency_seconds_bucket", `{le="0.1"}`, 2),
+		vl("edge1", "latency_seconds_bucket", `{le="+Inf"}`, 3),
+		vl("edge1", "latency_seconds_sum", "", 0.5),
+		vl("edge1", "latency_seconds_count", "", 3),
+		vl("edge1", "temperature_celsius", "", 21.5),
+	}
+	if !reflect.DeepEqual(w.valueLists, want) {
+		t.Errorf("got value lists %v, want %v", w.valueLists, want)
+	}
+	wantTypes := []string{PrometheusCounter, PrometheusCounter, PrometheusCounter, PrometheusCounter, PrometheusCounter, PrometheusCounter, PrometheusGauge}
+	if got := metricTypes(w.infos); !reflect.DeepEqual(got, wantTypes) {
+		t.Errorf("got metric types %v, want %v", got, wantTypes)
+	}
+
+	w.valueLists = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("up 1\nload{instance=\"a\"} 0.5\n")))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing instance") {
+		t.Errorf("got response %d %q", rec.Code, rec.Body.String())
+	}
+	if len(w.valueLists) != 1 || w.valueLists[0].Host != "a" {
+		t.Errorf("valid series not written: %v", w.valueLists)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("up{ 1\n")))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for invalid exposition", rec.Code)
+	}
+	if payloads := q.Payloads(); len(payloads) != 2 {
+		t.Errorf("got invalid payloads %+v", payloads)
+	}
+}
+
+// appendProtoMessage appends the message m as field num to b.
+func appendProtoMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// remoteWriteSeries encodes a TimeSeries message.
+func remoteWriteSeries(labels []string, value float64, ms int64) []byte {
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ms))
+
+	var series []byte
+	for i := 0; i+1 < len(labels); i += 2 {
+		var label []byte
+		label = appendProtoMessage(label, 1, []byte(labels[i]))
+		label = appendProtoMessage(label, 2, []byte(labels[i+1]))
+		series = appendProtoMessage(series, 1, label)
+	}
+	return appendProtoMessage(series, 2, sample)
+}
+
+func TestPrometheusRemoteWrite(t *testing.T) {
+	w := &collectingWriter{}
+	h := (&Prometheus{}).handler(w)
+
+	var req []byte
+	req = appendProtoMessage(req, 1, remoteWriteSeries([]string{"__name__", "node_load1", "instance", "edge1", "job", "node"}, 0.5, 1700000000000))
+	req = appendProtoMessage(req, 1, remoteWriteSeries([]string{"__name__", "node_load5", "instance", "edge1"}, math.Float64frombits(staleNaN), 1700000000000))
+	req = appendProtoMessage(req, 1, remoteWriteSeries([]string{"__name__", "node_forks_total", "instance", "edge1"}, 12, 1700000000000))
+	// Metadata may follow the series it describes.
+	var metadata []byte
+	metadata = protowire.AppendTag(metadata, 1, protowire.VarintType)
+	metadata = protowire.AppendVarint(metadata, remoteWriteGauge)
+	metadata = appendProtoMessage(metadata, 2, []byte("node_load1"))
+	req = appendProtoMessage(req, 3, metadata)
+
+	r := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(snappy.Encode(nil, req)))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set("Content-Encoding", "snappy")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got response %d %q", rec.Code, rec.Body.String())
+	}
+	want := []*api.ValueList{{
+		Identifier: api.Identifier{Host: "edge1", Plugin: PrometheusPlugin, Type: "node_load1", TypeInstance: `{job="node"}`},
+		Time:       time.UnixMilli(1700000000000),
+		Values:     []api.Value{api.Gauge(0.5)},
+		DSNames:    []string{"value"},
+	}, {
+		Identifier: api.Identifier{Host: "edge1", Plugin: PrometheusPlugin, Type: "node_forks_total"},
+		Time:       time.UnixMilli(1700000000000),
+		Values:     []api.Value{api.Gauge(12)},
+		DSNames:    []string{"value"},
+	}}
+	if !reflect.DeepEqual(w.valueLists, want) {
+		t.Errorf("got value lists %v, want %v", w.valueLists, want)
+	}
+	if got, want := metricTypes(w.infos), []string{PrometheusGauge, PrometheusCounter}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got metric types %v, want %v", got, want)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(req))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for uncompressed request", rec.Code)
+	}
+}
+
+// metricTypes returns the metric types of infos.
+func metricTypes(infos []Info) []string {
+	types := make([]string, len(infos))
+	for i, info := range infos {
+		types[i] = info.MetricType
+	}
+	return types
+}
+
+func TestRemoteWriteType(t *testing.T) {
+	families := map[string]uint64{
+		"http_requests":    remoteWriteCounter,
+		"rpc_duration":     remoteWriteSummary,
+		"request_duration": remoteWriteHistogram,
+		"queue_size":       remoteWriteGaugeHistogram,
+		"build_info":       remoteWriteInfo,
+	}
+	for name, want := range map[string]string{
+		"http_requests":           PrometheusCounter,
+		"rpc_duration":            PrometheusGauge,
+		"rpc_duration_sum":        PrometheusCounter,
+		"request_duration_bucket": PrometheusCounter,
+		"request_duration_count":  PrometheusCounter,
+		"queue_size_bucket":       PrometheusGauge,
+		"build_info":              PrometheusGauge,
+		"node_forks_total":        PrometheusCounter,
+		"node_load1":              PrometheusUntyped,
+		"unknown_count":           PrometheusUntyped,
+	} {
+		if got := remoteWriteType(name, families); got != want {
+			t.Errorf("remoteWriteType(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxQuarantinedPayload is the number of bytes kept of each invalid payload.
+const maxQuarantinedPayload = 4096
+
+// Classes of invalid payloads.
+const (
+	invalidClassParse     = "parse"
+	invalidClassAuth      = "auth"
+	invalidClassJSON      = "json"
+	invalidClassValueList = "value_list"
+)
+
+// InvalidPayload is a payload that could not be converted to value lists.
+type InvalidPayload struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	// Address is the sender's address, if known.
+	Address  string `json:"address,omitempty"`
+	Username string `json:"username,omitempty"`
+	Class    string `json:"class"`
+	Error    string `json:"error"`
+	// Size is the size of the payload, of which at most 4096 bytes are kept
+	// in Payload. Payload is base64-encoded if it is not valid UTF-8, as
+	// indicated by Encoding.
+	Size     int    `json:"size"`
+	Payload  string `json:"payload"`
+	Encoding string `json:"encoding"`
+}
+
+// Quarantine keeps the most recent invalid payloads received by sources, so
+// that bugs of agents can be diagnosed without capturing traffic, and counts
+// invalid payloads by source and class. It implements prometheus.Collector and
+// may be shared by several sources.
+type Quarantine struct {
+	invalid *prometheus.CounterVec
+
+	mu       sync.Mutex
+	payloads []InvalidPayload
+	next     int
+}
+
+// NewQuarantine returns a new Quarantine keeping up to size payloads. With a
+// size of 0, invalid payloads are only counted.
+func NewQuarantine(size int) *Quarantine {
+	return &Quarantine{
+		invalid: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_invalid_payloads_total",
+				Help: "Number of received payloads that could not be converted to value lists, by source and class of error.",
+			},
+			[]string{"source", "class"},
+		),
+		payloads: make([]InvalidPayload, 0, size),
+	}
+}
+
+// record accounts payload, received by source from the sender given by info,
+// which failed with an error of the given class.
+func (q *Quarantine) record(source string, info Info, class string, payload []byte, err error) {
+	if q == nil {
+		return
+	}
+	q.invalid.WithLabelValues(source, class).Inc()
+	if cap(q.payloads) == 0 {
+		return
+	}
+
+	p := InvalidPayload{
+		Time:     time.Now(),
+		Source:   source,
+		Username: info.Username,
+		Class:    class,
+		Error:    err.Error(),
+		Size:     len(payload),
+		Encoding: "text",
+	}
+	if info.Addr.IsValid() {
+		p.Address = info.Addr.String()
+	}
+	if len(payload) > maxQuarantinedPayload {
+		payload = payload[:maxQuarantinedPayload]
+	}
+	if utf8.Valid(payload) {
+		p.Payload = string(payload)
+	} else {
+		p.Payload, p.Encoding = base64.StdEncoding.EncodeToString(payload), "base64"
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.payloads) < cap(q.payloads) {
+		q.payloads = append(q.payloads, p)
+	} else {
+		q.payloads[q.next] = p
+	}
+	q.next = (q.next + 1) % cap(q.payloads)
+}
+
+// Payloads returns the kept invalid payloads, most recent first.
+func (q *Quarantine) Payloads() []InvalidPayload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	payloads := make([]InvalidPayload, 0, len(q.payloads))
+	for i := range len(q.payloads) {
+		payloads = append(payloads, q.payloads[(q.next-1-i+2*len(q.payloads))%len(q.payloads)])
+	}
+	return payloads
+}
+
+// Collect implements prometheus.Collector.
+func (q *Quarantine) Collect(ch chan<- prometheus.Metric) {
+	q.invalid.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (q *Quarantine) Describe(ch chan<- *prometheus.Desc) {
+	q.invalid.Describe(ch)
+}
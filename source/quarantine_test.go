@@ -0,0 +1,85 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuarantine(t *testing.T) {
+	q := NewQuarantine(2)
+	info := Info{Addr: netip.MustParseAddr("192.0.2.1"), Username: "alice"}
+	q.record("udp", info, invalidClassParse, []byte{0xff, 0x00}, errors.New("first"))
+	q.record("http", info, invalidClassJSON, []byte("[{"), errors.New("second"))
+	q.record("http", Info{}, invalidClassJSON, []byte(strings.Repeat("x", maxQuarantinedPayload+1)), errors.New("third"))
+
+	payloads := q.Payloads()
+	if len(payloads) != 2 || payloads[0].Error != "third" || payloads[1].Error != "second" {
+		t.Fatalf("got payloads %+v, want the two most recent", payloads)
+	}
+	if p := payloads[0]; p.Size != maxQuarantinedPayload+1 || len(p.Payload) != maxQuarantinedPayload || p.Address != "" {
+		t.Errorf("got size %d, payload of %d bytes, address %q", p.Size, len(p.Payload), p.Address)
+	}
+	if p := payloads[1]; p.Address != "192.0.2.1" || p.Username != "alice" || p.Payload != "[{" || p.Encoding != "text" {
+		t.Errorf("got payload %+v", p)
+	}
+
+	q.record("udp", info, invalidClassParse, []byte{0xff, 0x00}, errors.New("fourth"))
+	if p := q.Payloads()[0]; p.Payload != "/wA=" || p.Encoding != "base64" {
+		t.Errorf("got payload %q, encoding %q for binary data", p.Payload, p.Encoding)
+	}
+
+	want := `
+# HELP collectd_exporter_invalid_payloads_total Number of received payloads that could not be converted to value lists, by source and class of error.
+# TYPE collectd_exporter_invalid_payloads_total counter
+collectd_exporter_invalid_payloads_total{class="json",source="http"} 2
+collectd_exporter_invalid_payloads_total{class="parse",source="udp"} 2
+`
+	if err := testutil.CollectAndCompare(q, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// Without room for payloads, they are only counted.
+	q = NewQuarantine(0)
+	q.record("udp", info, invalidClassParse, nil, errors.New("dropped"))
+	if payloads := q.Payloads(); len(payloads) != 0 {
+		t.Errorf("got payloads %+v, want none", payloads)
+	}
+}
+
+func TestHandlerQuarantine(t *testing.T) {
+	q := NewQuarantine(10)
+	handler := (&HTTP{Quarantine: q}).handler(&collectingWriter{})
+	for _, body := range []string{
+		`not json`,
+		`[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"host":"example.com","plugin":"load","type":"load"},{"values":"x"},{"values":[1],"dstypes":["gauge"],"dsnames":["value"]}]`,
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader(body)))
+	}
+
+	var classes []string
+	for _, p := range q.Payloads() {
+		classes = append(classes, p.Class)
+	}
+	if got := strings.Join(classes, ","); got != "value_list,json,json" {
+		t.Errorf("got classes %s, want value_list,json,json", got)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errQueueFull is returned for value lists that did not fit into a Queue.
+var errQueueFull = errors.New("push queue full")
+
+// Queue buffers the value lists of pushes, so that requests are answered
+// without waiting for the writer. Its workers write the value lists in the
+// background. It implements prometheus.Collector.
+type Queue struct {
+	ch      chan queuedValueList
+	workers int
+
+	rejected prometheus.Counter
+	length   prometheus.GaugeFunc
+	capacity prometheus.Gauge
+}
+
+// queuedValueList is a value list waiting in a Queue, along with its origin.
+type queuedValueList struct {
+	vl   *api.ValueList
+	info Info
+	span trace.SpanContext
+}
+
+// NewQueue returns a Queue holding up to size value lists, which are written
+// by the given number of workers.
+func NewQueue(size, workers int) *Queue {
+	q := &Queue{
+		ch:      make(chan queuedValueList, size),
+		workers: max(workers, 1),
+		rejected: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_push_queue_rejected_value_lists_total",
+				Help: "Number of pushed value lists rejected because the push queue was full.",
+			},
+		),
+		capacity: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "collectd_exporter_push_queue_capacity",
+				Help: "Number of pushed value lists the push queue can hold.",
+			},
+		),
+	}
+	q.length = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "collectd_exporter_push_queue_length",
+			Help: "Number of pushed value lists waiting in the push queue.",
+		},
+		func() float64 { return float64(len(q.ch)) },
+	)
+	q.capacity.Set(float64(size))
+
+	return q
+}
+
+// push adds vl, received with the Info and span of ctx, to the queue. It
+// returns errQueueFull without blocking if the queue is full.
+func (q *Queue) push(ctx context.Context, vl *api.ValueList) error {
+	info, _ := FromContext(ctx)
+	select {
+	case q.ch <- queuedValueList{vl: vl, info: info, span: trace.SpanContextFromContext(ctx)}:
+		return nil
+	default:
+		q.rejected.Inc()
+		return errQueueFull
+	}
+}
+
+// run writes queued value lists to w until ctx is canceled. Value lists left
+// in the queue are dropped.
+func (q *Queue) run(ctx context.Context, w api.Writer) {
+	var wg sync.WaitGroup
+	for range q.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item := <-q.ch:
+					// The value list keeps its origin, but is no longer
+					// bound to the request, which has been answered.
+					wctx := NewContext(trace.ContextWithSpanContext(ctx, item.span), item.info)
+					w.Write(wctx, item.vl)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Collect implements prometheus.Collector.
+func (q *Queue) Collect(ch chan<- prometheus.Metric) {
+	ch <- q.rejected
+	ch <- q.length
+	ch <- q.capacity
+}
+
+// Describe implements prometheus.Collector.
+func (q *Queue) Describe(ch chan<- *prometheus.Desc) {
+	ch <- q.rejected.Desc()
+	ch <- q.length.Desc()
+	ch <- q.capacity.Desc()
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingWriter passes value lists on to its channel.
+type blockingWriter chan *api.ValueList
+
+func (w blockingWriter) Write(ctx context.Context, vl *api.ValueList) error {
+	select {
+	case w <- vl:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestQueue(t *testing.T) {
+	mux := http.NewServeMux()
+	q := NewQueue(1, 1)
+	h := &HTTP{Mux: mux, Path: "/collectd-post", Queue: q}
+	w := make(blockingWriter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- h.Start(ctx, w) }()
+
+	body := `[{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+		`"host":"example.com","plugin":"load","plugin_instance":"","type":"load","type_instance":""}]`
+	post := func() int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collectd-post", strings.NewReader(body)))
+		return rec.Code
+	}
+	var code int
+	for deadline := time.Now().Add(5 * time.Second); code != http.StatusAccepted; time.Sleep(10 * time.Millisecond) {
+		if code = post(); time.Now().After(deadline) {
+			t.Fatalf("got status %d, want %d", code, http.StatusAccepted)
+		}
+	}
+
+	// The worker is blocked writing the first value list, the second one
+	// waits in the queue and the third one is rejected.
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(q.length) != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("worker did not take the first value list")
+		}
+	}
+	if code := post(); code != http.StatusAccepted {
+		t.Errorf("got status %d, want %d", code, http.StatusAccepted)
+	}
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with full queue, want %d", code, http.StatusServiceUnavailable)
+	}
+	if got := testutil.ToFloat64(q.rejected); got != 1 {
+		t.Errorf("got %v rejected value lists, want 1", got)
+	}
+
+	for range 2 {
+		if vl := <-w; vl.Host != "example.com" {
+			t.Errorf("got value list %v", vl)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package source provides the transports collectd value lists are received
+// with and manages their lifecycle.
+package source
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records spans of the global OpenTelemetry tracer provider, which
+// does nothing unless configured by the application.
+var tracer = otel.Tracer("github.com/prometheus/collectd_exporter/source")
+
+// spanError marks span as failed with err.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Source receives value lists from a transport.
+type Source interface {
+	// Start receives value lists and writes them to w until ctx is
+	// canceled. It returns an error if the source cannot be started or
+	// fails. Sources that run out of input, such as a recording, return
+	// nil.
+	Start(ctx context.Context, w api.Writer) error
+}
+
+// Group runs a set of named sources and exposes metrics about them. It
+// implements prometheus.Collector.
+type Group struct {
+	logger  *slog.Logger
+	names   []string
+	sources []Source
+	// down is set for each source while it has not been started or has
+	// failed, see Down.
+	down []*atomic.Bool
+
+	initialBackoff, maxBackoff time.Duration
+
+	up          *prometheus.GaugeVec
+	valueLists  *prometheus.CounterVec
+	writeErrors *prometheus.CounterVec
+	restarts    *prometheus.CounterVec
+}
+
+// NewGroup returns an empty Group. A nil logger discards all log messages.
+func NewGroup(logger *slog.Logger) *Group {
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	return &Group{
+		logger: logger,
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "collectd_exporter_source_up",
+				Help: "Whether the source is running.",
+			},
+			[]string{"source"},
+		),
+		valueLists: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_source_value_lists_total",
+				Help: "Number of value lists received, by source.",
+			},
+			[]string{"source"},
+		),
+		writeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_source_write_errors_total",
+				Help: "Number of received value lists that could not be written, by source.",
+			},
+			[]string{"source"},
+		),
+		restarts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_source_restarts_total",
+				Help: "Number of times a failed source was restarted, by source.",
+			},
+			[]string{"source"},
+		),
+	}
+}
+
+// RestartOnFailure makes Run restart failing sources instead of stopping the
+// group, e.g. when the network interface a socket is bound to goes away.
+// Restarts are delayed by a backoff doubling from initial up to limit, which
+// is reset once a source ran for longer than limit. RestartOnFailure must not
+// be called after Run.
+func (g *Group) RestartOnFailure(initial, limit time.Duration) {
+	g.initialBackoff, g.maxBackoff = initial, limit
+}
+
+// Add adds s to the group under the given name, which is used in logs and
+// as the "source" label of the group's metrics. Add must not be called after
+// Run.
+func (g *Group) Add(name string, s Source) {
+	g.names = append(g.names, name)
+	g.sources = append(g.sources, s)
+	down := new(atomic.Bool)
+	down.Store(true)
+	g.down = append(g.down, down)
+
+	g.up.WithLabelValues(name)
+	g.valueLists.WithLabelValues(name)
+	g.writeErrors.WithLabelValues(name)
+	g.restarts.WithLabelValues(name)
+}
+
+// Run starts all sources, writing their value lists to w, and waits for them
+// to stop. If a source fails and is not restarted, all other sources are
+// stopped and its error is returned. Run returns nil once ctx is canceled and
+// all sources stopped.
+func (g *Group) Run(ctx context.Context, w api.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	for i, s := range g.sources {
+		name := g.names[i]
+		iw := instrumentedWriter{
+			w:           w,
+			name:        name,
+			valueLists:  g.valueLists.WithLabelValues(name),
+			writeErrors: g.writeErrors.WithLabelValues(name),
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			up := g.up.WithLabelValues(name)
+			backoff := g.initialBackoff
+			for {
+				up.Set(1)
+				g.down[i].Store(false)
+				g.logger.Info("Starting source", "source", name)
+				start := time.Now()
+				err := s.Start(ctx, iw)
+				up.Set(0)
+
+				if err == nil || ctx.Err() != nil {
+					g.logger.Info("Source stopped", "source", name)
+					return
+				}
+				g.down[i].Store(true)
+				if g.maxBackoff <= 0 {
+					g.logger.Error("Source failed", "source", name, "err", err)
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+
+				if time.Since(start) > g.maxBackoff {
+					backoff = g.initialBackoff
+				}
+				g.logger.Error("Source failed, restarting", "source", name, "err", err, "backoff", backoff)
+				select {
+				case <-ctx.Done():
+					g.logger.Info("Source stopped", "source", name)
+					return
+				case <-time.After(backoff):
+				}
+				g.restarts.WithLabelValues(name).Inc()
+				backoff = min(2*backoff, g.maxBackoff)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// Down returns the names of the sources that have not been started by Run
+// yet, or have failed and are waiting to be restarted or stopped the group.
+// Sources that ran out of input or were stopped by canceling the context of
+// Run are not down.
+func (g *Group) Down() []string {
+	var down []string
+	for i, name := range g.names {
+		if g.down[i].Load() {
+			down = append(down, name)
+		}
+	}
+	return down
+}
+
+// Collect implements prometheus.Collector.
+func (g *Group) Collect(ch chan<- prometheus.Metric) {
+	g.up.Collect(ch)
+	g.valueLists.Collect(ch)
+	g.writeErrors.Collect(ch)
+	g.restarts.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (g *Group) Describe(ch chan<- *prometheus.Desc) {
+	g.up.Describe(ch)
+	g.valueLists.Describe(ch)
+	g.writeErrors.Describe(ch)
+	g.restarts.Describe(ch)
+}
+
+// instrumentedWriter counts the value lists written by a source and records
+// the source's name in the context passed on.
+type instrumentedWriter struct {
+	w                       api.Writer
+	name                    string
+	valueLists, writeErrors prometheus.Counter
+}
+
+// Write implements api.Writer.
+func (w instrumentedWriter) Write(ctx context.Context, vl *api.ValueList) error {
+	w.valueLists.Inc()
+	info, _ := FromContext(ctx)
+	if info.Name == "" {
+		info.Name = w.name
+		ctx = NewContext(ctx, info)
+	}
+
+	err := w.w.Write(ctx, vl)
+	if err != nil {
+		w.writeErrors.Inc()
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// funcSource adapts a function to the Source interface.
+type funcSource func(ctx context.Context, w api.Writer) error
+
+func (f funcSource) Start(ctx context.Context, w api.Writer) error {
+	return f(ctx, w)
+}
+
+// collectingWriter stores all value lists written to it, along with the
+// source info of their context.
+type collectingWriter struct {
+	mu         sync.Mutex
+	valueLists []*api.ValueList
+	infos      []Info
+}
+
+func (w *collectingWriter) Write(ctx context.Context, vl *api.ValueList) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, _ := FromContext(ctx)
+	w.valueLists = append(w.valueLists, vl)
+	w.infos = append(w.infos, info)
+	return nil
+}
+
+func TestGroup(t *testing.T) {
+	errFailed := errors.New("failed")
+	g := NewGroup(nil)
+	g.Add("finite", funcSource(func(ctx context.Context, w api.Writer) error {
+		for i := 0; i < 2; i++ {
+			if err := w.Write(ctx, &api.ValueList{Values: []api.Value{api.Gauge(i)}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	started := make(chan struct{})
+	g.Add("blocking", funcSource(func(ctx context.Context, _ api.Writer) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	g.Add("failing", funcSource(func(context.Context, api.Writer) error {
+		<-started
+		return errFailed
+	}))
+
+	w := &collectingWriter{}
+	if err := g.Run(context.Background(), w); !errors.Is(err, errFailed) {
+		t.Fatalf("got error %v, want %v", err, errFailed)
+	}
+	if len(w.valueLists) != 2 {
+		t.Errorf("got %d value lists, want 2", len(w.valueLists))
+	}
+	for _, info := range w.infos {
+		if info.Name != "finite" {
+			t.Errorf("got source name %q, want %q", info.Name, "finite")
+		}
+	}
+
+	want := `
+# HELP collectd_exporter_source_up Whether the source is running.
+# TYPE collectd_exporter_source_up gauge
+collectd_exporter_source_up{source="blocking"} 0
+collectd_exporter_source_up{source="failing"} 0
+collectd_exporter_source_up{source="finite"} 0
+# HELP collectd_exporter_source_value_lists_total Number of value lists received, by source.
+# TYPE collectd_exporter_source_value_lists_total counter
+collectd_exporter_source_value_lists_total{source="blocking"} 0
+collectd_exporter_source_value_lists_total{source="failing"} 0
+collectd_exporter_source_value_lists_total{source="finite"} 2
+`
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(g)
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "collectd_exporter_source_up", "collectd_exporter_source_value_lists_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGroupRestart(t *testing.T) {
+	g := NewGroup(nil)
+	g.RestartOnFailure(time.Millisecond, 10*time.Millisecond)
+	starts := 0
+	g.Add("flapping", funcSource(func(context.Context, api.Writer) error {
+		starts++
+		if starts < 3 {
+			return errors.New("interface down")
+		}
+		return nil
+	}))
+
+	if err := g.Run(context.Background(), &collectingWriter{}); err != nil {
+		t.Fatalf("got error %v, want nil", err)
+	}
+	if starts != 3 {
+		t.Errorf("source started %d times, want 3", starts)
+	}
+	if got := testutil.ToFloat64(g.restarts.WithLabelValues("flapping")); got != 2 {
+		t.Errorf("got %v restarts, want 2", got)
+	}
+
+	if down := g.Down(); len(down) != 0 {
+		t.Errorf("source that ran out of input reported down")
+	}
+
+	// Sources waiting to be restarted stop with the group.
+	g = NewGroup(nil)
+	g.RestartOnFailure(time.Hour, time.Hour)
+	g.Add("failing", funcSource(func(context.Context, api.Writer) error {
+		return errors.New("interface down")
+	}))
+	if down := g.Down(); !slices.Equal(down, []string{"failing"}) {
+		t.Errorf("got sources %v down before Run", down)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Run(ctx, &collectingWriter{}); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	if down := g.Down(); !slices.Equal(down, []string{"failing"}) {
+		t.Errorf("got sources %v down, want the failed source", down)
+	}
+}
+
+func TestGroupCancel(t *testing.T) {
+	g := NewGroup(nil)
+	started := make(chan struct{})
+	g.Add("blocking", funcSource(func(ctx context.Context, _ api.Writer) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- g.Run(ctx, &collectingWriter{}) }()
+	<-started
+	if down := g.Down(); len(down) != 0 {
+		t.Errorf("got sources %v down while running", down)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+}
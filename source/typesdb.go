@@ -0,0 +1,178 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"cmp"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxUnknownTypes is the maximum number of series of
+// collectd_exporter_unknown_type_total, including unknownTypeOther. Beyond
+// maxUnknownTypes-1 cached types, further types are counted as
+// unknownTypeOther.
+const maxUnknownTypes = 256
+
+// unknownTypeOther is the type label of unknown types not cached because the
+// cache is full.
+const unknownTypeOther = "__other__"
+
+// UnknownType is a type of received value lists missing from the types.db.
+type UnknownType struct {
+	Type      string    `json:"type"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// ValueLists is the number of value lists of the type dropped since
+	// it was first seen.
+	ValueLists int `json:"value_lists"`
+}
+
+// UnknownTypes is a negative cache of the types of value lists received in
+// binary protocol packets that are missing from the types.db. Such value
+// lists are dropped, as their data sources cannot be named. A type is logged
+// when it is first seen, and then only once it has not been seen for the TTL,
+// instead of for every packet. Dropped value lists are counted by type.
+// UnknownTypes implements prometheus.Collector and may be shared by several
+// sources.
+type UnknownTypes struct {
+	ttl     time.Duration
+	dropped *prometheus.CounterVec
+
+	mu    sync.Mutex
+	types map[string]*UnknownType
+}
+
+// NewUnknownTypes returns a new UnknownTypes forgetting types not seen for
+// ttl.
+func NewUnknownTypes(ttl time.Duration) *UnknownTypes {
+	return &UnknownTypes{
+		ttl: ttl,
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_unknown_type_total",
+				Help: "Number of received value lists dropped because their type is missing from the types.db, by type.",
+			},
+			[]string{"type"},
+		),
+		types: map[string]*UnknownType{},
+	}
+}
+
+// record accounts a value list of the unknown type typ, received at now. It
+// returns whether the type was not cached, i.e. should be logged.
+func (u *UnknownTypes) record(typ string, now time.Time) bool {
+	if u == nil {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(now)
+
+	t, ok := u.types[typ]
+	if !ok {
+		if len(u.types) >= maxUnknownTypes-1 {
+			u.dropped.WithLabelValues(unknownTypeOther).Inc()
+			return false
+		}
+		t = &UnknownType{Type: typ, FirstSeen: now}
+		u.types[typ] = t
+	}
+	t.LastSeen = now
+	t.ValueLists++
+	u.dropped.WithLabelValues(typ).Inc()
+	return !ok
+}
+
+// expire forgets the types not seen for the TTL before now, along with
+// their counters, so that senders cycling through type names cannot grow the
+// number of series without bound. u.mu must be held.
+func (u *UnknownTypes) expire(now time.Time) {
+	maps.DeleteFunc(u.types, func(typ string, t *UnknownType) bool {
+		if now.Sub(t.LastSeen) <= u.ttl {
+			return false
+		}
+		u.dropped.DeleteLabelValues(typ)
+		return true
+	})
+}
+
+// Types returns the cached unknown types, most recently seen first.
+func (u *UnknownTypes) Types() []UnknownType {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.expire(time.Now())
+
+	types := make([]UnknownType, 0, len(u.types))
+	for _, t := range u.types {
+		types = append(types, *t)
+	}
+	slices.SortFunc(types, func(a, b UnknownType) int {
+		return cmp.Or(b.LastSeen.Compare(a.LastSeen), cmp.Compare(a.Type, b.Type))
+	})
+	return types
+}
+
+// Collect implements prometheus.Collector.
+func (u *UnknownTypes) Collect(ch chan<- prometheus.Metric) {
+	u.dropped.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (u *UnknownTypes) Describe(ch chan<- *prometheus.Desc) {
+	u.dropped.Describe(ch)
+}
+
+// parsePacket parses a binary protocol packet like network.Parse, except that
+// value lists of types missing from opts.TypesDB are recorded in unknown,
+// which may be nil, instead of being logged by the network package for
+// every packet.
+func parsePacket(b []byte, opts network.ParseOpts, unknown *UnknownTypes, logger *slog.Logger) ([]*api.ValueList, error) {
+	typesDB := opts.TypesDB
+	opts.TypesDB = nil
+	valueLists, err := network.Parse(b, opts)
+	if typesDB == nil {
+		return valueLists, err
+	}
+
+	kept := valueLists[:0]
+	for _, vl := range valueLists {
+		ds, ok := typesDB.DataSet(vl.Type)
+		if !ok {
+			if unknown.record(vl.Type, time.Now()) {
+				logger.Warn("Dropping value lists of a type missing from the types.db", "type", vl.Type, "identifier", vl.Identifier.String())
+			}
+			continue
+		}
+		values := make([]any, len(vl.Values))
+		for i, v := range vl.Values {
+			values[i] = v
+		}
+		converted, verr := ds.Values(values...)
+		if verr != nil {
+			logger.Debug("Dropping value list not matching its type in the types.db", "identifier", vl.Identifier.String(), "err", verr)
+			continue
+		}
+		vl.Values, vl.DSNames = converted, ds.Names()
+		kept = append(kept, vl)
+	}
+	return kept, err
+}
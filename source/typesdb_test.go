@@ -0,0 +1,112 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParsePacketUnknownTypes(t *testing.T) {
+	typesDB, err := api.NewTypesDB(strings.NewReader("load shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := network.NewBuffer(0)
+	for _, typ := range []string{"load", "mystery", "mystery"} {
+		if err := buf.Write(context.Background(), &api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: typ, Type: typ},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1), api.Gauge(2), api.Gauge(3)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packet, err := buf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&log, nil))
+	unknown := NewUnknownTypes(time.Hour)
+	for range 2 {
+		valueLists, err := parsePacket(packet, network.ParseOpts{TypesDB: typesDB}, unknown, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(valueLists) != 1 || !slices.Equal(valueLists[0].DSNames, []string{"shortterm", "midterm", "longterm"}) {
+			t.Fatalf("got value lists %v, want one of type load", valueLists)
+		}
+	}
+
+	if n := strings.Count(log.String(), "type=mystery"); n != 1 {
+		t.Errorf("unknown type logged %d times, want once:\n%s", n, log.String())
+	}
+	if got := testutil.ToFloat64(unknown.dropped.WithLabelValues("mystery")); got != 4 {
+		t.Errorf("got %v dropped value lists, want 4", got)
+	}
+	if types := unknown.Types(); len(types) != 1 || types[0].Type != "mystery" || types[0].ValueLists != 4 {
+		t.Errorf("got unknown types %+v", types)
+	}
+}
+
+func TestUnknownTypesExpiry(t *testing.T) {
+	u := NewUnknownTypes(time.Minute)
+	now := time.Now()
+	for _, step := range []struct {
+		at  time.Duration
+		log bool
+	}{
+		{0, true},
+		{30 * time.Second, false},
+		// Seen within the TTL of the previous value list.
+		{80 * time.Second, false},
+		{3 * time.Minute, true},
+	} {
+		if log := u.record("mystery", now.Add(step.at)); log != step.log {
+			t.Errorf("at %v: got log %t, want %t", step.at, log, step.log)
+		}
+	}
+
+	for i := range maxUnknownTypes - 1 {
+		u.record(fmt.Sprint("type", i), now.Add(3*time.Minute))
+	}
+	if got := testutil.ToFloat64(u.dropped.WithLabelValues(unknownTypeOther)); got != 1 {
+		t.Errorf("got %v value lists of uncached types, want 1", got)
+	}
+
+	// A sender cycling through type names does not grow the number of
+	// series once the previous names expire.
+	for round := range 5 {
+		at := now.Add(time.Duration(5+2*round) * time.Minute)
+		for i := range maxUnknownTypes {
+			u.record(fmt.Sprint("round", round, "type", i), at)
+		}
+		if n := testutil.CollectAndCount(u); n > maxUnknownTypes {
+			t.Fatalf("round %d: got %d series, want at most %d", round, n, maxUnknownTypes)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// UDP receives value lists in collectd's binary network protocol.
+type UDP struct {
+	// Addr is the address to listen on, e.g. ":25826". The zone of an IPv6
+	// multicast group, as in "[ff02::1:2%eth1]:25826", selects the
+	// interface the group is joined on.
+	Addr string
+	// Interface is the name of the network interface multicast groups are
+	// joined on. Defaults to the zone of Addr, or the system's default
+	// interface for groups with a scope beyond the link.
+	Interface string
+	// Device is the name of the network interface the socket is bound to
+	// with SO_BINDTODEVICE, so that only packets received on it are
+	// accepted. Only supported on Linux.
+	Device string
+	// ReadBuffer is the target size of the socket's receive buffer, if
+	// positive. If the operating system refuses it, the buffer is raised
+	// as far as permitted and a warning is logged.
+	ReadBuffer int
+	// PacketSize is the size of the largest packet accepted, which must be
+	// at least collectd's MaxPacketSize. Larger packets are dropped.
+	// Defaults to network.DefaultBufferSize.
+	PacketSize int
+	// ParseOpts controls authentication and the types.db used to parse
+	// packets.
+	ParseOpts network.ParseOpts
+	// UserSecurityLevels overrides ParseOpts.SecurityLevel for packets
+	// signed or encrypted by the given users.
+	UserSecurityLevels map[string]network.SecurityLevel
+	// AllowedSources restricts the senders packets are accepted from.
+	// Packets from other addresses are dropped before parsing. If empty,
+	// packets from all addresses are accepted.
+	AllowedSources []netip.Prefix
+	// Metrics accounts received packets. May be nil.
+	Metrics *UDPMetrics
+	// AuthFailures accounts packets failing signature verification or
+	// decryption. May be nil.
+	AuthFailures *AuthFailures
+	// Quarantine keeps packets that could not be parsed. May be nil.
+	Quarantine *Quarantine
+	// UnknownTypes accounts value lists of types missing from the
+	// types.db. May be nil.
+	UnknownTypes *UnknownTypes
+	// Logger receives parse errors. May be nil.
+	Logger *slog.Logger
+
+	// conn is the socket bound by Listen, or set by tests.
+	conn *net.UDPConn
+}
+
+// Listen binds the socket without receiving from it yet, so that callers can
+// report readiness once all sockets are bound. Start calls it if necessary.
+func (u *UDP) Listen() error {
+	if u.conn != nil {
+		return nil
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", u.Addr)
+	if err != nil {
+		return fmt.Errorf("resolving listen address: %w", err)
+	}
+
+	var conn *net.UDPConn
+	if laddr.IP != nil && laddr.IP.IsMulticast() {
+		ifi, err := multicastInterface(laddr, u.Interface)
+		if err != nil {
+			return err
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, laddr)
+		if err != nil {
+			return fmt.Errorf("creating socket: %w", err)
+		}
+	} else if conn, err = net.ListenUDP("udp", laddr); err != nil {
+		return fmt.Errorf("creating socket: %w", err)
+	}
+	if u.Device != "" {
+		if err := bindToDevice(conn, u.Device); err != nil {
+			conn.Close()
+			return fmt.Errorf("binding to device %q: %w", u.Device, err)
+		}
+	}
+	if u.ReadBuffer > 0 {
+		if err := u.tuneReadBuffer(conn); err != nil {
+			conn.Close()
+			return fmt.Errorf("adjusting read buffer: %w", err)
+		}
+	}
+	if size, err := readBufferSize(conn); err == nil {
+		u.Metrics.setReadBuffer(u.Addr, size)
+	}
+
+	u.conn = conn
+	return nil
+}
+
+// minReadBuffer is the smallest receive buffer tuneReadBuffer falls back to.
+const minReadBuffer = 64 << 10
+
+// tuneReadBuffer raises the receive buffer of conn toward u.ReadBuffer. Some
+// systems refuse sizes beyond their limit, in which case smaller sizes are
+// tried; Linux silently caps them at net.core.rmem_max, which privileged
+// processes may exceed. A warning is logged if the target is not reached.
+func (u *UDP) tuneReadBuffer(conn *net.UDPConn) error {
+	size := u.ReadBuffer
+	for {
+		err := conn.SetReadBuffer(size)
+		if err == nil {
+			break
+		}
+		if size/2 < minReadBuffer {
+			return err
+		}
+		size /= 2
+	}
+
+	granted, err := readBufferSize(conn)
+	if err != nil {
+		// The size cannot be read back; trust the call that succeeded.
+		granted = size
+	}
+	if granted >= u.ReadBuffer {
+		return nil
+	}
+	if forceReadBuffer(conn, u.ReadBuffer) == nil {
+		if granted, err = readBufferSize(conn); err == nil && granted >= u.ReadBuffer {
+			return nil
+		}
+	}
+
+	logger := u.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+	args := []any{"address", u.Addr, "requested", u.ReadBuffer, "granted", granted}
+	if limit := readBufferLimit(); limit > 0 {
+		args = append(args, "rmem_max", limit)
+		logger.Warn("Receive buffer clamped by net.core.rmem_max, raise it with sysctl to avoid dropping packets", args...)
+	} else {
+		logger.Warn("Receive buffer smaller than requested", args...)
+	}
+	return nil
+}
+
+// Start implements Source.
+func (u *UDP) Start(ctx context.Context, w api.Writer) error {
+	if err := u.Listen(); err != nil {
+		return err
+	}
+	conn := u.conn
+
+	logger := u.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	size := u.PacketSize
+	if size <= 0 {
+		size = network.DefaultBufferSize
+	}
+
+	// One spare byte tells truncated packets apart from those of exactly
+	// the maximum size. Parsing copies what it keeps, so the buffer is
+	// reused for every packet.
+	buf := make([]byte, size+1)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Bind a new socket if started again.
+			u.conn = nil
+			return err
+		}
+		if n > size {
+			u.Metrics.drop(dropReasonTooLarge)
+			logger.Debug("Dropping packet exceeding the packet size", "remote", addr, "packet_size", size)
+			continue
+		}
+
+		if !u.allowed(addr.Addr().Unmap()) {
+			u.Metrics.drop(dropReasonSourceNotAllowed)
+			continue
+		}
+
+		level, user := packetSecurity(buf[:n])
+		info := Info{Addr: addr.Addr().Unmap(), Username: user}
+		opts := u.ParseOpts
+		if l, ok := u.UserSecurityLevels[user]; ok && user != "" {
+			opts.SecurityLevel = l
+		}
+		pctx, span := tracer.Start(ctx, "collectd.packet", trace.WithSpanKind(trace.SpanKindServer))
+		if span.IsRecording() {
+			// Formatting the address allocates.
+			span.SetAttributes(
+				attribute.String("network.peer.address", info.Addr.String()),
+				attribute.Int("collectd.packet.size", n),
+			)
+		}
+		valueLists, err := parsePacket(buf[:n], opts, u.UnknownTypes, logger)
+		if err != nil {
+			spanError(span, err)
+			span.End()
+			class := invalidClassAuth
+			switch level {
+			case network.Sign:
+				u.AuthFailures.record(info.Addr, user, authReasonSignature, err)
+			case network.Encrypt:
+				u.AuthFailures.record(info.Addr, user, authReasonDecryption, err)
+			default:
+				class = invalidClassParse
+			}
+			u.Quarantine.record("udp", info, class, buf[:n], err)
+			logger.Debug("Error parsing packet", "remote", addr, "err", err)
+			continue
+		}
+
+		// Writes may block, e.g. while the collector is busy; keep
+		// reading in the meantime. Packets already received are written
+		// even once ctx is canceled, so that they are not lost on
+		// shutdown.
+		if span.IsRecording() {
+			span.SetAttributes(attribute.Int("collectd.value_lists", len(valueLists)))
+		}
+		info.Bytes = share(n, len(valueLists))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer span.End()
+			wctx := NewContext(context.WithoutCancel(pctx), info)
+			for _, vl := range valueLists {
+				if err := w.Write(wctx, vl); err != nil {
+					logger.Debug("Error writing value list", "err", err)
+				}
+			}
+		}()
+	}
+}
+
+// allowed returns whether packets from addr are accepted.
+func (u *UDP) allowed(addr netip.Addr) bool {
+	if len(u.AllowedSources) == 0 {
+		return true
+	}
+	for _, p := range u.AllowedSources {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Part types of signed and encrypted binary protocol packets.
+const (
+	partSignSHA256    = 0x0200
+	partEncryptAES256 = 0x0210
+)
+
+// packetSecurity returns whether the packet b is signed or encrypted, and by
+// which user, as given by its first part. The user is not authenticated by
+// this; it is "" if the part is malformed.
+func packetSecurity(b []byte) (network.SecurityLevel, string) {
+	if len(b) < 4 {
+		return network.None, ""
+	}
+	partType := binary.BigEndian.Uint16(b)
+	partLength := int(binary.BigEndian.Uint16(b[2:]))
+	if partLength < 4 || partLength > len(b) {
+		return network.None, ""
+	}
+	payload := b[4:partLength]
+
+	switch partType {
+	case partSignSHA256:
+		// A SHA-256 HMAC followed by the user name.
+		if len(payload) > sha256.Size {
+			return network.Sign, string(payload[sha256.Size:])
+		}
+		return network.Sign, ""
+	case partEncryptAES256:
+		// The length of the user name followed by the user name.
+		if len(payload) >= 2 {
+			n := int(binary.BigEndian.Uint16(payload))
+			if 2+n <= len(payload) {
+				return network.Encrypt, string(payload[2 : 2+n])
+			}
+		}
+		return network.Encrypt, ""
+	}
+	return network.None, ""
+}
+
+// multicastInterface returns the interface to join the multicast group laddr
+// on: the interface given by name, else the zone of laddr. A nil interface
+// selects the system's default, which is refused for interface- and
+// link-local IPv6 groups as their scope requires a specific interface.
+func multicastInterface(laddr *net.UDPAddr, name string) (*net.Interface, error) {
+	if name == "" {
+		name = laddr.Zone
+	}
+	if name == "" {
+		if laddr.IP.IsInterfaceLocalMulticast() || laddr.IP.IsLinkLocalMulticast() && laddr.IP.To4() == nil {
+			return nil, fmt.Errorf("multicast group %s has link scope, an interface is required", laddr.IP)
+		}
+		return nil, nil
+	}
+
+	if index, err := strconv.Atoi(name); err == nil {
+		ifi, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return nil, fmt.Errorf("looking up multicast interface: %w", err)
+		}
+		return ifi, nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("looking up multicast interface: %w", err)
+	}
+	return ifi, nil
+}
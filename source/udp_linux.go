@@ -0,0 +1,87 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package source
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// bindToDevice restricts conn to packets received on the given interface.
+func bindToDevice(conn *net.UDPConn, device string) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var bindErr error
+	if err := rc.Control(func(fd uintptr) {
+		bindErr = syscall.BindToDevice(int(fd), device)
+	}); err != nil {
+		return err
+	}
+	return bindErr
+}
+
+// readBufferSize returns the size of the receive buffer of conn. Linux
+// reserves twice the requested size for bookkeeping and reports that; the
+// requested size is returned, so that it can be compared to the target.
+func readBufferSize(conn *net.UDPConn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil {
+		return 0, err
+	}
+	return size / 2, sockErr
+}
+
+// forceReadBuffer sets the receive buffer of conn beyond net.core.rmem_max,
+// which requires CAP_NET_ADMIN.
+func forceReadBuffer(conn *net.UDPConn, size int) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, size)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// readBufferLimit returns net.core.rmem_max, the largest receive buffer
+// unprivileged processes can set, or 0 if it is unknown.
+func readBufferLimit() int {
+	b, err := os.ReadFile("/proc/sys/net/core/rmem_max")
+	if err != nil {
+		return 0
+	}
+	limit, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return limit
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package source
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBindToDevice(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := bindToDevice(conn, "does-not-exist0"); err == nil {
+		t.Error("expected an error for an unknown device")
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		err := bindToDevice(conn, ifi.Name)
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("binding to a device is not permitted")
+		}
+		if err != nil {
+			t.Errorf("binding to %s: %v", ifi.Name, err)
+		}
+		return
+	}
+	t.Skip("no loopback interface found")
+}
+
+func TestTuneReadBuffer(t *testing.T) {
+	limit := readBufferLimit()
+	if limit == 0 {
+		t.Skip("net.core.rmem_max unknown")
+	}
+
+	for _, requested := range []int{min(limit, 128<<10), 2 * limit} {
+		u := &UDP{Addr: "127.0.0.1:0", ReadBuffer: requested, Metrics: NewUDPMetrics()}
+		if err := u.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		u.conn.Close()
+
+		// Beyond rmem_max, the buffer is only raised with CAP_NET_ADMIN.
+		got := int(testutil.ToFloat64(u.Metrics.readBuffer.WithLabelValues(u.Addr)))
+		if got != requested && (requested <= limit || got != limit) {
+			t.Errorf("requested %d with rmem_max %d: got receive buffer of %d", requested, limit, got)
+		}
+	}
+}
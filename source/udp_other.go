@@ -0,0 +1,41 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package source
+
+import (
+	"errors"
+	"net"
+)
+
+// bindToDevice is not supported on this platform.
+func bindToDevice(*net.UDPConn, string) error {
+	return errors.New("binding to a device is only supported on Linux")
+}
+
+// readBufferSize is not supported on this platform.
+func readBufferSize(*net.UDPConn) (int, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// forceReadBuffer is not supported on this platform.
+func forceReadBuffer(*net.UDPConn, int) error {
+	return errors.ErrUnsupported
+}
+
+// readBufferLimit is unknown on this platform.
+func readBufferLimit() int {
+	return 0
+}
@@ -0,0 +1,392 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"collectd.org/api"
+	"collectd.org/network"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan *api.ValueList, 1)
+	done := make(chan error)
+	go func() {
+		u := &UDP{conn: conn}
+		done <- u.Start(ctx, api.WriterFunc(func(_ context.Context, vl *api.ValueList) error {
+			received <- vl
+			return nil
+		}))
+	}()
+
+	client, err := network.Dial(conn.LocalAddr().String(), network.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	want := api.Identifier{Host: "example.com", Plugin: "load", Type: "load"}
+	if err := client.Write(ctx, &api.ValueList{
+		Identifier: want,
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Gauge(1)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case vl := <-received:
+		if vl.Identifier != want {
+			t.Errorf("got identifier %v, want %v", vl.Identifier, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for value list")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("got error %v after cancellation, want nil", err)
+	}
+}
+
+func TestUDPPacketSize(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan *api.ValueList, 100)
+	u := &UDP{PacketSize: 4000, Metrics: NewUDPMetrics(), conn: conn}
+	go u.Start(ctx, api.WriterFunc(func(_ context.Context, vl *api.ValueList) error {
+		received <- vl
+		return nil
+	}))
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write(make([]byte, 4001)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A packet exceeding the default size is received in full.
+	buf := network.NewBuffer(4000)
+	for i := 0; buf.Available() > 100; i++ {
+		if err := buf.Write(ctx, &api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: "cpu", PluginInstance: strconv.Itoa(i), Type: "cpu"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Derive(i)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packet, err := buf.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) <= network.DefaultBufferSize {
+		t.Fatalf("got packet of %d bytes, want more than %d", len(packet), network.DefaultBufferSize)
+	}
+	if _, err := client.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for value list")
+	}
+	if got := testutil.ToFloat64(u.Metrics.dropped.WithLabelValues(dropReasonTooLarge)); got != 1 {
+		t.Errorf("got %v packets dropped as too large, want 1", got)
+	}
+}
+
+func TestUDPUnknownInterface(t *testing.T) {
+	u := &UDP{Addr: "239.192.74.66:0", Interface: "does-not-exist0"}
+	if err := u.Start(context.Background(), api.WriterFunc(nil)); err == nil {
+		t.Error("expected an error for an unknown multicast interface")
+	}
+}
+
+func TestMulticastInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skip("no network interfaces available")
+	}
+	ifi := ifaces[0]
+
+	cases := []struct {
+		addr, name string
+		want       string
+		err        bool
+	}{
+		{addr: "239.192.74.66:25826"},
+		{addr: "239.192.74.66:25826", name: ifi.Name, want: ifi.Name},
+		{addr: "[ff18::efc0:4a42]:25826"},
+		{addr: "[ff02::1:2%" + ifi.Name + "]:25826", want: ifi.Name},
+		{addr: "[ff02::1:2%" + strconv.Itoa(ifi.Index) + "]:25826", want: ifi.Name},
+		{addr: "[ff02::1:2]:25826", err: true},
+		{addr: "[ff01::1:2]:25826", err: true},
+		{addr: "239.192.74.66:25826", name: "does-not-exist0", err: true},
+	}
+	for _, c := range cases {
+		laddr, err := net.ResolveUDPAddr("udp", c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := multicastInterface(laddr, c.name)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.addr, err)
+			continue
+		}
+		var name string
+		if got != nil {
+			name = got.Name
+		}
+		if name != c.want {
+			t.Errorf("%s: got interface %q, want %q", c.addr, name, c.want)
+		}
+	}
+}
+
+// passwords implements network.PasswordLookup.
+type passwords map[string]string
+
+func (p passwords) Password(user string) (string, error) {
+	password, ok := p[user]
+	if !ok {
+		return "", errors.New("unknown user")
+	}
+	return password, nil
+}
+
+func TestUDPUserSecurityLevels(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	users := passwords{"alice": "secret", "bob": "hunter2"}
+	authFailures := NewAuthFailures(nil, 0)
+	received := make(chan string, 3)
+	go func() {
+		u := &UDP{
+			ParseOpts:          network.ParseOpts{PasswordLookup: users, SecurityLevel: network.Encrypt},
+			UserSecurityLevels: map[string]network.SecurityLevel{"alice": network.Sign},
+			AuthFailures:       authFailures,
+			conn:               conn,
+		}
+		u.Start(ctx, api.WriterFunc(func(ctx context.Context, vl *api.ValueList) error {
+			info, _ := FromContext(ctx)
+			received <- info.Username + "/" + vl.Plugin
+			return nil
+		}))
+	}()
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Packets are built by hand, as network.Client sends an additional
+	// empty packet when closed.
+	send := func(user, password string, level network.SecurityLevel, plugin string) {
+		buf := network.NewBuffer(0)
+		if level == network.Encrypt {
+			buf.Encrypt(user, password)
+		} else {
+			buf.Sign(user, password)
+		}
+		if err := buf.Write(ctx, &api.ValueList{
+			Identifier: api.Identifier{Host: "example.com", Plugin: plugin, Type: "gauge"},
+			Time:       time.Now(),
+			Interval:   10 * time.Second,
+			Values:     []api.Value{api.Gauge(1)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		packet, err := buf.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("bob", users["bob"], network.Sign, "dropped")
+	send("bob", "wrong", network.Encrypt, "wrong_password")
+	send("mallory", "guess", network.Sign, "unknown_user")
+	send("alice", users["alice"], network.Sign, "signed")
+	send("bob", users["bob"], network.Encrypt, "encrypted")
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case s := <-received:
+			got[s] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for value lists, got %v", got)
+		}
+	}
+	if !got["alice/signed"] || !got["bob/encrypted"] {
+		t.Errorf("got value lists %v, want alice/signed and bob/encrypted", got)
+	}
+	select {
+	case s := <-received:
+		t.Errorf("got unexpected value list %s", s)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	want := `
+# HELP collectd_exporter_auth_failures_total Number of binary protocol packets that failed signature verification or decryption, by sender address, user and reason.
+# TYPE collectd_exporter_auth_failures_total counter
+collectd_exporter_auth_failures_total{address="127.0.0.1",reason="decryption",user="bob"} 1
+collectd_exporter_auth_failures_total{address="127.0.0.1",reason="signature",user="mallory"} 1
+`
+	if err := testutil.CollectAndCompare(authFailures, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUDPAllowedSources(t *testing.T) {
+	u := &UDP{AllowedSources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.1":   false,
+		"2001:db8::1": true,
+		"::1":         false,
+	} {
+		if got := u.allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("%s: got allowed %v, want %v", addr, got, want)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u.Metrics = NewUDPMetrics()
+	u.conn = conn
+	go u.Start(ctx, api.WriterFunc(func(context.Context, *api.ValueList) error {
+		t.Error("value list from disallowed source written")
+		return nil
+	}))
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("not a collectd packet")); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := u.Metrics.dropped.WithLabelValues(dropReasonSourceNotAllowed)
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(dropped) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the packet to be dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkUDP measures receiving and parsing one packet of a value list at
+// a time over the loopback interface.
+func BenchmarkUDP(b *testing.B) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan struct{}, 1)
+	done := make(chan error)
+	go func() {
+		u := &UDP{conn: conn}
+		done <- u.Start(ctx, api.WriterFunc(func(context.Context, *api.ValueList) error {
+			received <- struct{}{}
+			return nil
+		}))
+	}()
+
+	buf := network.NewBuffer(0)
+	if err := buf.Write(ctx, &api.ValueList{
+		Identifier: api.Identifier{Host: "example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets"},
+		Time:       time.Now(),
+		Interval:   10 * time.Second,
+		Values:     []api.Value{api.Derive(1), api.Derive(2)},
+	}); err != nil {
+		b.Fatal(err)
+	}
+	packet, err := buf.Bytes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := client.Write(packet); err != nil {
+			b.Fatal(err)
+		}
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			b.Fatal("timed out waiting for value list")
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons for dropping UDP packets before parsing.
+const (
+	dropReasonSourceNotAllowed = "source_not_allowed"
+	dropReasonTooLarge         = "too_large"
+)
+
+// UDPMetrics holds metrics about received packets, which may be shared by
+// several UDP sources. It implements prometheus.Collector.
+type UDPMetrics struct {
+	dropped    *prometheus.CounterVec
+	readBuffer *prometheus.GaugeVec
+}
+
+// NewUDPMetrics returns a new UDPMetrics.
+func NewUDPMetrics() *UDPMetrics {
+	m := &UDPMetrics{
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "collectd_exporter_udp_dropped_packets_total",
+				Help: "Number of binary protocol packets dropped before parsing, by reason.",
+			},
+			[]string{"reason"},
+		),
+		readBuffer: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "collectd_exporter_udp_receive_buffer_bytes",
+				Help: "Size of the socket receive buffer granted by the operating system, by listen address.",
+			},
+			[]string{"address"},
+		),
+	}
+	m.dropped.WithLabelValues(dropReasonSourceNotAllowed)
+	m.dropped.WithLabelValues(dropReasonTooLarge)
+
+	return m
+}
+
+// drop accounts a packet dropped for the given reason.
+func (m *UDPMetrics) drop(reason string) {
+	if m != nil {
+		m.dropped.WithLabelValues(reason).Inc()
+	}
+}
+
+// setReadBuffer records the receive buffer size of the socket listening on
+// addr.
+func (m *UDPMetrics) setReadBuffer(addr string, size int) {
+	if m != nil {
+		m.readBuffer.WithLabelValues(addr).Set(float64(size))
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *UDPMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.dropped.Collect(ch)
+	m.readBuffer.Collect(ch)
+}
+
+// Describe implements prometheus.Collector.
+func (m *UDPMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.dropped.Describe(ch)
+	m.readBuffer.Describe(ch)
+}
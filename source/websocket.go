@@ -0,0 +1,195 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"collectd.org/api"
+	"github.com/prometheus/common/promslog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
+)
+
+// maxWebSocketMessage is the maximum size of a WebSocket message in bytes.
+const maxWebSocketMessage = 1 << 20
+
+// WebSocket accepts value lists in collectd's JSON format over WebSocket
+// connections to Path on Mux, for agents that can only reach the exporter
+// through HTTP proxies. Each message holds an array of value lists, as posted
+// by the write_http plugin, or a single value list.
+type WebSocket struct {
+	Mux    *http.ServeMux
+	Path   string
+	Logger *slog.Logger
+	// AllowedLabels are the names of the labels senders may add to the
+	// value lists of a connection, as for HTTP.
+	AllowedLabels []string
+	// Quarantine keeps invalid messages and value lists. May be nil.
+	Quarantine *Quarantine
+}
+
+// Start implements Source. It registers the handler and blocks until ctx is
+// canceled, after which open connections are closed and later ones are
+// rejected with 503 Service Unavailable. As handlers cannot be removed from
+// a ServeMux, Start must only be called once.
+func (s *WebSocket) Start(ctx context.Context, w api.Writer) error {
+	logger := s.Logger
+	if logger == nil {
+		logger = promslog.NewNopLogger()
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		stopped bool
+		conns   = map[*websocket.Conn]struct{}{}
+	)
+	server := websocket.Server{Handshake: checkOrigin, Handler: func(conn *websocket.Conn) {
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			return
+		}
+		conns[conn] = struct{}{}
+		wg.Add(1)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			wg.Done()
+		}()
+
+		conn.MaxPayloadBytes = maxWebSocketMessage
+		serveWebSocket(conn, w, s.AllowedLabels, s.Quarantine, logger)
+	}}
+	s.Mux.HandleFunc(s.Path, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if stopped {
+			mu.Unlock()
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		mu.Unlock()
+		if _, err := requestLabels(r, s.AllowedLabels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		server.ServeHTTP(w, r)
+	})
+
+	<-ctx.Done()
+	mu.Lock()
+	stopped = true
+	for conn := range conns {
+		conn.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+	return nil
+}
+
+// checkOrigin rejects WebSocket handshakes with an Origin header not naming
+// the host of the request. Agents do not send the header, but browsers do, so
+// that web pages cannot write value lists to the exporter across sites.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	if r.Header.Get("Origin") == "" {
+		return nil
+	}
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin == nil || origin.Host != r.Host {
+		return fmt.Errorf("cross-origin connection from %q", r.Header.Get("Origin"))
+	}
+	return nil
+}
+
+// serveWebSocket writes the value lists received on conn to w until the
+// connection is closed. The labels of the connection have been checked
+// against allowed before. Invalid messages and value lists are recorded in q.
+func serveWebSocket(conn *websocket.Conn, w api.Writer, allowed []string, q *Quarantine, logger *slog.Logger) {
+	r := conn.Request()
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	info := requestInfo(r)
+	info.Labels, _ = requestLabels(r, allowed)
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Debug("Error reading WebSocket message", "remote", r.RemoteAddr, "err", err)
+			}
+			return
+		}
+
+		valueLists, err := parseMessage(data)
+		if err != nil {
+			q.record("websocket", info, invalidClassJSON, data, err)
+			logger.Debug("Error parsing WebSocket message", "remote", r.RemoteAddr, "err", err)
+			continue
+		}
+
+		msgCtx, span := tracer.Start(ctx, "collectd.websocket.message", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.Int("messaging.message.body.size", len(data)),
+				attribute.Int("collectd.value_lists", len(valueLists)),
+			))
+		info.Bytes = share(len(data), len(valueLists))
+		msgCtx = NewContext(msgCtx, info)
+		for _, vl := range valueLists {
+			if err := validateValueList(vl); err != nil {
+				payload, _ := json.Marshal(vl)
+				q.record("websocket", info, invalidClassValueList, payload, err)
+				logger.Debug("Invalid WebSocket value list", "remote", r.RemoteAddr, "err", err)
+				continue
+			}
+			if err := w.Write(msgCtx, vl); err != nil {
+				logger.Debug("Error writing WebSocket value list", "err", err)
+			}
+		}
+		span.End()
+	}
+}
+
+// parseMessage parses a WebSocket message holding an array of value lists or
+// a single value list.
+func parseMessage(data []byte) ([]*api.ValueList, error) {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		vl := &api.ValueList{}
+		if err := json.Unmarshal(data, vl); err != nil {
+			return nil, err
+		}
+		return []*api.ValueList{vl}, nil
+	}
+
+	var valueLists []*api.ValueList
+	if err := json.Unmarshal(data, &valueLists); err != nil {
+		return nil, err
+	}
+	return valueLists, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	s := &WebSocket{Mux: mux, Path: "/collectd-ws"}
+	w := &collectingWriter{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Start(ctx, w) }()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/collectd-ws"
+	var conn *websocket.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if conn, err = websocket.Dial(url, "", srv.URL); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+
+	// Browsers cannot connect from other sites.
+	if _, err := websocket.Dial(url, "", "http://attacker.example.com"); err == nil {
+		t.Error("cross-origin connection accepted")
+	}
+
+	vl := `{"values":[1],"dstypes":["gauge"],"dsnames":["value"],"time":1700000000,"interval":10,` +
+		`"host":"example.com","plugin":"load","plugin_instance":"","type":"load","type_instance":""}`
+	for _, msg := range []string{"[" + vl + "," + vl + "]", "not json", vl} {
+		if err := websocket.Message.Send(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		w.mu.Lock()
+		n := len(w.valueLists)
+		w.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d value lists, want 3", n)
+		}
+	}
+	if w.valueLists[2].Host != "example.com" || !w.infos[0].Addr.IsLoopback() {
+		t.Errorf("got value lists %v, source info %v", w.valueLists, w.infos)
+	}
+
+	// Stopping closes open connections and rejects new ones.
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	var msg string
+	if err := websocket.Message.Receive(conn, &msg); err == nil {
+		t.Error("connection still open after stopping")
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collectd-ws", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d after stopping, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
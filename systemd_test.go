@@ -0,0 +1,122 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+)
+
+// notifySocket listens on a NOTIFY_SOCKET for the duration of the test.
+func notifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn, timeout time.Duration) (string, bool) {
+	t.Helper()
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+func TestSDNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("got error %v without NOTIFY_SOCKET", err)
+	}
+
+	conn := notifySocket(t)
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := receive(t, conn, time.Second); got != "READY=1" {
+		t.Errorf("got state %q, want %q", got, "READY=1")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	cases := []struct {
+		usec, pid string
+		want      time.Duration
+		err       bool
+	}{
+		{},
+		{usec: "30000000", want: 30 * time.Second},
+		{usec: "30000000", pid: strconv.Itoa(os.Getpid()), want: 30 * time.Second},
+		{usec: "30000000", pid: "1"},
+		{usec: "thirty", err: true},
+	}
+	for _, c := range cases {
+		t.Setenv("WATCHDOG_USEC", c.usec)
+		t.Setenv("WATCHDOG_PID", c.pid)
+		got, err := watchdogInterval()
+		if c.err != (err != nil) {
+			t.Errorf("%q/%q: got error %v", c.usec, c.pid, err)
+		}
+		if got != c.want {
+			t.Errorf("%q/%q: got interval %v, want %v", c.usec, c.pid, got, c.want)
+		}
+	}
+}
+
+func TestRunWatchdog(t *testing.T) {
+	conn := notifySocket(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	alive := make(chan error, 1)
+	alive <- nil
+	ping := func(ctx context.Context) error {
+		select {
+		case err := <-alive:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	go runWatchdog(ctx, 20*time.Millisecond, ping, promslog.NewNopLogger())
+	if got, _ := receive(t, conn, time.Second); got != "WATCHDOG=1" {
+		t.Fatalf("got state %q, want %q", got, "WATCHDOG=1")
+	}
+
+	// No pings are sent while the main loop is unresponsive.
+	alive <- errors.New("hanging")
+	if got, ok := receive(t, conn, 50*time.Millisecond); ok {
+		t.Errorf("got state %q from an unresponsive exporter", got)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/prometheus/collectd_exporter/source"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// startServer binds the listeners given by flags and serves srv on them in
+// the background. If proxyProtocol is set, connections must start with a
+// PROXY protocol header. The error ending the server is sent to the returned
+// channel.
+func startServer(srv *http.Server, flags *web.FlagConfig, proxyProtocol bool, logger *slog.Logger) (<-chan error, error) {
+	listeners, err := webListeners(flags)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol {
+		if listeners == nil {
+			return nil, errors.New("the PROXY protocol is not supported with systemd socket activation or vsock addresses")
+		}
+		for i, l := range listeners {
+			listeners[i] = proxyListener{l}
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if listeners != nil {
+			errc <- web.ServeMultiple(listeners, srv, flags, logger)
+		} else {
+			errc <- web.ListenAndServe(srv, flags, logger)
+		}
+	}()
+	return errc, nil
+}
+
+// webListeners binds the TCP addresses, and Unix domain sockets given as
+// "unix:///path", of --web.listen-address, so that readiness is only
+// reported once they accept connections. It returns
+// nil if the listeners are better left to web.ListenAndServe, i.e. for
+// systemd socket activation, where systemd already holds the sockets, and
+// vsock addresses.
+func webListeners(flags *web.FlagConfig) ([]net.Listener, error) {
+	if flags.WebSystemdSocket != nil && *flags.WebSystemdSocket {
+		return nil, nil
+	}
+	for _, address := range *flags.WebListenAddresses {
+		if strings.HasPrefix(address, "vsock://") {
+			return nil, nil
+		}
+	}
+
+	var listeners []net.Listener
+	for _, address := range *flags.WebListenAddresses {
+		l, err := listenWeb(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenWeb binds a single address of --web.listen-address.
+func listenWeb(address string) (net.Listener, error) {
+	socket, ok := strings.CutPrefix(address, "unix://")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("missing path in %q", address)
+	}
+	if err := removeStaleSocket(socket); err != nil {
+		return nil, err
+	}
+	// The socket file is removed again when the listener is closed.
+	return net.Listen("unix", socket)
+}
+
+// removeStaleSocket removes the socket file at path left behind by an
+// exporter that was not shut down cleanly. Sockets still accepting
+// connections and other files are left alone, so that binding fails.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// tcpListenAddress returns the first TCP address of --web.listen-address, or
+// the empty string if the exporter only listens on Unix domain sockets.
+func tcpListenAddress(flags *web.FlagConfig) string {
+	for _, address := range *flags.WebListenAddresses {
+		if !strings.HasPrefix(address, "unix://") {
+			return address
+		}
+	}
+	return ""
+}
+
+// exporterAddress returns the address identifying the exporter listening on
+// the TCP address listen in the exported_by label. An empty or unspecified host
+// is replaced by hostname, as is listen if the exporter has no TCP address.
+func exporterAddress(listen, hostname string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return hostname
+	}
+	if ip, err := netip.ParseAddr(host); host == "" || err == nil && ip.IsUnspecified() {
+		host = hostname
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// landingLinks returns the links of the landing page to the enabled
+// endpoints, so that they can be discovered without reading the flags. Push
+// endpoints served by the same server are listed in push.
+func landingLinks(metricsPath, selfMetricsPath string, invalidPayloads bool, push []web.LandingLinks) []web.LandingLinks {
+	links := []web.LandingLinks{{Address: metricsPath, Text: "Metrics"}}
+	if selfMetricsPath != "" {
+		links = append(links, web.LandingLinks{Address: selfMetricsPath, Text: "Exporter metrics"})
+	}
+	links = append(links,
+		web.LandingLinks{Address: "/-/healthy", Text: "Health", Description: "Whether all listeners are running"},
+		web.LandingLinks{Address: "/sd", Text: "Service discovery", Description: "Targets for scraping each host individually via HTTP service discovery"},
+		web.LandingLinks{Address: "/api/v1/hosts", Text: "Hosts", Description: "Hosts with cached value lists"},
+		web.LandingLinks{Address: "/api/v1/series", Text: "Series", Description: "Cached value lists and the series converted from them"},
+		web.LandingLinks{Address: "/api/v1/metadata", Text: "Metadata", Description: "Help and type of the converted metrics"},
+		web.LandingLinks{Address: "/api/v1/top", Text: "Top talkers", Description: "Hosts and plugins producing the most values and series"},
+		web.LandingLinks{Address: "/api/v1/status/flags", Text: "Flags", Description: "Command-line flags of the exporter"},
+		web.LandingLinks{Address: "/api/v1/status/config", Text: "Configuration", Description: "Loaded configuration file"},
+	)
+	if invalidPayloads {
+		links = append(links, web.LandingLinks{Address: "/debug/invalid-payloads", Text: "Invalid payloads", Description: "Recent payloads that could not be converted to value lists"})
+	}
+	links = append(links, web.LandingLinks{Address: "/debug/unknown-types", Text: "Unknown types", Description: "Types of received value lists missing from the types.db"})
+	return append(links, push...)
+}
+
+// healthHandler answers 200 OK while all sources are running, and 503 Service
+// Unavailable listing the sources that are down otherwise, so that a failed
+// listener is noticed even though the HTTP server still answers.
+func healthHandler(sources *source.Group) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down := sources.Down(); len(down) > 0 {
+			http.Error(w, "Sources down: "+strings.Join(down, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "Healthy.")
+	})
+}
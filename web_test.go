@@ -0,0 +1,215 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"collectd.org/api"
+	"github.com/prometheus/collectd_exporter/source"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+func TestWebListeners(t *testing.T) {
+	systemd, noSystemd, config := true, false, ""
+
+	ls, err := webListeners(&web.FlagConfig{WebListenAddresses: &[]string{"127.0.0.1:0"}, WebSystemdSocket: &systemd})
+	if err != nil || ls != nil {
+		t.Errorf("got listeners %v, error %v with socket activation", ls, err)
+	}
+	ls, err = webListeners(&web.FlagConfig{WebListenAddresses: &[]string{"vsock://:9103"}, WebSystemdSocket: &noSystemd})
+	if err != nil || ls != nil {
+		t.Errorf("got listeners %v, error %v for vsock", ls, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/collectd-post", func(http.ResponseWriter, *http.Request) {})
+	srv := &http.Server{Handler: mux}
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{"127.0.0.1:0"},
+		WebSystemdSocket:   &noSystemd,
+		WebConfigFile:      &config,
+	}
+	ls, err = webListeners(flags)
+	if err != nil || len(ls) != 1 {
+		t.Fatalf("got listeners %v, error %v", ls, err)
+	}
+	// Serve on the bound address.
+	addr := ls[0].Addr().String()
+	ls[0].Close()
+	flags.WebListenAddresses = &[]string{addr}
+
+	errc, err := startServer(srv, flags, false, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post("http://"+addr+"/collectd-post", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("got error %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestWebListenersUnix(t *testing.T) {
+	noSystemd, config := false, ""
+	socket := filepath.Join(t.TempDir(), "exporter.sock")
+
+	// A socket left behind by an unclean shutdown is replaced.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(http.ResponseWriter, *http.Request) {})
+	srv := &http.Server{Handler: mux}
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{"unix://" + socket},
+		WebSystemdSocket:   &noSystemd,
+		WebConfigFile:      &config,
+	}
+	errc, err := startServer(srv, flags, false, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A socket in use is not.
+	if _, err := webListeners(flags); err == nil {
+		t.Error("expected error binding socket in use")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://localhost/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-errc
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on shutdown: %v", err)
+	}
+}
+
+func TestTCPListenAddress(t *testing.T) {
+	flags := &web.FlagConfig{WebListenAddresses: &[]string{"unix:///run/exporter.sock", ":9103"}}
+	if got := tcpListenAddress(flags); got != ":9103" {
+		t.Errorf("got %q, want %q", got, ":9103")
+	}
+	flags.WebListenAddresses = &[]string{"unix:///run/exporter.sock"}
+	if got := tcpListenAddress(flags); got != "" {
+		t.Errorf("got %q, want empty address", got)
+	}
+}
+
+func TestExporterAddress(t *testing.T) {
+	for listen, want := range map[string]string{
+		":9103":            "exporter-1:9103",
+		"0.0.0.0:9103":     "exporter-1:9103",
+		"[::]:9103":        "exporter-1:9103",
+		"10.0.0.1:9103":    "10.0.0.1:9103",
+		"[2001:db8::1]:80": "[2001:db8::1]:80",
+		"":                 "exporter-1",
+	} {
+		if got := exporterAddress(listen, "exporter-1"); got != want {
+			t.Errorf("%q: got %q, want %q", listen, got, want)
+		}
+	}
+}
+
+func TestLandingLinks(t *testing.T) {
+	addresses := func(links []web.LandingLinks) []string {
+		var a []string
+		for _, l := range links {
+			a = append(a, l.Address)
+		}
+		return a
+	}
+
+	got := addresses(landingLinks("/metrics", "", false, nil))
+	if got[0] != "/metrics" || slices.Contains(got, "/debug/invalid-payloads") || !slices.Contains(got, "/api/v1/status/flags") {
+		t.Errorf("got links %v", got)
+	}
+	got = addresses(landingLinks("/metrics", "/exporter-metrics", true, []web.LandingLinks{{Address: "/write"}}))
+	for _, want := range []string{"/exporter-metrics", "/debug/invalid-payloads", "/write"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("got links %v, want %s", got, want)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	g := source.NewGroup(nil)
+	started := make(chan struct{})
+	g.Add("udp", blockingSource(started))
+	h := healthHandler(g)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "udp") {
+		t.Errorf("got response %d %q before the listener started", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.Run(ctx, nil)
+	<-started
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got response %d %q while the listener is running", rec.Code, rec.Body)
+	}
+}
+
+// blockingSource is a source closing itself once started and running until
+// its context is canceled.
+type blockingSource chan struct{}
+
+func (s blockingSource) Start(ctx context.Context, _ api.Writer) error {
+	close(s)
+	<-ctx.Done()
+	return nil
+}